@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access times. The purge, eviction and the orphan GC go by when a cached
+// file was last served, but filesystems mounted with noatime or relatime,
+// and several container volume drivers, do not keep access times up to
+// date. So pacoloco records every serve in an index of its own, saved to
+// cache_dir, and the cache storage reports the access times from it.
+
+// accessIndexFileName is the file in cache_dir the access index is saved to.
+const accessIndexFileName = "access-times"
+
+// accessIndexHeader starts the first line of a saved access index, followed
+// by the time the index started recording.
+const accessIndexHeader = "pacoloco-access-times 1"
+
+// accessIndexSaveInterval is how often the access index is saved if it
+// changed. A crash loses at most the serves of this period.
+const accessIndexSaveInterval = 5 * time.Minute
+
+var (
+	// accessTimes is the access index of the cache, nil until main loads it.
+	accessTimes       *accessIndex
+	accessIndexTicker *routineTicker
+)
+
+// accessIndex maps cached files to the time they were last served.
+type accessIndex struct {
+	path      string
+	saveMutex sync.Mutex // serializes writers of the file
+
+	mutex sync.Mutex
+	// since is when the index started recording. A file without an entry
+	// was not served since, so it counts as last served then; that keeps a
+	// new index from making the whole cache look stale.
+	since time.Time
+	times map[string]time.Time // by repo + "/" + name
+	dirty bool
+}
+
+func newAccessIndex(path string, since time.Time) *accessIndex {
+	return &accessIndex{path: path, since: since, times: make(map[string]time.Time), dirty: true}
+}
+
+// loadAccessIndex reads the access index saved at path. A missing or broken
+// index is replaced with an empty one.
+func loadAccessIndex(path string) *accessIndex {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Starting the access index %v, files cached so far count as accessed now", path)
+		return newAccessIndex(path, time.Now())
+	}
+	if err == nil {
+		var x *accessIndex
+		if x, err = parseAccessIndex(path, data); err == nil {
+			return x
+		}
+	}
+	log.Printf("Unable to read the access index %v, starting a new one: %v", path, err)
+	return newAccessIndex(path, time.Now())
+}
+
+func parseAccessIndex(path string, data []byte) (*accessIndex, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return nil, errors.New("the header is missing")
+	}
+	since, ok := strings.CutPrefix(scanner.Text(), accessIndexHeader+" ")
+	if !ok {
+		return nil, fmt.Errorf("unexpected header %q", scanner.Text())
+	}
+	sinceUnix, err := strconv.ParseInt(since, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected header %q", scanner.Text())
+	}
+	x := newAccessIndex(path, time.Unix(sinceUnix, 0))
+	x.dirty = false
+	for scanner.Scan() {
+		at, key, ok := strings.Cut(scanner.Text(), " ")
+		atUnix, err := strconv.ParseInt(at, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("malformed entry %q", scanner.Text())
+		}
+		x.times[key] = time.Unix(atUnix, 0)
+	}
+	return x, scanner.Err()
+}
+
+func accessIndexKey(repo, name string) string {
+	return repo + "/" + name
+}
+
+// lastAccess returns when the file was last served as far as the index
+// knows.
+func (x *accessIndex) lastAccess(repo, name string) time.Time {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if at, ok := x.times[accessIndexKey(repo, name)]; ok {
+		return at
+	}
+	return x.since
+}
+
+// record notes that the file was served at the given time.
+func (x *accessIndex) record(repo, name string, at time.Time) {
+	if strings.ContainsRune(name, '\n') {
+		return // cannot be saved, the file keeps the time of the index start
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	key := accessIndexKey(repo, name)
+	if at.After(x.times[key]) {
+		x.times[key] = at
+		x.dirty = true
+	}
+}
+
+// forget drops the entry of a file that was removed from the cache.
+func (x *accessIndex) forget(repo, name string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	key := accessIndexKey(repo, name)
+	if _, ok := x.times[key]; ok {
+		delete(x.times, key)
+		x.dirty = true
+	}
+}
+
+// save writes the index to its file if it changed since the last save.
+func (x *accessIndex) save() error {
+	x.saveMutex.Lock()
+	defer x.saveMutex.Unlock()
+
+	x.mutex.Lock()
+	if !x.dirty {
+		x.mutex.Unlock()
+		return nil
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v %d\n", accessIndexHeader, x.since.Unix())
+	for key, at := range x.times {
+		fmt.Fprintf(&buf, "%d %v\n", at.Unix(), key)
+	}
+	x.dirty = false
+	x.mutex.Unlock()
+
+	// replace the file atomically, a crash must not leave half an index
+	tmpPath := x.path + ".tmp"
+	err := os.WriteFile(tmpPath, buf.Bytes(), 0o644)
+	if err == nil {
+		err = os.Rename(tmpPath, x.path)
+	}
+	if err != nil {
+		x.mutex.Lock()
+		x.dirty = true
+		x.mutex.Unlock()
+	}
+	return err
+}
+
+func setupAccessIndexRoutine() *routineTicker {
+	ticker := newRoutineTicker(accessIndexSaveInterval)
+	go func() {
+		for ticker.wait() {
+			saveAccessIndex()
+		}
+	}()
+	return ticker
+}
+
+func saveAccessIndex() {
+	if accessTimes == nil {
+		return
+	}
+	if err := accessTimes.save(); err != nil {
+		log.Printf("Unable to save the access index: %v", err)
+	}
+}
+
+// indexedStorage is a Storage that reports access times from the access
+// index. Where the storage itself knows of a more recent access, like the
+// Last-Modified of an S3 object that another instance sharing the bucket
+// served, that one counts.
+type indexedStorage struct {
+	Storage
+	index *accessIndex
+}
+
+func (s *indexedStorage) accessTime(repo string, f CachedFile) time.Time {
+	if at := s.index.lastAccess(repo, f.Name); at.After(f.AccessTime) {
+		return at
+	}
+	return f.AccessTime
+}
+
+func (s *indexedStorage) Stat(repo, name string) (CachedFile, error) {
+	f, err := s.Storage.Stat(repo, name)
+	if err == nil {
+		f.AccessTime = s.accessTime(repo, f)
+	}
+	return f, err
+}
+
+func (s *indexedStorage) List(repo string) ([]CachedFile, error) {
+	files, err := s.Storage.List(repo)
+	for i := range files {
+		files[i].AccessTime = s.accessTime(repo, files[i])
+	}
+	return files, err
+}
+
+// Commit counts a newly cached file as served, the client that requested
+// it is receiving it.
+func (s *indexedStorage) Commit(repo, name string, buffer *os.File, modTime time.Time) error {
+	if err := s.Storage.Commit(repo, name, buffer, modTime); err != nil {
+		return err
+	}
+	s.index.record(repo, name, time.Now())
+	return nil
+}
+
+func (s *indexedStorage) Delete(repo, name string) error {
+	err := s.Storage.Delete(repo, name)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		s.index.forget(repo, name)
+	}
+	return err
+}
+
+func (s *indexedStorage) Touch(repo, name string, at time.Time) error {
+	s.index.record(repo, name, at)
+	return s.Storage.Touch(repo, name, at)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// useAccessIndex makes the cache storage go by the given access index for
+// the rest of the test.
+func useAccessIndex(t *testing.T, x *accessIndex) {
+	accessTimes = x
+	t.Cleanup(func() { accessTimes = nil })
+}
+
+func TestAccessIndexSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), accessIndexFileName)
+	since := time.Unix(1700000000, 0)
+	served := time.Unix(1700001000, 0)
+
+	x := newAccessIndex(path, since)
+	x.record("repo", "foo-1-1-any.pkg.tar.zst", served)
+	x.record("repo", "foo-1-1-any.pkg.tar.zst", served.Add(-time.Hour)) // out of order
+	x.record("repo", "sub dir/bar-1-1-any.pkg.tar.zst", served)
+	x.record("repo", "gone-1-1-any.pkg.tar.zst", served)
+	x.forget("repo", "gone-1-1-any.pkg.tar.zst")
+	require.NoError(t, x.save())
+
+	loaded := loadAccessIndex(path)
+	require.Equal(t, since, loaded.since)
+	require.Equal(t, served, loaded.lastAccess("repo", "foo-1-1-any.pkg.tar.zst"))
+	require.Equal(t, served, loaded.lastAccess("repo", "sub dir/bar-1-1-any.pkg.tar.zst"))
+	require.Equal(t, since, loaded.lastAccess("repo", "gone-1-1-any.pkg.tar.zst"), "an unknown file counts as served when the index started")
+	require.Equal(t, since, loaded.lastAccess("other-repo", "foo-1-1-any.pkg.tar.zst"))
+
+	// an unchanged index is not written again
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, loaded.save())
+	require.NoFileExists(t, path)
+}
+
+func TestAccessIndexColdStart(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now().Add(-time.Second)
+
+	x := loadAccessIndex(filepath.Join(dir, "missing"))
+	require.True(t, x.since.After(before))
+	require.True(t, x.lastAccess("repo", "foo-1-1-any.pkg.tar.zst").After(before))
+
+	broken := filepath.Join(dir, "broken")
+	require.NoError(t, os.WriteFile(broken, []byte(accessIndexHeader+" 1700000000\nnot an entry\n"), 0o644))
+	x = loadAccessIndex(broken)
+	require.True(t, x.since.After(before), "a broken index starts over")
+	require.Empty(t, x.times)
+}
+
+func TestPurgeUsesAccessIndex(t *testing.T) {
+	cacheDir := t.TempDir()
+	config.Store(&Config{CacheDir: cacheDir, PurgeFilesAfter: 7 * 24 * 60 * 60})
+	// the filesystem does not update access times, all files look unused
+	served := writeCachedFile(t, cacheDir, "noatime-repo", "served-1-1-any.pkg.tar.zst", 10, 30*24*time.Hour)
+	unused := writeCachedFile(t, cacheDir, "noatime-repo", "unused-1-1-any.pkg.tar.zst", 10, 30*24*time.Hour)
+
+	x := newAccessIndex(filepath.Join(cacheDir, accessIndexFileName), time.Now())
+	useAccessIndex(t, x)
+	purgeStaleFiles(config.Load().cacheStorage(), cacheDir, config.Load().PurgeFilesAfter, "noatime-repo")
+	require.FileExists(t, served, "nothing is stale right after the index started")
+	require.FileExists(t, unused)
+
+	x.since = time.Now().Add(-10 * 24 * time.Hour)
+	require.NoError(t, config.Load().cacheStorage().Touch("noatime-repo", "served-1-1-any.pkg.tar.zst", time.Now()))
+	purgeStaleFiles(config.Load().cacheStorage(), cacheDir, config.Load().PurgeFilesAfter, "noatime-repo")
+	require.FileExists(t, served)
+	require.NoFileExists(t, unused)
+	require.NotContains(t, x.times, accessIndexKey("noatime-repo", "unused-1-1-any.pkg.tar.zst"))
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// apiHandler serves the API under /api/v1/. The read-only lookups are
+// served to the clients like the repos, under `auth` if it is configured.
+// The other endpoints form the admin API and require the admin_token of the
+// config as a bearer token; without a configured token it is disabled.
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/search/file", apiSearchFile)
+	mux.HandleFunc("GET /api/v1/packages/{name}", apiGetPackage)
+	mux.HandleFunc("GET /api/v1/packages/{name}/versions", apiListPackageVersions)
+	mux.HandleFunc("GET /api/v1/packages/{name}/cached", apiListCachedVersions)
+	mux.Handle("/api/v1/", requireAdminToken(adminAPIHandler()))
+	return mux
+}
+
+func adminAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/repos", apiListRepos)
+	mux.HandleFunc("PUT /api/v1/repos/{repo}/files/{file}", apiUploadFile)
+	mux.HandleFunc("DELETE /api/v1/repos/{repo}/files/{file}", apiDeleteFile)
+	mux.HandleFunc("DELETE /api/v1/repos/{repo}/packages/{name}", apiDeletePackage)
+	mux.HandleFunc("GET /api/v1/downloads", apiListDownloads)
+	mux.HandleFunc("GET /api/v1/mirrors", apiListMirrors)
+	mux.HandleFunc("POST /api/v1/purge", apiPurge)
+	mux.HandleFunc("POST /api/v1/gc", apiOrphanGC)
+	mux.HandleFunc("POST /api/v1/prefetch", apiPrefetch)
+	mux.HandleFunc("GET /api/v1/snapshots", apiListSnapshots)
+	mux.HandleFunc("POST /api/v1/snapshots", apiCreateSnapshot)
+	mux.HandleFunc("DELETE /api/v1/snapshots/{name}", apiDeleteSnapshot)
+	return mux
+}
+
+// hasAdminToken reports whether req carries the admin_token of c.
+func hasAdminToken(c *Config, req *http.Request) bool {
+	given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && c.AdminToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(c.AdminToken)) == 1
+}
+
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := config.Load()
+		if c.AdminToken == "" {
+			http.NotFound(w, req)
+			return
+		}
+		if !hasAdminToken(c, req) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pacoloco"`)
+			writeAPIError(w, http.StatusUnauthorized, errors.New("a valid admin token is required"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// apiClientAccess authenticates the client of a read-only lookup and
+// returns which repos of c it may see, all of them for the admin. It
+// answers the request itself if the client has no valid credentials.
+func apiClientAccess(w http.ResponseWriter, req *http.Request, c *Config) (mayUse func(repoName string) bool, ok bool) {
+	if hasAdminToken(c, req) {
+		return func(string) bool { return true }, true
+	}
+	mayUse, err := authenticate(c, req)
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("WWW-Authenticate", `Basic realm="pacoloco"`)
+		writeAPIError(w, http.StatusUnauthorized, errors.New("valid credentials are required"))
+		return nil, false
+	}
+	return mayUse, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("unable to write api response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+type apiRepo struct {
+	Name           string   `json:"name"`
+	URLs           []string `json:"urls"`
+	CacheSizeBytes int64    `json:"cache_size_bytes"`
+	CachePackages  int64    `json:"cache_packages"`
+}
+
+func apiListRepos(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	names := make([]string, 0, len(c.Repos))
+	for name := range c.Repos {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	repos := make([]apiRepo, 0, len(names))
+	for _, name := range names {
+		size, count, err := gatherCacheStats(c.repoStorage(name), name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		repos = append(repos, apiRepo{
+			Name:           name,
+			URLs:           c.Repos[name].getUrls(),
+			CacheSizeBytes: int64(size),
+			CachePackages:  int64(count),
+		})
+	}
+	writeJSON(w, http.StatusOK, repos)
+}
+
+type apiDownload struct {
+	Repo          string `json:"repo"`
+	Path          string `json:"path"`
+	File          string `json:"file"`
+	BytesReceived int64  `json:"bytes_received"`
+	ContentLength int64  `json:"content_length"`
+	Readers       int    `json:"readers"`
+}
+
+// activeDownloads takes a snapshot of the downloaders map.
+func activeDownloads() []apiDownload {
+	downloadersMutex.Lock()
+	defer downloadersMutex.Unlock()
+
+	downloads := make([]apiDownload, 0, len(downloaders))
+	for _, d := range downloaders {
+		d.eventCond.L.Lock()
+		dl := apiDownload{
+			Repo:          d.repoName,
+			Path:          d.urlPath,
+			File:          d.fileName,
+			BytesReceived: d.eventReceived.size(),
+			Readers:       d.usageCount,
+		}
+		if d.eventMetadataReceived {
+			dl.ContentLength = d.contentLength
+		}
+		if !d.eventDone {
+			dl.Readers-- // the download goroutine itself
+		}
+		d.eventCond.L.Unlock()
+		downloads = append(downloads, dl)
+	}
+	slices.SortFunc(downloads, func(a, b apiDownload) int {
+		return strings.Compare(a.File, b.File)
+	})
+	return downloads
+}
+
+func apiListDownloads(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, activeDownloads())
+}
+
+// apiRepoStorage resolves the storage of the repo of c named in the
+// request.
+func apiRepoStorage(c *Config, req *http.Request) (Storage, error) {
+	repoName := req.PathValue("repo")
+	if c.Repos[repoName] == nil {
+		return nil, fmt.Errorf("%w: repo %v is not configured", errNotFound, repoName)
+	}
+	return c.repoStorage(repoName), nil
+}
+
+// removeCachedFile deletes a cache entry and accounts for it in the repo
+// gauges.
+func removeCachedFile(storage Storage, repoName string, fileName string) error {
+	f, err := storage.Stat(repoName, fileName)
+	if err != nil {
+		return err
+	}
+	return deleteCachedFile(storage, repoName, f)
+}
+
+// deleteCachedFile deletes a cache entry described by f and accounts for it
+// in the repo gauges.
+func deleteCachedFile(storage Storage, repoName string, f CachedFile) error {
+	if err := storage.Delete(repoName, f.Name); err != nil {
+		return err
+	}
+	log.Printf("Removed cached file %v/%v", repoName, f.Name)
+	cacheSizeGauge.WithLabelValues(repoName).Sub(float64(f.Size))
+	cachePackageGauge.WithLabelValues(repoName).Dec()
+	forgetRepoDB(repoName, f.Name)
+	return nil
+}
+
+// forgetRepoDB drops what was indexed from a cached file that was deleted,
+// if it is a repo database.
+func forgetRepoDB(repoName string, fileName string) {
+	switch path.Ext(fileName) {
+	case ".db":
+		dropRepoDBChecksums(repoName, fileName)
+	case ".files":
+		dropFilesIndex(repoName, fileName)
+	}
+}
+
+// lockLocalRepo keeps uploads out while files are removed from a local
+// repo; the returned function updates its databases and unlocks it. For
+// other repos of c both do nothing.
+func lockLocalRepo(c *Config, repoName string) (unlock func() error) {
+	if !c.Repos[repoName].Local {
+		return func() error { return nil }
+	}
+	localRepoMutex.Lock()
+	return func() error {
+		defer localRepoMutex.Unlock()
+		return updateLocalRepoDBs(c, repoName)
+	}
+}
+
+// apiUploadFile stores the request body as a package or signature in a
+// local repo, e.g. curl -T foo-1.0-1-x86_64.pkg.tar.zst, and updates the
+// repo databases.
+func apiUploadFile(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	repoName := req.PathValue("repo")
+	repo := c.Repos[repoName]
+	if repo == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w: repo %v is not configured", errNotFound, repoName))
+		return
+	}
+	if !repo.Local {
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("repo %v is not local, only local repos accept uploads", repoName))
+		return
+	}
+	if req.ContentLength > c.uploadLimit() {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: the limit is %d bytes", errUploadTooLarge, c.uploadLimit()))
+		return
+	}
+	f, err := uploadLocalFile(c, repoName, req.PathValue("file"), req.Body)
+	if errors.Is(err, errUploadTooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if errors.Is(err, errInvalidUpload) {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"uploaded": f.Name, "size": f.Size})
+}
+
+func apiDeleteFile(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	storage, err := apiRepoStorage(c, req)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	fileName := req.PathValue("file")
+	// buffer files belong to running downloads and "." / ".." are no files
+	if isBufferFile(fileName) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid file name %q", fileName))
+		return
+	}
+
+	unlock := lockLocalRepo(c, req.PathValue("repo"))
+	err = removeCachedFile(storage, req.PathValue("repo"), fileName)
+	if unlockErr := unlock(); err == nil {
+		err = unlockErr
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w: %v is not cached", errNotFound, fileName))
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"removed": {fileName}})
+}
+
+// apiDeletePackage removes every cached version, architecture and signature
+// of a package.
+func apiDeletePackage(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	storage, err := apiRepoStorage(c, req)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	repoName := req.PathValue("repo")
+	pkgName := req.PathValue("name")
+
+	unlock := lockLocalRepo(c, repoName)
+	removed, err := removeCachedPackage(storage, repoName, pkgName)
+	if unlockErr := unlock(); err == nil {
+		err = unlockErr
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(removed) == 0 {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w: package %v is not cached", errNotFound, pkgName))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"removed": removed})
+}
+
+// removeCachedPackage removes the cached files of a package from a repo and
+// returns their names.
+func removeCachedPackage(storage Storage, repoName string, pkgName string) ([]string, error) {
+	files, err := storage.List(repoName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	removed := []string{}
+	for _, f := range files {
+		matches := filenameRegex.FindStringSubmatch(f.Name)
+		if matches == nil || matches[1] != pkgName || strings.Contains(f.Name, "/") {
+			continue
+		}
+		if err := removeCachedFile(storage, repoName, f.Name); err != nil {
+			return removed, err
+		}
+		removed = append(removed, f.Name)
+	}
+	return removed, nil
+}
+
+// apiPurge runs the stale file purge over all repos and returns once it is
+// done.
+func apiPurge(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	if c.PurgeFilesAfter == 0 {
+		writeAPIError(w, http.StatusConflict, errors.New("purging is disabled, set purge_files_after to enable it"))
+		return
+	}
+	purgeAllRepos(c)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "purged"})
+}
+
+// apiOrphanGC removes the cached packages no repo database references
+// anymore and reports them. With ?dry_run=true it only reports what it
+// would remove.
+func apiOrphanGC(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	if c.OrphanGC == nil {
+		writeAPIError(w, http.StatusConflict, errors.New("orphan GC is disabled, configure the orphan_gc section to enable it"))
+		return
+	}
+	dryRun := c.OrphanGC.DryRun
+	if v := req.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid dry_run value %q", v))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, collectAllOrphans(c, dryRun))
+}
+
+// apiSearchFile looks up the packages owning a file in the cached .files
+// databases of the repos the client may use, like pacman -F. The path
+// parameter is a path or a file name, the optional repo parameter restricts
+// the search to one repo.
+func apiSearchFile(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	mayUse, ok := apiClientAccess(w, req, c)
+	if !ok {
+		return
+	}
+	query := req.URL.Query()
+	filePath := query.Get("path")
+	if strings.Trim(filePath, "/") == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("the path parameter is required"))
+		return
+	}
+	repoName := query.Get("repo")
+	if repoName != "" && (c.Repos[repoName] == nil || !mayUse(repoName)) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown repo %v", repoName))
+		return
+	}
+	results := slices.DeleteFunc(searchFiles(filePath, repoName), func(r fileSearchResult) bool { return !mayUse(r.Repo) })
+	writeJSON(w, http.StatusOK, results)
+}
+
+// apiPackageMetadata looks up the entries of the package named in the
+// request in the databases of the repos of c the client may use.
+func apiPackageMetadata(w http.ResponseWriter, req *http.Request, c *Config) ([]PackageMetadata, bool) {
+	mayUse, ok := apiClientAccess(w, req, c)
+	if !ok {
+		return nil, false
+	}
+	db := metadataDB.Load()
+	if db == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, errors.New("the package metadata is unavailable"))
+		return nil, false
+	}
+	packages, err := findPackageMetadata(db, c, req.PathValue("name"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return slices.DeleteFunc(packages, func(p PackageMetadata) bool { return !mayUse(p.RepoName) }), true
+}
+
+// apiGetPackage returns the entries of a package in the cached databases of
+// all repos, the newest version first.
+func apiGetPackage(w http.ResponseWriter, req *http.Request) {
+	packages, ok := apiPackageMetadata(w, req, config.Load())
+	if !ok {
+		return
+	}
+	if len(packages) == 0 {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w: no repo database lists package %v", errNotFound, req.PathValue("name")))
+		return
+	}
+	writeJSON(w, http.StatusOK, packages)
+}
+
+type apiPackageVersion struct {
+	Repo     string `json:"repo"`
+	Database string `json:"database"`
+	Version  string `json:"version"`
+	Arch     string `json:"arch"`
+	Cached   bool   `json:"cached"`
+}
+
+// apiListPackageVersions lists the versions of a package the repos offer,
+// the newest first, and whether they are cached.
+func apiListPackageVersions(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	packages, ok := apiPackageMetadata(w, req, c)
+	if !ok {
+		return
+	}
+	versions := make([]apiPackageVersion, 0, len(packages))
+	for _, p := range packages {
+		_, err := c.repoStorage(p.RepoName).Stat(p.RepoName, path.Join(path.Dir(p.DBName), p.FileName))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		versions = append(versions, apiPackageVersion{
+			Repo:     p.RepoName,
+			Database: p.DBName,
+			Version:  p.Version,
+			Arch:     p.Arch,
+			Cached:   err == nil,
+		})
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// apiListCachedVersions lists the cached files of a package in the repos
+// the client may use, the newest version first.
+func apiListCachedVersions(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	mayUse, ok := apiClientAccess(w, req, c)
+	if !ok {
+		return
+	}
+	cached, err := findCachedVersions(c, req.PathValue("name"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, slices.DeleteFunc(cached, func(v cachedPackageVersion) bool { return !mayUse(v.Repo) }))
+}
+
+// apiPrefetch starts a prefetch run in the background; it can take as long
+// as downloading every updated package.
+func apiPrefetch(w http.ResponseWriter, req *http.Request) {
+	if config.Load().Prefetch == nil || prefetchDB == nil {
+		writeAPIError(w, http.StatusConflict, errors.New("prefetching is disabled, configure the prefetch section to enable it"))
+		return
+	}
+	go prefetchPackages()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "prefetch started"})
+}
+
+func apiListSnapshots(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, listSnapshots())
+}
+
+// apiSnapshotRequest is the optional body of a snapshot creation.
+type apiSnapshotRequest struct {
+	Name  string   `json:"name"`
+	Repos []string `json:"repos"`
+}
+
+// apiCreateSnapshot snapshots the databases of the repos named in the
+// request body, or of all repos. The name defaults to the current date.
+func apiCreateSnapshot(w http.ResponseWriter, req *http.Request) {
+	var body apiSnapshotRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	s, err := createSnapshot(config.Load(), body.Name, body.Repos)
+	switch {
+	case errors.Is(err, errNotFound):
+		writeAPIError(w, http.StatusNotFound, err)
+	case errors.Is(err, errSnapshotExists):
+		writeAPIError(w, http.StatusConflict, err)
+	case errors.Is(err, errInvalidSnapshot):
+		writeAPIError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusCreated, s)
+	}
+}
+
+func apiDeleteSnapshot(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	err := deleteSnapshot(config.Load().CacheDir, name)
+	if errors.Is(err, errNotFound) {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"deleted": name})
+}
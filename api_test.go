@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testAdminToken = "s3cret"
+
+func apiRequest(t *testing.T, method string, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	apiHandler().ServeHTTP(w, req)
+	return w
+}
+
+func decodeAPIResponse[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var v T
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	return v
+}
+
+func setupAPIConfig(t *testing.T) string {
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:   cacheDir,
+		Port:       -1,
+		AdminToken: testAdminToken,
+		Repos: map[string]*Repo{
+			"api-repo":   {URL: "http://api.example.com"},
+			"empty-repo": {URLs: []string{"http://one.example.com", "http://two.example.com"}},
+		},
+	})
+	repoDir := filepath.Join(cacheDir, "pkgs", "api-repo")
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	for name, content := range map[string]string{
+		"foo-1.0-1-x86_64.pkg.tar.zst":     "1234567890",
+		"foo-1.0-1-x86_64.pkg.tar.zst.sig": "sig",
+		"foo-1.1-1-x86_64.pkg.tar.zst":     "12345",
+		"foobar-1.0-1-any.pkg.tar.zst":     "123",
+		".bar-2.0-1-any.pkg.tar.zst":       "buffer",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(repoDir, name), []byte(content), 0o644))
+	}
+	return cacheDir
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	setupAPIConfig(t)
+
+	require.Equal(t, http.StatusUnauthorized, apiRequest(t, http.MethodGet, "/api/v1/repos", "").Code)
+	require.Equal(t, http.StatusUnauthorized, apiRequest(t, http.MethodGet, "/api/v1/repos", "wrong").Code)
+	require.Equal(t, http.StatusOK, apiRequest(t, http.MethodGet, "/api/v1/repos", testAdminToken).Code)
+
+	config.Load().AdminToken = ""
+	require.Equal(t, http.StatusNotFound, apiRequest(t, http.MethodGet, "/api/v1/repos", "").Code, "the api is disabled without a token")
+}
+
+func TestAPIListRepos(t *testing.T) {
+	setupAPIConfig(t)
+
+	w := apiRequest(t, http.MethodGet, "/api/v1/repos", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	repos := decodeAPIResponse[[]apiRepo](t, w)
+	require.Equal(t, []apiRepo{
+		{Name: "api-repo", URLs: []string{"http://api.example.com"}, CacheSizeBytes: 21, CachePackages: 4},
+		{Name: "empty-repo", URLs: []string{"http://one.example.com", "http://two.example.com"}},
+	}, repos)
+}
+
+func TestAPIDeleteFile(t *testing.T) {
+	cacheDir := setupAPIConfig(t)
+	repoDir := filepath.Join(cacheDir, "pkgs", "api-repo")
+
+	w := apiRequest(t, http.MethodDelete, "/api/v1/repos/api-repo/files/foo-1.1-1-x86_64.pkg.tar.zst", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoFileExists(t, filepath.Join(repoDir, "foo-1.1-1-x86_64.pkg.tar.zst"))
+	require.FileExists(t, filepath.Join(repoDir, "foo-1.0-1-x86_64.pkg.tar.zst"))
+
+	w = apiRequest(t, http.MethodDelete, "/api/v1/repos/api-repo/files/foo-1.1-1-x86_64.pkg.tar.zst", testAdminToken)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	w = apiRequest(t, http.MethodDelete, "/api/v1/repos/api-repo/files/.bar-2.0-1-any.pkg.tar.zst", testAdminToken)
+	require.Equal(t, http.StatusBadRequest, w.Code, "buffer files of running downloads cannot be deleted")
+	w = apiRequest(t, http.MethodDelete, "/api/v1/repos/unknown-repo/files/foo-1.0-1-x86_64.pkg.tar.zst", testAdminToken)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAPIDeletePackage(t *testing.T) {
+	cacheDir := setupAPIConfig(t)
+	repoDir := filepath.Join(cacheDir, "pkgs", "api-repo")
+
+	w := apiRequest(t, http.MethodDelete, "/api/v1/repos/api-repo/packages/foo", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	removed := decodeAPIResponse[map[string][]string](t, w)
+	require.ElementsMatch(t, []string{
+		"foo-1.0-1-x86_64.pkg.tar.zst",
+		"foo-1.0-1-x86_64.pkg.tar.zst.sig",
+		"foo-1.1-1-x86_64.pkg.tar.zst",
+	}, removed["removed"])
+	require.FileExists(t, filepath.Join(repoDir, "foobar-1.0-1-any.pkg.tar.zst"))
+
+	w = apiRequest(t, http.MethodDelete, "/api/v1/repos/api-repo/packages/foo", testAdminToken)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAPIListDownloads(t *testing.T) {
+	const content = "content of a download in progress"
+	release := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content[:10]))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte(content[10:]))
+	}))
+	defer mirror.Close()
+
+	setupAPIConfig(t)
+	config.Load().Repos["api-repo"].URL = mirror.URL
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/repo/api-repo/slow-1-1-any.pkg.tar.zst", nil)
+		_ = handleRequest(httptest.NewRecorder(), req)
+	}()
+
+	var downloads []apiDownload
+	require.Eventually(t, func() bool {
+		w := apiRequest(t, http.MethodGet, "/api/v1/downloads", testAdminToken)
+		downloads = decodeAPIResponse[[]apiDownload](t, w)
+		return len(downloads) == 1 && downloads[0].BytesReceived == 10
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "api-repo", downloads[0].Repo)
+	require.Equal(t, "/slow-1-1-any.pkg.tar.zst", downloads[0].Path)
+	require.Equal(t, int64(len(content)), downloads[0].ContentLength)
+	require.Equal(t, 1, downloads[0].Readers)
+
+	close(release)
+	<-done
+}
+
+func TestAPIPurge(t *testing.T) {
+	cacheDir := setupAPIConfig(t)
+	require.Equal(t, http.StatusConflict, apiRequest(t, http.MethodPost, "/api/v1/purge", testAdminToken).Code)
+
+	config.Load().PurgeFilesAfter = 3600
+	stale := filepath.Join(cacheDir, "pkgs", "api-repo", "foobar-1.0-1-any.pkg.tar.zst")
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	w := apiRequest(t, http.MethodPost, "/api/v1/purge", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoFileExists(t, stale)
+	require.FileExists(t, filepath.Join(cacheDir, "pkgs", "api-repo", "foo-1.0-1-x86_64.pkg.tar.zst"))
+}
+
+func TestAPIPrefetchDisabled(t *testing.T) {
+	setupAPIConfig(t)
+	require.Equal(t, http.StatusConflict, apiRequest(t, http.MethodPost, "/api/v1/prefetch", testAdminToken).Code)
+	require.Equal(t, http.StatusMethodNotAllowed, apiRequest(t, http.MethodGet, "/api/v1/prefetch", testAdminToken).Code)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Client authentication. With an `auth` section the repos are only served
+// to clients that identify themselves: with HTTP Basic credentials of the
+// htpasswd file, a static token, or a client certificate signed by the
+// tls.client_ca. The identity is the user name, the name of the token or
+// the common name of the certificate. `auth.repos` lists which repos an
+// identity may use, `auth.default_repos` the ones of identities it does not
+// list; an identity that is listed in neither may use none.
+
+var (
+	errUnauthorized = errors.New("authentication required")
+	errForbidden    = errors.New("access denied")
+)
+
+// peerIdentity is the identity of peers and cluster nodes, which present
+// the peer token and may use all repos.
+const peerIdentity = "peer"
+
+// basicAuthCacheTTL is how long a verified password is remembered. bcrypt
+// is slow by design, and pacman sends the credentials with every file.
+const basicAuthCacheTTL = 5 * time.Minute
+
+var authDeniedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pacoloco_auth_denied_total",
+	Help: "Number of requests denied for missing or wrong credentials or a repo the client may not use",
+}, []string{"repo", "reason"})
+
+// verifiedPasswords holds until when the hash of a user name and password
+// that matched the htpasswd file is trusted without running bcrypt again.
+var (
+	verifiedPasswords      = make(map[[sha256.Size]byte]time.Time)
+	verifiedPasswordsMutex sync.Mutex
+)
+
+// loadHtpasswd reads an htpasswd file of bcrypt hashes, as written by
+// `htpasswd -B`.
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d is not a user:hash entry", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("the password of %v on line %d is not a bcrypt hash, use htpasswd -B", user, line)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// loadCertPool reads a bundle of PEM encoded certificates, the CAs client
+// certificates or the certificates of the mirrors are verified against.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%v has no PEM encoded certificates", path)
+	}
+	return pool, nil
+}
+
+// checkPassword reports whether password is the one of user in the htpasswd
+// file.
+func (a *Auth) checkPassword(user string, password string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + ":" + password + ":" + string(hash)))
+	verifiedPasswordsMutex.Lock()
+	trusted := time.Now().Before(verifiedPasswords[key])
+	verifiedPasswordsMutex.Unlock()
+	if trusted {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	verifiedPasswordsMutex.Lock()
+	defer verifiedPasswordsMutex.Unlock()
+	for k, until := range verifiedPasswords {
+		if time.Now().After(until) {
+			delete(verifiedPasswords, k)
+		}
+	}
+	verifiedPasswords[key] = time.Now().Add(basicAuthCacheTTL)
+	return true
+}
+
+// checkToken returns the name of the token given, "" if it is none of the
+// configured ones, and whether it is the peer token.
+func (a *Auth) checkToken(token string) (name string, peer bool) {
+	if a.PeerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.PeerToken)) == 1 {
+		return peerIdentity, true
+	}
+	for name, t := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return name, false
+		}
+	}
+	return "", false
+}
+
+// identify returns the identity the credentials of req belong to, "" if
+// it has none or they are wrong, and whether it presented the peer token.
+// Only the peer token makes a peer: a user or a certificate named like the
+// peers is refused.
+func (a *Auth) identify(req *http.Request) (identity string, peer bool) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		if name := req.TLS.VerifiedChains[0][0].Subject.CommonName; name != peerIdentity {
+			return name, false
+		}
+		return "", false
+	}
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return a.checkToken(token)
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		// a token also works as the password of its name, pacman can
+		// only send Basic credentials
+		if name, peer := a.checkToken(password); name != "" && name == user {
+			return name, peer
+		}
+		if user != peerIdentity && a.checkPassword(user, password) {
+			return user, false
+		}
+	}
+	return "", false
+}
+
+// mayUse reports whether identity may use a repo. Peers may use all of
+// them.
+func (a *Auth) mayUse(identity string, peer bool, repoName string) bool {
+	if peer {
+		return true
+	}
+	repos, ok := a.Repos[identity]
+	if !ok {
+		repos = a.DefaultRepos
+	}
+	return slices.Contains(repos, repoName) || slices.Contains(repos, "*")
+}
+
+// authorize checks that req may use a repo of c. Requests are allowed if
+// no authentication is configured.
+func authorize(c *Config, req *http.Request, repoName string) error {
+	a := c.Auth
+	if a == nil {
+		return nil
+	}
+	identity, peer := a.identify(req)
+	if identity == "" {
+		authDeniedCounter.WithLabelValues(repoName, "unauthenticated").Inc()
+		return fmt.Errorf("%w: %v %v from %v", errUnauthorized, req.Method, req.URL.Path, req.RemoteAddr)
+	}
+	if !a.mayUse(identity, peer, repoName) {
+		authDeniedCounter.WithLabelValues(repoName, "forbidden").Inc()
+		return fmt.Errorf("%w: %v may not use repo %v, %v %v from %v", errForbidden, identity, repoName, req.Method, req.URL.Path, req.RemoteAddr)
+	}
+	return nil
+}
+
+// authenticate checks the credentials of req for a request that is not
+// about one repo, such as the dashboard, and returns which repos of c the
+// client may see: all of them if no authentication is configured.
+func authenticate(c *Config, req *http.Request) (mayUse func(repoName string) bool, err error) {
+	a := c.Auth
+	if a == nil {
+		return func(string) bool { return true }, nil
+	}
+	identity, peer := a.identify(req)
+	if identity == "" {
+		authDeniedCounter.WithLabelValues("", "unauthenticated").Inc()
+		return nil, fmt.Errorf("%w: %v %v from %v", errUnauthorized, req.Method, req.URL.Path, req.RemoteAddr)
+	}
+	return func(repoName string) bool { return a.mayUse(identity, peer, repoName) }, nil
+}
+
+// peerTransport sends the requests to peers and cluster nodes with the
+// peer token.
+type peerTransport struct{}
+
+func (peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// not on redirects, e.g. to the presigned URLs of an S3 storage
+	if a := config.Load().Auth; a != nil && a.PeerToken != "" && strings.HasPrefix(req.URL.Path, "/peer/") {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+a.PeerToken)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setupAuth(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from the mirror"))
+	}))
+	t.Cleanup(mirror.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     -1,
+		Auth: &Auth{
+			Tokens:    map[string]string{"ci": "ci-token"},
+			Repos:     map[string][]string{"ci": {"public-repo"}, "builder": {"*"}},
+			PeerToken: "peer-token",
+			users:     map[string][]byte{"alice": hash},
+		},
+		Repos: map[string]*Repo{
+			"public-repo":  {URL: mirror.URL},
+			"private-repo": {URL: mirror.URL},
+		},
+	})
+}
+
+func authTestRequest(urlPath string, setup func(req *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, urlPath, nil)
+	if setup != nil {
+		setup(req)
+	}
+	w := httptest.NewRecorder()
+	pacolocoHandler(w, req)
+	return w
+}
+
+func TestAuthorize(t *testing.T) {
+	setupAuth(t)
+	const privateFile = "/repo/private-repo/foo-1.0-1-x86_64.pkg.tar.zst"
+	unauthenticated := testutil.ToFloat64(authDeniedCounter.WithLabelValues("private-repo", "unauthenticated"))
+	forbidden := testutil.ToFloat64(authDeniedCounter.WithLabelValues("private-repo", "forbidden"))
+
+	w := authTestRequest(privateFile, nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, `Basic realm="pacoloco"`, w.Header().Get("WWW-Authenticate"))
+	w = authTestRequest(privateFile, func(req *http.Request) { req.SetBasicAuth("alice", "wrong") })
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	w = authTestRequest(privateFile, func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") })
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, unauthenticated+3, testutil.ToFloat64(authDeniedCounter.WithLabelValues("private-repo", "unauthenticated")))
+
+	// a user that is not listed in repos may only use the default ones
+	w = authTestRequest(privateFile, func(req *http.Request) { req.SetBasicAuth("alice", "secret") })
+	require.Equal(t, http.StatusForbidden, w.Code)
+	config.Load().Auth.DefaultRepos = []string{"private-repo"}
+	for range 2 {
+		w = authTestRequest(privateFile, func(req *http.Request) { req.SetBasicAuth("alice", "secret") })
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "from the mirror", w.Body.String())
+	}
+
+	// tokens are sent as bearer tokens, or as the password of their name
+	w = authTestRequest("/repo/public-repo/foo-1.0-1-x86_64.pkg.tar.zst", func(req *http.Request) { req.Header.Set("Authorization", "Bearer ci-token") })
+	require.Equal(t, http.StatusOK, w.Code)
+	w = authTestRequest("/repo/public-repo/foo-1.0-1-x86_64.pkg.tar.zst", func(req *http.Request) { req.SetBasicAuth("ci", "ci-token") })
+	require.Equal(t, http.StatusOK, w.Code)
+	w = authTestRequest("/repo/public-repo/foo-1.0-1-x86_64.pkg.tar.zst", func(req *http.Request) { req.SetBasicAuth("alice", "ci-token") })
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = authTestRequest(privateFile, func(req *http.Request) { req.SetBasicAuth("ci", "ci-token") })
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Equal(t, forbidden+2, testutil.ToFloat64(authDeniedCounter.WithLabelValues("private-repo", "forbidden")))
+
+	// the peers may use all repos
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodHead, "/peer/private-repo/foo-1.0-1-x86_64.pkg.tar.zst", nil)
+	req.Header.Set("Authorization", "Bearer peer-token")
+	require.NoError(t, handlePeerRequest(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	peerHandler(w, httptest.NewRequest(http.MethodHead, "/peer/private-repo/foo-1.0-1-x86_64.pkg.tar.zst", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// a user named like the peers is not one
+	config.Load().Auth.users["peer"] = config.Load().Auth.users["alice"]
+	config.Load().Auth.DefaultRepos = []string{"public-repo"}
+	w = authTestRequest(privateFile, func(req *http.Request) { req.SetBasicAuth("peer", "secret") })
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	w = authTestRequest(privateFile, func(req *http.Request) { req.SetBasicAuth("peer", "peer-token") })
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestPeerTransport(t *testing.T) {
+	setupAuth(t)
+	var authorization string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer peer.Close()
+
+	resp, err := peerClient.Head(peer.URL + "/peer/private-repo/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, "Bearer peer-token", authorization)
+
+	// only the peers get the token
+	resp, err = peerClient.Head(peer.URL + "/presigned/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Empty(t, authorization)
+}
+
+// newTestCert returns a certificate for cn signed by parent, self-signed if
+// parent is nil.
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificate(t *testing.T) {
+	setupAuth(t)
+	ca := newTestCert(t, "pacoloco test CA", nil)
+	config.Load().clientCAs = x509.NewCertPool()
+	config.Load().clientCAs.AddCert(ca.Leaf)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(pacolocoHandler))
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: config.Load().clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cert *tls.Certificate, urlPath string) int {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get(server.URL + urlPath)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	builder := newTestCert(t, "builder", &ca)
+	require.Equal(t, http.StatusOK, get(&builder, "/repo/private-repo/foo-1.0-1-x86_64.pkg.tar.zst"))
+	require.Equal(t, http.StatusUnauthorized, get(nil, "/repo/private-repo/foo-1.0-1-x86_64.pkg.tar.zst"))
+
+	// the common name is the identity
+	ci := newTestCert(t, "ci", &ca)
+	require.Equal(t, http.StatusOK, get(&ci, "/repo/public-repo/foo-1.0-1-x86_64.pkg.tar.zst"))
+	require.Equal(t, http.StatusForbidden, get(&ci, "/repo/private-repo/foo-1.0-1-x86_64.pkg.tar.zst"))
+
+	// only the peer token makes a peer
+	peer := newTestCert(t, "peer", &ca)
+	require.Equal(t, http.StatusUnauthorized, get(&peer, "/repo/private-repo/foo-1.0-1-x86_64.pkg.tar.zst"))
+}
+
+func TestDashboardRequiresAuth(t *testing.T) {
+	setupAuth(t)
+
+	w := httptest.NewRecorder()
+	dashboardHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, `Basic realm="pacoloco"`, w.Header().Get("WWW-Authenticate"))
+	require.NotContains(t, w.Body.String(), "private-repo")
+
+	// the dashboard only shows the repos of the client
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("ci", "ci-token")
+	dashboardHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "public-repo")
+	require.NotContains(t, w.Body.String(), "private-repo")
+}
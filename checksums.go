@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errChecksumMismatch reports a downloaded package whose size or SHA256
+// differs from what the repo database promises.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+var checksumMismatchCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pacoloco_checksum_mismatch_total",
+	Help: "Number of downloaded packages rejected because they do not match the repo database",
+}, []string{"repo", "upstream"})
+
+// packageChecksum is what a repo database says about a package file.
+type packageChecksum struct {
+	size      int64
+	sha256Sum string
+}
+
+// packageChecksums holds the checksums of every package listed in the repo
+// databases pacoloco has seen, so downloads can be verified before they are
+// committed to the cache. A repo can serve several databases (core.db,
+// extra.db, ...), so the index is keyed by repo name, then database file name,
+// then package file name.
+var (
+	packageChecksums      = make(map[string]map[string]map[string]packageChecksum)
+	packageChecksumsMutex sync.RWMutex
+)
+
+// setRepoDBChecksums replaces the checksums learned from one database file.
+func setRepoDBChecksums(repoName string, dbFileName string, entries []repoDBEntry) {
+	checksums := make(map[string]packageChecksum, len(entries))
+	for _, e := range entries {
+		if e.SHA256Sum == "" {
+			continue
+		}
+		checksums[e.FileName] = packageChecksum{size: e.CSize, sha256Sum: e.SHA256Sum}
+	}
+
+	packageChecksumsMutex.Lock()
+	defer packageChecksumsMutex.Unlock()
+	if packageChecksums[repoName] == nil {
+		packageChecksums[repoName] = make(map[string]map[string]packageChecksum)
+	}
+	packageChecksums[repoName][dbFileName] = checksums
+}
+
+// dropRepoDBChecksums forgets the checksums learned from a database of a
+// repo, or from all of them if dbFileName is empty.
+func dropRepoDBChecksums(repoName string, dbFileName string) {
+	packageChecksumsMutex.Lock()
+	defer packageChecksumsMutex.Unlock()
+	if dbFileName == "" {
+		delete(packageChecksums, repoName)
+		return
+	}
+	delete(packageChecksums[repoName], dbFileName)
+}
+
+// lookupPackageChecksum returns the checksum of a package file if any
+// database of the repo lists it.
+func lookupPackageChecksum(repoName string, fileName string) (packageChecksum, bool) {
+	packageChecksumsMutex.RLock()
+	defer packageChecksumsMutex.RUnlock()
+	for _, checksums := range packageChecksums[repoName] {
+		if c, ok := checksums[fileName]; ok {
+			return c, true
+		}
+	}
+	return packageChecksum{}, false
+}
+
+// loadRepoDBChecksums parses a cached repo database and records the
+// checksums of the packages it lists.
+func loadRepoDBChecksums(storage Storage, repoName string, dbName string) {
+	entries, err := readCachedRepoDB(storage, repoName, dbName)
+	if err != nil {
+		log.Printf("Unable to read checksums from %v/%v: %v", repoName, dbName, err)
+		return
+	}
+	setRepoDBChecksums(repoName, dbName, entries)
+}
+
+func readCachedRepoDB(storage Storage, repoName string, dbName string) ([]repoDBEntry, error) {
+	f, err := storage.Open(repoName, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRepoDB(repoName+"/"+dbName, f)
+}
+
+// loadCachedChecksums indexes every database already cached for a repo.
+func loadCachedChecksums(storage Storage, repoName string) {
+	files, err := storage.List(repoName)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if path.Ext(f.Name) == ".db" {
+			loadRepoDBChecksums(storage, repoName, f.Name)
+		}
+	}
+}
+
+// verifyPackageChecksum checks the complete content of a buffer file
+// against the checksum expected for it.
+func verifyPackageChecksum(f *os.File, size int64, expected packageChecksum) error {
+	if expected.size != 0 && size != expected.size {
+		return fmt.Errorf("%w: size is %v, the repo database says %v", errChecksumMismatch, size, expected.size)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, expected.sha256Sum) {
+		return fmt.Errorf("%w: SHA256 is %v, the repo database says %v", errChecksumMismatch, sum, expected.sha256Sum)
+	}
+	return nil
+}
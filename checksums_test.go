@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestChecksumMismatchFallsThroughToNextMirror verifies that a package whose
+// content differs from the repo database is not cached and is fetched again
+// from the next mirror, and that a client that was already streaming the
+// rejected content is told so.
+func TestChecksumMismatchFallsThroughToNextMirror(t *testing.T) {
+	const good = "the real package content"
+	const bad = "a corrupted package body"
+	require.Equal(t, len(good), len(bad))
+
+	var badHits atomic.Int32
+	clientReading := make(chan struct{})
+	badMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(bad)))
+		// hold back the last byte until the client has started streaming
+		_, _ = w.Write([]byte(bad[:len(bad)-1]))
+		w.(http.Flusher).Flush()
+		select {
+		case <-clientReading:
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = w.Write([]byte(bad[len(bad)-1:]))
+	}))
+	defer badMirror.Close()
+	goodMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(good)))
+		_, _ = w.Write([]byte(good))
+	}))
+	defer goodMirror.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"checksum-repo": {URLs: []string{badMirror.URL, goodMirror.URL}}},
+	})
+	const fileName = "verified-1-1-any.pkg.tar.zst"
+	setRepoDBChecksums("checksum-repo", "checksum.db", []repoDBEntry{
+		{FileName: fileName, CSize: int64(len(good)), SHA256Sum: sha256Hex(good)},
+	})
+
+	badHost := badMirror.Listener.Addr().String()
+	before := testutil.ToFloat64(checksumMismatchCounter.WithLabelValues("checksum-repo", badHost))
+
+	// the client that starts the download streams the bad mirror's bytes
+	// until they are rejected
+	f, err := parseRequestURL(config.Load(), "/repo/checksum-repo/"+fileName)
+	require.NoError(t, err)
+	require.NoError(t, f.mkCacheDir())
+	_, r, err := getDownloadReader(f)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	buf := make([]byte, len(bad))
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Positive(t, n)
+	close(clientReading)
+	rest, err := io.ReadAll(r)
+	require.ErrorIs(t, err, errDownloadRestarted)
+	require.NoError(t, r.Close())
+	streamed := string(buf[:n]) + string(rest)
+	require.True(t, strings.HasPrefix(bad, streamed), "the client received %q", streamed)
+
+	// later clients get the content of the next mirror
+	req := httptest.NewRequest(http.MethodGet, "/repo/checksum-repo/"+fileName, nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, good, w.Body.String())
+
+	require.Equal(t, int32(1), badHits.Load())
+	require.Equal(t, before+1, testutil.ToFloat64(checksumMismatchCounter.WithLabelValues("checksum-repo", badHost)))
+	require.Eventually(t, func() bool {
+		cached, err := os.ReadFile(filepath.Join(cacheDir, "pkgs", "checksum-repo", fileName))
+		return err == nil && string(cached) == good
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestChecksumSizeMismatchIsRejectedEarly verifies that a mirror announcing
+// the wrong size is skipped before its body is downloaded.
+func TestChecksumSizeMismatchIsRejectedEarly(t *testing.T) {
+	const content = "package content served with the wrong size"
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	}))
+	defer mirror.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"size-repo": {URL: mirror.URL}},
+	})
+	const fileName = "sized-1-1-any.pkg.tar.zst"
+	setRepoDBChecksums("size-repo", "size.db", []repoDBEntry{
+		{FileName: fileName, CSize: int64(len(content)) + 1, SHA256Sum: sha256Hex(content)},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/size-repo/"+fileName, nil)
+	w := httptest.NewRecorder()
+	require.Error(t, handleRequest(w, req))
+	require.NoFileExists(t, filepath.Join(cacheDir, "pkgs", "size-repo", fileName))
+	requireNoBufferFiles(t, filepath.Join(cacheDir, "pkgs", "size-repo"))
+}
+
+func TestLoadCachedChecksums(t *testing.T) {
+	cacheDir := t.TempDir()
+	repoDir := filepath.Join(cacheDir, "pkgs", "loaded-repo")
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	createDbTarball(t, filepath.Join(repoDir, "loaded.db"), getTestTarDB())
+
+	loadCachedChecksums(newFSStorage(filepath.Join(cacheDir, "pkgs")), "loaded-repo")
+
+	c, ok := lookupPackageChecksum("loaded-repo", "acl-2.3.1-1-x86_64.pkg.tar.zst")
+	require.True(t, ok)
+	require.Equal(t, int64(139672), c.size)
+	require.Equal(t, "2e87a6382bcffc364015f848217d0afdcffdaa5efab43d5ee1b4d80a9645c5b8", c.sha256Sum)
+
+	_, ok = lookupPackageChecksum("loaded-repo", "unknown-1-1-any.pkg.tar.zst")
+	require.False(t, ok)
+	_, ok = lookupPackageChecksum("other-repo", "acl-2.3.1-1-x86_64.pkg.tar.zst")
+	require.False(t, ok)
+}
+
+func TestDropChecksums(t *testing.T) {
+	cacheDir := t.TempDir()
+	storage := newFSStorage(filepath.Join(cacheDir, "pkgs"))
+	for _, repoName := range []string{"dropped-repo", "removed-repo"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "pkgs", repoName), os.ModePerm))
+		createDbTarball(t, filepath.Join(cacheDir, "pkgs", repoName, "core.db"), getTestTarDB())
+		loadCachedChecksums(storage, repoName)
+		_, ok := lookupPackageChecksum(repoName, "acl-2.3.1-1-x86_64.pkg.tar.zst")
+		require.True(t, ok)
+	}
+
+	// the checksums of a deleted database are not used anymore
+	require.NoError(t, removeCachedFile(storage, "dropped-repo", "core.db"))
+	_, ok := lookupPackageChecksum("dropped-repo", "acl-2.3.1-1-x86_64.pkg.tar.zst")
+	require.False(t, ok)
+
+	// neither are those of a repo the config does not have anymore
+	updateRepoGauges(&Config{Repos: map[string]*Repo{"removed-repo": {}}}, &Config{Repos: map[string]*Repo{}})
+	_, ok = lookupPackageChecksum("removed-repo", "acl-2.3.1-1-x86_64.pkg.tar.zst")
+	require.False(t, ok)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Cluster mode. The instances of a `cluster` split the cache between them
+// instead of each keeping a full copy: every file is owned by one node,
+// picked by a consistent-hash ring over the nodes, and the other nodes
+// forward requests for it to the owner, proxying its response or
+// redirecting the client there. The nodes are listed in the config or in a
+// DNS SRV record that is looked up again every refresh_interval. A node
+// that leaves the record, or that cannot be reached, drops out of the ring
+// and only the files it owned move, each to the next node on the ring. The
+// new owner looks the files up at the other nodes like at its peers, so the
+// copies cached under the previous ring are not downloaded again.
+
+// clusterPathPrefix is the route of requests forwarded to the owner of a
+// file. They are served like /repo/ requests but never forwarded again, so
+// nodes whose rings disagree while the membership changes cannot pass a
+// request back and forth.
+const clusterPathPrefix = "/cluster/"
+
+// ringReplicas is the number of points each node has on the ring. More
+// points spread the files more evenly between the nodes.
+const ringReplicas = 128
+
+// clusterNodeBackoff is how long a node that could not be reached is left
+// out of the ring.
+const clusterNodeBackoff = 30 * time.Second
+
+var (
+	clusterNodesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pacoloco_cluster_nodes",
+		Help: "Number of nodes in the cluster ring",
+	})
+	clusterForwardedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pacoloco_cluster_forwarded_total",
+		Help: "Number of requests forwarded to the node that owns the file",
+	}, []string{"repo", "node"})
+)
+
+// hashRing maps file keys to the nodes of the cluster.
+type hashRing struct {
+	// self is the node of this instance, "" if it is none of the nodes
+	self   string
+	nodes  []string
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// clusterRing is the ring of the current cluster membership, nil outside
+// of cluster mode.
+var clusterRing atomic.Pointer[hashRing]
+
+// clusterTicker drives the refresh of the cluster membership, see
+// applyConfig.
+var clusterTicker *routineTicker
+
+// downNodes holds until when the nodes that could not be reached are left
+// out of the ring.
+var (
+	downNodes      = make(map[string]time.Time)
+	downNodesMutex sync.Mutex
+)
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newHashRing(nodes []string, self string) *hashRing {
+	nodes = slices.Clone(nodes)
+	if self != "" {
+		nodes = append(nodes, self)
+	}
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+
+	r := &hashRing{self: self, nodes: nodes}
+	for _, node := range nodes {
+		for i := range ringReplicas {
+			r.points = append(r.points, ringPoint{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int { return cmp.Compare(a.hash, b.hash) })
+	return r
+}
+
+// owner returns the node that owns key: the first node from the hash of
+// key on that is not down. It is "" if all nodes are down.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int { return cmp.Compare(p.hash, h) })
+	for j := range r.points {
+		p := r.points[(i+j)%len(r.points)]
+		if p.node == r.self || !nodeDown(p.node) {
+			return p.node
+		}
+	}
+	return ""
+}
+
+// others returns the nodes other than this instance that are not down.
+func (r *hashRing) others() []string {
+	return slices.DeleteFunc(slices.Clone(r.nodes), func(node string) bool { return node == r.self || nodeDown(node) })
+}
+
+func nodeDown(node string) bool {
+	downNodesMutex.Lock()
+	defer downNodesMutex.Unlock()
+	return time.Now().Before(downNodes[node])
+}
+
+func markNodeDown(node string) {
+	downNodesMutex.Lock()
+	defer downNodesMutex.Unlock()
+	downNodes[node] = time.Now().Add(clusterNodeBackoff)
+}
+
+// clusterKey is the part of RequestedFile.key() that names the file. The
+// destination is left out, it differs between nodes with another cache_dir.
+func (f *RequestedFile) clusterKey() string {
+	return f.repoName + f.urlPath()
+}
+
+// clusterOwner returns the node a file has to be requested from, "" if
+// this instance serves it itself.
+func clusterOwner(f *RequestedFile) string {
+	ring := clusterRing.Load()
+	if ring == nil {
+		return ""
+	}
+	if owner := ring.owner(f.clusterKey()); owner != ring.self {
+		return owner
+	}
+	return ""
+}
+
+// forwardToOwner answers a request for a file another node owns, with the
+// response of the owner or a redirect to it. It reports whether it did; if
+// the owner cannot be reached it is left out of the ring for a while and
+// the file is served here.
+func forwardToOwner(w http.ResponseWriter, req *http.Request, f *RequestedFile, owner string) bool {
+	target, err := url.Parse(owner + clusterPathPrefix + f.repoName + f.urlPath())
+	if err != nil {
+		log.Printf("forwarding %v to %v: %v", f.key(), owner, err)
+		return false
+	}
+	clusterForwardedCounter.WithLabelValues(f.repoName, owner).Inc()
+	if c := f.config.Cluster; c != nil && c.Redirect {
+		http.Redirect(w, req, target.String(), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	var proxyErr error
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL = target
+			r.Out.Host = ""
+			r.SetXForwarded()
+			// the client is authorized here, the owner trusts the node
+			if a := f.config.Auth; a != nil && a.PeerToken != "" {
+				r.Out.Header.Set("Authorization", "Bearer "+a.PeerToken)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyErr = err
+		},
+	}
+	proxy.ServeHTTP(w, req)
+	if proxyErr == nil || req.Context().Err() != nil {
+		return true
+	}
+	log.Printf("unable to forward %v to %v, serving it here: %v", f.key(), owner, proxyErr)
+	markNodeDown(owner)
+	return false
+}
+
+func clusterHandler(w http.ResponseWriter, req *http.Request) {
+	if err := handleClusterRequest(w, req); err != nil {
+		writeRequestError(w, err)
+	}
+}
+
+// handleClusterRequest serves /cluster/<repo>/<path>/<file>, a request
+// another node forwarded to this one as the owner of the file.
+func handleClusterRequest(w http.ResponseWriter, req *http.Request) error {
+	f, err := parseRequestURL(config.Load(), "/repo/"+strings.TrimPrefix(req.URL.Path, clusterPathPrefix))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotFound, err)
+	}
+	if f.repo == nil {
+		return fmt.Errorf("%w: cannot find repo %s in the config file", errNotFound, f.repoName)
+	}
+	if err := authorize(f.config, req, f.repoName); err != nil {
+		return err
+	}
+	return serveRepoFile(w, req, f)
+}
+
+// lookupClusterNodes returns the nodes the SRV record of the cluster lists.
+func lookupClusterNodes(cluster *Cluster) ([]string, error) {
+	resolver := net.DefaultResolver
+	if cluster.DNSServer != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, cluster.DNSServer)
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, records, err := resolver.LookupSRV(ctx, "", "", cluster.SRV)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]string, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		nodes = append(nodes, cluster.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+	}
+	return nodes, nil
+}
+
+// findSelf returns the node of this instance: the one whose port is the
+// listen port and whose host resolves to an address of this machine.
+func findSelf(nodes []string, port int) string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Unable to list the local addresses: %v", err)
+		return ""
+	}
+	local := make(map[string]bool)
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+
+	for _, node := range nodes {
+		u, err := url.Parse(node)
+		if err != nil {
+			continue
+		}
+		nodePort := u.Port()
+		if nodePort == "" {
+			nodePort = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		}
+		if nodePort != strconv.Itoa(port) {
+			continue
+		}
+		ips, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if local[ip] {
+				return node
+			}
+		}
+	}
+	return ""
+}
+
+// updateClusterRing builds the ring of the current members of the cluster.
+// If they cannot be looked up the ring stays as it is.
+func updateClusterRing(c *Config) {
+	nodes := c.Cluster.Nodes
+	if c.Cluster.SRV != "" {
+		var err error
+		if nodes, err = lookupClusterNodes(c.Cluster); err != nil {
+			log.Printf("Unable to look up the cluster nodes at %v: %v", c.Cluster.SRV, err)
+			return
+		}
+	}
+	self := c.Cluster.Self
+	if self == "" {
+		self = findSelf(nodes, c.Port)
+	}
+
+	ring := newHashRing(nodes, self)
+	if old := clusterRing.Swap(ring); old == nil || !slices.Equal(old.nodes, ring.nodes) || old.self != ring.self {
+		if self == "" {
+			log.Printf("Cluster nodes are %v, none of them is this instance: all requests are forwarded", ring.nodes)
+		} else {
+			log.Printf("Cluster nodes are %v, this instance is %v", ring.nodes, self)
+		}
+	}
+	clusterNodesGauge.Set(float64(len(ring.nodes)))
+}
+
+func setupClusterRoutine(c *Config) *routineTicker {
+	// the first ring is in place before the first request
+	updateClusterRing(c)
+	ticker := newRoutineTicker(time.Duration(c.Cluster.RefreshInterval) * time.Second)
+	go func() {
+		for ticker.wait() {
+			if c := config.Load(); c.Cluster != nil {
+				updateClusterRing(c)
+			}
+		}
+	}()
+	return ticker
+}
+
+// updateClusterRoutine enters, leaves or restarts cluster mode for a new
+// config. The membership is looked up again right away, the nodes or the
+// way to find them could have changed.
+func updateClusterRoutine(newConfig *Config) {
+	if clusterTicker != nil {
+		clusterTicker.Stop()
+		clusterTicker = nil
+	}
+	if newConfig.Cluster == nil {
+		clusterRing.Store(nil)
+		clusterNodesGauge.Set(0)
+		return
+	}
+	clusterTicker = setupClusterRoutine(newConfig)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func resetCluster(t *testing.T) {
+	t.Cleanup(func() {
+		clusterRing.Store(nil)
+		downNodesMutex.Lock()
+		downNodes = make(map[string]time.Time)
+		downNodesMutex.Unlock()
+	})
+}
+
+func TestHashRing(t *testing.T) {
+	resetCluster(t)
+	nodes := []string{"http://node-a:9129", "http://node-b:9129", "http://node-c:9129"}
+	ring := newHashRing(nodes, "http://node-a:9129")
+	require.Equal(t, nodes, ring.nodes)
+	require.Equal(t, []string{"http://node-b:9129", "http://node-c:9129"}, ring.others())
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := range 3000 {
+		key := fmt.Sprintf("archlinux/core/os/x86_64/pkg%d-1.0-1-x86_64.pkg.tar.zst", i)
+		owners[key] = ring.owner(key)
+		counts[owners[key]]++
+	}
+	for _, node := range nodes {
+		require.Greater(t, counts[node], 600, "the files are spread over the nodes")
+	}
+
+	// when a node leaves, only its files move
+	smaller := newHashRing(nodes[:2], "http://node-a:9129")
+	for key, owner := range owners {
+		if owner != "http://node-c:9129" {
+			require.Equal(t, owner, smaller.owner(key))
+		} else {
+			require.NotEqual(t, owner, smaller.owner(key))
+		}
+	}
+
+	// and the same happens while it cannot be reached
+	markNodeDown("http://node-c:9129")
+	for key := range owners {
+		require.Equal(t, smaller.owner(key), ring.owner(key))
+	}
+	markNodeDown("http://node-b:9129")
+	markNodeDown("http://node-a:9129")
+	require.Equal(t, "http://node-a:9129", ring.owner("core/foo"), "this instance is never down")
+}
+
+// ownedFile returns the path of a package of "cluster-repo" owned by node.
+func ownedFile(t *testing.T, node string) string {
+	for i := range 1000 {
+		urlPath := fmt.Sprintf("/repo/cluster-repo/x86_64/pkg%d-1.0-1-x86_64.pkg.tar.zst", i)
+		f, err := parseRequestURL(config.Load(), urlPath)
+		require.NoError(t, err)
+		if clusterRing.Load().owner(f.clusterKey()) == node {
+			return urlPath
+		}
+	}
+	t.Fatalf("no file is owned by %v", node)
+	return ""
+}
+
+func TestClusterForwarding(t *testing.T) {
+	resetCluster(t)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from the mirror"))
+	}))
+	defer mirror.Close()
+	var forwarded atomic.Value
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/peer/") {
+			http.NotFound(w, r)
+			return
+		}
+		forwarded.Store(r.URL.Path)
+		_, _ = w.Write([]byte("from the owner"))
+	}))
+	defer owner.Close()
+
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     -1,
+		Cluster:  &Cluster{Self: "http://self.invalid:9129", Nodes: []string{owner.URL}, RefreshInterval: DefaultClusterRefresh},
+		Repos: map[string]*Repo{
+			"cluster-repo": {URL: mirror.URL},
+		},
+	})
+	updateClusterRing(config.Load())
+	remoteFile := ownedFile(t, owner.URL)
+	localFile := ownedFile(t, "http://self.invalid:9129")
+
+	w := peerTestRequest(t, handleRequest, http.MethodGet, remoteFile)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the owner", w.Body.String())
+	require.Equal(t, "/cluster/"+strings.TrimPrefix(remoteFile, "/repo/"), forwarded.Load())
+
+	w = peerTestRequest(t, handleRequest, http.MethodGet, localFile)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the mirror", w.Body.String())
+
+	// a forwarded request is served by the node it was forwarded to
+	w = peerTestRequest(t, handleClusterRequest, http.MethodGet, "/cluster/"+strings.TrimPrefix(remoteFile, "/repo/"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the mirror", w.Body.String())
+
+	config.Load().Cluster.Redirect = true
+	w = peerTestRequest(t, handleRequest, http.MethodHead, remoteFile)
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	require.Equal(t, owner.URL+"/cluster/"+strings.TrimPrefix(remoteFile, "/repo/"), w.Header().Get("Location"))
+	config.Load().Cluster.Redirect = false
+
+	// the files of a node that cannot be reached are served by the others
+	owner.Close()
+	w = peerTestRequest(t, handleRequest, http.MethodGet, ownedFile(t, owner.URL))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the mirror", w.Body.String())
+	require.True(t, nodeDown(owner.URL))
+}
+
+// serveSRV answers DNS queries over UDP with the SRV records of targets, by
+// host:port.
+func serveSRV(t *testing.T, targets ...string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			// the question ends after the name and its type and class
+			end := 12
+			for query[end] != 0 {
+				end += int(query[end]) + 1
+			}
+			end += 5
+
+			resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+			resp = binary.BigEndian.AppendUint16(resp, 0x8180) // a response, recursion available
+			resp = binary.BigEndian.AppendUint16(resp, 1)
+			resp = binary.BigEndian.AppendUint16(resp, uint16(len(targets)))
+			resp = binary.BigEndian.AppendUint32(resp, 0)
+			resp = append(resp, query[12:end]...)
+			for _, target := range targets {
+				host, port, _ := net.SplitHostPort(target)
+				portNum, _ := strconv.Atoi(port)
+				var rdata []byte
+				rdata = binary.BigEndian.AppendUint16(rdata, 10) // priority
+				rdata = binary.BigEndian.AppendUint16(rdata, 10) // weight
+				rdata = binary.BigEndian.AppendUint16(rdata, uint16(portNum))
+				for _, label := range strings.Split(host, ".") {
+					rdata = append(rdata, byte(len(label)))
+					rdata = append(rdata, label...)
+				}
+				rdata = append(rdata, 0)
+
+				resp = binary.BigEndian.AppendUint16(resp, 0xc00c) // the name of the question
+				resp = binary.BigEndian.AppendUint16(resp, 33)     // SRV
+				resp = binary.BigEndian.AppendUint16(resp, 1)      // IN
+				resp = binary.BigEndian.AppendUint32(resp, 60)
+				resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+				resp = append(resp, rdata...)
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestClusterSRV(t *testing.T) {
+	resetCluster(t)
+	dnsServer := serveSRV(t, "localhost:9129", "node-b.cluster.test:9129")
+
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     9129,
+		Cluster: &Cluster{
+			SRV:             "_pacoloco._tcp.cluster.test.",
+			Scheme:          "http",
+			DNSServer:       dnsServer,
+			RefreshInterval: DefaultClusterRefresh,
+		},
+	})
+	updateClusterRing(config.Load())
+	ring := clusterRing.Load()
+	require.NotNil(t, ring)
+	require.Equal(t, []string{"http://localhost:9129", "http://node-b.cluster.test:9129"}, ring.nodes)
+	require.Equal(t, "http://localhost:9129", ring.self, "found by its address")
+
+	// the ring is kept while the record cannot be looked up
+	config.Load().Cluster.DNSServer = "127.0.0.1:1"
+	updateClusterRing(config.Load())
+	require.Same(t, ring, clusterRing.Load())
+}
@@ -1,32 +1,87 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/gorhill/cronexpr"
 	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
 )
 
 const (
-	DefaultPort          = 9129
-	DefaultCacheDir      = "/var/cache/pacoloco"
-	DefaultTTLUnaccessed = 30
-	DefaultTTLUnupdated  = 200
-	DefaultDBName        = "sqlite-pkg-cache.db"
+	DefaultPort            = 9129
+	DefaultCacheDir        = "/var/cache/pacoloco"
+	DefaultTTLUnaccessed   = 30
+	DefaultTTLUnupdated    = 200
+	DefaultDBName          = "sqlite-pkg-cache.db"
+	DefaultMetadataDBName  = "sqlite-pkg-metadata.db"
+	DefaultShutdownTimeout = 30
+	DefaultSegmentMinSize  = 100
+	DefaultSegments        = 4
+	DefaultS3Region        = "us-east-1"
+	DefaultKeepVersions    = 1
+	DefaultOrphanMinAge    = 7
+	DefaultClusterRefresh  = 30
+	DefaultMaxUploadSize   = 4 << 30
+	// the timeouts of http.DefaultTransport, in seconds
+	DefaultDialTimeout         = 30
+	DefaultTLSHandshakeTimeout = 10
 )
 
 type Repo struct {
-	URL                  string     `yaml:"url"`
-	URLs                 []string   `yaml:"urls"`
-	Mirrorlist           string     `yaml:"mirrorlist"`
-	HttpProxy            string     `yaml:"http_proxy"`
-	LastMirrorlistCheck  time.Time  `yaml:"-"`
-	MirrorlistMutex      sync.Mutex `yaml:"-"`
-	LastModificationTime time.Time  `yaml:"-"`
+	URL          string   `yaml:"url"`
+	URLs         []string `yaml:"urls"`
+	Mirrorlist   string   `yaml:"mirrorlist"`
+	HttpProxy    string   `yaml:"http_proxy"`
+	Keyring      string   `yaml:"keyring"`
+	RaceMirrors  int      `yaml:"race_mirrors"`
+	MaxCacheSize string   `yaml:"max_cache_size"`
+	Local        bool     `yaml:"local"`
+	Merge        []string `yaml:"merge"`
+	// UpstreamAuth, Headers and the TLS settings apply to the requests to
+	// the mirrors of the repo.
+	UpstreamAuth         *UpstreamAuth     `yaml:"upstream_auth"`
+	Headers              map[string]string `yaml:"headers"`
+	ClientCert           string            `yaml:"client_cert"`
+	ClientKey            string            `yaml:"client_key"`
+	CABundle             string            `yaml:"ca_bundle"`
+	Transport            *Transport        `yaml:"transport"`
+	LastMirrorlistCheck  time.Time         `yaml:"-"`
+	MirrorlistMutex      sync.Mutex        `yaml:"-"`
+	LastModificationTime time.Time         `yaml:"-"`
+
+	// keyring holds the keys loaded from Keyring; packages of the repo are
+	// only cached once their signature verifies against it.
+	keyring openpgp.EntityList
+	// maxCacheSize is MaxCacheSize in bytes, 0 if the repo has no quota.
+	maxCacheSize int64
+	// upstreamHeader holds the credentials and Headers sent to the mirrors.
+	upstreamHeader http.Header
+	// tlsConfig holds ClientCert and CABundle, nil if neither is set.
+	tlsConfig *tls.Config
+	// client sends the requests to the mirrors, see setupUpstreamClients.
+	client *http.Client
+}
+
+// UpstreamAuth holds the credentials of private mirrors. Secrets are read
+// from a file or an environment variable, so the config file can be shared.
+type UpstreamAuth struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+	PasswordEnv  string `yaml:"password_env"`
+	TokenFile    string `yaml:"token_file"`
+	TokenEnv     string `yaml:"token_env"`
 }
 
 type RefreshPeriod struct {
@@ -35,9 +90,68 @@ type RefreshPeriod struct {
 	TTLUnupdated  int    `yaml:"ttl_unupdated_in_days"`
 }
 
+type SegmentedDownload struct {
+	MinSizeMB int `yaml:"min_size_mb"`
+	Segments  int `yaml:"segments"`
+}
+
+type OrphanGC struct {
+	KeepVersions int  `yaml:"keep_versions"`
+	MinAgeDays   int  `yaml:"min_age_days"`
+	DryRun       bool `yaml:"dry_run"`
+}
+
+type Cluster struct {
+	// Self is the URL of this instance as the other nodes reach it. If it
+	// is empty, the node whose host resolves to a local address and whose
+	// port is the listen port is this instance.
+	Self  string   `yaml:"self"`
+	Nodes []string `yaml:"nodes"`
+	// SRV is a DNS SRV record listing the nodes, looked up every
+	// RefreshInterval seconds through DNSServer, if set.
+	SRV             string `yaml:"srv"`
+	Scheme          string `yaml:"scheme"`
+	DNSServer       string `yaml:"dns_server"`
+	RefreshInterval int    `yaml:"refresh_interval"`
+	// Redirect sends clients to the owner of a file instead of proxying
+	// the owner's response.
+	Redirect bool `yaml:"redirect"`
+}
+
+type StorageConfig struct {
+	S3 *S3Config `yaml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	Prefix          string `yaml:"prefix"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	Redirect        bool   `yaml:"redirect"`
+}
+
 type Tls struct {
 	Certificate string `yaml:"cert"`
 	Key         string `yaml:"key"`
+	// ClientCA verifies the certificates clients may authenticate with.
+	ClientCA string `yaml:"client_ca"`
+}
+
+type Auth struct {
+	Htpasswd string            `yaml:"htpasswd"`
+	Tokens   map[string]string `yaml:"tokens"`
+	// Repos lists the repos an identity may use, DefaultRepos the ones of
+	// identities it does not list. "*" stands for all repos.
+	Repos        map[string][]string `yaml:"repos"`
+	DefaultRepos []string            `yaml:"default_repos"`
+	// PeerToken is sent to the peers and cluster nodes and accepted from
+	// them for all repos.
+	PeerToken string `yaml:"peer_token"`
+
+	// users maps the users of the htpasswd file to their bcrypt hashes.
+	users map[string][]byte
 }
 
 type Config struct {
@@ -47,14 +161,33 @@ type Config struct {
 	Repos           map[string]*Repo `yaml:"repos,omitempty"`
 	PurgeFilesAfter int              `yaml:"purge_files_after"`
 	DownloadTimeout int              `yaml:"download_timeout"`
+	ShutdownTimeout int              `yaml:"shutdown_timeout"`
 	Prefetch        *RefreshPeriod   `yaml:"prefetch"`
 	HttpProxy       string           `yaml:"http_proxy"`
 	UserAgent       string           `yaml:"user_agent"`
 	LogTimestamp    bool             `yaml:"set_timestamp_to_logs"`
 	Tls             *Tls             `yaml:"tls"`
+	AdminToken      string           `yaml:"admin_token"`
+	MaxCacheSize    string           `yaml:"max_cache_size"`
+	MaxUploadSize   string           `yaml:"max_upload_size"`
+	Peers           []string         `yaml:"peers"`
+	Transport       *Transport       `yaml:"transport"`
+
+	SegmentedDownload *SegmentedDownload `yaml:"segmented_download"`
+	Storage           *StorageConfig     `yaml:"storage"`
+	OrphanGC          *OrphanGC          `yaml:"orphan_gc"`
+	Cluster           *Cluster           `yaml:"cluster"`
+	Auth              *Auth              `yaml:"auth"`
+
+	// maxCacheSize is MaxCacheSize in bytes, 0 if the cache has no quota.
+	maxCacheSize int64
+	// maxUploadSize is MaxUploadSize in bytes, 0 for DefaultMaxUploadSize.
+	maxUploadSize int64
+	// clientCAs holds the certificates of Tls.ClientCA.
+	clientCAs *x509.CertPool
 }
 
-var config *Config
+var config atomic.Pointer[Config]
 
 func parseConfig(raw []byte) (*Config, error) {
 	result := Config{
@@ -77,19 +210,109 @@ func parseConfig(raw []byte) (*Config, error) {
 		if len(repo.URLs) > 0 && repo.Mirrorlist != "" {
 			return nil, fmt.Errorf("repo '%v' specifies both urls and mirrorlist parameter, please use only one of them", name)
 		}
-		if repo.URL == "" && len(repo.URLs) == 0 && repo.Mirrorlist == "" {
+		if repo.Local {
+			// packages of a local repo are uploaded, it has no upstream
+			if repo.URL != "" || len(repo.URLs) > 0 || repo.Mirrorlist != "" {
+				return nil, fmt.Errorf("local repo '%v' cannot have url(s) or a mirrorlist", name)
+			}
+			if repo.Keyring != "" || repo.MaxCacheSize != "" {
+				return nil, fmt.Errorf("local repo '%v' cannot have a keyring or max_cache_size", name)
+			}
+			if repo.isMerged() {
+				return nil, fmt.Errorf("repo '%v' cannot be both local and merged", name)
+			}
+		} else if repo.isMerged() {
+			if repo.URL != "" || len(repo.URLs) > 0 || repo.Mirrorlist != "" {
+				return nil, fmt.Errorf("merged repo '%v' cannot have url(s) or a mirrorlist", name)
+			}
+			if repo.Keyring != "" || repo.MaxCacheSize != "" {
+				return nil, fmt.Errorf("merged repo '%v' cannot have a keyring or max_cache_size", name)
+			}
+			for _, member := range repo.Merge {
+				if result.Repos[member] == nil || member == name {
+					return nil, fmt.Errorf("merged repo '%v' merges '%v', which is not another configured repo", name, member)
+				}
+				if result.Repos[member].isMerged() {
+					return nil, fmt.Errorf("merged repo '%v' cannot merge '%v', which is a merged repo itself", name, member)
+				}
+			}
+		} else if repo.URL == "" && len(repo.URLs) == 0 && repo.Mirrorlist == "" {
 			return nil, fmt.Errorf("please specify url(s) or mirrorlist for repo '%v'", name)
 		}
 		// validate Mirrorlist config
 		if repo.Mirrorlist != "" && unix.Access(repo.Mirrorlist, unix.R_OK) != nil {
 			return nil, fmt.Errorf("mirrorlist file %v for repo %v does not exist or isn't readable for userid %v", repo.Mirrorlist, name, os.Getuid())
 		}
+		if repo.Keyring != "" {
+			keyring, err := loadKeyring(repo.Keyring)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load keyring %v for repo %v: %v", repo.Keyring, name, err)
+			}
+			repo.keyring = keyring
+		}
+		if err := repo.loadUpstreamOptions(); err != nil {
+			return nil, fmt.Errorf("repo %v: %v", name, err)
+		}
+		if repo.HttpProxy != "" {
+			if _, err := url.Parse(repo.HttpProxy); err != nil {
+				return nil, fmt.Errorf("invalid http_proxy of repo %v: %v", name, err)
+			}
+		}
+		if repo.Transport != nil {
+			if err := repo.Transport.validate(); err != nil {
+				return nil, fmt.Errorf("transport of repo %v: %v", name, err)
+			}
+		}
+		if repo.RaceMirrors < 0 {
+			return nil, fmt.Errorf("'race_mirrors' of repo %v cannot be negative", name)
+		}
+		if repo.MaxCacheSize != "" {
+			size, err := parseSize(repo.MaxCacheSize)
+			if err != nil {
+				return nil, fmt.Errorf("'max_cache_size' of repo %v: %v", name, err)
+			}
+			repo.maxCacheSize = size
+		}
+	}
+
+	if result.HttpProxy != "" {
+		if _, err := url.Parse(result.HttpProxy); err != nil {
+			return nil, fmt.Errorf("invalid http_proxy: %v", err)
+		}
+	}
+	if result.Transport != nil {
+		if err := result.Transport.validate(); err != nil {
+			return nil, fmt.Errorf("transport: %v", err)
+		}
 	}
 
 	if result.PurgeFilesAfter < 10*60 && result.PurgeFilesAfter != 0 {
 		return nil, fmt.Errorf("'purge_files_after' period is too low (%v) please specify at least 10 minutes", result.PurgeFilesAfter)
 	}
 
+	if result.MaxCacheSize != "" {
+		size, err := parseSize(result.MaxCacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("'max_cache_size': %v", err)
+		}
+		result.maxCacheSize = size
+	}
+
+	if result.MaxUploadSize != "" {
+		size, err := parseSize(result.MaxUploadSize)
+		if err != nil {
+			return nil, fmt.Errorf("'max_upload_size': %v", err)
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("'max_upload_size' cannot be 0")
+		}
+		result.maxUploadSize = size
+	}
+
+	if result.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("'shutdown_timeout' value is too low. Please set it to a value greater than 0")
+	}
+
 	if unix.Access(result.CacheDir, unix.R_OK|unix.W_OK) != nil {
 		return nil, fmt.Errorf("directory %v does not exist or isn't writable for userid %v", result.CacheDir, os.Getuid())
 	}
@@ -116,6 +339,96 @@ func parseConfig(raw []byte) (*Config, error) {
 		}
 	}
 
+	if result.SegmentedDownload != nil {
+		if result.SegmentedDownload.MinSizeMB == 0 {
+			result.SegmentedDownload.MinSizeMB = DefaultSegmentMinSize
+		}
+		if result.SegmentedDownload.Segments == 0 {
+			result.SegmentedDownload.Segments = DefaultSegments
+		}
+		if result.SegmentedDownload.MinSizeMB < 0 {
+			return nil, fmt.Errorf("'min_size_mb' value is too low. Please set it to a value greater than 0")
+		}
+		if result.SegmentedDownload.Segments < 2 {
+			return nil, fmt.Errorf("'segments' value is too low. Please set it to at least 2")
+		}
+	}
+
+	if result.OrphanGC != nil {
+		if result.OrphanGC.KeepVersions == 0 {
+			result.OrphanGC.KeepVersions = DefaultKeepVersions
+		}
+		if result.OrphanGC.MinAgeDays == 0 {
+			result.OrphanGC.MinAgeDays = DefaultOrphanMinAge
+		}
+		if result.OrphanGC.KeepVersions < 0 {
+			return nil, fmt.Errorf("'keep_versions' value is too low. Please set it to a value greater than 0")
+		}
+		if result.OrphanGC.MinAgeDays < 0 {
+			return nil, fmt.Errorf("'min_age_days' value is too low. Please set it to a value greater than 0")
+		}
+	}
+
+	if result.Storage != nil && result.Storage.S3 != nil {
+		s3 := result.Storage.S3
+		if s3.Region == "" {
+			s3.Region = DefaultS3Region
+		}
+		s3.Prefix = strings.Trim(s3.Prefix, "/")
+		if u, err := url.Parse(s3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("s3 endpoint '%v' must be an http or https URL", s3.Endpoint)
+		}
+		if s3.Bucket == "" {
+			return nil, fmt.Errorf("please specify the bucket of the s3 storage")
+		}
+		if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			return nil, fmt.Errorf("please specify access_key_id and secret_access_key of the s3 storage")
+		}
+	}
+
+	for i, peer := range result.Peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("peer '%v' must be an http or https URL", peer)
+		}
+		result.Peers[i] = strings.TrimRight(peer, "/")
+	}
+
+	if result.Cluster != nil {
+		cluster := result.Cluster
+		if (len(cluster.Nodes) > 0) == (cluster.SRV != "") {
+			return nil, fmt.Errorf("please specify either the nodes or the srv record of the cluster")
+		}
+		if cluster.Scheme == "" {
+			cluster.Scheme = "http"
+		}
+		if cluster.Scheme != "http" && cluster.Scheme != "https" {
+			return nil, fmt.Errorf("cluster scheme '%v' must be http or https", cluster.Scheme)
+		}
+		if cluster.RefreshInterval == 0 {
+			cluster.RefreshInterval = DefaultClusterRefresh
+		}
+		if cluster.RefreshInterval < 0 {
+			return nil, fmt.Errorf("'refresh_interval' value is too low. Please set it to a value greater than 0")
+		}
+		if cluster.DNSServer != "" {
+			if _, _, err := net.SplitHostPort(cluster.DNSServer); err != nil {
+				return nil, fmt.Errorf("cluster dns_server '%v' must be a host:port address", cluster.DNSServer)
+			}
+		}
+		for i, node := range append([]string{cluster.Self}, cluster.Nodes...) {
+			if i == 0 && node == "" {
+				continue // found among the nodes
+			}
+			if u, err := url.Parse(node); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("cluster node '%v' must be an http or https URL", node)
+			}
+		}
+		cluster.Self = strings.TrimRight(cluster.Self, "/")
+		for i, node := range cluster.Nodes {
+			cluster.Nodes[i] = strings.TrimRight(node, "/")
+		}
+	}
+
 	if result.Tls != nil {
 		if unix.Access(result.Tls.Certificate, unix.R_OK) != nil {
 			return nil, fmt.Errorf("tls cert file %v does not exist or isn't readable for userid %v", result.Tls.Certificate, os.Getuid())
@@ -123,6 +436,56 @@ func parseConfig(raw []byte) (*Config, error) {
 		if unix.Access(result.Tls.Key, unix.R_OK) != nil {
 			return nil, fmt.Errorf("tls key file %v does not exist or isn't readable for userid %v", result.Tls.Key, os.Getuid())
 		}
+		if result.Tls.ClientCA != "" {
+			pool, err := loadCertPool(result.Tls.ClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load tls client_ca: %v", err)
+			}
+			result.clientCAs = pool
+		}
+	}
+
+	if result.Auth != nil {
+		auth := result.Auth
+		if auth.Htpasswd == "" && len(auth.Tokens) == 0 && result.clientCAs == nil {
+			return nil, fmt.Errorf("please specify an htpasswd file, tokens or a tls client_ca for auth")
+		}
+		if auth.Htpasswd != "" {
+			users, err := loadHtpasswd(auth.Htpasswd)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load htpasswd file %v: %v", auth.Htpasswd, err)
+			}
+			if _, ok := users[peerIdentity]; ok {
+				return nil, fmt.Errorf("htpasswd user name '%v' is reserved for the peers", peerIdentity)
+			}
+			auth.users = users
+		}
+		for name, token := range auth.Tokens {
+			if token == "" {
+				return nil, fmt.Errorf("auth token '%v' is empty", name)
+			}
+		}
+		if _, ok := auth.Tokens[peerIdentity]; ok {
+			return nil, fmt.Errorf("auth token name '%v' is reserved for the peer_token", peerIdentity)
+		}
+		if result.Cluster != nil && result.Cluster.Redirect && (auth.Htpasswd != "" || len(auth.Tokens) > 0) {
+			return nil, fmt.Errorf("cluster redirect cannot be combined with auth passwords or tokens, clients do not send them to the node they are redirected to")
+		}
+		for identity, repos := range auth.Repos {
+			if identity == peerIdentity {
+				return nil, fmt.Errorf("the peers may use all repos, '%v' cannot be restricted", peerIdentity)
+			}
+			for _, repoName := range repos {
+				if repoName != "*" && result.Repos[repoName] == nil {
+					return nil, fmt.Errorf("auth repos of '%v' list '%v', which is not a configured repo", identity, repoName)
+				}
+			}
+		}
+		for _, repoName := range auth.DefaultRepos {
+			if repoName != "*" && result.Repos[repoName] == nil {
+				return nil, fmt.Errorf("auth default_repos list '%v', which is not a configured repo", repoName)
+			}
+		}
 	}
 	return &result, nil
 }
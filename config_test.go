@@ -1,11 +1,13 @@
 package main
 
 import (
+	"net/http"
 	"os"
 	"path"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // test that `parseConfig()` can successfully load YAML config
@@ -253,6 +255,95 @@ repos:
 	require.Contains(t, err.Error(), "specify url(s) or mirrorlist")
 }
 
+func TestParseConfigNegativeRaceMirrors(t *testing.T) {
+	_, err := parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+    race_mirrors: -1
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "race_mirrors")
+}
+
+func TestParseConfigSegmentedDownload(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+segmented_download: {}
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.NoError(t, err)
+	require.Equal(t, &SegmentedDownload{MinSizeMB: DefaultSegmentMinSize, Segments: DefaultSegments}, c.SegmentedDownload)
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+segmented_download:
+  segments: 1
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "'segments'")
+}
+
+func TestParseConfigS3Storage(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+storage:
+  s3:
+    endpoint: http://localhost:9000
+    bucket: pacoloco
+    prefix: /cache/
+    access_key_id: minio
+    secret_access_key: minio123
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.NoError(t, err)
+	require.Equal(t, &S3Config{
+		Endpoint:        "http://localhost:9000",
+		Region:          DefaultS3Region,
+		Bucket:          "pacoloco",
+		Prefix:          "cache",
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+	}, c.Storage.S3)
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+storage:
+  s3:
+    endpoint: localhost:9000
+    bucket: pacoloco
+    access_key_id: minio
+    secret_access_key: minio123
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "endpoint")
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+storage:
+  s3:
+    endpoint: http://localhost:9000
+    access_key_id: minio
+    secret_access_key: minio123
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bucket")
+}
+
 func TestParseConfigPurgeFilesAfterTooLow(t *testing.T) {
 	_, err := parseConfig([]byte(`
 cache_dir: /tmp
@@ -344,3 +435,385 @@ repos:
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "tls key file")
 }
+
+func TestParseConfigMaxCacheSize(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+max_cache_size: 100G
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+    max_cache_size: 500M
+`))
+	require.NoError(t, err)
+	require.Equal(t, int64(100<<30), c.maxCacheSize)
+	require.Equal(t, int64(500<<20), c.Repos["archlinux"].maxCacheSize)
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+    max_cache_size: lots
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max_cache_size")
+}
+
+func TestParseConfigMaxUploadSize(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  private:
+    local: true
+`))
+	require.NoError(t, err)
+	require.Equal(t, int64(DefaultMaxUploadSize), c.uploadLimit())
+
+	c, err = parseConfig([]byte(`
+cache_dir: /tmp
+max_upload_size: 100M
+repos:
+  private:
+    local: true
+`))
+	require.NoError(t, err)
+	require.Equal(t, int64(100<<20), c.uploadLimit())
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+max_upload_size: 0
+repos:
+  private:
+    local: true
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max_upload_size")
+}
+
+func TestParseConfigOrphanGC(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+orphan_gc: {}
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.NoError(t, err)
+	require.Equal(t, &OrphanGC{KeepVersions: DefaultKeepVersions, MinAgeDays: DefaultOrphanMinAge}, c.OrphanGC)
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+orphan_gc:
+  keep_versions: -1
+repos:
+  archlinux:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "keep_versions")
+}
+
+func TestParseConfigLocalRepo(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  private:
+    local: true
+`))
+	require.NoError(t, err)
+	require.True(t, c.Repos["private"].Local)
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  private:
+    local: true
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "local repo")
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  private:
+    local: true
+    max_cache_size: 1G
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max_cache_size")
+}
+
+func TestParseConfigMergedRepo(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+  core-overrides:
+    local: true
+  merged:
+    merge: [core-overrides, core]
+`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"core-overrides", "core"}, c.Repos["merged"].Merge)
+
+	for _, repos := range []string{
+		"merged:\n    merge: [unknown]",
+		"merged:\n    merge: [merged]",
+		"merged:\n    merge: [core]\n    url: http://mirrors.kernel.org/archlinux",
+		"merged:\n    merge: [core]\n  merged2:\n    merge: [merged]",
+	} {
+		_, err := parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+  ` + repos + "\n"))
+		require.Error(t, err, repos)
+		require.Contains(t, err.Error(), "merged repo")
+	}
+}
+
+func TestParseConfigPeers(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+peers:
+  - http://cache1.lan:9129/
+  - https://cache2.lan
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"http://cache1.lan:9129", "https://cache2.lan"}, c.Peers)
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+peers:
+  - cache1.lan:9129
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "peer")
+}
+
+func TestParseConfigCluster(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+cluster:
+  nodes:
+    - http://pacoloco-0.lan:9129/
+    - http://pacoloco-1.lan:9129
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.NoError(t, err)
+	require.Equal(t, &Cluster{
+		Nodes:           []string{"http://pacoloco-0.lan:9129", "http://pacoloco-1.lan:9129"},
+		Scheme:          "http",
+		RefreshInterval: DefaultClusterRefresh,
+	}, c.Cluster)
+
+	c, err = parseConfig([]byte(`
+cache_dir: /tmp
+cluster:
+  self: http://pacoloco-0.pacoloco:9129
+  srv: _http._tcp.pacoloco.default.svc.cluster.local
+  dns_server: 10.0.0.10:53
+  redirect: true
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.NoError(t, err)
+	require.Equal(t, "http://pacoloco-0.pacoloco:9129", c.Cluster.Self)
+	require.True(t, c.Cluster.Redirect)
+
+	for _, cluster := range []string{
+		"srv: _http._tcp.pacoloco\n  nodes: [http://pacoloco-0.lan:9129]",
+		"self: http://pacoloco-0.lan:9129",
+		"nodes: [pacoloco-0.lan:9129]",
+		"srv: _http._tcp.pacoloco\n  scheme: ftp",
+		"srv: _http._tcp.pacoloco\n  dns_server: 10.0.0.10",
+		"srv: _http._tcp.pacoloco\n  refresh_interval: -1",
+	} {
+		_, err := parseConfig([]byte(`
+cache_dir: /tmp
+cluster:
+  ` + cluster + `
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+		require.Error(t, err, cluster)
+	}
+}
+
+func TestParseConfigAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	htpasswd := path.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0o600))
+
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+auth:
+  htpasswd: ` + htpasswd + `
+  tokens:
+    ci: s3cr3t
+  repos:
+    ci: [core]
+  default_repos: ["*"]
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"ci": "s3cr3t"}, c.Auth.Tokens)
+	require.Equal(t, map[string][]string{"ci": {"core"}}, c.Auth.Repos)
+	require.Equal(t, []string{"*"}, c.Auth.DefaultRepos)
+	require.Equal(t, map[string][]byte{"alice": hash}, c.Auth.users)
+
+	for _, auth := range []string{
+		"auth: {}",
+		"auth: {htpasswd: /nonexistent}",
+		"auth: {tokens: {ci: ''}}",
+		"auth: {tokens: {ci: s3cr3t}, repos: {ci: [extra]}}",
+		"auth: {tokens: {ci: s3cr3t}, repos: {peer: [core]}}",
+		"auth: {tokens: {ci: s3cr3t}, default_repos: [extra]}",
+	} {
+		_, err = parseConfig([]byte(`
+cache_dir: /tmp
+` + auth + `
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+		require.Error(t, err, auth)
+	}
+
+	// only bcrypt hashes are accepted
+	require.NoError(t, os.WriteFile(htpasswd, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600))
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+auth:
+  htpasswd: ` + htpasswd + `
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.ErrorContains(t, err, "htpasswd -B")
+
+	// the peers are only identified by the peer token
+	require.NoError(t, os.WriteFile(htpasswd, []byte("peer:"+string(hash)+"\n"), 0o600))
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+auth:
+  htpasswd: ` + htpasswd + `
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+	require.ErrorContains(t, err, "reserved for the peers")
+}
+
+func TestParseConfigUpstreamAuth(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0o600))
+
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  private:
+    url: https://pkgs.example.com/arch
+    upstream_auth:
+      token_file: ` + tokenFile + `
+    headers:
+      X-Api-Key: key
+`))
+	require.NoError(t, err)
+	require.Equal(t, http.Header{"Authorization": {"Bearer s3cr3t"}, "X-Api-Key": {"key"}}, c.Repos["private"].upstreamHeader)
+	require.Nil(t, c.Repos["private"].tlsConfig)
+
+	t.Setenv("PACOLOCO_TEST_EMPTY", "")
+	for _, options := range []string{
+		"upstream_auth: {}",
+		"upstream_auth: {password_env: PACOLOCO_TEST_PASSWORD}",
+		"upstream_auth: {username: builder, password_env: PACOLOCO_TEST_EMPTY}",
+		"upstream_auth: {username: builder, password_file: /nonexistent}",
+		"upstream_auth: {username: builder, token_file: " + tokenFile + "}",
+		"upstream_auth: {token_file: " + tokenFile + ", token_env: PACOLOCO_TEST_TOKEN}",
+		"headers: {'X Api Key': key}",
+		"client_cert: /etc/pacoloco/client.crt",
+		"ca_bundle: /nonexistent",
+	} {
+		_, err = parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  private:
+    url: https://pkgs.example.com/arch
+    ` + options + `
+`))
+		require.Error(t, err, options)
+		require.NotContains(t, err.Error(), "s3cr3t")
+	}
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  uploads:
+    local: true
+    headers:
+      X-Api-Key: key
+`))
+	require.Error(t, err)
+}
+
+func TestParseConfigTransport(t *testing.T) {
+	c, err := parseConfig([]byte(`
+cache_dir: /tmp
+transport:
+  dial_timeout: 5
+  ip_preference: ipv6
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+    transport:
+      max_conns_per_host: 4
+      disable_http2: true
+      source_address: 192.0.2.1
+`))
+	require.NoError(t, err)
+	require.Equal(t, &Transport{DialTimeout: 5, IPPreference: "ipv6"}, c.Transport)
+	require.Equal(t, &Transport{MaxConnsPerHost: 4, DisableHTTP2: true, SourceAddress: "192.0.2.1"}, c.Repos["core"].Transport)
+
+	for _, transport := range []string{
+		"{dial_timeout: -1}",
+		"{source_address: eth0}",
+		"{ip_preference: ipv5}",
+	} {
+		_, err = parseConfig([]byte(`
+cache_dir: /tmp
+transport: ` + transport + `
+repos:
+  core:
+    url: http://mirrors.kernel.org/archlinux
+`))
+		require.Error(t, err, transport)
+	}
+
+	_, err = parseConfig([]byte(`
+cache_dir: /tmp
+repos:
+  uploads:
+    local: true
+    transport:
+      disable_http2: true
+`))
+	require.Error(t, err)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes":   formatBytes,
+	"percent": func(v float64) string { return fmt.Sprintf("%.1f%%", v*100) },
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format("2006-01-02 15:04:05 MST")
+	},
+}).Parse(dashboardHTML))
+
+// lastPrefetchRun is the start time of the latest prefetch run, shown on
+// the dashboard.
+var lastPrefetchRun atomic.Pointer[time.Time]
+
+type dashboardRepo struct {
+	Name          string
+	URLs          []string
+	CacheSize     int64
+	CachePackages int64
+	Hits          int64
+	Misses        int64
+	HitRatio      float64
+}
+
+type dashboardDownload struct {
+	apiDownload
+	Progress float64
+}
+
+type dashboardData struct {
+	Now          time.Time
+	Repos        []dashboardRepo
+	Downloads    []dashboardDownload
+	Prefetch     bool
+	LastPrefetch time.Time
+	NextPrefetch time.Time
+}
+
+// metricValue reads the current value of a counter or gauge.
+func metricValue(m prometheus.Metric) float64 {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return 0
+	}
+	switch {
+	case pb.Counter != nil:
+		return pb.Counter.GetValue()
+	case pb.Gauge != nil:
+		return pb.Gauge.GetValue()
+	}
+	return 0
+}
+
+// gatherDashboardData collects the state of the repos of c the client may
+// see, and of their downloads.
+func gatherDashboardData(c *Config, mayUse func(repoName string) bool) dashboardData {
+	data := dashboardData{Now: time.Now()}
+
+	names := make([]string, 0, len(c.Repos))
+	for name := range c.Repos {
+		if mayUse(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		r := dashboardRepo{
+			Name:          name,
+			URLs:          c.Repos[name].getUrls(),
+			CacheSize:     int64(metricValue(cacheSizeGauge.WithLabelValues(name))),
+			CachePackages: int64(metricValue(cachePackageGauge.WithLabelValues(name))),
+			Hits:          int64(metricValue(cacheServedCounter.WithLabelValues(name))),
+			Misses:        int64(metricValue(cacheMissedCounter.WithLabelValues(name))),
+		}
+		if total := r.Hits + r.Misses; total > 0 {
+			r.HitRatio = float64(r.Hits) / float64(total)
+		}
+		data.Repos = append(data.Repos, r)
+	}
+
+	for _, d := range activeDownloads() {
+		if !mayUse(d.Repo) {
+			continue
+		}
+		dl := dashboardDownload{apiDownload: d}
+		if d.ContentLength > 0 {
+			dl.Progress = float64(d.BytesReceived) / float64(d.ContentLength)
+		}
+		data.Downloads = append(data.Downloads, dl)
+	}
+
+	if c.Prefetch != nil {
+		data.Prefetch = true
+		if last := lastPrefetchRun.Load(); last != nil {
+			data.LastPrefetch = *last
+		}
+		if duration, err := getCronDuration(c.Prefetch.Cron, data.Now); err == nil {
+			data.NextPrefetch = data.Now.Add(duration)
+		}
+	}
+	return data
+}
+
+// dashboardHandler renders the status page. With auth, it requires
+// credentials and only shows the repos the client may use.
+func dashboardHandler(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	mayUse, err := authenticate(c, req)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, gatherDashboardData(c, mayUse)); err != nil {
+		log.Printf("unable to render the dashboard: %v", err)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     -1,
+		Repos: map[string]*Repo{
+			"dashboard-repo": {URLs: []string{"http://one.example.com", "http://two.example.com"}},
+		},
+	})
+	cacheSizeGauge.WithLabelValues("dashboard-repo").Set(3 * 1024 * 1024)
+	cachePackageGauge.WithLabelValues("dashboard-repo").Set(7)
+	cacheServedCounter.WithLabelValues("dashboard-repo").Add(3)
+	cacheMissedCounter.WithLabelValues("dashboard-repo").Add(1)
+
+	w := httptest.NewRecorder()
+	dashboardHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	require.Contains(t, body, "dashboard-repo")
+	require.Contains(t, body, "<li>http://one.example.com</li>")
+	require.Contains(t, body, "<li>http://two.example.com</li>")
+	require.Contains(t, body, "3.0 MiB")
+	require.Contains(t, body, "75.0%")
+	require.Contains(t, body, "Nothing is downloading.")
+	require.Contains(t, body, "Prefetching is disabled.")
+}
+
+func TestDashboardPrefetchTimes(t *testing.T) {
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     -1,
+		Prefetch: &RefreshPeriod{Cron: "0 0 3 * * * *"},
+	})
+	last := time.Date(2024, 5, 1, 3, 0, 0, 0, time.Local)
+	lastPrefetchRun.Store(&last)
+	t.Cleanup(func() { lastPrefetchRun.Store(nil) })
+
+	data := gatherDashboardData(config.Load(), func(string) bool { return true })
+	require.True(t, data.Prefetch)
+	require.Equal(t, last, data.LastPrefetch)
+	require.True(t, data.NextPrefetch.After(data.Now))
+	require.Equal(t, 3, data.NextPrefetch.Hour())
+
+	w := httptest.NewRecorder()
+	dashboardHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Contains(t, w.Body.String(), "2024-05-01 03:00:00")
+}
+
+func TestFormatBytes(t *testing.T) {
+	require.Equal(t, "0 B", formatBytes(0))
+	require.Equal(t, "1023 B", formatBytes(1023))
+	require.Equal(t, "1.0 KiB", formatBytes(1024))
+	require.Equal(t, "1.5 MiB", formatBytes(1536*1024))
+	require.Equal(t, "2.0 GiB", formatBytes(2<<30))
+}
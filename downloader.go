@@ -7,7 +7,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -38,18 +37,51 @@ var downloadStallTimeout = time.Minute
 // downloaded normally.
 var errSignatureNotFound = errors.New("database signature not found upstream")
 
+// errCannotResume reports a response to a resumed request that does not
+// continue the file in the buffer file, e.g. because it changed upstream.
+var errCannotResume = errors.New("cannot resume")
+
+// errLocalStorage reports a failure to write, read back or commit the
+// downloaded file, which is no fault of the mirror it came from.
+var errLocalStorage = errors.New("local storage error")
+
+// upstreamStatusError reports a response of an upstream with an unexpected
+// status code.
+type upstreamStatusError struct {
+	url        string
+	statusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("unable to download url %s, status code is %d", e.url, e.statusCode)
+}
+
 type Downloader struct {
-	key            string // repoName + path + filename
-	outputFileName string
-	bufferFile     *os.File
+	key        string // repoName + path + filename
+	fileName   string
+	storage    Storage // receives the downloaded file
+	bufferFile *os.File
 
 	// downloaded metadata
 	modificationTime time.Time
 	contentLength    int64
+	// etag and metadataUpstream identify the response the metadata came
+	// from. A transfer that breaks off is resumed with a Range request, and
+	// the resumed response has to be checked against them so that the
+	// pieces stitched together in bufferFile belong to the same file.
+	etag             string
+	metadataUpstream string
 
 	repoName string
 	repo     *Repo
 	urlPath  string // path + filename
+	// peer is the instance the file is being fetched from while it is
+	// fetched from a peer rather than from the mirrors.
+	peer string
+	// config is the configuration active when the download started. The
+	// download goroutine reads its settings from here rather than from the
+	// global, which a reload replaces concurrently.
+	config *Config
 
 	// usageCount is the number of active users of this Downloader: every
 	// client streaming from it plus the download goroutine itself. It is
@@ -64,9 +96,20 @@ type Downloader struct {
 	eventMetadataReceived bool
 	eventNotModified      bool
 	eventDone             bool
-	eventDataReceivedSize int64
+	// eventReceived tracks which parts of the file are in bufferFile.
+	// Segmented downloads fill it out of order; clients stream only its
+	// contiguous prefix.
+	eventReceived byteRanges
+	// generation counts how often the received data was discarded to start
+	// over (see restart); readers that consumed data of an earlier
+	// generation cannot continue.
+	generation int
 }
 
+// errDownloadRestarted is returned to clients that were streaming data the
+// Downloader later discarded as invalid.
+var errDownloadRestarted = errors.New("download restarted after receiving invalid data")
+
 func (d *Downloader) decrementUsage() {
 	downloadersMutex.Lock()
 	defer downloadersMutex.Unlock()
@@ -83,20 +126,63 @@ func (d *Downloader) decrementUsage() {
 	_ = os.Remove(d.bufferFile.Name())
 }
 
+// receivedPrefix returns the length of the data received from the start
+// of the file without gaps.
+func (d *Downloader) receivedPrefix() int64 {
+	d.eventCond.L.Lock()
+	defer d.eventCond.L.Unlock()
+	return d.eventReceived.prefix()
+}
+
 func (d *Downloader) download() error {
-	urls := d.repo.getUrls()
+	urls := orderMirrors(d.repo.getUrls())
 	if len(urls) == 0 {
 		return fmt.Errorf("repo %v has no urls", d.repoName)
 	}
 
-	var proxyURL *url.URL
-	if d.repo.HttpProxy != "" {
-		proxyURL, _ = url.Parse(d.repo.HttpProxy)
+	client := upstreamClient(d.repo)
+
+	// Packages another instance has cached are fetched from it. Databases
+	// always come from the mirrors.
+	if peers := lookupPeers(d.config); len(peers) > 0 && !forceCheckAtServer(d.fileName) && d.receivedPrefix() == 0 {
+		if d.downloadFromPeer(peers) {
+			return nil
+		}
+	}
+
+	// Only a fresh download races: a resumed one has to stay with
+	// mirrors that can serve the remainder. The winner's response is
+	// received by the first attempt below.
+	var raced *upstreamTransfer
+	if d.repo.RaceMirrors > 1 && len(urls) > 1 && d.receivedPrefix() == 0 {
+		urls, raced = d.raceMirrors(urls, d.repo.RaceMirrors, client)
 	}
 
+	var rejected error // why the last mirror's package was refused, if it was
 	for _, u := range urls {
-		err := d.downloadFromUpstream(u, proxyURL)
-		if err != nil {
+		// A transfer that broke off after making progress (a stalled or
+		// truncated body) is resumed from the same mirror once before moving
+		// on; the next mirrors resume from wherever the data ends.
+		for attempt := 0; ; attempt++ {
+			received := d.receivedPrefix()
+			var stats *transferStats
+			var err error
+			if raced != nil {
+				stats = raced.stats
+				err = d.receiveUpstream(client, raced)
+				raced.close()
+				raced = nil
+			} else {
+				stats = &transferStats{}
+				err = d.downloadFromUpstream(u, client, stats)
+			}
+			// a shutdown cancelling the transfer says nothing about the mirror
+			if downloadsCtx.Err() == nil && !errors.Is(err, errSignatureNotFound) {
+				recordMirrorTransfer(u, stats, err)
+			}
+			if err == nil {
+				return nil
+			}
 			if errors.Is(err, errSignatureNotFound) {
 				// The upstream does not publish a signature for this
 				// database. Other mirrors of the same repository will not
@@ -104,21 +190,171 @@ func (d *Downloader) download() error {
 				return nil
 			}
 			log.Printf("unable to download file %v: %v", d.key, err)
-			continue // try next mirror
+			if errors.Is(err, errSignatureInvalid) {
+				rejected = err
+			}
+			if resumed := d.receivedPrefix(); attempt == 0 && resumed > received {
+				log.Printf("resuming download of %v from byte %v", d.key, resumed)
+				continue
+			}
+			break // try next mirror
 		}
-		return nil
+	}
+	if rejected != nil {
+		return fmt.Errorf("unable to download file %v: %w", d.key, rejected)
 	}
 	return fmt.Errorf("unable to download file %v", d.key)
 }
 
-func (d *Downloader) downloadFromUpstream(repoURL string, proxyURL *url.URL) error {
+// parseContentRange parses the value of a Content-Range response header,
+// "bytes <start>-<end>/<total>". total is -1 if the server sent "*".
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("unsupported Content-Range %q", header)
+	}
+	rangeSpec, totalSpec, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	startSpec, endSpec, ok := strings.Cut(rangeSpec, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if start, err = strconv.ParseInt(startSpec, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if end, err = strconv.ParseInt(endSpec, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	total = -1
+	if totalSpec != "*" {
+		if total, err = strconv.ParseInt(totalSpec, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+	return start, end, total, nil
+}
+
+// checkResumedResponse verifies that a response to a resumed request
+// continues the file whose first part is already in the buffer file. It
+// returns the number of leading body bytes to skip: a server that ignored
+// the Range header sends the whole file again.
+func (d *Downloader) checkResumedResponse(repoURL string, resp *http.Response, offset int64) (int64, error) {
+	if etag := resp.Header.Get("ETag"); etag != "" && d.etag != "" && repoURL == d.metadataUpstream && etag != d.etag {
+		return 0, fmt.Errorf("%w: ETag changed from %v to %v", errCannotResume, d.etag, etag)
+	}
+	var lm time.Time
+	if lmStr := resp.Header.Get("Last-Modified"); lmStr != "" {
+		lm, _ = http.ParseTime(lmStr)
+	}
+	if !lm.IsZero() && !d.modificationTime.IsZero() && !lm.Equal(d.modificationTime) {
+		return 0, fmt.Errorf("%w: Last-Modified changed from %v to %v", errCannotResume, d.modificationTime, lm)
+	}
+	// Package file names carry the version, so equal sizes are enough to
+	// trust another mirror. Mutable files (databases) can change under the
+	// same name and are only resumed if the upstream proves it is the same
+	// revision.
+	if forceCheckAtServer(d.fileName) && (lm.IsZero() || d.modificationTime.IsZero()) {
+		return 0, fmt.Errorf("%w: no Last-Modified to validate the resumed content", errCannotResume)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, err
+		}
+		if start != offset {
+			return 0, fmt.Errorf("%w: requested data from byte %v but received from byte %v", errCannotResume, offset, start)
+		}
+		if d.contentLength > 0 && total != -1 && total != d.contentLength {
+			return 0, fmt.Errorf("%w: file size changed from %v to %v", errCannotResume, d.contentLength, total)
+		}
+		return 0, nil
+	case http.StatusOK:
+		if d.contentLength > 0 && resp.ContentLength != d.contentLength {
+			return 0, fmt.Errorf("%w: file size changed from %v to %v", errCannotResume, d.contentLength, resp.ContentLength)
+		}
+		return offset, nil
+	default:
+		return 0, fmt.Errorf("%w: %w", errCannotResume, &upstreamStatusError{url: resp.Request.URL.String(), statusCode: resp.StatusCode})
+	}
+}
+
+// upstreamClient returns the client for requests to the mirrors of a repo,
+// see newUpstreamClient. Only repos of a config that was not applied, in
+// tests, have none.
+func upstreamClient(repo *Repo) *http.Client {
+	if repo.client == nil {
+		return http.DefaultClient
+	}
+	return repo.client
+}
+
+// newUpstreamRequest returns a request to a mirror, or to the peer of a peer
+// transfer, with the headers all of them get. The credentials and headers
+// of the repo are only for its mirrors.
+func (d *Downloader) newUpstreamRequest(ctx context.Context, method string, upstreamURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, upstreamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", d.config.UserAgent)
+	if d.peer == "" {
+		for name, values := range d.repo.upstreamHeader {
+			req.Header[name] = values
+		}
+	}
+	return req, nil
+}
+
+func (d *Downloader) downloadFromUpstream(repoURL string, client *http.Client, stats *transferStats) error {
+	t, err := d.sendUpstreamRequest(downloadsCtx, repoURL, client, stats)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	return d.receiveUpstream(client, t)
+}
+
+// upstreamTransfer is a request to a mirror whose response headers have
+// arrived, with the context and the stall watchdog of its transfer.
+type upstreamTransfer struct {
+	repoURL  string
+	req      *http.Request
+	resp     *http.Response
+	offset   int64 // the received prefix the request continues
+	ctx      context.Context
+	watchdog *time.Timer
+	stats    *transferStats
+	// cancels release the contexts of the transfer
+	cancels []context.CancelFunc
+}
+
+// close ends the transfer, cancelling it if it is still running.
+func (t *upstreamTransfer) close() {
+	if t.resp != nil {
+		_ = t.resp.Body.Close()
+	}
+	t.watchdog.Stop()
+	for _, cancel := range t.cancels {
+		cancel()
+	}
+}
+
+// sendUpstreamRequest asks a mirror for the file, or for the part of it
+// that is not received yet, and waits for the response headers. The
+// transfer is cancelled when parent is; the caller closes it.
+func (d *Downloader) sendUpstreamRequest(parent context.Context, repoURL string, client *http.Client, stats *transferStats) (*upstreamTransfer, error) {
 	upstreamURL := repoURL + d.urlPath
+	t := &upstreamTransfer{repoURL: repoURL, stats: stats}
 
-	baseCtx := context.Background()
-	if config.DownloadTimeout > 0 {
+	baseCtx := parent
+	if d.config.DownloadTimeout > 0 {
 		var cancel context.CancelFunc
-		baseCtx, cancel = context.WithTimeout(baseCtx, time.Duration(config.DownloadTimeout)*time.Second)
-		defer cancel()
+		baseCtx, cancel = context.WithTimeout(baseCtx, time.Duration(d.config.DownloadTimeout)*time.Second)
+		t.cancels = append(t.cancels, cancel)
 	}
 
 	// The watchdog guards every phase of the transfer: connecting,
@@ -129,47 +365,72 @@ func (d *Downloader) downloadFromUpstream(repoURL string, proxyURL *url.URL) err
 	// in cond.Wait; config.DownloadTimeout alone does not help because it
 	// only caps the total duration and defaults to unlimited.
 	ctx, cancel := context.WithCancel(baseCtx)
-	defer cancel()
-	watchdog := time.AfterFunc(downloadStallTimeout, cancel)
-	defer watchdog.Stop()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	t.ctx = ctx
+	t.cancels = append(t.cancels, cancel)
+	t.watchdog = time.AfterFunc(downloadStallTimeout, func() {
+		stats.stalled.Store(true)
+		cancel()
+	})
+
+	req, err := d.newUpstreamRequest(t.ctx, http.MethodGet, upstreamURL)
 	if err != nil {
-		return err
+		t.close()
+		return nil, err
 	}
+	t.req = req
 
-	if stat, err := os.Stat(d.outputFileName); err == nil {
-		req.Header.Set("If-Modified-Since", stat.ModTime().UTC().Format(http.TimeFormat))
+	// Part of the file has already been received from a previous attempt
+	// and possibly streamed to clients: ask for the remainder only.
+	t.offset = d.receivedPrefix()
+	if t.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", t.offset))
+	} else if cached, err := d.storage.Stat(d.repoName, d.fileName); err == nil && !cached.ModTime.IsZero() {
+		req.Header.Set("If-Modified-Since", cached.ModTime.UTC().Format(http.TimeFormat))
 	}
 
 	// golang requests compression for all requests except HEAD
 	// some servers return compressed data without Content-Length header info
 	// disable compression as it useless for package data
 	req.Header.Add("Accept-Encoding", "identity")
-	req.Header.Set("User-Agent", config.UserAgent)
 
 	log.Printf("downloading %v", upstreamURL)
 
-	var client *http.Client
-	if proxyURL != nil {
-		proxy := http.ProxyURL(proxyURL)
-		transport := &http.Transport{Proxy: proxy}
-		client = &http.Client{Transport: transport}
-	} else {
-		client = http.DefaultClient
-	}
-
+	requested := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		t.close()
+		return nil, err
 	}
-	defer resp.Body.Close()
+	t.resp = resp
+	stats.latency = time.Since(requested)
 
 	// Headers received: give the first body chunk its own full budget.
-	watchdog.Reset(downloadStallTimeout)
+	t.watchdog.Reset(downloadStallTimeout)
+	return t, nil
+}
+
+// receiveUpstream processes the response of a mirror: it checks the
+// response, announces the metadata to the clients and receives the body.
+func (d *Downloader) receiveUpstream(client *http.Client, t *upstreamTransfer) error {
+	repoURL, req, resp, offset := t.repoURL, t.req, t.resp, t.offset
+	ctx, watchdog, stats := t.ctx, t.watchdog, t.stats
+	upstreamURL := repoURL + d.urlPath
 
 	downloadedFilesCounter.WithLabelValues(d.repoName, req.Host, strconv.Itoa(resp.StatusCode)).Inc()
 
+	if offset > 0 {
+		skip, err := d.checkResumedResponse(repoURL, resp, offset)
+		if err != nil {
+			return fmt.Errorf("resuming %s: %w", upstreamURL, err)
+		}
+		if skip > 0 {
+			if _, err := io.CopyN(io.Discard, resp.Body, skip); err != nil {
+				return fmt.Errorf("resuming %s: %w", upstreamURL, err)
+			}
+		}
+		return d.receiveBody(client, upstreamURL, resp, watchdog, stats)
+	}
+
 	switch resp.StatusCode {
 	case http.StatusOK:
 		break
@@ -187,9 +448,9 @@ func (d *Downloader) downloadFromUpstream(repoURL string, proxyURL *url.URL) err
 		if strings.HasSuffix(d.urlPath, ".db.sig") {
 			return errSignatureNotFound
 		}
-		return fmt.Errorf("unable to download url %s, status code is %d", upstreamURL, resp.StatusCode)
+		return &upstreamStatusError{url: upstreamURL, statusCode: resp.StatusCode}
 	default:
-		return fmt.Errorf("unable to download url %s, status code is %d", upstreamURL, resp.StatusCode)
+		return &upstreamStatusError{url: upstreamURL, statusCode: resp.StatusCode}
 	}
 
 	if lmStr := resp.Header.Get("Last-Modified"); lmStr != "" {
@@ -203,69 +464,161 @@ func (d *Downloader) downloadFromUpstream(repoURL string, proxyURL *url.URL) err
 			d.contentLength = cl
 		}
 	}
+	d.etag = resp.Header.Get("ETag")
+	d.metadataUpstream = repoURL
+
+	// Reject a package of the wrong size before streaming any of it.
+	if expected, ok := lookupPackageChecksum(d.repoName, d.fileName); ok {
+		if expected.size != 0 && d.contentLength > 0 && d.contentLength != expected.size {
+			checksumMismatchCounter.WithLabelValues(d.repoName, req.Host).Inc()
+			return fmt.Errorf("%w: %v has size %v, the repo database says %v", errChecksumMismatch, upstreamURL, d.contentLength, expected.size)
+		}
+	}
 
 	d.eventCond.L.Lock()
 	d.eventMetadataReceived = true
 	d.eventCond.Broadcast()
 	d.eventCond.L.Unlock()
 
-	if err := d.copyToBufferFile(resp.Body, func() {
+	if segments := d.planSegments(resp); segments != nil {
+		return d.receiveSegmented(ctx, client, repoURL, resp, watchdog, stats, segments)
+	}
+	return d.receiveBody(client, upstreamURL, resp, watchdog, stats)
+}
+
+// receiveBody appends the response body to the buffer file and, once the
+// file is complete and verified, moves it to its place in the cache.
+func (d *Downloader) receiveBody(client *http.Client, upstreamURL string, resp *http.Response, watchdog *time.Timer, stats *transferStats) error {
+	bodyStart := time.Now()
+	n, err := d.copyToBufferFile(resp.Body, d.receivedPrefix(), -1, func() {
 		watchdog.Reset(downloadStallTimeout)
-	}); err != nil {
+	})
+	stats.bodyBytes = n
+	stats.bodyDuration = time.Since(bodyStart)
+	if err != nil {
 		return err
 	}
+	return d.commit(client, upstreamURL, resp, watchdog)
+}
 
-	if d.contentLength > 0 && d.eventDataReceivedSize != d.contentLength {
-		return fmt.Errorf("receiving file %v: Content-Length is %v while received body length is %v", upstreamURL, d.contentLength, d.eventDataReceivedSize)
+// commit verifies the complete file in the buffer file and moves it to its
+// place in the cache.
+func (d *Downloader) commit(client *http.Client, upstreamURL string, resp *http.Response, watchdog *time.Timer) error {
+	if received := d.receivedPrefix(); d.contentLength > 0 && received != d.contentLength {
+		return fmt.Errorf("receiving file %v: Content-Length is %v while received body length is %v", upstreamURL, d.contentLength, received)
 	}
 
-	if err := os.Rename(d.bufferFile.Name(), d.outputFileName); err != nil {
-		return err
+	// A broken or malicious mirror must not poison the cache: verify the
+	// package against the repo database before committing it.
+	if expected, ok := lookupPackageChecksum(d.repoName, d.fileName); ok {
+		if err := verifyPackageChecksum(d.bufferFile, d.receivedPrefix(), expected); err != nil {
+			if !errors.Is(err, errChecksumMismatch) {
+				return fmt.Errorf("verifying %v: %w: %w", upstreamURL, errLocalStorage, err)
+			}
+			checksumMismatchCounter.WithLabelValues(d.repoName, resp.Request.URL.Host).Inc()
+			d.restart()
+			return fmt.Errorf("verifying %v: %w", upstreamURL, err)
+		}
 	}
 
-	if !d.modificationTime.IsZero() {
-		if err := os.Chtimes(d.outputFileName, time.Now(), d.modificationTime); err != nil {
-			return err
+	if d.repo.keyring != nil && isPackageFile(d.fileName) {
+		watchdog.Reset(downloadStallTimeout)
+		if err := d.verifySignature(resp.Request.Context(), client, upstreamURL); err != nil {
+			if errors.Is(err, errSignatureInvalid) {
+				signatureFailuresCounter.WithLabelValues(d.repoName, resp.Request.URL.Host).Inc()
+				d.restart()
+			}
+			return fmt.Errorf("verifying signature of %v: %w", upstreamURL, err)
 		}
 	}
 
+	// The prefetcher downloads databases into a temporary directory, which
+	// is neither subject to the cache quotas nor indexed.
+	inCache := strings.HasPrefix(d.bufferFile.Name(), filepath.Join(d.config.CacheDir, "pkgs")+string(filepath.Separator))
+	if inCache && !d.makeRoom(d.receivedPrefix()) {
+		// the clients got it from the buffer file, it is just not kept
+		log.Printf("not caching %v: its %v bytes exceed max_cache_size", d.key, d.receivedPrefix())
+		return nil
+	}
+
+	if err := d.storage.Commit(d.repoName, d.fileName, d.bufferFile, d.modificationTime); err != nil {
+		return fmt.Errorf("%w: %w", errLocalStorage, err)
+	}
+
+	if inCache && strings.HasSuffix(d.fileName, ".db") {
+		// learn the checksums of the packages this database lists; it is
+		// done asynchronously as clients wait for eventDone to end streaming
+		go loadRepoDBChecksums(d.storage, d.repoName, d.fileName)
+		go loadRepoDBMetadata(d.storage, d.repoName, d.fileName)
+	}
+	if inCache && strings.HasSuffix(d.fileName, ".files") {
+		go loadRepoFilesDB(d.storage, d.repoName, d.fileName)
+	}
+
 	cacheSizeGauge.WithLabelValues(d.repoName).Add(float64(d.contentLength))
 	cachePackageGauge.WithLabelValues(d.repoName).Inc()
 
 	return nil
 }
 
-// copyToBufferFile streams the response body into the buffer file, calling
-// keepalive after every received chunk so the caller's stall watchdog knows
-// the transfer is making progress.
-func (d *Downloader) copyToBufferFile(in io.ReadCloser, keepalive func()) error {
+// copyToBufferFile streams a response body into the buffer file starting
+// at offset, calling keepalive after every received chunk so the caller's
+// stall watchdog knows the transfer is making progress. It stops after
+// limit bytes unless limit is negative, and returns the number of bytes
+// written.
+func (d *Downloader) copyToBufferFile(in io.Reader, offset int64, limit int64, keepalive func()) (int64, error) {
 	out := d.bufferFile
 	buff := make([]byte, 1024*1024)
+	if limit >= 0 {
+		in = io.LimitReader(in, limit)
+	}
 
+	var written int64
 	for {
 		n, err := in.Read(buff)
 		if n > 0 {
-			if _, err2 := out.Write(buff[:n]); err2 != nil {
-				return err2
+			// Write at the explicit offset rather than at the file
+			// position: a previous attempt that failed halfway through a
+			// write must not shift the resumed data, and segments of the
+			// file are written concurrently.
+			if _, err2 := out.WriteAt(buff[:n], offset+written); err2 != nil {
+				return written, fmt.Errorf("%w: %w", errLocalStorage, err2)
 			}
 			// progress means the chunk is both received and persisted
 			keepalive()
 
 			d.eventCond.L.Lock()
-			d.eventDataReceivedSize += int64(n)
+			d.eventReceived.add(offset+written, offset+written+int64(n))
 			d.eventCond.Broadcast()
 			d.eventCond.L.Unlock()
+			written += int64(n)
 		}
 
 		if err == io.EOF {
-			return nil
+			return written, nil
 		}
 		if err != nil {
-			return err
+			return written, err
 		}
 	}
 }
 
+// restart discards the data received so far, so that the next mirror
+// starts over from the first byte. New clients wait for the metadata of
+// that mirror.
+func (d *Downloader) restart() {
+	d.eventCond.L.Lock()
+	d.eventReceived = nil
+	d.eventMetadataReceived = false
+	d.generation++
+	d.eventCond.Broadcast()
+	d.eventCond.L.Unlock()
+
+	if err := d.bufferFile.Truncate(0); err != nil {
+		log.Printf("unable to truncate buffer file %v: %v", d.bufferFile.Name(), err)
+	}
+}
+
 func (d *Downloader) waitForCompletion() error {
 	d.eventCond.L.Lock()
 	for !d.eventDone {
@@ -301,9 +654,12 @@ func getDownloadReader(f *RequestedFile) (time.Time, io.ReadSeekCloser, error) {
 
 	if d.eventMetadataReceived {
 		modTime := d.modificationTime
+		d.eventCond.L.Lock()
 		r := &DownloadReader{
 			downloader: d,
+			generation: d.generation,
 		}
+		d.eventCond.L.Unlock()
 
 		return modTime, r, nil
 	}
@@ -321,6 +677,7 @@ func getDownloadReader(f *RequestedFile) (time.Time, io.ReadSeekCloser, error) {
 type DownloadReader struct {
 	downloader *Downloader
 	offset     int64
+	generation int // generation of the Downloader data this reader streams
 }
 
 func (d *DownloadReader) Close() error {
@@ -330,19 +687,34 @@ func (d *DownloadReader) Close() error {
 
 func (d *DownloadReader) Read(p []byte) (int, error) {
 	// Snapshot the streaming state under the lock: the download goroutine
-	// keeps mutating eventDataReceivedSize (and eventually eventDone)
+	// keeps mutating eventReceived (and eventually eventDone)
 	// concurrently, so they must not be re-read after unlocking.
 	dl := d.downloader
 	dl.eventCond.L.Lock()
-	for !(dl.eventDataReceivedSize > d.offset || dl.eventDone) {
+	for !(dl.eventReceived.prefix() > d.offset || dl.eventDone || dl.generation != d.generation) {
 		dl.eventCond.Wait()
 	}
-	received := dl.eventDataReceivedSize
+	if dl.generation != d.generation && d.offset > 0 {
+		dl.eventCond.L.Unlock()
+		return 0, errDownloadRestarted
+	}
+	// a reader that has not consumed anything yet simply follows the restart
+	d.generation = dl.generation
+	received := dl.eventReceived.prefix()
 	done := dl.eventDone
 	dl.eventCond.L.Unlock()
 
 	if received > d.offset {
-		n, err := dl.bufferFile.ReadAt(p, d.offset)
+		// only the contiguous prefix is complete, a segment downloading
+		// further on may have written the file beyond it already
+		n, err := dl.bufferFile.ReadAt(p[:min(int64(len(p)), received-d.offset)], d.offset)
+		// the data may have been discarded while it was being read
+		dl.eventCond.L.Lock()
+		restarted := dl.generation != d.generation
+		dl.eventCond.L.Unlock()
+		if restarted {
+			return 0, errDownloadRestarted
+		}
 		d.offset += int64(n)
 		if err == io.EOF {
 			// EOF on the bufferFile does not mean that we are done downloading
@@ -394,6 +766,10 @@ func getDownloader(f *RequestedFile) (*Downloader, error) {
 
 	d, ok := downloaders[key]
 	if !ok {
+		if shuttingDown.Load() {
+			return nil, errShuttingDown
+		}
+
 		bufferFile, err := os.Create(f.bufferFileName())
 		if err != nil {
 			return nil, err
@@ -403,13 +779,15 @@ func getDownloader(f *RequestedFile) (*Downloader, error) {
 		cond := sync.NewCond(m)
 
 		d = &Downloader{
-			key:            key,
-			urlPath:        f.urlPath(),
-			outputFileName: f.cachedFilePath,
-			bufferFile:     bufferFile,
-			repoName:       f.repoName,
-			repo:           config.Repos[f.repoName],
-			eventCond:      cond,
+			key:        key,
+			urlPath:    f.urlPath(),
+			fileName:   f.fileName,
+			storage:    f.storage,
+			bufferFile: bufferFile,
+			repoName:   f.repoName,
+			repo:       f.repo,
+			config:     f.config,
+			eventCond:  cond,
 		}
 		d.usageCount++ // one downloader is in use by the caller
 		downloaders[key] = d
@@ -442,11 +820,14 @@ type RequestedFile struct {
 	pathAtRepo string
 	fileName   string
 
-	cacheDir       string
-	cachedFilePath string
+	storage  Storage // keeps the cached file
+	cacheDir string  // local directory of the buffer file
+
+	config *Config // the config the file is requested under
+	repo   *Repo   // the repo in config, nil if it is not configured
 }
 
-func parseRequestURL(urlPath string) (*RequestedFile, error) {
+func parseRequestURL(c *Config, urlPath string) (*RequestedFile, error) {
 	matches := pathRegex.FindStringSubmatch(urlPath)
 	if len(matches) == 0 {
 		return nil, fmt.Errorf("input url path '%v' does not match expected format", urlPath)
@@ -454,31 +835,40 @@ func parseRequestURL(urlPath string) (*RequestedFile, error) {
 	repoName := matches[1]
 	pathAtRepo := matches[2]
 	fileName := matches[3]
+	if fileName == "." || fileName == ".." {
+		return nil, fmt.Errorf("input url path '%v' does not name a file", urlPath)
+	}
 
-	cachePath := filepath.Join(config.CacheDir, "pkgs", repoName)
-	cachedFilePath := filepath.Join(cachePath, fileName)
-
-	return &RequestedFile{
-		repoName:       repoName,
-		pathAtRepo:     pathAtRepo,
-		fileName:       fileName,
-		cacheDir:       cachePath,
-		cachedFilePath: cachedFilePath,
-	}, nil
+	return newRequestedFile(c, repoName, pathAtRepo, fileName), nil
 }
 
-func (f *RequestedFile) getRepo() *Repo {
-	return config.Repos[f.repoName]
+// newRequestedFile describes a file of a repo of c and where it is stored.
+func newRequestedFile(c *Config, repoName string, pathAtRepo string, fileName string) *RequestedFile {
+	repo := c.Repos[repoName]
+	cacheDir := filepath.Join(c.CacheDir, "pkgs", repoName)
+	if repo != nil && repo.Local {
+		cacheDir = filepath.Join(c.CacheDir, localReposDir, repoName)
+	}
+	return &RequestedFile{
+		repoName:   repoName,
+		pathAtRepo: pathAtRepo,
+		fileName:   fileName,
+		storage:    c.repoStorage(repoName),
+		cacheDir:   cacheDir,
+		config:     c,
+		repo:       repo,
+	}
 }
 
 // key used for downloaders map; each active Downloader is referenced by its
-// key. The destination path is part of the identity: the same upstream path
-// can be requested for different destinations at the same time (a client
+// key. The destination is part of the identity: the same upstream path can
+// be requested for different destinations at the same time (a client
 // filling the package cache while the prefetcher fetches the db into its
 // temporary directory), and such downloads must not share a Downloader
-// because only the creator's outputFileName receives the downloaded file.
+// because only the creator's storage receives the downloaded file. Each
+// destination has its own buffer directory.
 func (f *RequestedFile) key() string {
-	return f.repoName + f.urlPath() + "->" + f.cachedFilePath
+	return f.repoName + f.urlPath() + "->" + filepath.Join(f.cacheDir, f.fileName)
 }
 
 func (f *RequestedFile) urlPath() string {
@@ -491,7 +881,7 @@ func (f *RequestedFile) mkCacheDir() error {
 }
 
 func (f *RequestedFile) cachedFileExists() bool {
-	_, err := os.Stat(f.cachedFilePath)
+	_, err := f.storage.Stat(f.repoName, f.fileName)
 	return err == nil
 }
 
@@ -50,13 +50,13 @@ func TestParallelDownload(t *testing.T) {
 		URL: fmt.Sprintf("http://localhost:%d/myrepo", ln.Addr().(*net.TCPAddr).Port),
 	}
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testPacolocoDir,
 		Port:            -1,
 		PurgeFilesAfter: -1,
 		DownloadTimeout: 999,
 		Repos:           map[string]*Repo{"up": repo},
-	}
+	})
 
 	files := []string{
 		"foobar-3.3.6-7-x86_64.pkg.tar.zst",
@@ -113,14 +113,14 @@ func TestDownloadTimeout(t *testing.T) {
 
 	testDir := t.TempDir()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testDir,
 		Port:            -1,
 		DownloadTimeout: 1, // 1 second timeout
 		Repos: map[string]*Repo{
 			"timeout-repo": {URL: mirror.URL},
 		},
-	}
+	})
 
 	req := httptest.NewRequest(http.MethodGet, "/repo/timeout-repo/test-1-1-any.pkg.tar.zst", nil)
 	w := httptest.NewRecorder()
@@ -137,14 +137,14 @@ func TestDownloadBadStatusCode(t *testing.T) {
 
 	testDir := t.TempDir()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testDir,
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos: map[string]*Repo{
 			"bad-repo": {URL: mirror.URL},
 		},
-	}
+	})
 
 	req := httptest.NewRequest(http.MethodGet, "/repo/bad-repo/test-1-1-any.pkg.tar.zst", nil)
 	w := httptest.NewRecorder()
@@ -161,14 +161,14 @@ func TestDownloadNotModified(t *testing.T) {
 
 	testDir := t.TempDir()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testDir,
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos: map[string]*Repo{
 			"notmod-repo": {URL: mirror.URL},
 		},
-	}
+	})
 
 	// Create a cached file so the downloader sends If-Modified-Since
 	cachePath := testDir + "/pkgs/notmod-repo"
@@ -203,12 +203,12 @@ func TestConcurrentForceCheckRequests(t *testing.T) {
 	mirror := httptest.NewServer(http.HandlerFunc(handler))
 	defer mirror.Close()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        t.TempDir(),
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos:           map[string]*Repo{"race-repo": {URL: mirror.URL}},
-	}
+	})
 
 	const (
 		clients           = 32
@@ -264,12 +264,12 @@ func TestConcurrentDownloadsShareUpstreamRequest(t *testing.T) {
 	mirror := httptest.NewServer(http.HandlerFunc(handler))
 	defer mirror.Close()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        t.TempDir(),
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos:           map[string]*Repo{"flight-repo": {URL: mirror.URL}},
-	}
+	})
 
 	const clients = 16
 
@@ -331,12 +331,12 @@ func TestStalledDownloadAborts(t *testing.T) {
 	defer func() { downloadStallTimeout = oldStall }()
 
 	run := func(t *testing.T, mirror *httptest.Server, fileName string) (*httptest.ResponseRecorder, error) {
-		config = &Config{
+		config.Store(&Config{
 			CacheDir:        t.TempDir(),
 			Port:            -1,
 			DownloadTimeout: 0, // the dangerous default: no total timeout
 			Repos:           map[string]*Repo{"stall-repo": {URL: mirror.URL}},
-		}
+		})
 
 		w := httptest.NewRecorder()
 		done := make(chan error, 1)
@@ -401,12 +401,12 @@ func TestStallWatchdogResetsBetweenPhases(t *testing.T) {
 	downloadStallTimeout = 500 * time.Millisecond
 	defer func() { downloadStallTimeout = oldStall }()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        t.TempDir(),
 		Port:            -1,
 		DownloadTimeout: 0,
 		Repos:           map[string]*Repo{"steady-repo": {URL: mirror.URL}},
-	}
+	})
 
 	req := httptest.NewRequest(http.MethodGet, "/repo/steady-repo/steady-1-1-any.pkg.tar.zst", nil)
 	w := httptest.NewRecorder()
@@ -434,12 +434,12 @@ func TestPrefetchAndClientDoNotShareDownloader(t *testing.T) {
 	cacheDir := t.TempDir()
 	tmpDBDir := t.TempDir()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        cacheDir,
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos:           map[string]*Repo{"collide-repo": {URL: mirror.URL}},
-	}
+	})
 
 	clientDone := make(chan error, 1)
 	go func() {
@@ -458,21 +458,21 @@ func TestPrefetchAndClientDoNotShareDownloader(t *testing.T) {
 	require.NoError(t, err, "client destination must receive the file")
 	require.Equal(t, content, string(clientFile))
 
-	prefetchFile, err := os.ReadFile(filepath.Join(tmpDBDir, "core.db"))
+	prefetchFile, err := os.ReadFile(filepath.Join(tmpDBDir, "collide-repo", "core.db"))
 	require.NoError(t, err, "prefetch destination must receive the file")
 	require.Equal(t, content, string(prefetchFile))
 }
 
 func TestParseRequestURLInvalid(t *testing.T) {
-	config = &Config{}
-	_, err := parseRequestURL("/invalid/path")
+	config.Store(&Config{})
+	_, err := parseRequestURL(config.Load(), "/invalid/path")
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "does not match expected format")
 
-	_, err = parseRequestURL("")
+	_, err = parseRequestURL(config.Load(), "")
 	require.Error(t, err)
 
-	_, err = parseRequestURL("/repofoo/bar/test.db")
+	_, err = parseRequestURL(config.Load(), "/repofoo/bar/test.db")
 	require.Error(t, err)
 }
 
@@ -497,7 +497,7 @@ func TestDownloadSizesUse64Bits(t *testing.T) {
 }
 
 func TestRequestedFile(t *testing.T) {
-	config = &Config{}
+	config.Store(&Config{})
 
 	data := []struct {
 		input, urlPath, key string
@@ -508,7 +508,7 @@ func TestRequestedFile(t *testing.T) {
 	}
 
 	for _, d := range data {
-		f, err := parseRequestURL(d.input)
+		f, err := parseRequestURL(config.Load(), d.input)
 		require.NoError(t, err)
 		require.Equal(t, d.urlPath, f.urlPath())
 		require.Equal(t, d.key, f.key())
@@ -536,14 +536,14 @@ func TestSignedDatabaseSignatureIsRefreshed(t *testing.T) {
 	defer mirror.Close()
 
 	testDir := t.TempDir()
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testDir,
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos: map[string]*Repo{
 			"signed-repo": {URL: mirror.URL},
 		},
-	}
+	})
 
 	// An outdated signature is already cached, as it would be after the
 	// upstream published a new database.
@@ -578,14 +578,14 @@ func TestMissingDatabaseSignatureIsQuiet(t *testing.T) {
 	defer mirror.Close()
 
 	testDir := t.TempDir()
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testDir,
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos: map[string]*Repo{
 			"unsigned-repo": {URL: mirror.URL},
 		},
-	}
+	})
 
 	var logs strings.Builder
 	previous := log.Writer()
@@ -611,16 +611,147 @@ func TestOtherDatabaseNotFoundStillFails(t *testing.T) {
 	defer mirror.Close()
 
 	testDir := t.TempDir()
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testDir,
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos: map[string]*Repo{
 			"missing-db-repo": {URL: mirror.URL},
 		},
-	}
+	})
 
 	req := httptest.NewRequest(http.MethodGet, "/repo/missing-db-repo/core.db", nil)
 	w := httptest.NewRecorder()
 	require.Error(t, handleRequest(w, req))
 }
+
+// truncatingHandler serves the first half of content and then drops the
+// connection, like a mirror that dies mid-transfer.
+func truncatingHandler(content string, modTime time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		_, _ = w.Write([]byte(content[:len(content)/2]))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// TestResumeDownloadOnNextMirror verifies that a transfer that breaks off
+// midway continues with a Range request on the next mirror instead of
+// appending the whole file again to the already received half.
+func TestResumeDownloadOnNextMirror(t *testing.T) {
+	content := strings.Repeat("0123456789", 100*1024)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	var brokenHits atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenHits.Add(1)
+		truncatingHandler(content, modTime)(w, r)
+	}))
+	defer broken.Close()
+
+	var rangeHeader atomic.Value
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader.Store(r.Header.Get("Range"))
+		http.ServeContent(w, r, "pkg", modTime, strings.NewReader(content))
+	}))
+	defer healthy.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"resume-repo": {URLs: []string{broken.URL, healthy.URL}}},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/resume-repo/resume-1-1-any.pkg.tar.zst", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, content, w.Body.String(), "the client must see one seamless stream")
+
+	require.Equal(t, int32(2), brokenHits.Load(), "the broken mirror is retried once before moving on")
+	require.Equal(t, fmt.Sprintf("bytes=%d-", len(content)/2), rangeHeader.Load(), "the next mirror must be asked for the remainder only")
+	cached, err := os.ReadFile(filepath.Join(cacheDir, "pkgs", "resume-repo", "resume-1-1-any.pkg.tar.zst"))
+	require.NoError(t, err)
+	require.Equal(t, content, string(cached))
+}
+
+// TestResumeDownloadIgnoredRange covers upstreams without range support:
+// they answer a resumed request with the full file, whose already received
+// prefix must be skipped.
+func TestResumeDownloadIgnoredRange(t *testing.T) {
+	content := strings.Repeat("abcdefghij", 50*1024)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	var hits atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			truncatingHandler(content, modTime)(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		_, _ = w.Write([]byte(content))
+	}))
+	defer mirror.Close()
+
+	config.Store(&Config{
+		CacheDir:        t.TempDir(),
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"norange-repo": {URL: mirror.URL}},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/norange-repo/norange-1-1-any.pkg.tar.zst", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, content, w.Body.String())
+	require.Equal(t, int32(2), hits.Load())
+}
+
+// TestResumeDownloadRejectsChangedFile verifies that a resumed response
+// for a different revision of the file is not stitched onto the received
+// part.
+func TestResumeDownloadRejectsChangedFile(t *testing.T) {
+	content := strings.Repeat("x", 64*1024)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	broken := httptest.NewServer(truncatingHandler(content, modTime))
+	defer broken.Close()
+	changed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "db", modTime.Add(time.Minute), strings.NewReader(strings.Repeat("y", len(content))))
+	}))
+	defer changed.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"changed-repo": {URLs: []string{broken.URL, changed.URL}}},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/changed-repo/core.db", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.NotContains(t, w.Body.String(), "y", "data of another revision must not be appended")
+	_, err := os.Stat(filepath.Join(cacheDir, "pkgs", "changed-repo", "core.db"))
+	require.ErrorIs(t, err, os.ErrNotExist, "an incomplete file must not be cached")
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, total, err := parseContentRange("bytes 100-199/1000")
+	require.NoError(t, err)
+	require.Equal(t, []int64{100, 199, 1000}, []int64{start, end, total})
+
+	_, _, total, err = parseContentRange("bytes 0-9/*")
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), total)
+
+	for _, invalid := range []string{"", "bytes */1000", "items 0-9/10", "bytes 9-0/10", "bytes 0-9"} {
+		_, _, _, err := parseContentRange(invalid)
+		require.Error(t, err, invalid)
+	}
+}
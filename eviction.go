@@ -0,0 +1,314 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Size-based eviction. With max_cache_size set, globally or for a repo,
+// every file about to be committed to the cache first makes room for itself
+// by evicting the least recently used packages. A package and its signature
+// are evicted together; files that are being served or downloaded and the
+// repo databases are never evicted, and a file larger than a quota is not
+// cached at all. The space used is kept as a running total per repo, the storage
+// is only listed when there is something to evict.
+
+var evictedFilesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pacoloco_cache_evicted_files_total",
+	Help: "Number of cached files evicted to keep the cache within max_cache_size",
+}, []string{"repo"})
+
+// evictionMutex serializes eviction passes, so that concurrent commits do
+// not both count the same free space.
+var evictionMutex sync.Mutex
+
+var (
+	servedFilesMutex sync.Mutex
+	servedFiles      = make(map[string]int) // evictionKey -> number of clients
+)
+
+// evictionKey identifies the eviction group of a cached file: a package and
+// its detached signature share one.
+func evictionKey(repoName, fileName string) string {
+	return repoName + "/" + strings.TrimSuffix(fileName, ".sig")
+}
+
+// pinServedFile protects a cached file from eviction while it is served.
+// The returned function releases it.
+func pinServedFile(repoName, fileName string) func() {
+	key := evictionKey(repoName, fileName)
+	servedFilesMutex.Lock()
+	servedFiles[key]++
+	servedFilesMutex.Unlock()
+	return func() {
+		servedFilesMutex.Lock()
+		defer servedFilesMutex.Unlock()
+		servedFiles[key]--
+		if servedFiles[key] == 0 {
+			delete(servedFiles, key)
+		}
+	}
+}
+
+// pinnedFiles returns the eviction keys of the files that are being served
+// from the cache or downloaded into it, and of those snapshots retain.
+func pinnedFiles() map[string]bool {
+	pinned := make(map[string]bool)
+	servedFilesMutex.Lock()
+	for key := range servedFiles {
+		pinned[key] = true
+	}
+	servedFilesMutex.Unlock()
+
+	downloadersMutex.Lock()
+	for _, d := range downloaders {
+		pinned[evictionKey(d.repoName, d.fileName)] = true
+	}
+	downloadersMutex.Unlock()
+	addSnapshotPins(pinned)
+	return pinned
+}
+
+// repoUsage is the space the cached files of a repo take.
+type repoUsage struct {
+	total int64
+	sizes map[string]int64 // file name -> size
+}
+
+// cacheUsage holds the usage of the repos a quota needed so far, keyed by
+// usageKey. A repo is counted from a listing of its storage the first
+// time, and from then on follows the commits and deletions of usageStorage.
+// Every listing for eviction or the purge counts it anew, which also
+// catches up with the changes of other instances sharing an S3 bucket.
+var (
+	cacheUsageMutex sync.Mutex
+	cacheUsage      = make(map[string]*repoUsage)
+)
+
+func usageKey(cacheDir, repoName string) string {
+	return cacheDir + "/" + repoName
+}
+
+// setRepoUsage counts the usage of a repo from a listing of its storage.
+// The caller holds cacheUsageMutex.
+func setRepoUsage(key string, files []CachedFile) *repoUsage {
+	u := &repoUsage{sizes: make(map[string]int64, len(files))}
+	for _, f := range files {
+		u.sizes[f.Name] = f.Size
+		u.total += f.Size
+	}
+	cacheUsage[key] = u
+	return u
+}
+
+// countRepoUsage records the usage of a repo after its storage was listed.
+func countRepoUsage(cacheDir, repoName string, files []CachedFile) {
+	cacheUsageMutex.Lock()
+	defer cacheUsageMutex.Unlock()
+	setRepoUsage(usageKey(cacheDir, repoName), files)
+}
+
+// repoUsageExcept returns the space the cached files of a repo take, not
+// counting the file except, listing the storage if the repo was not
+// counted yet.
+func repoUsageExcept(cacheDir string, storage Storage, repoName string, except string) (int64, error) {
+	cacheUsageMutex.Lock()
+	defer cacheUsageMutex.Unlock()
+	key := usageKey(cacheDir, repoName)
+	u := cacheUsage[key]
+	if u == nil {
+		// listed under the lock, so that no commit or deletion is missed
+		files, err := storage.List(repoName)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, err
+		}
+		u = setRepoUsage(key, files)
+	}
+	return u.total - u.sizes[except], nil
+}
+
+// resetCacheUsage forgets the usage of all repos, e.g. when the storage
+// may have changed with the config.
+func resetCacheUsage() {
+	cacheUsageMutex.Lock()
+	defer cacheUsageMutex.Unlock()
+	clear(cacheUsage)
+}
+
+// usageStorage is the Storage of the cache, keeping cacheUsage up to date.
+type usageStorage struct {
+	Storage
+	cacheDir string
+}
+
+func (s *usageStorage) Commit(repo, name string, buffer *os.File, modTime time.Time) error {
+	info, statErr := buffer.Stat()
+	if err := s.Storage.Commit(repo, name, buffer, modTime); err != nil {
+		return err
+	}
+	cacheUsageMutex.Lock()
+	defer cacheUsageMutex.Unlock()
+	key := usageKey(s.cacheDir, repo)
+	u := cacheUsage[key]
+	if u == nil {
+		return nil
+	}
+	if statErr != nil {
+		delete(cacheUsage, key) // counted anew when needed
+		return nil
+	}
+	u.total += info.Size() - u.sizes[name]
+	u.sizes[name] = info.Size()
+	return nil
+}
+
+func (s *usageStorage) Delete(repo, name string) error {
+	err := s.Storage.Delete(repo, name)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		cacheUsageMutex.Lock()
+		if u := cacheUsage[usageKey(s.cacheDir, repo)]; u != nil {
+			u.total -= u.sizes[name]
+			delete(u.sizes, name)
+		}
+		cacheUsageMutex.Unlock()
+	}
+	return err
+}
+
+// evictionGroup is a package together with its signature.
+type evictionGroup struct {
+	repoName   string
+	files      []CachedFile
+	size       int64
+	lastAccess time.Time
+}
+
+// makeRoom evicts the least recently used files until a file of the given
+// size fits into the quotas of the repo and of the whole cache. The file
+// itself is protected, an older copy of it does not count as used space.
+// It reports false, evicting nothing, for a file larger than a quota: it
+// is not cached.
+func (d *Downloader) makeRoom(size int64) bool {
+	repoQuota := d.repo.maxCacheSize
+	globalQuota := d.config.maxCacheSize
+	if repoQuota == 0 && globalQuota == 0 {
+		return true
+	}
+	if (repoQuota > 0 && size > repoQuota) || (globalQuota > 0 && size > globalQuota) {
+		return false
+	}
+
+	evictionMutex.Lock()
+	defer evictionMutex.Unlock()
+
+	var pinned map[string]bool
+	pin := func() map[string]bool {
+		if pinned == nil {
+			pinned = pinnedFiles()
+			pinned[evictionKey(d.repoName, d.fileName)] = true
+		}
+		return pinned
+	}
+	cacheDir := d.config.CacheDir
+	if repoQuota > 0 {
+		usage, err := repoUsageExcept(cacheDir, d.storage, d.repoName, d.fileName)
+		if err != nil || usage+size > repoQuota {
+			evictLeastRecentlyUsed(cacheDir, d.storage, []string{d.repoName}, repoQuota-size, pin(), d.repoName+"/"+d.fileName)
+		}
+	}
+	if globalQuota > 0 {
+		repoNames := make([]string, 0, len(d.config.Repos))
+		var usage int64
+		var err error
+		for repoName := range d.config.Repos {
+			repoNames = append(repoNames, repoName)
+			except := ""
+			if repoName == d.repoName {
+				except = d.fileName
+			}
+			repoUsage, repoErr := repoUsageExcept(cacheDir, d.storage, repoName, except)
+			usage += repoUsage
+			err = cmp.Or(err, repoErr)
+		}
+		if err != nil || usage+size > globalQuota {
+			evictLeastRecentlyUsed(cacheDir, d.storage, repoNames, globalQuota-size, pin(), d.repoName+"/"+d.fileName)
+		}
+	}
+	return true
+}
+
+// evictLeastRecentlyUsed evicts groups of the given repos, least recently
+// accessed first, until they use no more than limit bytes. Files of pinned
+// groups are skipped, and replaced ("<repo>/<file>") is not counted. The
+// repo databases are never evicted: the packages of an active repo are
+// looked up and verified with them.
+func evictLeastRecentlyUsed(cacheDir string, storage Storage, repoNames []string, limit int64, pinned map[string]bool, replaced string) {
+	var usage int64
+	var groups []*evictionGroup
+	for _, repoName := range repoNames {
+		files, err := storage.List(repoName)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("unable to list the cache of %v for eviction: %v", repoName, err)
+			return
+		}
+		countRepoUsage(cacheDir, repoName, files)
+		byKey := make(map[string]*evictionGroup)
+		for _, f := range files {
+			if repoName+"/"+f.Name == replaced {
+				continue
+			}
+			key := evictionKey(repoName, f.Name)
+			g := byKey[key]
+			if g == nil {
+				g = &evictionGroup{repoName: repoName}
+				byKey[key] = g
+				if !pinned[key] && !isRepoDBFile(strings.TrimSuffix(f.Name, ".sig")) {
+					groups = append(groups, g)
+				}
+			}
+			g.files = append(g.files, f)
+			g.size += f.Size
+			if f.AccessTime.After(g.lastAccess) {
+				g.lastAccess = f.AccessTime
+			}
+			usage += f.Size
+		}
+	}
+	if usage <= limit {
+		return
+	}
+
+	slices.SortStableFunc(groups, func(a, b *evictionGroup) int {
+		return a.lastAccess.Compare(b.lastAccess)
+	})
+	for _, g := range groups {
+		if usage <= limit {
+			return
+		}
+		for _, f := range g.files {
+			err := deleteCachedFile(storage, g.repoName, f)
+			if errors.Is(err, fs.ErrNotExist) {
+				usage -= f.Size // removed by someone else meanwhile
+				continue
+			} else if err != nil {
+				log.Printf("unable to evict %v/%v: %v", g.repoName, f.Name, err)
+				continue
+			}
+			evictedFilesCounter.WithLabelValues(g.repoName).Inc()
+			usage -= f.Size
+		}
+	}
+	if usage > limit {
+		log.Printf("cache of %v stays %v bytes over max_cache_size, the remaining files are in use", strings.Join(repoNames, ", "), usage-limit)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCachedFile puts a file of the given size into the cache, last
+// accessed the given time ago.
+func writeCachedFile(t *testing.T, cacheDir, repoName, fileName string, size int, age time.Duration) string {
+	path := filepath.Join(cacheDir, "pkgs", repoName, fileName)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	require.NoError(t, os.WriteFile(path, make([]byte, size), 0o644))
+	at := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, at, at))
+	return path
+}
+
+func TestEvictionOnCommit(t *testing.T) {
+	content := "0123456789"
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(content))
+	}))
+	defer mirror.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"lru-repo": {URL: mirror.URL, maxCacheSize: 25}},
+	})
+	oldPkg := writeCachedFile(t, cacheDir, "lru-repo", "old-1-1-any.pkg.tar.zst", 10, 3*time.Hour)
+	oldSig := writeCachedFile(t, cacheDir, "lru-repo", "old-1-1-any.pkg.tar.zst.sig", 2, 3*time.Hour)
+	midPkg := writeCachedFile(t, cacheDir, "lru-repo", "mid-1-1-any.pkg.tar.zst", 10, 2*time.Hour)
+	cacheSizeGauge.WithLabelValues("lru-repo").Set(22)
+	cachePackageGauge.WithLabelValues("lru-repo").Set(3)
+	evicted := testutil.ToFloat64(evictedFilesCounter.WithLabelValues("lru-repo"))
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/lru-repo/new-1-1-any.pkg.tar.zst", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, content, w.Body.String())
+
+	// the gauges are updated once the new package is committed
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(cachePackageGauge.WithLabelValues("lru-repo")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.FileExists(t, filepath.Join(cacheDir, "pkgs", "lru-repo", "new-1-1-any.pkg.tar.zst"))
+
+	// the least recently used package goes together with its signature
+	for _, path := range []string{oldPkg, oldSig} {
+		_, err := os.Stat(path)
+		require.ErrorIs(t, err, os.ErrNotExist, path)
+	}
+	require.FileExists(t, midPkg)
+	require.Equal(t, float64(20), testutil.ToFloat64(cacheSizeGauge.WithLabelValues("lru-repo")))
+	require.Equal(t, evicted+2, testutil.ToFloat64(evictedFilesCounter.WithLabelValues("lru-repo")))
+}
+
+func TestEvictionSparesServedFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	config.Store(&Config{CacheDir: cacheDir, Repos: map[string]*Repo{"pinned-repo": {maxCacheSize: 30}}})
+	served := writeCachedFile(t, cacheDir, "pinned-repo", "served-1-1-any.pkg.tar.zst", 10, 3*time.Hour)
+	older := writeCachedFile(t, cacheDir, "pinned-repo", "older-1-1-any.pkg.tar.zst", 10, 2*time.Hour)
+	newer := writeCachedFile(t, cacheDir, "pinned-repo", "newer-1-1-any.pkg.tar.zst", 10, time.Hour)
+
+	unpin := pinServedFile("pinned-repo", "served-1-1-any.pkg.tar.zst.sig")
+	defer unpin()
+	d := &Downloader{
+		config:   config.Load(),
+		repo:     config.Load().Repos["pinned-repo"],
+		repoName: "pinned-repo",
+		fileName: "incoming-1-1-any.pkg.tar.zst",
+		storage:  config.Load().cacheStorage(),
+	}
+	d.makeRoom(10)
+
+	require.FileExists(t, served, "a package whose signature is served stays")
+	_, err := os.Stat(older)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.FileExists(t, newer)
+
+	// files in use can exceed the quota, there is nothing else to evict
+	require.True(t, d.makeRoom(25))
+	require.FileExists(t, served)
+	_, err = os.Stat(newer)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestEvictionSparesRepoDBs(t *testing.T) {
+	cacheDir := t.TempDir()
+	config.Store(&Config{CacheDir: cacheDir, Repos: map[string]*Repo{"db-repo": {maxCacheSize: 30}}})
+	db := writeCachedFile(t, cacheDir, "db-repo", "core.db", 10, 3*time.Hour)
+	files := writeCachedFile(t, cacheDir, "db-repo", "core.files", 10, 3*time.Hour)
+	pkg := writeCachedFile(t, cacheDir, "db-repo", "old-1-1-any.pkg.tar.zst", 10, 2*time.Hour)
+	d := &Downloader{
+		config:   config.Load(),
+		repo:     config.Load().Repos["db-repo"],
+		repoName: "db-repo",
+		fileName: "incoming-1-1-any.pkg.tar.zst",
+		storage:  config.Load().cacheStorage(),
+	}
+
+	// a file larger than the quota is not cached, and evicts nothing
+	require.False(t, d.makeRoom(31))
+	require.FileExists(t, pkg)
+
+	require.True(t, d.makeRoom(20))
+	_, err := os.Stat(pkg)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.FileExists(t, db, "the databases of the repo are kept")
+	require.FileExists(t, files, "the databases of the repo are kept")
+}
+
+func TestEvictionServesOversizedFile(t *testing.T) {
+	content := "a package larger than the quota"
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(content))
+	}))
+	defer mirror.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"small-repo": {URL: mirror.URL, maxCacheSize: 20}},
+	})
+	kept := writeCachedFile(t, cacheDir, "small-repo", "kept-1-1-any.pkg.tar.zst", 10, 3*time.Hour)
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/small-repo/large-1-1-any.pkg.tar.zst", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, content, w.Body.String())
+
+	// the download is not kept once it is complete, and evicts nothing
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(filepath.Join(cacheDir, "pkgs", "small-repo"))
+		return err == nil && len(entries) == 1 && entries[0].Name() == filepath.Base(kept)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestEvictionGlobalQuota(t *testing.T) {
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:     cacheDir,
+		Repos:        map[string]*Repo{"global-a": {}, "global-b": {}},
+		maxCacheSize: 25,
+	})
+	oldest := writeCachedFile(t, cacheDir, "global-b", "oldest-1-1-any.pkg.tar.zst", 10, 3*time.Hour)
+	older := writeCachedFile(t, cacheDir, "global-a", "older-1-1-any.pkg.tar.zst", 10, 2*time.Hour)
+	// a newer copy of the committed file replaces this one, it does not
+	// count as used space
+	replaced := writeCachedFile(t, cacheDir, "global-a", "core.db", 5, time.Hour)
+
+	d := &Downloader{
+		config:   config.Load(),
+		repo:     config.Load().Repos["global-a"],
+		repoName: "global-a",
+		fileName: "core.db",
+		storage:  config.Load().cacheStorage(),
+	}
+	d.makeRoom(10)
+
+	_, err := os.Stat(oldest)
+	require.ErrorIs(t, err, os.ErrNotExist, "the least recently used file of any repo is evicted")
+	require.FileExists(t, older)
+	require.FileExists(t, replaced)
+}
+
+// listCountingStorage counts the listings of a Storage.
+type listCountingStorage struct {
+	Storage
+	lists int
+}
+
+func (s *listCountingStorage) List(repo string) ([]CachedFile, error) {
+	s.lists++
+	return s.Storage.List(repo)
+}
+
+func TestEvictionKeepsRunningTotal(t *testing.T) {
+	cacheDir := t.TempDir()
+	config.Store(&Config{CacheDir: cacheDir, Repos: map[string]*Repo{"total-repo": {maxCacheSize: 30}}})
+	old := writeCachedFile(t, cacheDir, "total-repo", "old-1-1-any.pkg.tar.zst", 10, 2*time.Hour)
+	listing := &listCountingStorage{Storage: newFSStorage(filepath.Join(cacheDir, "pkgs"))}
+	storage := &usageStorage{Storage: listing, cacheDir: cacheDir}
+	d := &Downloader{
+		config:   config.Load(),
+		repo:     config.Load().Repos["total-repo"],
+		repoName: "total-repo",
+		fileName: "incoming-1-1-any.pkg.tar.zst",
+		storage:  storage,
+	}
+
+	// the repo is listed once to count it
+	d.makeRoom(10)
+	require.Equal(t, 1, listing.lists)
+
+	// then commits and deletions keep the total
+	buffer, err := os.CreateTemp(filepath.Join(cacheDir, "pkgs", "total-repo"), ".new-*")
+	require.NoError(t, err)
+	_, err = buffer.Write(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, storage.Commit("total-repo", "new-1-1-any.pkg.tar.zst", buffer, time.Time{}))
+	require.NoError(t, buffer.Close())
+	usage, err := repoUsageExcept(cacheDir, storage, "total-repo", "")
+	require.NoError(t, err)
+	require.Equal(t, int64(20), usage)
+	d.makeRoom(10)
+	require.Equal(t, 1, listing.lists, "the file fits, nothing is listed")
+
+	require.NoError(t, storage.Delete("total-repo", "new-1-1-any.pkg.tar.zst"))
+	usage, err = repoUsageExcept(cacheDir, storage, "total-repo", "")
+	require.NoError(t, err)
+	require.Equal(t, int64(10), usage)
+
+	// only a file that does not fit lists the repo to evict
+	d.makeRoom(25)
+	require.Equal(t, 2, listing.lists)
+	_, err = os.Stat(old)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	usage, err = repoUsageExcept(cacheDir, storage, "total-repo", "")
+	require.NoError(t, err)
+	require.Zero(t, usage)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"log"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// File search. pacman -F looks up the owner of a file in the .files
+// databases, which list the files of every package. pacoloco indexes the
+// .files databases it caches, so that the owner of a path can be looked up
+// through the admin API without downloading them.
+
+// filesDB is the index of one .files database.
+type filesDB struct {
+	packages []filesDBPackage
+	dirs     []string
+	// files maps the base name of every file to its owners
+	files map[string][]fileOwner
+}
+
+type filesDBPackage struct {
+	name    string
+	version string
+}
+
+// fileOwner is a file in a filesDB: the index of its directory in dirs and
+// of its package in packages.
+type fileOwner struct {
+	dir uint32
+	pkg uint32
+}
+
+// fileSearchResult is a file found in a .files database.
+type fileSearchResult struct {
+	Repo     string `json:"repo"`
+	Database string `json:"database"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Path     string `json:"path"`
+}
+
+// filesIndex holds the indexed .files databases, keyed by repo name, then
+// database file name.
+var (
+	filesIndex      = make(map[string]map[string]*filesDB)
+	filesIndexMutex sync.RWMutex
+)
+
+// parseFilesDB indexes a compressed .files database.
+func parseFilesDB(name string, f io.ReadSeeker) (*filesDB, error) {
+	r, err := newDecompressReader(name, f, filesDatabaseSizeLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &filesDB{files: make(map[string][]fileOwner)}
+	dirs := make(map[string]uint32)
+	packages := make(map[string]uint32) // by the directory of the package's entries
+	pkgIndex := func(entryDir string) uint32 {
+		i, ok := packages[entryDir]
+		if !ok {
+			i = uint32(len(db.packages))
+			packages[entryDir] = i
+			db.packages = append(db.packages, filesDBPackage{})
+		}
+		return i
+	}
+
+	err = walkRepoDBTar(r, func(entryName string, content string) error {
+		entryDir, file := path.Split(entryName)
+		switch file {
+		case "desc":
+			fields := parseDescFields(content)
+			pkg := &db.packages[pkgIndex(entryDir)]
+			if v := fields["NAME"]; len(v) == 1 {
+				pkg.name = v[0]
+			}
+			if v := fields["VERSION"]; len(v) == 1 {
+				pkg.version = v[0]
+			}
+		case "files":
+			pkg := pkgIndex(entryDir)
+			for _, filePath := range parseDescFields(content)["FILES"] {
+				if strings.HasSuffix(filePath, "/") {
+					continue // a directory
+				}
+				dir, base := path.Split(filePath)
+				d, ok := dirs[dir]
+				if !ok {
+					d = uint32(len(db.dirs))
+					// copy the strings kept in the index, so that they do
+					// not keep the whole entry content alive
+					dir = strings.Clone(dir)
+					dirs[dir] = d
+					db.dirs = append(db.dirs, dir)
+				}
+				owners, ok := db.files[base]
+				if !ok {
+					base = strings.Clone(base)
+				}
+				db.files[base] = append(owners, fileOwner{dir: d, pkg: pkg})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// loadRepoFilesDB indexes a cached .files database, replacing what was
+// indexed for it before.
+func loadRepoFilesDB(storage Storage, repoName string, dbName string) {
+	f, err := storage.Open(repoName, dbName)
+	if err != nil {
+		log.Printf("Unable to index the files of %v/%v: %v", repoName, dbName, err)
+		return
+	}
+	db, err := parseFilesDB(repoName+"/"+dbName, f)
+	_ = f.Close()
+	if err != nil {
+		log.Printf("Unable to index the files of %v/%v: %v", repoName, dbName, err)
+		return
+	}
+
+	filesIndexMutex.Lock()
+	defer filesIndexMutex.Unlock()
+	if filesIndex[repoName] == nil {
+		filesIndex[repoName] = make(map[string]*filesDB)
+	}
+	filesIndex[repoName][dbName] = db
+}
+
+// dropFilesIndex removes a .files database of a repo from the index, or
+// all of them if dbName is empty.
+func dropFilesIndex(repoName string, dbName string) {
+	filesIndexMutex.Lock()
+	defer filesIndexMutex.Unlock()
+	if dbName == "" {
+		delete(filesIndex, repoName)
+		return
+	}
+	delete(filesIndex[repoName], dbName)
+}
+
+// loadCachedFilesDBs indexes every .files database already cached for a
+// repo.
+func loadCachedFilesDBs(storage Storage, repoName string) {
+	files, err := storage.List(repoName)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if path.Ext(f.Name) == ".files" {
+			loadRepoFilesDB(storage, repoName, f.Name)
+		}
+	}
+}
+
+// searchFiles finds the packages that own a file, in the .files databases
+// of the given repo or of all repos if repoName is empty. A query with a
+// slash is a path (a leading slash is optional), like pacman -F
+// /usr/bin/ls; any other query matches files of that name in any directory.
+func searchFiles(query string, repoName string) []fileSearchResult {
+	query = strings.TrimPrefix(query, "/")
+	dir, base := path.Split(query)
+	anyDir := !strings.Contains(query, "/")
+
+	filesIndexMutex.RLock()
+	defer filesIndexMutex.RUnlock()
+	results := []fileSearchResult{}
+	for repo, dbs := range filesIndex {
+		if repoName != "" && repo != repoName {
+			continue
+		}
+		for dbName, db := range dbs {
+			for _, owner := range db.files[base] {
+				if !anyDir && db.dirs[owner.dir] != dir {
+					continue
+				}
+				pkg := db.packages[owner.pkg]
+				results = append(results, fileSearchResult{
+					Repo:     repo,
+					Database: strings.TrimSuffix(path.Base(dbName), ".files"),
+					Package:  pkg.name,
+					Version:  pkg.version,
+					Path:     db.dirs[owner.dir] + base,
+				})
+			}
+		}
+	}
+	slices.SortFunc(results, func(a, b fileSearchResult) int {
+		return cmp.Or(
+			strings.Compare(a.Repo, b.Repo),
+			strings.Compare(a.Database, b.Database),
+			strings.Compare(a.Package, b.Package),
+			strings.Compare(a.Path, b.Path),
+		)
+	})
+	return results
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// createFilesDbTarball creates a .files database with the given files for
+// every package, given as "name-version".
+func createFilesDbTarball(t *testing.T, tarballFilePath string, packages map[string][]string) {
+	file, err := os.Create(tarballFilePath)
+	require.NoError(t, err)
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	defer gzipWriter.Close()
+	tarWriter := tar.NewWriter(gzipWriter)
+	defer tarWriter.Close()
+
+	for pkg, files := range packages {
+		i := strings.LastIndexByte(pkg[:strings.LastIndexByte(pkg, '-')], '-')
+		entries := map[string]string{
+			"desc":  "%FILENAME%\n" + pkg + "-x86_64.pkg.tar.zst\n\n%NAME%\n" + pkg[:i] + "\n\n%VERSION%\n" + pkg[i+1:] + "\n\n",
+			"files": "%FILES%\n" + strings.Join(files, "\n") + "\n",
+		}
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: pkg + "/", Typeflag: tar.TypeDir, Mode: 0o755}))
+		for name, content := range entries {
+			require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: pkg + "/" + name, Size: int64(len(content)), Mode: 0o644}))
+			_, err := tarWriter.Write([]byte(content))
+			require.NoError(t, err)
+		}
+	}
+}
+
+func resetFilesIndex(t *testing.T) {
+	filesIndexMutex.Lock()
+	filesIndex = make(map[string]map[string]*filesDB)
+	filesIndexMutex.Unlock()
+	t.Cleanup(func() {
+		filesIndexMutex.Lock()
+		filesIndex = make(map[string]map[string]*filesDB)
+		filesIndexMutex.Unlock()
+	})
+}
+
+func TestSearchFiles(t *testing.T) {
+	resetFilesIndex(t)
+	cacheDir := t.TempDir()
+	repoDir := filepath.Join(cacheDir, "pkgs", "files-repo")
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	createFilesDbTarball(t, filepath.Join(repoDir, "core.files"), map[string][]string{
+		"coreutils-9.4-3":  {"usr/", "usr/bin/", "usr/bin/ls", "usr/bin/cat"},
+		"busybox-1.36.1-2": {"usr/", "usr/lib/", "usr/lib/busybox/", "usr/lib/busybox/ls"},
+	})
+	createFilesDbTarball(t, filepath.Join(repoDir, "extra.files"), map[string][]string{
+		"uutils-coreutils-0.0.23-1": {"usr/bin/", "usr/bin/uu-ls"},
+	})
+	// databases are indexed, packages are not
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "ls-1-1-any.pkg.tar.zst"), []byte("pkg"), 0o644))
+	loadCachedFilesDBs(newFSStorage(filepath.Join(cacheDir, "pkgs")), "files-repo")
+
+	coreutils := fileSearchResult{Repo: "files-repo", Database: "core", Package: "coreutils", Version: "9.4-3", Path: "usr/bin/ls"}
+	require.Equal(t, []fileSearchResult{coreutils}, searchFiles("usr/bin/ls", ""))
+	require.Equal(t, []fileSearchResult{coreutils}, searchFiles("/usr/bin/ls", "files-repo"))
+	require.Equal(t, []fileSearchResult{
+		{Repo: "files-repo", Database: "core", Package: "busybox", Version: "1.36.1-2", Path: "usr/lib/busybox/ls"},
+		coreutils,
+	}, searchFiles("ls", ""), "a file name matches in any directory")
+	require.Equal(t, "uutils-coreutils", searchFiles("uu-ls", "")[0].Package)
+
+	require.Empty(t, searchFiles("usr/bin", ""), "directories are not indexed")
+	require.Empty(t, searchFiles("bin/ls", ""))
+	require.Empty(t, searchFiles("usr/bin/ls", "other-repo"))
+
+	// a deleted database is dropped from the index, and so is a removed repo
+	storage := newFSStorage(filepath.Join(cacheDir, "pkgs"))
+	require.NoError(t, removeCachedFile(storage, "files-repo", "core.files"))
+	require.Empty(t, searchFiles("usr/bin/ls", ""))
+	require.Len(t, searchFiles("uu-ls", ""), 1)
+	updateRepoGauges(&Config{Repos: map[string]*Repo{"files-repo": {}}}, &Config{Repos: map[string]*Repo{}})
+	require.Empty(t, searchFiles("uu-ls", ""))
+}
+
+func TestAPISearchFile(t *testing.T) {
+	resetFilesIndex(t)
+	cacheDir := setupAPIConfig(t)
+	createFilesDbTarball(t, filepath.Join(cacheDir, "pkgs", "api-repo", "core.files"), map[string][]string{
+		"foo-1.1-1": {"usr/bin/foo"},
+	})
+	loadCachedFilesDBs(config.Load().cacheStorage(), "api-repo")
+
+	w := apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []fileSearchResult{{Repo: "api-repo", Database: "core", Package: "foo", Version: "1.1-1", Path: "usr/bin/foo"}}, decodeAPIResponse[[]fileSearchResult](t, w))
+
+	w = apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo&repo=empty-repo", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "[]\n", w.Body.String())
+
+	require.Equal(t, http.StatusBadRequest, apiRequest(t, http.MethodGet, "/api/v1/search/file", testAdminToken).Code)
+	require.Equal(t, http.StatusNotFound, apiRequest(t, http.MethodGet, "/api/v1/search/file?path=foo&repo=unknown", testAdminToken).Code)
+
+	// a read-only lookup, which needs no admin token
+	w = apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, decodeAPIResponse[[]fileSearchResult](t, w), 1)
+
+	// with auth, clients need credentials and only find the files of their repos
+	config.Load().Auth = &Auth{
+		Tokens: map[string]string{"ci": "ci-token", "builder": "builder-token"},
+		Repos:  map[string][]string{"ci": {"empty-repo"}, "builder": {"api-repo"}},
+	}
+	w = apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, `Basic realm="pacoloco"`, w.Header().Get("WWW-Authenticate"))
+	w = apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo", "ci-token")
+	require.Equal(t, "[]\n", w.Body.String())
+	require.Equal(t, http.StatusNotFound, apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo&repo=api-repo", "ci-token").Code)
+	require.Len(t, decodeAPIResponse[[]fileSearchResult](t, apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo", "builder-token")), 1)
+	require.Len(t, decodeAPIResponse[[]fileSearchResult](t, apiRequest(t, http.MethodGet, "/api/v1/search/file?path=usr/bin/foo", testAdminToken)), 1)
+}
@@ -39,14 +39,14 @@ func TestPacolocoIntegrationWithPrefetching(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(testPacolocoDir)
 	notInvokingPrefetchTime := time.Now().Add(-time.Hour) // an hour ago
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testPacolocoDir,
 		Port:            -1,
 		PurgeFilesAfter: -1,
 		DownloadTimeout: 999,
 		Repos:           make(map[string]*Repo),
 		Prefetch:        &RefreshPeriod{Cron: "0 0 " + fmt.Sprint(notInvokingPrefetchTime.Hour()) + " ? * 1#1 *"},
-	}
+	})
 	setupPrefetch()
 	pacoloco := httptest.NewServer(http.HandlerFunc(pacolocoHandler))
 	defer pacoloco.Close()
@@ -81,14 +81,14 @@ func TestPacolocoIntegration(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(testPacolocoDir)
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        testPacolocoDir,
 		Port:            -1,
 		PurgeFilesAfter: -1,
 		DownloadTimeout: 999,
 		Repos:           make(map[string]*Repo),
 		Prefetch:        nil,
-	}
+	})
 
 	pacoloco := httptest.NewServer(http.HandlerFunc(pacolocoHandler))
 	defer pacoloco.Close()
@@ -129,8 +129,8 @@ func testRequestNonExistingDb(t *testing.T) {
 
 func testRequestExistingRepo(t *testing.T) {
 	// Requesting existing repo
-	config.Repos["repo1"] = &Repo{}
-	defer delete(config.Repos, "repo1")
+	config.Load().Repos["repo1"] = &Repo{}
+	defer delete(config.Load().Repos, "repo1")
 
 	requestCounter, err := cacheRequestsCounter.GetMetricWithLabelValues("repo1")
 	require.NoError(t, err)
@@ -174,8 +174,8 @@ func testRequestExistingRepoWithDb(t *testing.T) {
 	repo2 := &Repo{
 		URL: mirrorURL + "/mirror2",
 	}
-	config.Repos["repo2"] = repo2
-	defer delete(config.Repos, "repo2")
+	config.Load().Repos["repo2"] = repo2
+	defer delete(config.Load().Repos, "repo2")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror2"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror2"))
@@ -285,8 +285,8 @@ func testRequestPackageFile(t *testing.T) {
 	repo3 := &Repo{
 		URL: mirrorURL + "/mirror3",
 	}
-	config.Repos["repo3"] = repo3
-	defer delete(config.Repos, "repo3")
+	config.Load().Repos["repo3"] = repo3
+	defer delete(config.Load().Repos, "repo3")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror3"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror3"))
@@ -389,8 +389,8 @@ func testRequestDbMultipleTimes(t *testing.T) {
 	repo4 := &Repo{
 		URL: mirrorURL + "/mirror4",
 	}
-	config.Repos["repo4"] = repo4
-	defer delete(config.Repos, "repo4")
+	config.Load().Repos["repo4"] = repo4
+	defer delete(config.Load().Repos, "repo4")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror4"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror4"))
@@ -433,8 +433,8 @@ func testFailover(t *testing.T) {
 			mirrorURL + "/mirror-failover",
 		},
 	}
-	config.Repos["failover"] = failover
-	defer delete(config.Repos, "failover")
+	config.Load().Repos["failover"] = failover
+	defer delete(config.Load().Repos, "failover")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror-failover"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror-failover"))
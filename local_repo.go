@@ -0,0 +1,403 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local repos. A repo with `local: true` has no upstream: its packages are
+// uploaded through the admin API into cache_dir/local/<repo>, and pacoloco
+// generates <repo>.db and <repo>.files from them the way repo-add does.
+// Local repos are served like the others but never purged, evicted or
+// collected.
+
+// localReposDir is the directory in cache_dir the local repos are kept in.
+const localReposDir = "local"
+
+// localRepoMutex serializes the uploads to local repos and the generation
+// of their databases.
+var localRepoMutex sync.Mutex
+
+// localPackages caches the parsed packages of the local repos by
+// repo + "/" + file name, so that a database update only reads the new
+// packages.
+var localPackages = make(map[string]*localPackage)
+
+// localPackage is what repo-add puts into the databases about a package.
+type localPackage struct {
+	fileName string
+	size     int64
+	modTime  time.Time
+
+	info      map[string][]string // the .PKGINFO fields
+	md5Sum    string
+	sha256Sum string
+	files     []string // sorted, directories end with "/"
+}
+
+func (p *localPackage) name() string    { return strings.Join(p.info["pkgname"], "") }
+func (p *localPackage) version() string { return strings.Join(p.info["pkgver"], "") }
+
+// localStorage returns the Storage the local repos are kept in.
+func (c *Config) localStorage() Storage {
+	return newFSStorage(filepath.Join(c.CacheDir, localReposDir))
+}
+
+// uploadLimit returns the size limit of a package uploaded to a local repo.
+func (c *Config) uploadLimit() int64 {
+	if c.maxUploadSize == 0 {
+		return DefaultMaxUploadSize
+	}
+	return c.maxUploadSize
+}
+
+// repoStorage returns the Storage the files of a repo are served from.
+func (c *Config) repoStorage(repoName string) Storage {
+	if repo := c.Repos[repoName]; repo != nil && repo.Local {
+		return c.localStorage()
+	}
+	return c.cacheStorage()
+}
+
+// readLocalPackage reads the metadata and file list of a package archive.
+func readLocalPackage(fileName string, f io.ReadSeeker) (*localPackage, error) {
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), f); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r, err := newDecompressReader(fileName, f, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := &localPackage{
+		fileName:  fileName,
+		md5Sum:    hex.EncodeToString(md5Hash.Sum(nil)),
+		sha256Sum: hex.EncodeToString(sha256Hash.Sum(nil)),
+	}
+	tr := tar.NewReader(bufio.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if name == ".PKGINFO" {
+			if pkg.info, err = parsePkgInfo(io.LimitReader(tr, databaseSizeLimit)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if name == "" || strings.HasPrefix(name, ".") {
+			continue // the package metadata, like .BUILDINFO or .MTREE
+		}
+		if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		pkg.files = append(pkg.files, name)
+	}
+	if pkg.info == nil {
+		return nil, errors.New("the package has no .PKGINFO")
+	}
+	if pkg.name() == "" || pkg.version() == "" || len(pkg.info["arch"]) != 1 {
+		return nil, errors.New("the .PKGINFO lacks pkgname, pkgver or arch")
+	}
+	slices.Sort(pkg.files)
+	return pkg, nil
+}
+
+// parsePkgInfo reads the "key = value" lines of a .PKGINFO file.
+func parsePkgInfo(r io.Reader) (map[string][]string, error) {
+	info := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			return nil, fmt.Errorf("malformed .PKGINFO line %q", line)
+		}
+		info[key] = append(info[key], value)
+	}
+	return info, scanner.Err()
+}
+
+// descFields lists the fields of a desc entry in the order repo-add writes
+// them, with the .PKGINFO key they come from.
+var descFields = []struct{ desc, pkgInfo string }{
+	{"NAME", "pkgname"},
+	{"BASE", "pkgbase"},
+	{"VERSION", "pkgver"},
+	{"DESC", "pkgdesc"},
+	{"GROUPS", "group"},
+	{"CSIZE", ""},
+	{"ISIZE", "size"},
+	{"MD5SUM", ""},
+	{"SHA256SUM", ""},
+	{"PGPSIG", ""},
+	{"URL", "url"},
+	{"LICENSE", "license"},
+	{"ARCH", "arch"},
+	{"BUILDDATE", "builddate"},
+	{"PACKAGER", "packager"},
+	{"REPLACES", "replaces"},
+	{"CONFLICTS", "conflict"},
+	{"PROVIDES", "provides"},
+	{"DEPENDS", "depend"},
+	{"OPTDEPENDS", "optdepend"},
+	{"MAKEDEPENDS", "makedepend"},
+	{"CHECKDEPENDS", "checkdepend"},
+}
+
+// desc renders the desc entry of the package; signature is the content of
+// its detached signature, if it has one.
+func (p *localPackage) desc(signature []byte) string {
+	var b strings.Builder
+	write := func(field string, values ...string) {
+		if len(values) == 0 || len(values) == 1 && values[0] == "" {
+			return
+		}
+		fmt.Fprintf(&b, "%%%v%%\n%v\n\n", field, strings.Join(values, "\n"))
+	}
+	write("FILENAME", p.fileName)
+	for _, f := range descFields {
+		switch f.desc {
+		case "CSIZE":
+			write(f.desc, strconv.FormatInt(p.size, 10))
+		case "MD5SUM":
+			write(f.desc, p.md5Sum)
+		case "SHA256SUM":
+			write(f.desc, p.sha256Sum)
+		case "PGPSIG":
+			if signature != nil {
+				write(f.desc, base64.StdEncoding.EncodeToString(signature))
+			}
+		default:
+			write(f.desc, p.info[f.pkgInfo]...)
+		}
+	}
+	return b.String()
+}
+
+// loadLocalPackage returns the parsed package of a file in a local repo,
+// parsing it unless it is cached. Callers hold localRepoMutex.
+func loadLocalPackage(storage Storage, repoName string, f CachedFile) (*localPackage, error) {
+	key := repoName + "/" + f.Name
+	if pkg := localPackages[key]; pkg != nil && pkg.size == f.Size && pkg.modTime.Equal(f.ModTime) {
+		return pkg, nil
+	}
+	content, err := storage.Open(repoName, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	pkg, err := readLocalPackage(f.Name, content)
+	if err != nil {
+		return nil, err
+	}
+	pkg.size, pkg.modTime = f.Size, f.ModTime
+	localPackages[key] = pkg
+	return pkg, nil
+}
+
+// updateLocalRepoDBs generates <repo>.db and <repo>.files from the
+// packages in a local repo. Like repo-add, they list a single version of
+// every package, the newest. Callers hold localRepoMutex.
+func updateLocalRepoDBs(c *Config, repoName string) error {
+	storage := c.localStorage()
+	files, err := storage.List(repoName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	cached := make(map[string]bool, len(files))
+	for _, f := range files {
+		cached[f.Name] = true
+	}
+
+	newest := make(map[string]*localPackage)
+	for _, f := range files {
+		if !isPackageFile(f.Name) || strings.Contains(f.Name, "/") {
+			continue
+		}
+		pkg, err := loadLocalPackage(storage, repoName, f)
+		if err != nil {
+			log.Printf("Skipping %v of local repo %v: %v", f.Name, repoName, err)
+			continue
+		}
+		if current := newest[pkg.name()]; current == nil || vercmp(pkg.version(), current.version()) > 0 {
+			newest[pkg.name()] = pkg
+		}
+	}
+	// forget the packages that were removed
+	for key := range localPackages {
+		if name, ok := strings.CutPrefix(key, repoName+"/"); ok && !cached[name] {
+			delete(localPackages, key)
+		}
+	}
+
+	packages := make([]*localPackage, 0, len(newest))
+	for _, pkg := range newest {
+		packages = append(packages, pkg)
+	}
+	slices.SortFunc(packages, func(a, b *localPackage) int {
+		return strings.Compare(a.name(), b.name())
+	})
+
+	repoDir := filepath.Join(c.CacheDir, localReposDir, repoName)
+	if err := os.MkdirAll(repoDir, os.ModePerm); err != nil {
+		return err
+	}
+	var dbFiles, filesDBFiles []repoDBFile
+	for _, pkg := range packages {
+		var signature []byte
+		if cached[pkg.fileName+".sig"] {
+			if signature, err = os.ReadFile(filepath.Join(repoDir, pkg.fileName+".sig")); err != nil {
+				log.Printf("Unable to read the signature of %v: %v", pkg.fileName, err)
+			}
+		}
+		dir := pkg.name() + "-" + pkg.version() + "/"
+		desc := repoDBFile{name: dir + "desc", content: pkg.desc(signature)}
+		dbFiles = append(dbFiles, desc)
+		filesDBFiles = append(filesDBFiles, desc, repoDBFile{name: dir + "files", content: "%FILES%\n" + strings.Join(pkg.files, "\n") + "\n\n"})
+	}
+	now := time.Now()
+	if err := writeCompressedRepoDB(filepath.Join(repoDir, repoName+".db"), dbFiles, now); err != nil {
+		return fmt.Errorf("writing %v.db: %w", repoName, err)
+	}
+	if err := writeCompressedRepoDB(filepath.Join(repoDir, repoName+".files"), filesDBFiles, now); err != nil {
+		return fmt.Errorf("writing %v.files: %w", repoName, err)
+	}
+	log.Printf("Updated the databases of local repo %v with %d packages", repoName, len(packages))
+
+	size, count, err := gatherCacheStats(storage, repoName)
+	if err == nil {
+		cacheSizeGauge.WithLabelValues(repoName).Set(size)
+		cachePackageGauge.WithLabelValues(repoName).Set(count)
+	}
+	go loadRepoDBMetadata(storage, repoName, repoName+".db")
+	go loadRepoFilesDB(storage, repoName, repoName+".files")
+	return nil
+}
+
+// rebuildLocalRepo regenerates the databases of a local repo, e.g. after
+// packages were copied into its directory while pacoloco was not running.
+func rebuildLocalRepo(c *Config, repoName string) {
+	localRepoMutex.Lock()
+	defer localRepoMutex.Unlock()
+	if err := updateLocalRepoDBs(c, repoName); err != nil {
+		log.Printf("Unable to update the databases of local repo %v: %v", repoName, err)
+	}
+}
+
+// uploadLocalFile stores an uploaded package or signature in a local repo
+// and updates the repo databases. The body is received and checked before
+// localRepoMutex is taken, so a slow upload does not hold up the others.
+func uploadLocalFile(c *Config, repoName string, fileName string, body io.Reader) (CachedFile, error) {
+	if !filenameRegex.MatchString(fileName) {
+		return CachedFile{}, fmt.Errorf("%w: %v is neither a package nor a signature", errInvalidUpload, fileName)
+	}
+	isSignature := strings.HasSuffix(fileName, ".sig")
+	limit := c.uploadLimit()
+	if isSignature {
+		limit = maxSignatureSize
+	}
+
+	repoDir := filepath.Join(c.CacheDir, localReposDir, repoName)
+	if err := os.MkdirAll(repoDir, os.ModePerm); err != nil {
+		return CachedFile{}, err
+	}
+	// received under a buffer file name, so that a failed upload is
+	// never listed
+	tmp, err := os.CreateTemp(repoDir, "."+fileName+"-*")
+	if err != nil {
+		return CachedFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, io.LimitReader(body, limit+1))
+	if err != nil {
+		return CachedFile{}, err
+	}
+	if size > limit {
+		return CachedFile{}, fmt.Errorf("%w: %v is larger than %d bytes", errUploadTooLarge, fileName, limit)
+	}
+
+	if !isSignature {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return CachedFile{}, err
+		}
+		pkg, err := readLocalPackage(fileName, tmp)
+		if err != nil {
+			return CachedFile{}, fmt.Errorf("%w: %v", errInvalidUpload, err)
+		}
+		// pacman derives nothing from the file name, but the orphan GC,
+		// eviction and prefetching do
+		expected := pkg.name() + "-" + pkg.version() + "-" + pkg.info["arch"][0] + ".pkg.tar"
+		if !strings.HasPrefix(fileName, expected) {
+			return CachedFile{}, fmt.Errorf("%w: the package should be named %v*", errInvalidUpload, expected)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return CachedFile{}, err
+	}
+
+	localRepoMutex.Lock()
+	defer localRepoMutex.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(repoDir, fileName)); err != nil {
+		return CachedFile{}, err
+	}
+	log.Printf("Uploaded %v to local repo %v", fileName, repoName)
+
+	if err := updateLocalRepoDBs(c, repoName); err != nil {
+		return CachedFile{}, fmt.Errorf("updating the databases: %w", err)
+	}
+	return c.localStorage().Stat(repoName, fileName)
+}
+
+// errInvalidUpload marks uploads that are rejected for their content.
+var errInvalidUpload = errors.New("invalid upload")
+
+// errUploadTooLarge marks uploads above max_upload_size, or signatures
+// above maxSignatureSize.
+var errUploadTooLarge = errors.New("upload too large")
+
+// serveLocalFile serves a file of a local repo. Whatever the path in the
+// repo, files are looked up by name, so that Server lines with $arch work.
+func serveLocalFile(w http.ResponseWriter, req *http.Request, f *RequestedFile) error {
+	if isBufferFile(f.fileName) {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err := serveCachedFile(w, req, f); err != nil {
+		cacheServingFailedCounter.WithLabelValues(f.repoName).Inc()
+		return err
+	}
+	cacheServedCounter.WithLabelValues(f.repoName).Inc()
+	return nil
+}
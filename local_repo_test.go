@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// createTestPackage builds a zstd compressed package archive with the given
+// .PKGINFO and files.
+func createTestPackage(t *testing.T, pkgInfo string, files ...string) []byte {
+	var buf bytes.Buffer
+	zstdWriter, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	tarWriter := tar.NewWriter(zstdWriter)
+	entries := append([]string{".PKGINFO", ".BUILDINFO"}, files...)
+	for _, name := range entries {
+		content := ""
+		if name == ".PKGINFO" {
+			content = pkgInfo
+		}
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}
+		if name[len(name)-1] == '/' {
+			hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0o755}
+		}
+		require.NoError(t, tarWriter.WriteHeader(hdr))
+		_, err := tarWriter.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, zstdWriter.Close())
+	return buf.Bytes()
+}
+
+func fooPkgInfo(version string) string {
+	return `# Generated by makepkg
+pkgname = foo
+pkgbase = foo
+pkgver = ` + version + `
+pkgdesc = The foo tool
+url = https://example.com/foo
+builddate = 1700000000
+packager = Foo Maintainer <foo@example.com>
+size = 5678
+arch = x86_64
+license = MIT
+depend = glibc
+depend = bar>=2.0
+`
+}
+
+func setupLocalRepo(t *testing.T) string {
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:   cacheDir,
+		Port:       -1,
+		AdminToken: testAdminToken,
+		Repos: map[string]*Repo{
+			"private":  {Local: true},
+			"api-repo": {URL: "http://api.example.com"},
+		},
+	})
+	return cacheDir
+}
+
+func uploadRequest(t *testing.T, repoName string, fileName string, content []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/repos/"+repoName+"/files/"+fileName, bytes.NewReader(content))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	apiHandler().ServeHTTP(w, req)
+	return w
+}
+
+func readLocalRepoDB(t *testing.T, cacheDir string, dbName string) []repoDBEntry {
+	f, err := os.Open(filepath.Join(cacheDir, localReposDir, "private", dbName))
+	require.NoError(t, err)
+	defer f.Close()
+	entries, err := readRepoDB(dbName, f)
+	require.NoError(t, err)
+	return entries
+}
+
+func TestLocalRepoUpload(t *testing.T) {
+	cacheDir := setupLocalRepo(t)
+
+	pkg := createTestPackage(t, fooPkgInfo("1.0-1"), "usr/", "usr/bin/", "usr/bin/foo")
+	w := uploadRequest(t, "private", "foo-1.0-1-x86_64.pkg.tar.zst", pkg)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Equal(t, http.StatusCreated, uploadRequest(t, "private", "foo-1.0-1-x86_64.pkg.tar.zst.sig", []byte("signature")).Code)
+
+	entries := readLocalRepoDB(t, cacheDir, "private.db")
+	require.Len(t, entries, 1)
+	require.Equal(t, "foo-1.0-1-x86_64.pkg.tar.zst", entries[0].FileName)
+
+	f, err := os.Open(filepath.Join(cacheDir, localReposDir, "private", "private.db"))
+	require.NoError(t, err)
+	packages, err := parsePackageMetadata("private.db", f)
+	_ = f.Close()
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	require.Equal(t, "foo", packages[0].Name)
+	require.Equal(t, "1.0-1", packages[0].Version)
+	require.Equal(t, "The foo tool", packages[0].Description)
+	require.Equal(t, []string{"glibc", "bar>=2.0"}, packages[0].Depends)
+	require.Equal(t, int64(len(pkg)), packages[0].CSize)
+	require.Equal(t, int64(5678), packages[0].ISize)
+	require.Len(t, packages[0].SHA256Sum, 64)
+
+	f, err = os.Open(filepath.Join(cacheDir, localReposDir, "private", "private.files"))
+	require.NoError(t, err)
+	files, err := parseFilesDB("private.files", f)
+	_ = f.Close()
+	require.NoError(t, err)
+	require.Equal(t, []string{"usr/bin/"}, files.dirs, "the package metadata files are not listed")
+	require.Contains(t, files.files, "foo")
+
+	// the newest version is the one in the databases
+	require.Equal(t, http.StatusCreated, uploadRequest(t, "private", "foo-1.10-1-x86_64.pkg.tar.zst", createTestPackage(t, fooPkgInfo("1.10-1"))).Code)
+	require.Equal(t, http.StatusCreated, uploadRequest(t, "private", "foo-1.9-1-x86_64.pkg.tar.zst", createTestPackage(t, fooPkgInfo("1.9-1"))).Code)
+	entries = readLocalRepoDB(t, cacheDir, "private.db")
+	require.Len(t, entries, 1)
+	require.Equal(t, "foo-1.10-1-x86_64.pkg.tar.zst", entries[0].FileName)
+
+	// removing it brings the previous one back
+	require.Equal(t, http.StatusOK, apiRequest(t, http.MethodDelete, "/api/v1/repos/private/files/foo-1.10-1-x86_64.pkg.tar.zst", testAdminToken).Code)
+	entries = readLocalRepoDB(t, cacheDir, "private.db")
+	require.Len(t, entries, 1)
+	require.Equal(t, "foo-1.9-1-x86_64.pkg.tar.zst", entries[0].FileName)
+
+	require.Equal(t, http.StatusOK, apiRequest(t, http.MethodDelete, "/api/v1/repos/private/packages/foo", testAdminToken).Code)
+	require.Empty(t, readLocalRepoDB(t, cacheDir, "private.db"))
+}
+
+func TestLocalPackageDesc(t *testing.T) {
+	pkg := &localPackage{
+		fileName: "foo-1.0-1-x86_64.pkg.tar.zst",
+		size:     42,
+		info:     map[string][]string{"pkgname": {"foo"}, "pkgver": {"1.0-1"}, "arch": {"x86_64"}, "depend": {"a", "b"}},
+		md5Sum:   "md5",
+	}
+	require.Equal(t, "%FILENAME%\nfoo-1.0-1-x86_64.pkg.tar.zst\n\n"+
+		"%NAME%\nfoo\n\n"+
+		"%VERSION%\n1.0-1\n\n"+
+		"%CSIZE%\n42\n\n"+
+		"%MD5SUM%\nmd5\n\n"+
+		"%PGPSIG%\n"+base64.StdEncoding.EncodeToString([]byte("sig"))+"\n\n"+
+		"%ARCH%\nx86_64\n\n"+
+		"%DEPENDS%\na\nb\n\n", pkg.desc([]byte("sig")))
+}
+
+func TestLocalRepoUploadRejected(t *testing.T) {
+	setupLocalRepo(t)
+	pkg := createTestPackage(t, fooPkgInfo("1.0-1"))
+
+	require.Equal(t, http.StatusNotFound, uploadRequest(t, "unknown", "foo-1.0-1-x86_64.pkg.tar.zst", pkg).Code)
+	require.Equal(t, http.StatusConflict, uploadRequest(t, "api-repo", "foo-1.0-1-x86_64.pkg.tar.zst", pkg).Code)
+	require.Equal(t, http.StatusBadRequest, uploadRequest(t, "private", "foo.txt", pkg).Code)
+	require.Equal(t, http.StatusBadRequest, uploadRequest(t, "private", "foo-2.0-1-x86_64.pkg.tar.zst", pkg).Code, "the name does not match the .PKGINFO")
+	require.Equal(t, http.StatusBadRequest, uploadRequest(t, "private", "foo-1.0-1-x86_64.pkg.tar.zst", []byte("not a package")).Code)
+	require.Equal(t, http.StatusRequestEntityTooLarge, uploadRequest(t, "private", "foo-1.0-1-x86_64.pkg.tar.zst.sig", make([]byte, maxSignatureSize+1)).Code)
+
+	c := *config.Load()
+	c.maxUploadSize = int64(len(pkg) - 1)
+	config.Store(&c)
+	require.Equal(t, http.StatusRequestEntityTooLarge, uploadRequest(t, "private", "foo-1.0-1-x86_64.pkg.tar.zst", pkg).Code)
+	// a body without a Content-Length is cut off at the limit
+	_, err := uploadLocalFile(&c, "private", "foo-1.0-1-x86_64.pkg.tar.zst", bytes.NewReader(pkg))
+	require.ErrorIs(t, err, errUploadTooLarge)
+
+	files, err := config.Load().localStorage().List("private")
+	require.NoError(t, err)
+	require.Empty(t, files, "rejected uploads leave nothing behind")
+}
+
+func TestLocalRepoServe(t *testing.T) {
+	cacheDir := setupLocalRepo(t)
+	pkg := createTestPackage(t, fooPkgInfo("1.0-1"))
+	require.Equal(t, http.StatusCreated, uploadRequest(t, "private", "foo-1.0-1-x86_64.pkg.tar.zst", pkg).Code)
+
+	for _, urlPath := range []string{"/repo/private/foo-1.0-1-x86_64.pkg.tar.zst", "/repo/private/x86_64/foo-1.0-1-x86_64.pkg.tar.zst"} {
+		w := httptest.NewRecorder()
+		require.NoError(t, handleRequest(w, httptest.NewRequest(http.MethodGet, urlPath, nil)))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, pkg, w.Body.Bytes())
+	}
+
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, httptest.NewRequest(http.MethodGet, "/repo/private/private.db", nil)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// nothing is downloaded for a local repo
+	w = httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, httptest.NewRequest(http.MethodGet, "/repo/private/bar-1.0-1-x86_64.pkg.tar.zst", nil)))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	_, err := os.Stat(filepath.Join(cacheDir, "pkgs", "private"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLocalRepoRebuild(t *testing.T) {
+	cacheDir := setupLocalRepo(t)
+	// packages copied into the repo directory are picked up on startup
+	repoDir := filepath.Join(cacheDir, localReposDir, "private")
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "foo-1.0-1-x86_64.pkg.tar.zst"), createTestPackage(t, fooPkgInfo("1.0-1")), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "broken-1.0-1-x86_64.pkg.tar.zst"), []byte("broken"), 0o644))
+
+	rebuildLocalRepo(config.Load(), "private")
+	entries := readLocalRepoDB(t, cacheDir, "private.db")
+	require.Len(t, entries, 1, "broken packages are skipped")
+	require.Equal(t, "foo-1.0-1-x86_64.pkg.tar.zst", entries[0].FileName)
+	require.Len(t, readLocalRepoDB(t, cacheDir, "private.files"), 1)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Merged repos. A repo with `merge: [core-overrides, core]` combines other
+// configured repos, the first one taking priority: its databases are
+// generated from the databases of the merged repos, a package listed by
+// several of them taken from the first, and package files are served from
+// the repo whose database entry won.
+
+// mergedReposDir is the directory in cache_dir the generated databases of
+// the merged repos are kept in.
+const mergedReposDir = "merged"
+
+// mergedRepoMutex serializes the generation of merged databases.
+var mergedRepoMutex sync.Mutex
+
+// mergedDBs holds the generated databases by repo + "/" + file name.
+var mergedDBs = make(map[string]*mergedDB)
+
+// mergedDB is a generated database of a merged repo.
+type mergedDB struct {
+	// sources identifies the revisions of the databases it was merged
+	// from, it is generated again once they change
+	sources string
+	// owners maps the package files it lists to the repo they come from
+	owners map[string]string
+}
+
+func (r *Repo) isMerged() bool {
+	return len(r.Merge) > 0
+}
+
+// mergedSource is the database of a merged repo that one of its databases
+// is generated from.
+type mergedSource struct {
+	repoName string
+	storage  Storage
+	cached   CachedFile
+}
+
+// fetchMergedSource brings the database of a merged repo up to date and
+// describes it. For a local repo that is its own database, whatever name
+// was requested; it is nil if the local repo has no database yet.
+func fetchMergedSource(c *Config, repoName string, pathAtRepo string, fileName string) (*mergedSource, error) {
+	repo := c.Repos[repoName]
+	if repo.Local {
+		fileName = repoName + path.Ext(fileName)
+	}
+	f := newRequestedFile(c, repoName, pathAtRepo, fileName)
+	if !repo.Local {
+		if err := f.mkCacheDir(); err != nil {
+			return nil, err
+		}
+		if err := waitForVerifiedFile(f); err != nil {
+			if !f.cachedFileExists() {
+				return nil, err
+			}
+			log.Printf("Merging the cached %v/%v, it could not be updated: %v", repoName, fileName, err)
+		}
+	}
+	cached, err := f.storage.Stat(repoName, fileName)
+	if repo.Local && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &mergedSource{repoName: repoName, storage: f.storage, cached: cached}, nil
+}
+
+// updateMergedDB generates the requested database of a merged repo from
+// the databases of the repos it merges, unless they did not change since
+// the last time.
+func updateMergedDB(c *Config, f *RequestedFile) (*mergedDB, error) {
+	var sources []*mergedSource
+	var fingerprint strings.Builder
+	var modTime time.Time
+	for _, member := range f.repo.Merge {
+		source, err := fetchMergedSource(c, member, f.pathAtRepo, f.fileName)
+		if err != nil {
+			return nil, fmt.Errorf("fetching the database of %v: %w", member, err)
+		}
+		if source == nil {
+			continue
+		}
+		sources = append(sources, source)
+		fmt.Fprintf(&fingerprint, "%v/%v:%d:%d\n", member, source.cached.Name, source.cached.Size, source.cached.ModTime.UnixNano())
+		if source.cached.ModTime.After(modTime) {
+			modTime = source.cached.ModTime
+		}
+	}
+
+	mergedRepoMutex.Lock()
+	defer mergedRepoMutex.Unlock()
+
+	key := f.repoName + "/" + f.fileName
+	dbPath := filepath.Join(c.CacheDir, mergedReposDir, f.repoName, f.fileName)
+	if db := mergedDBs[key]; db != nil && db.sources == fingerprint.String() {
+		if _, err := os.Stat(dbPath); err == nil {
+			return db, nil
+		}
+	}
+
+	sizeLimit := int64(databaseSizeLimit)
+	if path.Ext(f.fileName) == ".files" {
+		sizeLimit = filesDatabaseSizeLimit
+	}
+	db := &mergedDB{sources: fingerprint.String(), owners: make(map[string]string)}
+	var files []repoDBFile
+	merged := make(map[string]bool) // names of the packages merged so far
+	for _, source := range sources {
+		content, err := source.storage.Open(source.repoName, source.cached.Name)
+		if err != nil {
+			return nil, err
+		}
+		r, err := newDecompressReader(source.cached.Name, content, sizeLimit)
+		if err != nil {
+			_ = content.Close()
+			return nil, err
+		}
+		// the files of a package, by the directory of its entries
+		var dirs []string
+		packages := make(map[string][]repoDBFile)
+		err = walkRepoDBTar(r, func(name string, content string) error {
+			dir := path.Dir(name)
+			if packages[dir] == nil {
+				dirs = append(dirs, dir)
+			}
+			packages[dir] = append(packages[dir], repoDBFile{name: name, content: content})
+			return nil
+		})
+		_ = content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %v/%v: %w", source.repoName, source.cached.Name, err)
+		}
+
+		var added []string
+		for _, dir := range dirs {
+			var desc map[string][]string
+			for _, file := range packages[dir] {
+				if path.Base(file.name) == "desc" {
+					desc = parseDescFields(file.content)
+				}
+			}
+			name := strings.Join(desc["NAME"], "")
+			if name == "" || merged[name] {
+				continue
+			}
+			added = append(added, name)
+			for _, fileName := range desc["FILENAME"] {
+				db.owners[fileName] = source.repoName
+			}
+			files = append(files, packages[dir]...)
+		}
+		for _, name := range added {
+			merged[name] = true
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dbPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := writeCompressedRepoDB(dbPath, files, modTime); err != nil {
+		return nil, err
+	}
+	log.Printf("Merged %v from %d repos, %d packages", key, len(sources), len(merged))
+	mergedDBs[key] = db
+	return db, nil
+}
+
+// mergedFileOwner returns the repo a file of a merged repo is served from:
+// the one whose database entry of the package was merged, otherwise the
+// first that has the file, otherwise the first one that is not local.
+func mergedFileOwner(c *Config, f *RequestedFile) string {
+	repo := f.repo
+	pkgFile := strings.TrimSuffix(f.fileName, ".sig")
+	mergedRepoMutex.Lock()
+	for key, db := range mergedDBs {
+		if owner := db.owners[pkgFile]; owner != "" && strings.HasPrefix(key, f.repoName+"/") && slices.Contains(repo.Merge, owner) {
+			mergedRepoMutex.Unlock()
+			return owner
+		}
+	}
+	mergedRepoMutex.Unlock()
+
+	for _, member := range repo.Merge {
+		if _, err := c.repoStorage(member).Stat(member, f.fileName); err == nil {
+			return member
+		}
+	}
+	for _, member := range repo.Merge {
+		if !c.Repos[member].Local {
+			return member
+		}
+	}
+	return repo.Merge[0]
+}
+
+// serveMergedFile serves a file of a merged repo: a generated database, or
+// the file of the repo it resolves to.
+func serveMergedFile(w http.ResponseWriter, req *http.Request, f *RequestedFile) error {
+	c := f.config
+	switch {
+	case isRepoDBFile(f.fileName):
+		if _, err := updateMergedDB(c, f); err != nil {
+			cacheServingFailedCounter.WithLabelValues(f.repoName).Inc()
+			return fmt.Errorf("merging %v/%v: %w", f.repoName, f.fileName, err)
+		}
+		merged := &RequestedFile{
+			repoName:   f.repoName,
+			pathAtRepo: f.pathAtRepo,
+			fileName:   f.fileName,
+			storage:    newFSStorage(filepath.Join(c.CacheDir, mergedReposDir)),
+		}
+		if err := serveCachedFile(w, req, merged); err != nil {
+			cacheServingFailedCounter.WithLabelValues(f.repoName).Inc()
+			return err
+		}
+		cacheServedCounter.WithLabelValues(f.repoName).Inc()
+		return nil
+	case isRepoDBFile(strings.TrimSuffix(f.fileName, ".sig")):
+		// the merged databases are unsigned
+		http.NotFound(w, req)
+		return nil
+	default:
+		return serveRepoFile(w, req, newRequestedFile(c, mergedFileOwner(c, f), f.pathAtRepo, f.fileName))
+	}
+}
+
+// forgetMergedDBs removes the generated databases of repos that are not
+// merged repos of c anymore.
+func forgetMergedDBs(c *Config) {
+	mergedRepoMutex.Lock()
+	defer mergedRepoMutex.Unlock()
+	for key := range mergedDBs {
+		repoName, _, _ := strings.Cut(key, "/")
+		if repo := c.Repos[repoName]; repo == nil || !repo.isMerged() {
+			delete(mergedDBs, key)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(c.CacheDir, mergedReposDir))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if repo := c.Repos[e.Name()]; repo == nil || !repo.isMerged() {
+			if err := os.RemoveAll(filepath.Join(c.CacheDir, mergedReposDir, e.Name())); err != nil {
+				log.Printf("Unable to remove the merged databases of %v: %v", e.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// setupMergedRepo configures the merged repo "merged" of the local repo
+// "overrides" with foo 1.0-1 over the upstream repo "upstream", whose
+// core.db lists foo 2.0-1 and bar 1.0-1.
+func setupMergedRepo(t *testing.T) string {
+	serverDir := t.TempDir()
+	upstreamDir := filepath.Join(serverDir, "core", "os", "x86_64")
+	require.NoError(t, os.MkdirAll(upstreamDir, os.ModePerm))
+	createDbTarball(t, filepath.Join(upstreamDir, "core.db"), []testTarDB{
+		fooDesc("2.0-1", "x86_64"),
+		{PkgName: "bar-1.0-1", Content: "%FILENAME%\nbar-1.0-1-x86_64.pkg.tar.zst\n\n%NAME%\nbar\n\n%VERSION%\n1.0-1\n\n"},
+	})
+	require.NoError(t, os.WriteFile(filepath.Join(upstreamDir, "bar-1.0-1-x86_64.pkg.tar.zst"), []byte("bar from upstream"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(upstreamDir, "baz-1.0-1-x86_64.pkg.tar.zst"), []byte("baz from upstream"), 0o644))
+	upstream := httptest.NewServer(http.FileServer(http.Dir(serverDir)))
+	t.Cleanup(upstream.Close)
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir: cacheDir,
+		Port:     -1,
+		Repos: map[string]*Repo{
+			"upstream":  {URL: upstream.URL},
+			"overrides": {Local: true},
+			"merged":    {Merge: []string{"overrides", "upstream"}},
+		},
+	})
+	t.Cleanup(func() { forgetMergedDBs(&Config{CacheDir: cacheDir}) })
+
+	_, err := uploadLocalFile(config.Load(), "overrides", "foo-1.0-1-x86_64.pkg.tar.zst", bytes.NewReader(createTestPackage(t, fooPkgInfo("1.0-1"))))
+	require.NoError(t, err)
+	return cacheDir
+}
+
+func mergedRequest(t *testing.T, urlPath string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, httptest.NewRequest(http.MethodGet, urlPath, nil)))
+	return w
+}
+
+// mergedDBFileNames requests a merged database and returns the package
+// files it lists.
+func mergedDBFileNames(t *testing.T, urlPath string) []string {
+	w := mergedRequest(t, urlPath)
+	require.Equal(t, http.StatusOK, w.Code)
+	entries, err := readRepoDB("core.db", bytes.NewReader(w.Body.Bytes()))
+	require.NoError(t, err)
+	var fileNames []string
+	for _, e := range entries {
+		fileNames = append(fileNames, e.FileName)
+	}
+	return fileNames
+}
+
+func TestMergedRepoDB(t *testing.T) {
+	cacheDir := setupMergedRepo(t)
+
+	fileNames := mergedDBFileNames(t, "/repo/merged/core/os/x86_64/core.db")
+	require.ElementsMatch(t, []string{"foo-1.0-1-x86_64.pkg.tar.zst", "bar-1.0-1-x86_64.pkg.tar.zst"}, fileNames, "the first repo takes priority")
+
+	// the merged database is only generated again once a source changes
+	dbPath := filepath.Join(cacheDir, mergedReposDir, "merged", "core.db")
+	before, err := os.Stat(dbPath)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, mergedRequest(t, "/repo/merged/core/os/x86_64/core.db").Code)
+	after, err := os.Stat(dbPath)
+	require.NoError(t, err)
+	require.Equal(t, before.ModTime(), after.ModTime())
+	require.True(t, os.SameFile(before, after))
+
+	_, err = uploadLocalFile(config.Load(), "overrides", "foo-1.1-1-x86_64.pkg.tar.zst", bytes.NewReader(createTestPackage(t, fooPkgInfo("1.1-1"))))
+	require.NoError(t, err)
+	fileNames = mergedDBFileNames(t, "/repo/merged/core/os/x86_64/core.db")
+	require.ElementsMatch(t, []string{"foo-1.1-1-x86_64.pkg.tar.zst", "bar-1.0-1-x86_64.pkg.tar.zst"}, fileNames)
+
+	// the merged databases are unsigned
+	require.Equal(t, http.StatusNotFound, mergedRequest(t, "/repo/merged/core/os/x86_64/core.db.sig").Code)
+}
+
+func TestMergedRepoPackages(t *testing.T) {
+	setupMergedRepo(t)
+	require.Equal(t, http.StatusOK, mergedRequest(t, "/repo/merged/core/os/x86_64/core.db").Code)
+
+	w := mergedRequest(t, "/repo/merged/core/os/x86_64/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, createTestPackage(t, fooPkgInfo("1.0-1")), w.Body.Bytes(), "served from the local repo")
+
+	w = mergedRequest(t, "/repo/merged/core/os/x86_64/bar-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "bar from upstream", w.Body.String())
+	_, err := config.Load().cacheStorage().Stat("upstream", "bar-1.0-1-x86_64.pkg.tar.zst")
+	require.NoError(t, err, "cached for the upstream repo")
+
+	// files no database lists resolve through the repos in order
+	w = mergedRequest(t, "/repo/merged/core/os/x86_64/baz-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "baz from upstream", w.Body.String())
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Package metadata. The desc entries of the repo databases in the cache are
+// kept in an SQLite database of their own (the prefetch database only
+// exists with prefetching enabled), so that the admin API can tell what
+// packages and versions the configured repos offer.
+
+// metadataDB holds the package metadata, nil until main opens it.
+var metadataDB atomic.Pointer[gorm.DB]
+
+// PackageMetadata is the desc entry of a package in a repo database.
+type PackageMetadata struct {
+	RepoName    string    `gorm:"primaryKey;not null" json:"repo"`
+	DBName      string    `gorm:"primaryKey;not null" json:"database"` // file name of the database in the repo
+	Name        string    `gorm:"primaryKey;not null;index" json:"name"`
+	Version     string    `gorm:"not null" json:"version"`
+	Arch        string    `json:"arch"`
+	FileName    string    `json:"filename"`
+	Description string    `json:"description"`
+	Depends     []string  `gorm:"serializer:json" json:"depends"`
+	Provides    []string  `gorm:"serializer:json" json:"provides"`
+	BuildDate   time.Time `json:"build_date"`
+	Packager    string    `json:"packager"`
+	CSize       int64     `json:"csize"`
+	ISize       int64     `json:"isize"`
+	SHA256Sum   string    `json:"sha256sum"`
+}
+
+// MetadataDB records the revision of a cached repo database whose entries
+// are in the package_metadata table, so that it is only parsed again once
+// it changed.
+type MetadataDB struct {
+	RepoName string `gorm:"primaryKey;not null"`
+	DBName   string `gorm:"primaryKey;not null"`
+	Size     int64
+	ModTime  time.Time
+}
+
+// openMetadataDB opens the metadata database in cacheDir, creating its
+// tables if needed.
+func openMetadataDB(cacheDir string) (*gorm.DB, error) {
+	dbPath := filepath.Join(cacheDir, DefaultMetadataDBName)
+	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	// the entries of a database are replaced by several goroutines, SQLite
+	// takes one writer at a time
+	sqlDB.SetMaxOpenConns(1)
+	if err := db.AutoMigrate(&PackageMetadata{}, &MetadataDB{}); err != nil {
+		_ = sqlDB.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// parsePackageMetadata reads the desc entries of a compressed repo
+// database.
+func parsePackageMetadata(name string, f io.ReadSeeker) ([]PackageMetadata, error) {
+	r, err := newDecompressReader(name, f, databaseSizeLimit)
+	if err != nil {
+		return nil, err
+	}
+	var packages []PackageMetadata
+	err = walkRepoDBTar(r, func(entryName string, desc string) error {
+		if path.Base(entryName) != "desc" {
+			return nil
+		}
+		fields := parseDescFields(desc)
+		field := func(name string) string {
+			return strings.Join(fields[name], "\n")
+		}
+		pkg := PackageMetadata{
+			Name:        field("NAME"),
+			Version:     field("VERSION"),
+			Arch:        field("ARCH"),
+			FileName:    field("FILENAME"),
+			Description: field("DESC"),
+			Depends:     fields["DEPENDS"],
+			Provides:    fields["PROVIDES"],
+			Packager:    field("PACKAGER"),
+			SHA256Sum:   field("SHA256SUM"),
+		}
+		if pkg.Name == "" {
+			log.Printf("Skipping %v of %v as it has no name", entryName, name)
+			return nil
+		}
+		if buildDate, err := strconv.ParseInt(field("BUILDDATE"), 10, 64); err == nil {
+			pkg.BuildDate = time.Unix(buildDate, 0).UTC()
+		}
+		pkg.CSize, _ = strconv.ParseInt(field("CSIZE"), 10, 64)
+		pkg.ISize, _ = strconv.ParseInt(field("ISIZE"), 10, 64)
+		packages = append(packages, pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// updateRepoDBMetadata stores the entries of a cached repo database,
+// unless the stored ones are from the same revision.
+func updateRepoDBMetadata(db *gorm.DB, storage Storage, repoName string, dbName string) error {
+	cached, err := storage.Stat(repoName, dbName)
+	if err != nil {
+		return err
+	}
+	var stored MetadataDB
+	err = db.Where("repo_name = ? AND db_name = ?", repoName, dbName).First(&stored).Error
+	if err == nil && stored.Size == cached.Size && stored.ModTime.Equal(cached.ModTime) {
+		return nil
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	f, err := storage.Open(repoName, dbName)
+	if err != nil {
+		return err
+	}
+	packages, err := parsePackageMetadata(repoName+"/"+dbName, f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	for i := range packages {
+		packages[i].RepoName = repoName
+		packages[i].DBName = dbName
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("repo_name = ? AND db_name = ?", repoName, dbName).Delete(&PackageMetadata{}).Error; err != nil {
+			return err
+		}
+		if len(packages) > 0 {
+			if err := tx.CreateInBatches(packages, 500).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&MetadataDB{RepoName: repoName, DBName: dbName, Size: cached.Size, ModTime: cached.ModTime}).Error
+	})
+}
+
+// loadRepoDBMetadata stores the entries of a repo database that landed in
+// the cache.
+func loadRepoDBMetadata(storage Storage, repoName string, dbName string) {
+	db := metadataDB.Load()
+	if db == nil {
+		return
+	}
+	if err := updateRepoDBMetadata(db, storage, repoName, dbName); err != nil {
+		log.Printf("Unable to store the package metadata of %v/%v: %v", repoName, dbName, err)
+	}
+}
+
+// loadCachedMetadata brings the metadata of a repo up to date with the
+// databases in its cache: it stores the entries of new or changed
+// databases and drops those of databases that are not cached anymore.
+func loadCachedMetadata(storage Storage, repoName string) {
+	db := metadataDB.Load()
+	if db == nil {
+		return
+	}
+	files, err := storage.List(repoName)
+	if err != nil {
+		return
+	}
+	var dbNames []string
+	for _, f := range files {
+		if path.Ext(f.Name) == ".db" {
+			dbNames = append(dbNames, f.Name)
+			loadRepoDBMetadata(storage, repoName, f.Name)
+		}
+	}
+	if err := dropMetadata(db, repoName, dbNames); err != nil {
+		log.Printf("Unable to drop the package metadata of %v: %v", repoName, err)
+	}
+}
+
+// dropMetadata deletes the metadata of the repo's databases other than
+// keepDBs.
+func dropMetadata(db *gorm.DB, repoName string, keepDBs []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		pkgs := tx.Where("repo_name = ?", repoName)
+		dbs := tx.Where("repo_name = ?", repoName)
+		if len(keepDBs) > 0 {
+			pkgs = pkgs.Where("db_name NOT IN ?", keepDBs)
+			dbs = dbs.Where("db_name NOT IN ?", keepDBs)
+		}
+		if err := pkgs.Delete(&PackageMetadata{}).Error; err != nil {
+			return err
+		}
+		return dbs.Delete(&MetadataDB{}).Error
+	})
+}
+
+// dropUnconfiguredMetadata deletes the metadata of repos that are not
+// configured anymore.
+func dropUnconfiguredMetadata(db *gorm.DB, c *Config) error {
+	var repoNames []string
+	if err := db.Model(&MetadataDB{}).Distinct().Pluck("repo_name", &repoNames).Error; err != nil {
+		return err
+	}
+	for _, repoName := range repoNames {
+		if c.Repos[repoName] == nil {
+			if err := dropMetadata(db, repoName, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findPackageMetadata returns the entries of a package in the databases of
+// the configured repos, the newest version first.
+func findPackageMetadata(db *gorm.DB, c *Config, name string) ([]PackageMetadata, error) {
+	var packages []PackageMetadata
+	if err := db.Where("name = ?", name).Find(&packages).Error; err != nil {
+		return nil, err
+	}
+	packages = slices.DeleteFunc(packages, func(p PackageMetadata) bool {
+		return c.Repos[p.RepoName] == nil
+	})
+	sortNewestFirst(packages, func(p PackageMetadata) (string, string) {
+		return p.Version, p.RepoName + "/" + p.DBName
+	})
+	return packages, nil
+}
+
+// sortNewestFirst sorts s by version, newest first, and by a tie breaker,
+// both returned by key.
+func sortNewestFirst[T any](s []T, key func(T) (version string, tieBreaker string)) {
+	slices.SortFunc(s, func(a, b T) int {
+		versionA, tieA := key(a)
+		versionB, tieB := key(b)
+		if ret := vercmp(versionB, versionA); ret != 0 {
+			return ret
+		}
+		return strings.Compare(tieA, tieB)
+	})
+}
+
+// cachedPackageVersion is a cached file of a package.
+type cachedPackageVersion struct {
+	Repo       string    `json:"repo"`
+	File       string    `json:"file"`
+	Version    string    `json:"version"`
+	Arch       string    `json:"arch"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// findCachedVersions lists the cached package files of a package in all
+// configured repos, the newest version first. Signatures are left out.
+func findCachedVersions(c *Config, name string) ([]cachedPackageVersion, error) {
+	cached := []cachedPackageVersion{}
+	for repoName := range c.Repos {
+		files, err := c.repoStorage(repoName).List(repoName)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			matches := filenameRegex.FindStringSubmatch(f.Name)
+			if matches == nil || matches[1] != name || strings.HasSuffix(f.Name, ".sig") {
+				continue
+			}
+			cached = append(cached, cachedPackageVersion{
+				Repo:       repoName,
+				File:       f.Name,
+				Version:    matches[2],
+				Arch:       matches[3],
+				Size:       f.Size,
+				LastAccess: f.AccessTime,
+			})
+		}
+	}
+	sortNewestFirst(cached, func(v cachedPackageVersion) (string, string) {
+		return v.Version, v.Repo + "/" + v.File
+	})
+	return cached, nil
+}
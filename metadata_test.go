@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fooDesc(version string, arch string) testTarDB {
+	return testTarDB{
+		PkgName: "foo-" + version,
+		Content: `%FILENAME%
+foo-` + version + "-" + arch + `.pkg.tar.zst
+
+%NAME%
+foo
+
+%VERSION%
+` + version + `
+
+%DESC%
+The foo tool
+
+%CSIZE%
+1234
+
+%ISIZE%
+5678
+
+%SHA256SUM%
+4f2d1e7c1a7cbd2d7a0b7d3d0a4e8a2f9b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e
+
+%ARCH%
+` + arch + `
+
+%BUILDDATE%
+1700000000
+
+%PACKAGER%
+Foo Maintainer <foo@example.com>
+
+%DEPENDS%
+glibc
+bar>=2.0
+
+%PROVIDES%
+libfoo.so=1-64
+
+`,
+	}
+}
+
+// useMetadataDB opens a metadata database in cacheDir for the rest of the
+// test.
+func useMetadataDB(t *testing.T, cacheDir string) {
+	db, err := openMetadataDB(cacheDir)
+	require.NoError(t, err)
+	metadataDB.Store(db)
+	t.Cleanup(func() {
+		closeMetadataDB()
+		metadataDB.Store(nil)
+	})
+}
+
+func writeRepoDB(t *testing.T, cacheDir string, repoName string, dbName string, modTime time.Time, content []testTarDB) string {
+	dbPath := filepath.Join(cacheDir, "pkgs", repoName, dbName)
+	require.NoError(t, os.MkdirAll(filepath.Dir(dbPath), os.ModePerm))
+	createDbTarball(t, dbPath, content)
+	require.NoError(t, os.Chtimes(dbPath, modTime, modTime))
+	return dbPath
+}
+
+func TestPackageMetadata(t *testing.T) {
+	cacheDir := t.TempDir()
+	config.Store(&Config{CacheDir: cacheDir, Repos: map[string]*Repo{"meta-repo": {}}})
+	useMetadataDB(t, cacheDir)
+	storage := config.Load().cacheStorage()
+
+	dbPath := writeRepoDB(t, cacheDir, "meta-repo", "core.db", time.Unix(1700000000, 0), []testTarDB{fooDesc("1.0-1", "x86_64")})
+	loadCachedMetadata(storage, "meta-repo")
+	packages, err := findPackageMetadata(metadataDB.Load(), config.Load(), "foo")
+	require.NoError(t, err)
+	require.Equal(t, []PackageMetadata{{
+		RepoName:    "meta-repo",
+		DBName:      "core.db",
+		Name:        "foo",
+		Version:     "1.0-1",
+		Arch:        "x86_64",
+		FileName:    "foo-1.0-1-x86_64.pkg.tar.zst",
+		Description: "The foo tool",
+		Depends:     []string{"glibc", "bar>=2.0"},
+		Provides:    []string{"libfoo.so=1-64"},
+		BuildDate:   time.Unix(1700000000, 0).UTC(),
+		Packager:    "Foo Maintainer <foo@example.com>",
+		CSize:       1234,
+		ISize:       5678,
+		SHA256Sum:   "4f2d1e7c1a7cbd2d7a0b7d3d0a4e8a2f9b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e",
+	}}, packages)
+
+	// an updated database replaces the entries of the old one
+	writeRepoDB(t, cacheDir, "meta-repo", "core.db", time.Unix(1700001000, 0), []testTarDB{fooDesc("1.1-1", "x86_64")})
+	loadRepoDBMetadata(storage, "meta-repo", "core.db")
+	writeRepoDB(t, cacheDir, "meta-repo", "testing.db", time.Unix(1700001000, 0), []testTarDB{fooDesc("1.10-1", "x86_64")})
+	loadRepoDBMetadata(storage, "meta-repo", "testing.db")
+	packages, err = findPackageMetadata(metadataDB.Load(), config.Load(), "foo")
+	require.NoError(t, err)
+	require.Len(t, packages, 2)
+	require.Equal(t, "1.10-1", packages[0].Version, "the newest version comes first")
+	require.Equal(t, "1.1-1", packages[1].Version)
+
+	// the entries of a database that is not cached anymore are dropped
+	require.NoError(t, os.Remove(dbPath))
+	loadCachedMetadata(storage, "meta-repo")
+	packages, err = findPackageMetadata(metadataDB.Load(), config.Load(), "foo")
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	require.Equal(t, "testing.db", packages[0].DBName)
+
+	// and so are those of removed repos
+	config.Store(&Config{CacheDir: cacheDir, Repos: map[string]*Repo{"other-repo": {}}})
+	require.NoError(t, dropUnconfiguredMetadata(metadataDB.Load(), config.Load()))
+	var count int64
+	require.NoError(t, metadataDB.Load().Model(&PackageMetadata{}).Count(&count).Error)
+	require.Zero(t, count)
+}
+
+func TestAPIPackages(t *testing.T) {
+	cacheDir := setupAPIConfig(t)
+	useMetadataDB(t, cacheDir)
+	writeRepoDB(t, cacheDir, "api-repo", "core.db", time.Now(), []testTarDB{fooDesc("1.1-1", "x86_64")})
+	writeRepoDB(t, cacheDir, "empty-repo", "core.db", time.Now(), []testTarDB{fooDesc("1.2-1", "x86_64")})
+	for repoName := range config.Load().Repos {
+		loadCachedMetadata(config.Load().cacheStorage(), repoName)
+	}
+
+	w := apiRequest(t, http.MethodGet, "/api/v1/packages/foo", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	packages := decodeAPIResponse[[]PackageMetadata](t, w)
+	require.Len(t, packages, 2)
+	require.Equal(t, "empty-repo", packages[0].RepoName)
+	require.Equal(t, []string{"glibc", "bar>=2.0"}, packages[0].Depends)
+	require.Equal(t, http.StatusNotFound, apiRequest(t, http.MethodGet, "/api/v1/packages/bar", testAdminToken).Code)
+
+	w = apiRequest(t, http.MethodGet, "/api/v1/packages/foo/versions", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []apiPackageVersion{
+		{Repo: "empty-repo", Database: "core.db", Version: "1.2-1", Arch: "x86_64"},
+		{Repo: "api-repo", Database: "core.db", Version: "1.1-1", Arch: "x86_64", Cached: true},
+	}, decodeAPIResponse[[]apiPackageVersion](t, w))
+
+	w = apiRequest(t, http.MethodGet, "/api/v1/packages/foo/cached", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	cached := decodeAPIResponse[[]cachedPackageVersion](t, w)
+	require.Len(t, cached, 2, "signatures are not listed")
+	require.Equal(t, "foo-1.1-1-x86_64.pkg.tar.zst", cached[0].File)
+	require.Equal(t, int64(5), cached[0].Size)
+	require.Equal(t, "1.0-1", cached[1].Version)
+
+	// read-only lookups, which need no admin token; with auth, clients need
+	// credentials and only see their repos
+	require.Equal(t, http.StatusOK, apiRequest(t, http.MethodGet, "/api/v1/packages/foo", "").Code)
+	config.Load().Auth = &Auth{
+		Tokens: map[string]string{"ci": "ci-token"},
+		Repos:  map[string][]string{"ci": {"empty-repo"}},
+	}
+	for _, urlPath := range []string{"/api/v1/packages/foo", "/api/v1/packages/foo/versions", "/api/v1/packages/foo/cached"} {
+		require.Equal(t, http.StatusUnauthorized, apiRequest(t, http.MethodGet, urlPath, "").Code, urlPath)
+	}
+	packages = decodeAPIResponse[[]PackageMetadata](t, apiRequest(t, http.MethodGet, "/api/v1/packages/foo", "ci-token"))
+	require.Len(t, packages, 1)
+	require.Equal(t, "empty-repo", packages[0].RepoName)
+	versions := decodeAPIResponse[[]apiPackageVersion](t, apiRequest(t, http.MethodGet, "/api/v1/packages/foo/versions", "ci-token"))
+	require.Equal(t, []apiPackageVersion{{Repo: "empty-repo", Database: "core.db", Version: "1.2-1", Arch: "x86_64"}}, versions)
+	require.Empty(t, decodeAPIResponse[[]cachedPackageVersion](t, apiRequest(t, http.MethodGet, "/api/v1/packages/foo/cached", "ci-token")))
+	config.Load().Auth.Repos["ci"] = nil
+	require.Equal(t, http.StatusNotFound, apiRequest(t, http.MethodGet, "/api/v1/packages/foo", "ci-token").Code)
+
+	closeMetadataDB()
+	metadataDB.Store(nil)
+	require.Equal(t, http.StatusServiceUnavailable, apiRequest(t, http.MethodGet, "/api/v1/packages/foo", testAdminToken).Code)
+}
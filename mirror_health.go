@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Mirror health tracking. Every transfer from an upstream updates the
+// health of its mirror; Downloader.download tries the mirrors of a repo
+// ordered by it instead of by list position, so that a slow or flaky mirror
+// stops costing every cache miss a timeout before the failover.
+const (
+	// healthSmoothing is the weight of the latest transfer in the moving
+	// averages.
+	healthSmoothing = 0.3
+	// healthReferenceSize is the transfer size the score estimates the
+	// download time of.
+	healthReferenceSize = 1024 * 1024
+	// minThroughputSample is the smallest body that says something about
+	// the bandwidth of a mirror rather than about its latency.
+	minThroughputSample = 64 * 1024
+	// failedMirrorPenalty stands in for the transfer time of a mirror that
+	// never completed a transfer.
+	failedMirrorPenalty = time.Second
+)
+
+// Failing mirrors are skipped for mirrorBackoffBase after the first
+// failure, doubling with every further consecutive failure up to
+// mirrorBackoffMax (variables only to allow shortening them in tests).
+var (
+	mirrorBackoffBase = 10 * time.Second
+	mirrorBackoffMax  = 10 * time.Minute
+)
+
+var (
+	mirrorScoreGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pacoloco_mirror_score",
+		Help: "Estimated seconds to download 1 MiB from the mirror, weighted by its error rate; lower is better",
+	}, []string{"upstream"})
+	mirrorLatencyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pacoloco_mirror_latency_seconds",
+		Help: "Moving average of the time until the mirror returns response headers",
+	}, []string{"upstream"})
+	mirrorThroughputGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pacoloco_mirror_throughput_bytes_per_second",
+		Help: "Moving average of the mirror download throughput",
+	}, []string{"upstream"})
+	mirrorErrorRateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pacoloco_mirror_error_rate",
+		Help: "Moving average of the share of failed transfers from the mirror",
+	}, []string{"upstream"})
+	mirrorStallsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pacoloco_mirror_stalls_total",
+		Help: "Number of transfers from the mirror aborted because they stopped making progress",
+	}, []string{"upstream"})
+)
+
+// transferStats describes one attempt to download a file from a mirror.
+type transferStats struct {
+	latency      time.Duration // until the response headers arrived, 0 if they did not
+	bodyBytes    int64
+	bodyDuration time.Duration
+	stalled      atomic.Bool // set by the stall watchdog
+}
+
+type mirrorHealth struct {
+	latency             float64 // seconds
+	throughput          float64 // bytes per second, 0 while unknown
+	errorRate           float64
+	successes           int64
+	failures            int64
+	stalls              int64
+	consecutiveFailures int
+	backoffUntil        time.Time
+}
+
+var (
+	mirrorHealths      = make(map[string]*mirrorHealth) // the key is the mirror URL
+	mirrorHealthsMutex sync.Mutex
+)
+
+func smooth(avg float64, sample float64, first bool) float64 {
+	if first {
+		return sample
+	}
+	return avg + healthSmoothing*(sample-avg)
+}
+
+// score estimates the seconds a download of healthReferenceSize takes from
+// the mirror, inflated by how often the mirror fails. Lower is better.
+func (h *mirrorHealth) score() float64 {
+	expected := failedMirrorPenalty.Seconds()
+	if h.successes > 0 {
+		expected = h.latency
+		if h.throughput > 0 {
+			expected += healthReferenceSize / h.throughput
+		}
+	}
+	return expected * (1 + 10*h.errorRate)
+}
+
+// isMirrorFailure reports whether a transfer failed because of the mirror:
+// a transport error, a timeout, a stall or a server error. An answer about
+// the file only, such as a 404 for a package the mirror does not have yet,
+// or a file that changed under a resumed download, is no failure, and
+// neither is a failure of the local storage.
+func isMirrorFailure(err error) bool {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= http.StatusInternalServerError
+	}
+	return !errors.Is(err, errCannotResume) && !errors.Is(err, errChecksumMismatch) && !errors.Is(err, errSignatureInvalid) && !errors.Is(err, errLocalStorage)
+}
+
+// recordMirrorTransfer updates the health of a mirror with the outcome of
+// a transfer from it. A transfer that failed without it being the fault of
+// the mirror, see isMirrorFailure, only contributes its timings.
+func recordMirrorTransfer(mirrorURL string, stats *transferStats, err error) {
+	mirrorHealthsMutex.Lock()
+	defer mirrorHealthsMutex.Unlock()
+
+	h := mirrorHealths[mirrorURL]
+	if h == nil {
+		h = &mirrorHealth{}
+		mirrorHealths[mirrorURL] = h
+	}
+	first := h.successes+h.failures == 0
+
+	if stats.latency > 0 {
+		h.latency = smooth(h.latency, stats.latency.Seconds(), h.successes == 0)
+	}
+	if stats.bodyBytes >= minThroughputSample && stats.bodyDuration > 0 {
+		h.throughput = smooth(h.throughput, float64(stats.bodyBytes)/stats.bodyDuration.Seconds(), h.throughput == 0)
+	}
+	switch {
+	case err == nil:
+		h.successes++
+		h.errorRate = smooth(h.errorRate, 0, first)
+		h.consecutiveFailures = 0
+		h.backoffUntil = time.Time{}
+	case isMirrorFailure(err):
+		h.failures++
+		h.errorRate = smooth(h.errorRate, 1, first)
+		h.consecutiveFailures++
+		backoff := mirrorBackoffBase << min(h.consecutiveFailures-1, 16)
+		h.backoffUntil = time.Now().Add(min(backoff, mirrorBackoffMax))
+		if stats.stalled.Load() {
+			h.stalls++
+			mirrorStallsCounter.WithLabelValues(mirrorURL).Inc()
+		}
+	}
+
+	mirrorScoreGauge.WithLabelValues(mirrorURL).Set(h.score())
+	mirrorLatencyGauge.WithLabelValues(mirrorURL).Set(h.latency)
+	mirrorThroughputGauge.WithLabelValues(mirrorURL).Set(h.throughput)
+	mirrorErrorRateGauge.WithLabelValues(mirrorURL).Set(h.errorRate)
+}
+
+// orderMirrors sorts mirror URLs by how fast they are expected to deliver.
+// Mirrors without any transfers yet come first, in list order, so that they
+// get measured. Mirrors backing off after failures go last: they are only
+// tried when every other mirror failed as well.
+func orderMirrors(urls []string) []string {
+	mirrorHealthsMutex.Lock()
+	defer mirrorHealthsMutex.Unlock()
+
+	now := time.Now()
+	rank := func(u string) (backingOff bool, score float64) {
+		h := mirrorHealths[u]
+		if h == nil {
+			return false, math.Inf(-1)
+		}
+		return now.Before(h.backoffUntil), h.score()
+	}
+
+	ordered := slices.Clone(urls)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		aOff, aScore := rank(a)
+		bOff, bScore := rank(b)
+		if aOff != bOff {
+			if aOff {
+				return 1
+			}
+			return -1
+		}
+		switch {
+		case aScore < bScore:
+			return -1
+		case aScore > bScore:
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+type apiMirror struct {
+	Repo                string    `json:"repo"`
+	URL                 string    `json:"url"`
+	Score               *float64  `json:"score"` // null while the mirror is unmeasured
+	LatencySeconds      float64   `json:"latency_seconds"`
+	ThroughputBytes     float64   `json:"throughput_bytes_per_second"`
+	ErrorRate           float64   `json:"error_rate"`
+	Successes           int64     `json:"successes"`
+	Failures            int64     `json:"failures"`
+	Stalls              int64     `json:"stalls"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	BackoffUntil        time.Time `json:"backoff_until,omitzero"`
+}
+
+// apiListMirrors reports the health of the mirrors of every repo, in the
+// order the next download would try them.
+func apiListMirrors(w http.ResponseWriter, req *http.Request) {
+	c := config.Load()
+	names := make([]string, 0, len(c.Repos))
+	for name := range c.Repos {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	mirrors := []apiMirror{}
+	for _, name := range names {
+		for _, u := range orderMirrors(c.Repos[name].getUrls()) {
+			m := apiMirror{Repo: name, URL: u}
+			mirrorHealthsMutex.Lock()
+			if h := mirrorHealths[u]; h != nil {
+				score := h.score()
+				m.Score = &score
+				m.LatencySeconds = h.latency
+				m.ThroughputBytes = h.throughput
+				m.ErrorRate = h.errorRate
+				m.Successes = h.successes
+				m.Failures = h.failures
+				m.Stalls = h.stalls
+				m.ConsecutiveFailures = h.consecutiveFailures
+				if time.Now().Before(h.backoffUntil) {
+					m.BackoffUntil = h.backoffUntil
+				}
+			}
+			mirrorHealthsMutex.Unlock()
+			mirrors = append(mirrors, m)
+		}
+	}
+	writeJSON(w, http.StatusOK, mirrors)
+}
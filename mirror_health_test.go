@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func resetMirrorHealth(t *testing.T) {
+	mirrorHealthsMutex.Lock()
+	mirrorHealths = make(map[string]*mirrorHealth)
+	mirrorHealthsMutex.Unlock()
+	t.Cleanup(func() {
+		mirrorHealthsMutex.Lock()
+		mirrorHealths = make(map[string]*mirrorHealth)
+		mirrorHealthsMutex.Unlock()
+	})
+}
+
+func TestOrderMirrors(t *testing.T) {
+	resetMirrorHealth(t)
+	const slow, fast, failing, unknown = "http://slow", "http://fast", "http://failing", "http://unknown"
+
+	recordMirrorTransfer(slow, &transferStats{latency: 2 * time.Second}, nil)
+	recordMirrorTransfer(fast, &transferStats{latency: 50 * time.Millisecond, bodyBytes: 10 << 20, bodyDuration: time.Second}, nil)
+	recordMirrorTransfer(failing, &transferStats{}, errors.New("connection refused"))
+
+	require.Equal(t, []string{unknown, fast, slow, failing}, orderMirrors([]string{failing, slow, unknown, fast}))
+}
+
+func TestNeutralTransferErrors(t *testing.T) {
+	resetMirrorHealth(t)
+	const mirror = "http://mirror"
+
+	neutral := []error{
+		&upstreamStatusError{url: mirror + "/missing-1-1-any.pkg.tar.zst", statusCode: http.StatusNotFound},
+		&upstreamStatusError{url: mirror + "/private-1-1-any.pkg.tar.zst", statusCode: http.StatusForbidden},
+		fmt.Errorf("resuming %v: %w", mirror, fmt.Errorf("%w: file size changed from 10 to 12", errCannotResume)),
+	}
+	for _, err := range neutral {
+		require.False(t, isMirrorFailure(err), err.Error())
+		recordMirrorTransfer(mirror, &transferStats{latency: time.Millisecond}, err)
+	}
+	mirrorHealthsMutex.Lock()
+	require.Zero(t, mirrorHealths[mirror].failures)
+	require.True(t, mirrorHealths[mirror].backoffUntil.IsZero())
+	mirrorHealthsMutex.Unlock()
+
+	require.True(t, isMirrorFailure(&upstreamStatusError{url: mirror, statusCode: http.StatusBadGateway}))
+	require.True(t, isMirrorFailure(fmt.Errorf("%w: %w", errCannotResume, &upstreamStatusError{url: mirror, statusCode: http.StatusServiceUnavailable})))
+	require.True(t, isMirrorFailure(errors.New("connection refused")))
+	require.True(t, isMirrorFailure(context.DeadlineExceeded))
+}
+
+// failingCommitStorage is a Storage that cannot keep any file.
+type failingCommitStorage struct {
+	Storage
+}
+
+func (failingCommitStorage) Commit(repo, name string, buffer *os.File, modTime time.Time) error {
+	return errors.New("no space left on device")
+}
+
+// TestCommitFailureKeepsMirrorHealthy verifies that a download the cache
+// cannot keep does not count against the mirror it came from.
+func TestCommitFailureKeepsMirrorHealthy(t *testing.T) {
+	resetMirrorHealth(t)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("package content"))
+	}))
+	defer mirror.Close()
+
+	config.Store(&Config{CacheDir: t.TempDir(), Port: -1, DownloadTimeout: 10})
+	bufferFile, err := os.CreateTemp(t.TempDir(), ".downloading-*")
+	require.NoError(t, err)
+	defer bufferFile.Close()
+	d := &Downloader{
+		config:     config.Load(),
+		repoName:   "health-repo",
+		repo:       &Repo{URL: mirror.URL},
+		urlPath:    "/kept-1-1-any.pkg.tar.zst",
+		fileName:   "kept-1-1-any.pkg.tar.zst",
+		storage:    failingCommitStorage{config.Load().cacheStorage()},
+		bufferFile: bufferFile,
+		eventCond:  sync.NewCond(&sync.Mutex{}),
+	}
+	require.Error(t, d.download())
+
+	mirrorHealthsMutex.Lock()
+	defer mirrorHealthsMutex.Unlock()
+	require.Zero(t, mirrorHealths[mirror.URL].failures)
+	require.True(t, mirrorHealths[mirror.URL].backoffUntil.IsZero())
+}
+
+func TestMirrorBackoff(t *testing.T) {
+	resetMirrorHealth(t)
+	oldBase, oldMax := mirrorBackoffBase, mirrorBackoffMax
+	mirrorBackoffBase, mirrorBackoffMax = 100*time.Millisecond, 300*time.Millisecond
+	t.Cleanup(func() { mirrorBackoffBase, mirrorBackoffMax = oldBase, oldMax })
+
+	const flaky, stable = "http://flaky", "http://stable"
+	recordMirrorTransfer(stable, &transferStats{latency: time.Second}, nil)
+	recordMirrorTransfer(flaky, &transferStats{latency: time.Millisecond}, nil)
+	require.Equal(t, []string{flaky, stable}, orderMirrors([]string{stable, flaky}))
+
+	for range 3 {
+		recordMirrorTransfer(flaky, &transferStats{}, errors.New("timeout"))
+	}
+	mirrorHealthsMutex.Lock()
+	backoff := time.Until(mirrorHealths[flaky].backoffUntil)
+	mirrorHealthsMutex.Unlock()
+	require.Greater(t, backoff, 250*time.Millisecond, "the backoff doubles with consecutive failures")
+	require.LessOrEqual(t, backoff, mirrorBackoffMax, "the backoff is capped")
+	require.Equal(t, []string{stable, flaky}, orderMirrors([]string{stable, flaky}))
+
+	// once the backoff expired the mirror competes by score again
+	require.Eventually(t, func() bool {
+		mirrorHealthsMutex.Lock()
+		defer mirrorHealthsMutex.Unlock()
+		return time.Now().After(mirrorHealths[flaky].backoffUntil)
+	}, time.Second, 10*time.Millisecond)
+
+	recordMirrorTransfer(flaky, &transferStats{latency: time.Millisecond}, nil)
+	mirrorHealthsMutex.Lock()
+	require.Zero(t, mirrorHealths[flaky].consecutiveFailures)
+	require.True(t, mirrorHealths[flaky].backoffUntil.IsZero())
+	mirrorHealthsMutex.Unlock()
+}
+
+// TestFailingMirrorIsSkipped verifies that after a mirror failed, the next
+// downloads start with a healthy mirror instead of waiting for the broken
+// one first.
+func TestFailingMirrorIsSkipped(t *testing.T) {
+	resetMirrorHealth(t)
+
+	var brokenHits atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brokenHits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("package content"))
+	}))
+	defer healthy.Close()
+
+	config.Store(&Config{
+		CacheDir:        t.TempDir(),
+		Port:            -1,
+		DownloadTimeout: 10,
+		AdminToken:      testAdminToken,
+		Repos:           map[string]*Repo{"health-repo": {URLs: []string{broken.URL, healthy.URL}}},
+	})
+
+	for _, pkg := range []string{"first-1-1-any.pkg.tar.zst", "second-1-1-any.pkg.tar.zst"} {
+		req := httptest.NewRequest(http.MethodGet, "/repo/health-repo/"+pkg, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, handleRequest(w, req))
+		require.Equal(t, "package content", w.Body.String())
+	}
+	require.Equal(t, int32(1), brokenHits.Load(), "the failing mirror must not be tried first again")
+	require.Equal(t, 1.0, testutil.ToFloat64(mirrorErrorRateGauge.WithLabelValues(broken.URL)))
+	require.Equal(t, 0.0, testutil.ToFloat64(mirrorErrorRateGauge.WithLabelValues(healthy.URL)))
+
+	w := apiRequest(t, http.MethodGet, "/api/v1/mirrors", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	mirrors := decodeAPIResponse[[]apiMirror](t, w)
+	require.Len(t, mirrors, 2)
+	require.Equal(t, healthy.URL, mirrors[0].URL)
+	require.Equal(t, int64(2), mirrors[0].Successes)
+	require.Equal(t, broken.URL, mirrors[1].URL)
+	require.Equal(t, int64(1), mirrors[1].Failures)
+	require.False(t, mirrors[1].BackoffUntil.IsZero())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Orphan GC. A package version is an orphan once none of the repo
+// databases in the cache lists it anymore: clients only install what the
+// databases offer, so nobody will request it again. The GC keeps the
+// keep_versions most recent cached versions of every package regardless,
+// so that a rollback stays possible, and deletes the other orphans that
+// were not accessed for min_age_days.
+
+// orphanGCReport describes the result of an orphan GC run over a repo.
+type orphanGCReport struct {
+	Repo       string   `json:"repo"`
+	DryRun     bool     `json:"dry_run"`
+	Removed    []string `json:"removed"`
+	FreedBytes int64    `json:"freed_bytes"`
+	// Skipped explains why the repo was not collected, if it was not.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// cachedPackage is a cached package file together with its signature.
+type cachedPackage struct {
+	version    string
+	files      []CachedFile
+	lastAccess time.Time
+}
+
+func setupOrphanGCRoutine() *routineTicker {
+	ticker := newRoutineTicker(24 * time.Hour) // collect orphans once a day
+	collect := func() {
+		if c := config.Load(); c.OrphanGC != nil {
+			collectAllOrphans(c, c.OrphanGC.DryRun)
+		}
+	}
+	go func() {
+		collect()
+		for ticker.wait() {
+			collect()
+		}
+	}()
+	return ticker
+}
+
+// collectAllOrphans runs the orphan GC over every repo of the config.
+func collectAllOrphans(c *Config, dryRun bool) []orphanGCReport {
+	repoNames := make([]string, 0, len(c.Repos))
+	for repoName, repo := range c.Repos {
+		if !repo.Local && !repo.isMerged() {
+			repoNames = append(repoNames, repoName)
+		}
+	}
+	slices.Sort(repoNames)
+
+	storage := c.cacheStorage()
+	olderThan := time.Now().Add(-24 * time.Hour * time.Duration(c.OrphanGC.MinAgeDays))
+	reports := make([]orphanGCReport, 0, len(repoNames))
+	for _, repoName := range repoNames {
+		report, err := collectOrphans(storage, repoName, c.OrphanGC.KeepVersions, olderThan, dryRun)
+		if err != nil {
+			log.Printf("Orphan GC of %v skipped: %v", repoName, err)
+			report.Skipped = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// collectOrphans removes the cached versions of the repo's packages that no
+// cached database lists, except the keepVersions most recent versions of
+// each package and versions accessed after olderThan. With dryRun set it
+// only reports what it would remove.
+func collectOrphans(storage Storage, repoName string, keepVersions int, olderThan time.Time, dryRun bool) (orphanGCReport, error) {
+	report := orphanGCReport{Repo: repoName, DryRun: dryRun, Removed: []string{}}
+	files, err := storage.List(repoName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+
+	// Without the databases there is no telling what is an orphan, and a
+	// database that cannot be read could list any of the packages.
+	referenced := make(map[string]bool)
+	databases := 0
+	for _, f := range files {
+		if path.Ext(f.Name) != ".db" {
+			continue
+		}
+		entries, err := readCachedRepoDB(storage, repoName, f.Name)
+		if err != nil {
+			return report, fmt.Errorf("reading %v: %w", f.Name, err)
+		}
+		for _, e := range entries {
+			referenced[e.FileName] = true
+		}
+		databases++
+	}
+	if databases == 0 {
+		return report, errors.New("no database of the repo is cached")
+	}
+
+	// group the package files by package name and architecture, then by
+	// version; a signature goes with its package file
+	packages := make(map[string]map[string]*cachedPackage)
+	for _, f := range files {
+		matches := filenameRegex.FindStringSubmatch(f.Name)
+		if matches == nil || strings.Contains(f.Name, "/") {
+			continue
+		}
+		name := matches[1] + " " + matches[3]
+		if packages[name] == nil {
+			packages[name] = make(map[string]*cachedPackage)
+		}
+		pkgFile := strings.TrimSuffix(f.Name, ".sig")
+		pkg := packages[name][pkgFile]
+		if pkg == nil {
+			pkg = &cachedPackage{version: matches[2]}
+			packages[name][pkgFile] = pkg
+		}
+		pkg.files = append(pkg.files, f)
+		if f.AccessTime.After(pkg.lastAccess) {
+			pkg.lastAccess = f.AccessTime
+		}
+	}
+
+	pinned := pinnedFiles()
+	for _, versions := range packages {
+		pkgFiles := make([]string, 0, len(versions))
+		for pkgFile := range versions {
+			pkgFiles = append(pkgFiles, pkgFile)
+		}
+		// newest first; files of the same version differ in compression
+		slices.SortFunc(pkgFiles, func(a, b string) int {
+			if ret := vercmp(versions[b].version, versions[a].version); ret != 0 {
+				return ret
+			}
+			return strings.Compare(a, b)
+		})
+
+		recency := 0 // how many newer versions are cached
+		for i, pkgFile := range pkgFiles {
+			pkg := versions[pkgFile]
+			if i > 0 && vercmp(pkg.version, versions[pkgFiles[i-1]].version) != 0 {
+				recency++
+			}
+			if recency < keepVersions || referenced[pkgFile] || !pkg.lastAccess.Before(olderThan) || pinned[evictionKey(repoName, pkgFile)] {
+				continue
+			}
+			for _, f := range pkg.files {
+				if !dryRun {
+					if err := deleteCachedFile(storage, repoName, f); err != nil {
+						log.Printf("Orphan GC could not remove %v/%v: %v", repoName, f.Name, err)
+						continue
+					}
+				}
+				report.Removed = append(report.Removed, f.Name)
+				report.FreedBytes += f.Size
+			}
+		}
+	}
+	slices.Sort(report.Removed)
+	if len(report.Removed) > 0 {
+		verb := "removed"
+		if dryRun {
+			verb = "would remove"
+		}
+		log.Printf("Orphan GC of %v %v %d files, %d bytes", repoName, verb, len(report.Removed), report.FreedBytes)
+	}
+	return report, nil
+}
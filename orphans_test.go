@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeOrphanRepo caches a database listing the given package files, and
+// the given cached files, all last accessed two weeks ago.
+func writeOrphanRepo(t *testing.T, cacheDir string, repoName string, listed []string, cached []string) {
+	repoDir := filepath.Join(cacheDir, "pkgs", repoName)
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	var db []testTarDB
+	for _, fileName := range listed {
+		db = append(db, testTarDB{PkgName: strings.TrimSuffix(fileName, ".pkg.tar.zst"), Content: "%FILENAME%\n" + fileName + "\n\n"})
+	}
+	createDbTarball(t, filepath.Join(repoDir, "core.db"), db)
+	for _, fileName := range cached {
+		writeCachedFile(t, cacheDir, repoName, fileName, 10, 14*24*time.Hour)
+	}
+}
+
+func TestCollectOrphans(t *testing.T) {
+	cacheDir := t.TempDir()
+	writeOrphanRepo(t, cacheDir, "gc-repo",
+		[]string{"foo-1.10-1-x86_64.pkg.tar.zst", "bar-2:1.0-1-any.pkg.tar.zst"},
+		[]string{
+			"foo-1.10-1-x86_64.pkg.tar.zst",
+			"foo-1.9-1-x86_64.pkg.tar.zst",
+			"foo-1.9-1-x86_64.pkg.tar.zst.sig",
+			"foo-1.8-2-x86_64.pkg.tar.zst",
+			"foo-1.8-1-x86_64.pkg.tar.xz",
+			"bar-2:1.0-1-any.pkg.tar.zst",
+			"bar-1:9.0-1-any.pkg.tar.zst",
+			// the newest cached version of a package dropped from the repo
+			"gone-1.0-1-any.pkg.tar.zst",
+			"gone-0.9-1-any.pkg.tar.zst",
+		})
+	// a recently used orphan stays until it was not used for a while
+	writeCachedFile(t, cacheDir, "gc-repo", "foo-1.7-1-x86_64.pkg.tar.zst", 10, time.Hour)
+	storage := newFSStorage(filepath.Join(cacheDir, "pkgs"))
+	olderThan := time.Now().Add(-7 * 24 * time.Hour)
+
+	// a dry run only reports
+	report, err := collectOrphans(storage, "gc-repo", 2, olderThan, true)
+	require.NoError(t, err)
+	expected := []string{
+		"foo-1.8-1-x86_64.pkg.tar.xz",
+		"foo-1.8-2-x86_64.pkg.tar.zst",
+	}
+	require.Equal(t, orphanGCReport{Repo: "gc-repo", DryRun: true, Removed: expected, FreedBytes: 20}, report)
+	require.FileExists(t, filepath.Join(cacheDir, "pkgs", "gc-repo", "foo-1.8-2-x86_64.pkg.tar.zst"))
+
+	report, err = collectOrphans(storage, "gc-repo", 1, olderThan, false)
+	require.NoError(t, err)
+	expected = []string{
+		"bar-1:9.0-1-any.pkg.tar.zst",
+		"foo-1.8-1-x86_64.pkg.tar.xz",
+		"foo-1.8-2-x86_64.pkg.tar.zst",
+		"foo-1.9-1-x86_64.pkg.tar.zst",
+		"foo-1.9-1-x86_64.pkg.tar.zst.sig",
+		"gone-0.9-1-any.pkg.tar.zst",
+	}
+	require.Equal(t, orphanGCReport{Repo: "gc-repo", Removed: expected, FreedBytes: 60}, report)
+
+	files, err := storage.List("gc-repo")
+	require.NoError(t, err)
+	var remaining []string
+	for _, f := range files {
+		remaining = append(remaining, f.Name)
+	}
+	require.ElementsMatch(t, []string{
+		"core.db",
+		"foo-1.10-1-x86_64.pkg.tar.zst",
+		"foo-1.7-1-x86_64.pkg.tar.zst",
+		"bar-2:1.0-1-any.pkg.tar.zst",
+		"gone-1.0-1-any.pkg.tar.zst",
+	}, remaining)
+}
+
+func TestCollectOrphansWithoutDatabase(t *testing.T) {
+	cacheDir := t.TempDir()
+	pkg := writeCachedFile(t, cacheDir, "nodb-repo", "foo-1.0-1-any.pkg.tar.zst", 10, 30*24*time.Hour)
+	writeCachedFile(t, cacheDir, "nodb-repo", "foo-1.1-1-any.pkg.tar.zst", 10, 30*24*time.Hour)
+
+	_, err := collectOrphans(newFSStorage(filepath.Join(cacheDir, "pkgs")), "nodb-repo", 1, time.Now(), false)
+	require.Error(t, err, "without a database nothing is known to be an orphan")
+	require.FileExists(t, pkg)
+
+	// an unreadable database could list any of the packages
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "pkgs", "nodb-repo", "broken.db"), []byte("garbage"), 0o644))
+	_, err = collectOrphans(newFSStorage(filepath.Join(cacheDir, "pkgs")), "nodb-repo", 1, time.Now(), false)
+	require.Error(t, err)
+	require.FileExists(t, pkg)
+}
+
+func TestAPIOrphanGC(t *testing.T) {
+	cacheDir := setupAPIConfig(t)
+	require.Equal(t, http.StatusConflict, apiRequest(t, http.MethodPost, "/api/v1/gc", testAdminToken).Code)
+
+	config.Load().OrphanGC = &OrphanGC{KeepVersions: 1, MinAgeDays: 7}
+	writeOrphanRepo(t, cacheDir, "api-repo", []string{"foo-1.1-1-x86_64.pkg.tar.zst"}, []string{
+		"foo-1.0-1-x86_64.pkg.tar.zst",
+		"foo-1.0-1-x86_64.pkg.tar.zst.sig",
+	})
+
+	w := apiRequest(t, http.MethodPost, "/api/v1/gc?dry_run=true", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	reports := decodeAPIResponse[[]orphanGCReport](t, w)
+	require.Len(t, reports, 2)
+	require.Equal(t, orphanGCReport{Repo: "api-repo", DryRun: true, Removed: []string{"foo-1.0-1-x86_64.pkg.tar.zst", "foo-1.0-1-x86_64.pkg.tar.zst.sig"}, FreedBytes: 20}, reports[0])
+	require.Equal(t, "empty-repo", reports[1].Repo)
+	require.FileExists(t, filepath.Join(cacheDir, "pkgs", "api-repo", "foo-1.0-1-x86_64.pkg.tar.zst"))
+
+	w = apiRequest(t, http.MethodPost, "/api/v1/gc", testAdminToken)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoFileExists(t, filepath.Join(cacheDir, "pkgs", "api-repo", "foo-1.0-1-x86_64.pkg.tar.zst"))
+	require.FileExists(t, filepath.Join(cacheDir, "pkgs", "api-repo", "foo-1.1-1-x86_64.pkg.tar.zst"))
+
+	require.Equal(t, http.StatusBadRequest, apiRequest(t, http.MethodPost, "/api/v1/gc?dry_run=maybe", testAdminToken).Code)
+}
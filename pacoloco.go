@@ -1,16 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -41,52 +44,42 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	config, err = parseConfig(yaml)
+	newConfig, err := parseConfig(yaml)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if config.LogTimestamp {
-		log.SetFlags(log.LstdFlags)
-	}
-	if config.Prefetch != nil {
-		prefetchTicker := setupPrefetchTicker()
-		defer prefetchTicker.Stop()
-		setupPrefetch() // enable refresh
-	}
-
-	for repoName := range config.Repos {
-		cachePath := filepath.Join(config.CacheDir, "pkgs", repoName)
-		totalCacheSize, totalPackageCount, err := gatherCacheStats(cachePath)
-		if err != nil {
-			log.Println("Gathering size failed for ", repoName)
-		}
-		cacheSizeGauge.WithLabelValues(repoName).Set(totalCacheSize)
-		cachePackageGauge.WithLabelValues(repoName).Set(totalPackageCount)
-	}
-
-	if config.PurgeFilesAfter != 0 {
-		cleanupTicker := setupPurgeStaleFilesRoutine()
-		defer cleanupTicker.Stop()
-	}
-
-	if config.HttpProxy != "" {
-		proxyUrl, err := url.Parse(config.HttpProxy)
-		if err != nil {
-			log.Fatal(err)
+	sweepOrphanedFiles(newConfig.CacheDir)
+	loadSnapshots(newConfig.CacheDir)
+	accessTimes = loadAccessIndex(filepath.Join(newConfig.CacheDir, accessIndexFileName))
+	accessIndexTicker = setupAccessIndexRoutine()
+	if db, err := openMetadataDB(newConfig.CacheDir); err != nil {
+		log.Printf("Package metadata is unavailable: %v", err)
+	} else {
+		if err := dropUnconfiguredMetadata(db, newConfig); err != nil {
+			log.Printf("Unable to drop the package metadata of removed repos: %v", err)
 		}
-		http.DefaultTransport = &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+		metadataDB.Store(db)
 	}
+	applyConfig(nil, newConfig)
+	handleReloadSignal(*configFile)
 
-	if config.UserAgent == "" {
-		config.UserAgent = "Pacoloco/1.2"
-	}
-
-	listenAddr := fmt.Sprintf("%s:%d", config.Address, config.Port)
-	log.Printf("Starting server at address %s:%d", config.Address, config.Port)
+	listenAddr := fmt.Sprintf("%s:%d", newConfig.Address, newConfig.Port)
+	log.Printf("Starting server at address %s:%d", newConfig.Address, newConfig.Port)
 	// The request path looks like '/repo/$reponame/$pathatmirror'
 	http.HandleFunc("/repo/", pacolocoHandler)
+	// Snapshots of the repo databases: '/snapshot/$name/$reponame/$pathatmirror'
+	http.HandleFunc("/snapshot/", snapshotHandler)
+	// Requests forwarded to the node that owns the file: '/cluster/$reponame/$pathatmirror'
+	http.HandleFunc("/cluster/", clusterHandler)
+	// Cached files for the peers: '/peer/$reponame/$pathatmirror'
+	http.HandleFunc("GET /peer/", peerHandler)
 	// Expose prometheus metrics
 	http.Handle("/metrics", promhttp.Handler())
+	// Status page for humans
+	http.HandleFunc("GET /{$}", dashboardHandler)
+	// Read-only lookups for the clients, and the admin API, only enabled if
+	// an admin_token is configured
+	http.Handle("/api/v1/", apiHandler())
 	// ReadHeaderTimeout protects against clients that open a connection and
 	// never send a request (slowloris); IdleTimeout reclaims parked
 	// keep-alive connections. Deliberately no ReadTimeout/WriteTimeout:
@@ -97,35 +90,62 @@ func main() {
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       2 * time.Minute,
 	}
-	if config.Tls != nil {
-		err = server.ListenAndServeTLS(config.Tls.Certificate, config.Tls.Key)
-	} else {
-		err = server.ListenAndServe()
+	if newConfig.clientCAs != nil {
+		// clients without a certificate can still use the other credentials
+		server.TLSConfig = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  newConfig.clientCAs,
+		}
 	}
-	if err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		if newConfig.Tls != nil {
+			serverErr <- server.ListenAndServeTLS(newConfig.Tls.Certificate, newConfig.Tls.Key)
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serverErr:
 		log.Fatal(err)
+	case sig := <-stop:
+		timeout := config.Load().ShutdownTimeout
+		if timeout == 0 {
+			timeout = DefaultShutdownTimeout
+		}
+		log.Printf("Received %v, shutting down (waiting up to %v seconds for active downloads)", sig, timeout)
+		gracefulShutdown(server, time.Duration(timeout)*time.Second)
+		log.Printf("Shutdown complete")
 	}
 }
 
-// walks through given directory and gathers its stats. Returns cache size in bytes and package count
-func gatherCacheStats(repoDir string) (totalCacheSize float64, totalPackageCount float64, err error) {
-	var size int64
-	var numberOfPackages int64
-	err = filepath.WalkDir(repoDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !d.IsDir() {
-			info, err := d.Info()
-			if err != nil {
-				return err
+// handleReloadSignal reloads the config file every time the process receives
+// SIGHUP. A broken config is reported and the running one stays active.
+func handleReloadSignal(configPath string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Printf("Received SIGHUP, reloading config from %v", configPath)
+			if err := reloadConfig(configPath); err != nil {
+				log.Printf("Config reload failed, keeping the current config: %v", err)
 			}
-			size += info.Size()
-			numberOfPackages++
 		}
-		return nil
-	})
-	return float64(size), float64(numberOfPackages), err
+	}()
+}
+
+// gatherCacheStats returns the size in bytes and the number of the files
+// cached for a repo.
+func gatherCacheStats(storage Storage, repoName string) (totalCacheSize float64, totalPackageCount float64, err error) {
+	files, err := storage.List(repoName)
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	return float64(size), float64(len(files)), err
 }
 
 // errNotFound marks request errors that must surface as 404: malformed
@@ -136,12 +156,28 @@ var errNotFound = errors.New("not found")
 
 func pacolocoHandler(w http.ResponseWriter, req *http.Request) {
 	if err := handleRequest(w, req); err != nil {
-		log.Println(err)
-		if errors.Is(err, errNotFound) {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeRequestError(w, err)
+	}
+}
+
+// writeRequestError logs the error of a failed request and answers it with
+// the matching status.
+func writeRequestError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, errShuttingDown) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if errors.Is(err, errUnauthorized) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pacoloco"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	} else if errors.Is(err, errForbidden) {
+		w.WriteHeader(http.StatusForbidden)
+	} else if errors.Is(err, errSignatureInvalid) {
+		// the upstreams only offered packages that failed verification
+		w.WriteHeader(http.StatusBadGateway)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
@@ -181,24 +217,41 @@ var (
 
 // force resources prefetching
 func prefetchRequest(urlPath string, cachePath string) error {
-	f, err := parseRequestURL(urlPath)
+	f, err := parseRequestURL(config.Load(), urlPath)
 	if err != nil {
 		return err
 	}
 
-	if f.getRepo() == nil {
+	if f.repo == nil {
 		return fmt.Errorf("cannot find repo %s in the config file", f.repoName)
 	}
+	if cachePath == "" && clusterOwner(f) != "" {
+		return nil // the owner prefetches it
+	}
 	if cachePath == "" {
 		// use default cache path
 		if err := f.mkCacheDir(); err != nil {
 			return err
 		}
 	} else {
-		f.cacheDir = cachePath
-		f.cachedFilePath = filepath.Join(cachePath, f.fileName)
+		// a temporary download, stored in <cachePath>/<repo>
+		f.storage = newFSStorage(cachePath)
+		f.cacheDir = filepath.Join(cachePath, f.repoName)
+		if err := f.mkCacheDir(); err != nil {
+			return err
+		}
+	}
+
+	if err := fetchFile(f); err != nil {
+		return err
 	}
 
+	maybeUpdatePrefetchDB(f)
+	return nil
+}
+
+// fetchFile downloads f into its storage unless it is stored already.
+func fetchFile(f *RequestedFile) error {
 	d, err := getDownloader(f)
 	if err != nil {
 		return err
@@ -210,28 +263,61 @@ func prefetchRequest(urlPath string, cachePath string) error {
 			return err
 		}
 	}
-
-	maybeUpdatePrefetchDB(f)
 	return nil
 }
 
 func handleRequest(w http.ResponseWriter, req *http.Request) error {
-	f, err := parseRequestURL(req.URL.Path)
+	f, err := parseRequestURL(config.Load(), req.URL.Path)
 	if err != nil {
 		return fmt.Errorf("%w: %v", errNotFound, err)
 	}
 
-	if f.getRepo() == nil {
+	if f.repo == nil {
 		return fmt.Errorf("%w: cannot find repo %s in the config file", errNotFound, f.repoName)
 	}
+	if err := authorize(f.config, req, f.repoName); err != nil {
+		return err
+	}
+	return serveRepoFile(w, req, f)
+}
 
+// serveRepoFile serves a file of a configured repo, downloading it into the
+// cache if needed. The repo is the one of the config f was requested
+// under, even if the config is reloaded meanwhile.
+func serveRepoFile(w http.ResponseWriter, req *http.Request, f *RequestedFile) error {
 	cacheRequestsCounter.WithLabelValues(f.repoName).Inc()
 
+	if strings.HasSuffix(f.fileName, ".db") {
+		recordRepoDBPath(f)
+	}
+	if f.repo.Local {
+		// nothing to download, the repo has what was uploaded to it
+		return serveLocalFile(w, req, f)
+	}
+	if f.repo.isMerged() {
+		return serveMergedFile(w, req, f)
+	}
+	if !strings.HasPrefix(req.URL.Path, clusterPathPrefix) {
+		if owner := clusterOwner(f); owner != "" && forwardToOwner(w, req, f, owner) {
+			return nil
+		}
+	}
+
 	// create cache directory if needed
 	if err := f.mkCacheDir(); err != nil {
 		return err
 	}
 
+	if f.repo.keyring != nil && isPackageFile(f.fileName) {
+		// Packages of a repo with a keyring must not reach clients before
+		// their signature is verified, so they are not streamed while
+		// downloading but served from the cache once complete.
+		if err := waitForVerifiedFile(f); err != nil {
+			cacheServingFailedCounter.WithLabelValues(f.repoName).Inc()
+			return err
+		}
+	}
+
 	modTime, r, err := getDownloadReader(f)
 	if err != nil {
 		cacheServingFailedCounter.WithLabelValues(f.repoName).Inc()
@@ -239,7 +325,10 @@ func handleRequest(w http.ResponseWriter, req *http.Request) error {
 	}
 	if r == nil {
 		log.Printf("serving cached file for %v", f.key())
-		http.ServeFile(w, req, f.cachedFilePath)
+		if err := serveCachedFile(w, req, f); err != nil {
+			cacheServingFailedCounter.WithLabelValues(f.repoName).Inc()
+			return err
+		}
 		cacheServedCounter.WithLabelValues(f.repoName).Inc()
 	} else {
 		http.ServeContent(w, req, f.fileName, modTime, r)
@@ -255,8 +344,55 @@ func handleRequest(w http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// serveCachedFile responds with a file from the storage, or redirects the
+// client to where the storage serves it itself. A file that is not cached,
+// such as an absent database signature, is answered with 404.
+func serveCachedFile(w http.ResponseWriter, req *http.Request, f *RequestedFile) error {
+	cached, err := f.storage.Stat(f.repoName, f.fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, req)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	redirect, err := f.storage.RedirectURL(f.repoName, f.fileName)
+	if err != nil {
+		return err
+	}
+	if redirect != "" {
+		http.Redirect(w, req, redirect, http.StatusFound)
+	} else {
+		defer pinServedFile(f.repoName, f.fileName)()
+		content, err := f.storage.Open(f.repoName, f.fileName)
+		if err != nil {
+			return err
+		}
+		http.ServeContent(w, req, f.fileName, cached.ModTime, content)
+		_ = content.Close()
+	}
+
+	go func() {
+		if err := f.storage.Touch(f.repoName, f.fileName, time.Now()); err != nil {
+			log.Printf("unable to record the access to %v: %v", f.key(), err)
+		}
+	}()
+	return nil
+}
+
+// waitForVerifiedFile downloads the requested file into the cache, if it is
+// not there yet, and waits until it is complete.
+func waitForVerifiedFile(f *RequestedFile) error {
+	d, err := getDownloader(f)
+	if err != nil || d == nil {
+		return err
+	}
+	err = d.waitForCompletion()
+	d.decrementUsage()
+	return err
+}
+
 func maybeUpdatePrefetchDB(f *RequestedFile) {
-	if config.Prefetch == nil {
+	if f.config.Prefetch == nil {
 		return
 	}
 	if !strings.HasSuffix(f.fileName, ".sig") && !strings.HasSuffix(f.fileName, ".db") {
@@ -29,12 +29,12 @@ func TestHandlerStatusCodes(t *testing.T) {
 	}))
 	defer mirror.Close()
 
-	config = &Config{
+	config.Store(&Config{
 		CacheDir:        t.TempDir(),
 		Port:            -1,
 		DownloadTimeout: 10,
 		Repos:           map[string]*Repo{"good-repo": {URL: mirror.URL}},
-	}
+	})
 
 	cases := []struct {
 		name string
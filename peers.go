@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Cache peering. Instances listed in `peers` share their caches: before a
+// package is downloaded from the mirrors, the peers are asked whether they
+// have it cached and it is fetched from the first one that does, over the
+// LAN instead of the internet. Peers answer from their cache only, under
+// /peer/<repo>/..., and never download a file or ask their own peers for it,
+// so instances peering with each other cannot send a request in circles.
+// Databases are not shared: they change under the same name, and a peer's
+// copy could be older than the mirrors'.
+
+var peerPathRegex = regexp.MustCompile("^/peer/([^/]*)(/.*)?/([^/]*)$")
+
+// peerLookupTimeout bounds how long a download waits for the peers to say
+// whether they have the file before it goes to the mirrors (a variable only
+// to allow shortening it in tests).
+var peerLookupTimeout = 2 * time.Second
+
+// peerClient sends the requests to the peers. They are on the local
+// network, so the proxies configured for the mirrors are not used.
+var peerClient = &http.Client{Transport: peerTransport{}}
+
+var (
+	peerLookupsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pacoloco_peer_lookups_total",
+		Help: "Number of files looked up at the peer, by whether it had them",
+	}, []string{"repo", "peer", "result"})
+	peerServedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pacoloco_peer_requests_total",
+		Help: "Number of requests from peers, by whether the file was cached",
+	}, []string{"repo", "result"})
+)
+
+// lookupPeers returns the instances a download asks for the file: the
+// peers and the other nodes of the cluster.
+func lookupPeers(c *Config) []string {
+	peers := c.Peers
+	if ring := clusterRing.Load(); ring != nil {
+		peers = append(slices.Clone(peers), ring.others()...)
+	}
+	return peers
+}
+
+// peerURL returns the base URL of a repo at a peer, the counterpart of the
+// URL of a mirror.
+func peerURL(peer string, repoName string) string {
+	return peer + "/peer/" + repoName
+}
+
+// downloadFromPeer fetches the file from a peer that has it cached. It
+// reports whether it did; if not, the mirrors take over and resume whatever
+// the peer delivered.
+func (d *Downloader) downloadFromPeer(peers []string) bool {
+	peer := d.findPeer(peers)
+	if peer == "" {
+		return false
+	}
+	d.peer = peer
+	defer func() { d.peer = "" }()
+	if err := d.downloadFromUpstream(peerURL(peer, d.repoName), peerClient, &transferStats{}); err != nil {
+		log.Printf("unable to download file %v from peer %v: %v", d.key, peer, err)
+		return false
+	}
+	return true
+}
+
+// findPeer asks all peers at the same time whether they have the file
+// cached and returns the first one that answers yes, "" if none does.
+func (d *Downloader) findPeer(peers []string) string {
+	ctx, cancel := context.WithTimeout(downloadsCtx, peerLookupTimeout)
+	defer cancel() // stops the lookups that are still running
+
+	results := make(chan string, len(peers)) // the peer, or "" if it does not have the file
+	for _, peer := range peers {
+		go func() {
+			if d.lookupPeer(ctx, peer) {
+				results <- peer
+			} else {
+				results <- ""
+			}
+		}()
+	}
+	for range peers {
+		if peer := <-results; peer != "" {
+			return peer
+		}
+	}
+	return ""
+}
+
+// lookupPeer asks a peer whether it has the file cached.
+func (d *Downloader) lookupPeer(ctx context.Context, peer string) bool {
+	lookupURL := peerURL(peer, d.repoName) + d.urlPath
+	host := peer
+	if u, err := url.Parse(peer); err == nil {
+		host = u.Host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, lookupURL, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", d.config.UserAgent)
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		// cancelled once another peer had the file
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			log.Printf("looking up %v at peer %v: %v", d.key, peer, err)
+			peerLookupsCounter.WithLabelValues(d.repoName, host, "error").Inc()
+		}
+		return false
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		peerLookupsCounter.WithLabelValues(d.repoName, host, "hit").Inc()
+		return true
+	case http.StatusNotFound:
+		peerLookupsCounter.WithLabelValues(d.repoName, host, "miss").Inc()
+		return false
+	default:
+		log.Printf("looking up %v at peer %v: status code is %d", d.key, peer, resp.StatusCode)
+		peerLookupsCounter.WithLabelValues(d.repoName, host, "error").Inc()
+		return false
+	}
+}
+
+func peerHandler(w http.ResponseWriter, req *http.Request) {
+	if err := handlePeerRequest(w, req); err != nil {
+		writeRequestError(w, err)
+	}
+}
+
+// handlePeerRequest serves /peer/<repo>/<path>/<file> to another instance:
+// from the cache only, a file that is not cached is answered with 404
+// rather than downloaded.
+func handlePeerRequest(w http.ResponseWriter, req *http.Request) error {
+	matches := peerPathRegex.FindStringSubmatch(req.URL.Path)
+	if matches == nil || matches[3] == "." || matches[3] == ".." {
+		return fmt.Errorf("%w: input url path '%v' does not match expected format", errNotFound, req.URL.Path)
+	}
+	repoName, pathAtRepo, fileName := matches[1], matches[2], matches[3]
+	c := config.Load()
+	if c.Repos[repoName] == nil {
+		return fmt.Errorf("%w: cannot find repo %s in the config file", errNotFound, repoName)
+	}
+	if err := authorize(c, req, repoName); err != nil {
+		return err
+	}
+	if forceCheckAtServer(fileName) {
+		return fmt.Errorf("%w: databases are not shared with peers, %v/%v was requested", errNotFound, repoName, fileName)
+	}
+
+	f := newRequestedFile(c, repoName, pathAtRepo, fileName)
+	if _, err := f.storage.Stat(repoName, fileName); err != nil {
+		peerServedCounter.WithLabelValues(repoName, "miss").Inc()
+		if errors.Is(err, fs.ErrNotExist) {
+			// an expected answer, not worth logging
+			http.NotFound(w, req)
+			return nil
+		}
+		return err
+	}
+	peerServedCounter.WithLabelValues(repoName, "hit").Inc()
+	return serveCachedFile(w, req, f)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// setupPeers configures the repo "peer-repo" with a mirror and a peer that
+// has bar-1.0-1 cached. It returns the counter of the requests to the
+// mirror and the peer.
+func setupPeers(t *testing.T) (*atomic.Int32, *httptest.Server) {
+	var mirrorGets atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorGets.Add(1)
+		_, _ = w.Write([]byte("from the mirror"))
+	}))
+	t.Cleanup(mirror.Close)
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/peer/peer-repo/x86_64/bar-1.0-1-x86_64.pkg.tar.zst" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("from the peer"))
+	}))
+	t.Cleanup(peer.Close)
+
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     -1,
+		Peers:    []string{peer.URL},
+		Repos: map[string]*Repo{
+			"peer-repo": {URL: mirror.URL},
+		},
+	})
+	return &mirrorGets, peer
+}
+
+func peerTestRequest(t *testing.T, handler func(http.ResponseWriter, *http.Request) error, method string, urlPath string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	require.NoError(t, handler(w, httptest.NewRequest(method, urlPath, nil)))
+	return w
+}
+
+func TestDownloadFromPeer(t *testing.T) {
+	mirrorGets, peer := setupPeers(t)
+	peerHost := strings.TrimPrefix(peer.URL, "http://")
+	hits := testutil.ToFloat64(peerLookupsCounter.WithLabelValues("peer-repo", peerHost, "hit"))
+	misses := testutil.ToFloat64(peerLookupsCounter.WithLabelValues("peer-repo", peerHost, "miss"))
+
+	w := peerTestRequest(t, handleRequest, http.MethodGet, "/repo/peer-repo/x86_64/bar-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the peer", w.Body.String())
+	require.Equal(t, int32(0), mirrorGets.Load())
+	require.Equal(t, hits+1, testutil.ToFloat64(peerLookupsCounter.WithLabelValues("peer-repo", peerHost, "hit")))
+
+	// files the peer does not have come from the mirror
+	w = peerTestRequest(t, handleRequest, http.MethodGet, "/repo/peer-repo/x86_64/baz-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the mirror", w.Body.String())
+	require.Equal(t, int32(1), mirrorGets.Load())
+	require.Equal(t, misses+1, testutil.ToFloat64(peerLookupsCounter.WithLabelValues("peer-repo", peerHost, "miss")))
+
+	// and so do databases, without asking the peer
+	w = peerTestRequest(t, handleRequest, http.MethodGet, "/repo/peer-repo/x86_64/peer-repo.db")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the mirror", w.Body.String())
+	require.Equal(t, misses+1, testutil.ToFloat64(peerLookupsCounter.WithLabelValues("peer-repo", peerHost, "miss")))
+}
+
+func TestDownloadFromUnreachablePeer(t *testing.T) {
+	mirrorGets, peer := setupPeers(t)
+	peer.Close()
+
+	w := peerTestRequest(t, handleRequest, http.MethodGet, "/repo/peer-repo/x86_64/bar-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the mirror", w.Body.String())
+	require.Equal(t, int32(1), mirrorGets.Load())
+}
+
+func TestPeerRequest(t *testing.T) {
+	mirrorGets, _ := setupPeers(t)
+	repoDir := filepath.Join(config.Load().CacheDir, "pkgs", "peer-repo")
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "foo-1.0-1-x86_64.pkg.tar.zst"), []byte("cached"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "peer-repo.db"), []byte("database"), 0o644))
+
+	w := peerTestRequest(t, handlePeerRequest, http.MethodGet, "/peer/peer-repo/x86_64/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "cached", w.Body.String())
+	require.Equal(t, http.StatusOK, peerTestRequest(t, handlePeerRequest, http.MethodHead, "/peer/peer-repo/x86_64/foo-1.0-1-x86_64.pkg.tar.zst").Code)
+
+	// a peer never downloads, nor asks its own peers
+	require.Equal(t, http.StatusNotFound, peerTestRequest(t, handlePeerRequest, http.MethodHead, "/peer/peer-repo/x86_64/bar-1.0-1-x86_64.pkg.tar.zst").Code)
+	require.Equal(t, int32(0), mirrorGets.Load())
+	require.NoFileExists(t, filepath.Join(repoDir, "bar-1.0-1-x86_64.pkg.tar.zst"))
+
+	w = httptest.NewRecorder()
+	peerHandler(w, httptest.NewRequest(http.MethodGet, "/peer/peer-repo/x86_64/peer-repo.db", nil))
+	require.Equal(t, http.StatusNotFound, w.Code, "databases are not shared")
+	w = httptest.NewRecorder()
+	peerHandler(w, httptest.NewRequest(http.MethodGet, "/peer/unknown/foo-1.0-1-x86_64.pkg.tar.zst", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
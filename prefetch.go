@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -26,12 +25,16 @@ func getCronDuration(cronStr string, from time.Time) (time.Duration, error) {
 }
 
 // Setups the prefetching ticker
-func setupPrefetchTicker() *time.Ticker {
-	if config.Prefetch == nil {
+func setupPrefetchTicker() *routineTicker {
+	c := config.Load()
+	if c.Prefetch == nil {
 		log.Fatalf("Called setupPrefetchTicker with config.Prefetch uninitialized")
 	}
 
-	duration, err := getCronDuration(config.Prefetch.Cron, time.Now())
+	// The schedule is captured here: a config reload that changes it stops
+	// this ticker and sets up a new one.
+	cron := c.Prefetch.Cron
+	duration, err := getCronDuration(cron, time.Now())
 	if err != nil {
 		log.Print(err)
 		return nil
@@ -41,16 +44,19 @@ func setupPrefetchTicker() *time.Ticker {
 		return nil
 	}
 
-	ticker := time.NewTicker(duration) // set prefetch as specified in config file
+	ticker := newRoutineTicker(duration) // set prefetch as specified in config file
 	log.Printf("The prefetching routine will be run on %v", time.Now().Add(duration))
 	go func() {
 		lastTimeInvoked := time.Time{}
-		for range ticker.C {
+		for ticker.wait() {
 			if time.Since(lastTimeInvoked) > time.Second {
+				if config.Load().Prefetch == nil {
+					return // prefetching got disabled by a config reload
+				}
 				prefetchPackages()
 				lastTimeInvoked = time.Now()
 				now := time.Now()
-				duration, err := getCronDuration(config.Prefetch.Cron, time.Now())
+				duration, err := getCronDuration(cron, time.Now())
 				if err == nil && duration > 0 {
 					ticker.Reset(duration) // update to the new timing
 					log.Printf("On %v the prefetching routine will be run again", now.Add(duration))
@@ -169,10 +175,13 @@ func purgePkgIfExists(pkgToDel *Package) {
 	if pkgToDel == nil {
 		return
 	}
-	for _, p := range pkgToDel.getAllPaths() {
-		pathToDelete := filepath.Join(config.CacheDir, p)
-		if err := os.Remove(pathToDelete); err != nil && !errors.Is(err, os.ErrNotExist) {
-			log.Printf("Error while trying to remove unused package %v : %v", pathToDelete, err)
+	storage := config.Load().cacheStorage()
+	for _, fileName := range pkgToDel.getAllFileNames() {
+		if snapshotPinned(pkgToDel.RepoName, fileName) {
+			continue
+		}
+		if err := storage.Delete(pkgToDel.RepoName, fileName); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error while trying to remove unused package %v/%v : %v", pkgToDel.RepoName, fileName, err)
 		}
 	}
 }
@@ -180,10 +189,11 @@ func purgePkgIfExists(pkgToDel *Package) {
 // purges unused and dead packages both from db and their files and removes unused db links from the db
 func cleanPrefetchDB() {
 	log.Printf("Cleaning the db...")
-	if config.Prefetch == nil {
+	c := config.Load()
+	if c.Prefetch == nil {
 		log.Fatalf("Shouldn't call a prefetch purge when prefetch is not set in the yaml. This is most likely a bug.")
 	}
-	period := 24 * time.Hour * time.Duration(config.Prefetch.TTLUnaccessed)
+	period := 24 * time.Hour * time.Duration(c.Prefetch.TTLUnaccessed)
 	olderThan := time.Now().Add(-period)
 	deadPkgs := getAndDropUnusedPackages(period)
 	dropUnusedDBFiles(olderThan) // drop too old db links
@@ -191,7 +201,7 @@ func cleanPrefetchDB() {
 	for _, pkgToDel := range deadPkgs {
 		purgePkgIfExists(&pkgToDel)
 	}
-	period = 24 * time.Hour * time.Duration(config.Prefetch.TTLUnupdated)
+	period = 24 * time.Hour * time.Duration(c.Prefetch.TTLUnupdated)
 	olderThan = time.Now().Add(-period)
 	deadPkgs = getAndDropDeadPackages(olderThan)
 	// deletes dead packages
@@ -201,7 +211,7 @@ func cleanPrefetchDB() {
 	// delete mirror links which does not exist on the config file or are invalid
 	mirrors := getAllMirrorsDB()
 	for _, mirror := range mirrors {
-		if _, exists := config.Repos[mirror.RepoName]; exists {
+		if _, exists := c.Repos[mirror.RepoName]; exists {
 			if !strings.HasPrefix(mirror.URL, "/repo/") {
 				log.Printf("warning: deleting %v link due to migrating to a newer version of pacoloco. Simply do 'pacman -Sy' on repo %v to fix the prefetching.", mirror.URL, mirror.RepoName)
 				deleteMirrorDBFromDB(mirror)
@@ -256,7 +266,14 @@ func prefetchPackages() {
 	if prefetchDB == nil {
 		return
 	}
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+	if shuttingDown.Load() {
+		return
+	}
 	log.Printf("Starting prefetching routine...")
+	now := time.Now()
+	lastPrefetchRun.Store(&now)
 	// update mirrorlists from file if they exist
 	// purge all useless files
 	cleanPrefetchDB()
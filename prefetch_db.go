@@ -25,15 +25,15 @@ type Package struct {
 	LastTimeRepoUpdated *time.Time `gorm:"not null"`
 }
 
-// there are many possible paths for a package, this function returns ALL the possible ones
-func (pkg Package) getAllPaths() []string {
-	baseString := filepath.Join("pkgs", pkg.RepoName, pkg.PackageName+"-"+pkg.Version+"-"+pkg.Arch)
-	var pkgPaths []string
+// there are many possible file names for a package, this function returns ALL the possible ones
+func (pkg Package) getAllFileNames() []string {
+	baseString := pkg.PackageName + "-" + pkg.Version + "-" + pkg.Arch
+	var fileNames []string
 	for _, ext := range allowedPackagesExtensions {
-		pkgPaths = append(pkgPaths, baseString+ext)
-		pkgPaths = append(pkgPaths, baseString+ext+".sig")
+		fileNames = append(fileNames, baseString+ext)
+		fileNames = append(fileNames, baseString+ext+".sig")
 	}
-	return pkgPaths
+	return fileNames
 }
 
 // MirrorDB is a struct which stores all the relevant information about a requested db file from a client.
@@ -67,10 +67,11 @@ func deleteMirrorPkgsTable() error {
 
 // Creates the db if it doesn't exist
 func createPrefetchDB() {
-	if config == nil {
+	c := config.Load()
+	if c == nil {
 		log.Fatalf("Config have not been parsed yet")
 	}
-	dbPath := filepath.Join(config.CacheDir, DefaultDBName)
+	dbPath := filepath.Join(c.CacheDir, DefaultDBName)
 	if _, err := os.Stat(dbPath); err == nil {
 		return // DB already exists
 	}
@@ -85,12 +86,13 @@ func createPrefetchDB() {
 }
 
 func getDBConnection() (*gorm.DB, error) {
-	if config == nil {
+	c := config.Load()
+	if c == nil {
 		return nil, fmt.Errorf("config have not been parsed yet")
 	}
-	dbPath := filepath.Join(config.CacheDir, DefaultDBName)
+	dbPath := filepath.Join(c.CacheDir, DefaultDBName)
 	logFlags := 0
-	if config.LogTimestamp {
+	if c.LogTimestamp {
 		logFlags = log.LstdFlags
 	}
 	newLogger := logger.New(
@@ -131,8 +133,9 @@ func getAndDropUnusedPackages(period time.Duration) []Package {
 // Returns unused db files or not existing repos and removes them from the db
 func dropUnusedDBFiles(olderThan time.Time) {
 	prefetchDB.Model(&MirrorDB{}).Unscoped().Where("mirror_dbs.last_time_downloaded < ?", olderThan).Delete(&MirrorDB{})
-	repoNames := make([]string, 0, len(config.Repos))
-	for key := range config.Repos {
+	c := config.Load()
+	repoNames := make([]string, 0, len(c.Repos))
+	for key := range c.Repos {
 		repoNames = append(repoNames, key)
 	}
 	prefetchDB.Model(&MirrorDB{}).Unscoped().Where("mirror_dbs.repo_name NOT IN ?", repoNames).Delete(&MirrorDB{})
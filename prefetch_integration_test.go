@@ -58,8 +58,8 @@ func testPrefetchRequestNonExistingDb(t *testing.T) {
 
 func testPrefetchRequestExistingRepo(t *testing.T) {
 	// Requesting existing repo
-	config.Repos["repo1"] = &Repo{}
-	defer delete(config.Repos, "repo1")
+	config.Load().Repos["repo1"] = &Repo{}
+	defer delete(config.Load().Repos, "repo1")
 
 	require.Error(t, prefetchRequest("/repo/repo1/test.db", ""))
 
@@ -73,8 +73,8 @@ func testPrefetchRequestPackageFile(t *testing.T) {
 	repo3 := &Repo{
 		URL: mirrorURL + "/mirror3",
 	}
-	config.Repos["repo3"] = repo3
-	defer delete(config.Repos, "repo3")
+	config.Load().Repos["repo3"] = repo3
+	defer delete(config.Load().Repos, "repo3")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror3"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror3"))
@@ -118,8 +118,8 @@ func testPrefetchFailover(t *testing.T) {
 			mirrorURL + "/mirror-failover",
 		},
 	}
-	config.Repos["failover"] = failover
-	defer delete(config.Repos, "failover")
+	config.Load().Repos["failover"] = failover
+	defer delete(config.Load().Repos, "failover")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror-failover"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror-failover"))
@@ -142,8 +142,8 @@ func testPrefetchRealDB(t *testing.T) {
 	repo2 := &Repo{
 		URL: mirrorURL + "/mirror2",
 	}
-	config.Repos["repo2"] = repo2
-	defer delete(config.Repos, "repo2")
+	config.Load().Repos["repo2"] = repo2
+	defer delete(config.Load().Repos, "repo2")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror2"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror2"))
@@ -161,8 +161,8 @@ func testPrefetchRequestExistingRepoWithDb(t *testing.T) {
 	repo2 := &Repo{
 		URL: mirrorURL + "/mirror2",
 	}
-	config.Repos["repo2"] = repo2
-	defer delete(config.Repos, "repo2")
+	config.Load().Repos["repo2"] = repo2
+	defer delete(config.Load().Repos, "repo2")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror2"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror2"))
@@ -207,14 +207,16 @@ func testIntegrationPrefetchAllPkgs(t *testing.T) {
 	repo3 := &Repo{
 		URL: mirrorURL + "/mirror3",
 	}
-	config.Repos["repo3"] = repo3
-	defer delete(config.Repos, "repo3")
+	config.Load().Repos["repo3"] = repo3
+	defer delete(config.Load().Repos, "repo3")
 
 	require.NoError(t, os.Mkdir(path.Join(mirrorDir, "mirror3"), os.ModePerm))
 	defer os.RemoveAll(path.Join(mirrorDir, "mirror3"))
-	// create a valid db file on the mirror
+	// create a valid db file on the mirror; it has to describe the fake
+	// package content below, as prefetched packages are verified against it
+	pkgContent := "TEST content for the file to be prefetched"
 	dbAtMirror := path.Join(mirrorDir, "mirror3", "test.db")
-	createDbTarball(t, dbAtMirror, getTestTarDB())
+	createDbTarball(t, dbAtMirror, withPackageChecksum(getTestTarDB(), "acl-2.3.1-1", pkgContent))
 	// fake a request to the db
 	_, err := updateDBRequestedDB("repo3", "", "/test.db")
 	require.NoErrorf(t, err, "Should not generate errors, but got %v", err)
@@ -223,11 +225,11 @@ func testIntegrationPrefetchAllPkgs(t *testing.T) {
 	// now i add a bit newer one, to ensure that the db gets updated accordingly
 	updateDBRequestedFile("repo3", "acl-2.1-0-x86_64.pkg.tar.zst")
 	// create the directories in the cache
-	require.NoError(t, os.Mkdir(path.Join(config.CacheDir, "pkgs", "repo3"), os.ModePerm))
+	require.NoError(t, os.Mkdir(path.Join(config.Load().CacheDir, "pkgs", "repo3"), os.ModePerm))
 
-	defer os.RemoveAll(path.Join(config.CacheDir, "pkgs"))
+	defer os.RemoveAll(path.Join(config.Load().CacheDir, "pkgs"))
 	// create this file in the cache
-	pkgAtCache := path.Join(config.CacheDir, "pkgs", "repo3", "acl-2.1-0-x86_64.pkg.tar.zst")
+	pkgAtCache := path.Join(config.Load().CacheDir, "pkgs", "repo3", "acl-2.1-0-x86_64.pkg.tar.zst")
 	pkgAtCacheContent := "cached old content"
 
 	require.NoError(t, os.WriteFile(pkgAtCache, []byte(pkgAtCacheContent), os.ModePerm))
@@ -235,7 +237,6 @@ func testIntegrationPrefetchAllPkgs(t *testing.T) {
 
 	// create a package file which should be prefetched with signature (the signature is invalid but I'm not checking it) on the mirror
 	pkgAtMirror := path.Join(mirrorDir, "mirror3", "acl-2.3.1-1-x86_64.pkg.tar.zst")
-	pkgContent := "TEST content for the file to be prefetched"
 	require.NoError(t, os.WriteFile(pkgAtMirror, []byte(pkgContent), os.ModePerm))
 	require.NoError(t, os.WriteFile(pkgAtMirror+".sig", []byte(pkgContent), os.ModePerm))
 	// create an updated package file with a wrong extension which should NOT be prefetched with signature (the signature is invalid but I'm not checking it) on the mirror
@@ -253,7 +254,7 @@ func testIntegrationPrefetchAllPkgs(t *testing.T) {
 	require.NoError(t, err)
 	require.Falsef(t, exists, "The file %v should not exist", pkgAtCache+".sig")
 	// new packages should appear
-	pkgAtCache = path.Join(config.CacheDir, "pkgs", "repo3", "acl-2.3.1-1-x86_64.pkg.tar.zst")
+	pkgAtCache = path.Join(config.Load().CacheDir, "pkgs", "repo3", "acl-2.3.1-1-x86_64.pkg.tar.zst")
 	exists, err = fileExists(pkgAtCache)
 	require.NoError(t, err)
 	require.Truef(t, exists, "The file %v should exist", pkgAtCache)
@@ -270,7 +271,7 @@ func testIntegrationPrefetchAllPkgs(t *testing.T) {
 	want = []byte(pkgContent)
 	require.Equal(t, want, got)
 	// new packages with the wrong extension should not appear
-	pkgAtCache = path.Join(config.CacheDir, "pkgs", "repo3", "acl-2.3.1-1-x86_64.pkg.tar")
+	pkgAtCache = path.Join(config.Load().CacheDir, "pkgs", "repo3", "acl-2.3.1-1-x86_64.pkg.tar")
 	exists, err = fileExists(pkgAtCache)
 	require.NoError(t, err)
 	require.Falsef(t, exists, "The file %v should not exist", pkgAtCache)
@@ -36,11 +36,11 @@ repos:
            -  https://mirror.example.com/mirror/packages/archlinux/
            -  http://mirror2.example.com/archlinux/test/
 `
-	var err error
-	config, err = parseConfig([]byte(c))
+	parsed, err := parseConfig([]byte(c))
 	if err != nil {
 		t.Fatalf("parseConfig failed: %v", err)
 	}
+	config.Store(parsed)
 	return tmpDir
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
@@ -9,41 +10,78 @@ import (
 	"github.com/djherbis/times"
 )
 
-func setupPurgeStaleFilesRoutine() *time.Ticker {
-	ticker := time.NewTicker(24 * time.Hour) // purge files once a day
+func setupPurgeStaleFilesRoutine() *routineTicker {
+	ticker := newRoutineTicker(24 * time.Hour) // purge files once a day
 	go func() {
-		for repoName := range config.Repos {
-			purgeStaleFiles(config.CacheDir, config.PurgeFilesAfter, repoName)
-		}
-		for range ticker.C {
-			for repoName := range config.Repos {
-				purgeStaleFiles(config.CacheDir, config.PurgeFilesAfter, repoName)
-			}
+		purgeAllRepos(config.Load())
+		for ticker.wait() {
+			purgeAllRepos(config.Load())
 		}
 	}()
 
 	return ticker
 }
 
+func purgeAllRepos(c *Config) {
+	storage := c.cacheStorage()
+	for repoName, repo := range c.Repos {
+		if repo.Local || repo.isMerged() {
+			continue // uploaded packages stay until they are deleted, merged repos cache nothing
+		}
+		purgeStaleFiles(storage, c.CacheDir, c.PurgeFilesAfter, repoName)
+	}
+}
+
 // purgeStaleFiles purges files in the pacoloco cache
-// it recursively scans `cacheDir`/pkgs and if the file access time is older than
-// `now` - purgeFilesAfter(seconds) then the file gets removed
-func purgeStaleFiles(cacheDir string, purgeFilesAfter int, repoName string) {
+// it lists the cached files of the repo and if the file access time is older than
+// `now` - purgeFilesAfter(seconds) then the file gets removed.
+// Buffer files left behind in `cacheDir`/pkgs by interrupted downloads are purged as well.
+func purgeStaleFiles(storage Storage, cacheDir string, purgeFilesAfter int, repoName string) {
 	// safety check, so we don't unintentionally wipe the whole cache
 	if purgeFilesAfter == 0 {
 		log.Fatalf("Stopping because purgeFilesAfter=%v and that would purge the whole cache", purgeFilesAfter)
 	}
 
 	removeIfOlder := time.Now().Add(time.Duration(-purgeFilesAfter) * time.Second)
-	pkgDir := filepath.Join(cacheDir, "pkgs", repoName)
 	var packageSize int64
 	var packageNum int64
-	// Go through all files in the repos, and check if access time is older than `removeIfOlder`
+	files, err := storage.List(repoName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println(err)
+	}
+	var kept []CachedFile
+	// Go through all files in the repo, and check if access time is older than `removeIfOlder`
+	for _, f := range files {
+		if f.AccessTime.Before(removeIfOlder) && !snapshotPinned(repoName, f.Name) {
+			log.Printf("Remove stale file %v/%v as its access time (%v) is too old", repoName, f.Name, f.AccessTime)
+			if err := storage.Delete(repoName, f.Name); err != nil {
+				log.Print(err)
+				kept = append(kept, f)
+			} else {
+				forgetRepoDB(repoName, f.Name)
+			}
+		} else {
+			packageSize += f.Size
+			packageNum++
+			kept = append(kept, f)
+		}
+	}
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		countRepoUsage(cacheDir, repoName, kept)
+	}
+	purgeStaleBufferFiles(filepath.Join(cacheDir, "pkgs", repoName), removeIfOlder)
+	cachePackageGauge.WithLabelValues(repoName).Set(float64(packageNum))
+	cacheSizeGauge.WithLabelValues(repoName).Set(float64(packageSize))
+}
+
+// purgeStaleBufferFiles removes the buffer files of downloads that were
+// interrupted before they completed.
+func purgeStaleBufferFiles(bufferDir string, removeIfOlder time.Time) {
 	walkfn := func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if !d.Type().IsRegular() {
+		if !d.Type().IsRegular() || !isBufferFile(d.Name()) {
 			return nil
 		}
 
@@ -51,26 +89,20 @@ func purgeStaleFiles(cacheDir string, purgeFilesAfter int, repoName string) {
 		if err != nil {
 			return err
 		}
-		t := times.Get(info)
-		atime := t.AccessTime()
-		// A file is stale only if it is neither read nor written: the
-		// buffer file of an in-flight download has no readers (stale
+		atime := times.Get(info).AccessTime()
+		// A buffer file is stale only if it is neither read nor written:
+		// the buffer file of an in-flight download has no readers (stale
 		// atime) but is actively appended to (fresh mtime), and must not
 		// be deleted from under its Downloader.
 		if atime.Before(removeIfOlder) && info.ModTime().Before(removeIfOlder) {
-			log.Printf("Remove stale file %v as its access time (%v) is too old", path, atime)
+			log.Printf("Remove stale buffer file %v as its access time (%v) is too old", path, atime)
 			if err := os.Remove(path); err != nil {
 				log.Print(err)
 			}
-		} else {
-			packageSize += info.Size()
-			packageNum++
 		}
 		return nil
 	}
-	if err := filepath.WalkDir(pkgDir, walkfn); err != nil {
+	if err := filepath.WalkDir(bufferDir, walkfn); err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Println(err)
 	}
-	cachePackageGauge.WithLabelValues(repoName).Set(float64(packageNum))
-	cacheSizeGauge.WithLabelValues(repoName).Set(float64(packageSize))
 }
@@ -16,7 +16,7 @@ func TestPurgeEmptyDirectory(t *testing.T) {
 	defer os.RemoveAll(testPacolocoDir)
 
 	// Don't create pkgs/testrepo directory - purge should handle missing dir gracefully
-	purgeStaleFiles(testPacolocoDir, 3600, "testrepo")
+	purgeStaleFiles(newFSStorage(path.Join(testPacolocoDir, "pkgs")), testPacolocoDir, 3600, "testrepo")
 
 	cachePackageNum, err := cachePackageGauge.GetMetricWithLabelValues("testrepo")
 	require.NoError(t, err)
@@ -45,7 +45,7 @@ func TestPurgeWithSubdirectories(t *testing.T) {
 	thresholdTime := time.Now().Add(time.Duration(-purgeFilesAfter) * time.Second)
 	os.Chtimes(fileInSubDir, thresholdTime.Add(-time.Hour), thresholdTime.Add(-time.Hour))
 
-	purgeStaleFiles(testPacolocoDir, purgeFilesAfter, "subrepo")
+	purgeStaleFiles(newFSStorage(path.Join(testPacolocoDir, "pkgs")), testPacolocoDir, purgeFilesAfter, "subrepo")
 
 	_, err = os.Stat(fileInSubDir)
 	require.ErrorIs(t, err, os.ErrNotExist, "nested file should be removed")
@@ -67,7 +67,7 @@ func TestPurgeSparesActivelyWrittenFiles(t *testing.T) {
 	// stale atime (nobody reads a buffer file), fresh mtime (writer active)
 	require.NoError(t, os.Chtimes(buffer, threshold.Add(-time.Hour), time.Now()))
 
-	purgeStaleFiles(dir, purgeFilesAfter, "inflightrepo")
+	purgeStaleFiles(newFSStorage(path.Join(dir, "pkgs")), dir, purgeFilesAfter, "inflightrepo")
 
 	_, err := os.Stat(buffer)
 	require.NoError(t, err, "actively written file must survive the purge")
@@ -123,7 +123,7 @@ func TestPurge(t *testing.T) {
 	expectedPackageNum := float64(2)
 	expectedSize := float64(infoToStay.Size() + infoToBePurgedLater.Size())
 
-	purgeStaleFiles(testPacolocoDir, purgeFilesAfter, "purgerepo")
+	purgeStaleFiles(newFSStorage(path.Join(testPacolocoDir, "pkgs")), testPacolocoDir, purgeFilesAfter, "purgerepo")
 
 	_, err = os.Stat(fileToRemove)
 	require.ErrorIs(t, err, os.ErrNotExist)
@@ -146,7 +146,7 @@ func TestPurge(t *testing.T) {
 	expectedPackageNum = testutil.ToFloat64(cachePackageNum) - 1
 	expectedSize = testutil.ToFloat64(cachePackageSize) - float64(infoToBePurgedLater.Size())
 
-	purgeStaleFiles(testPacolocoDir, purgeFilesAfter, "purgerepo")
+	purgeStaleFiles(newFSStorage(path.Join(testPacolocoDir, "pkgs")), testPacolocoDir, purgeFilesAfter, "purgerepo")
 
 	_, err = os.Stat(fileToStay)
 	require.NoError(t, err)
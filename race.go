@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Mirror racing. With race_mirrors set, a fresh download sends its request
+// to the best race_mirrors mirrors of the repo at the same time and
+// receives the file from the one that answers first. Pacman waits for the
+// first byte of every file of an upgrade one after the other, so on a cache
+// miss the response time of the mirror matters more than its bandwidth.
+
+var raceWinsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pacoloco_mirror_race_wins_total",
+	Help: "Number of mirror races won by the mirror",
+}, []string{"repo", "upstream"})
+
+// raceMirrors sends the download request to the first n of the urls
+// concurrently. The mirror that answers first with the file, or with Not
+// Modified, wins: it is moved to the front of the returned urls and its
+// transfer is returned for the download to continue, while the requests
+// to the other mirrors are cancelled. If no mirror answers that way, the
+// urls are returned unchanged without a transfer and the download tries
+// them as usual.
+func (d *Downloader) raceMirrors(urls []string, n int, client *http.Client) ([]string, *upstreamTransfer) {
+	contenders := urls[:min(n, len(urls))]
+
+	type result struct {
+		contender int
+		transfer  *upstreamTransfer // nil if the request failed
+	}
+	results := make(chan result, len(contenders))
+	cancels := make([]context.CancelFunc, len(contenders))
+	for i, u := range contenders {
+		ctx, cancel := context.WithCancel(downloadsCtx)
+		cancels[i] = cancel
+		go func() {
+			t, err := d.sendUpstreamRequest(ctx, u, client, &transferStats{})
+			if err == nil && t.resp.StatusCode != http.StatusOK && t.resp.StatusCode != http.StatusNotModified {
+				err = &upstreamStatusError{url: u + d.urlPath, statusCode: t.resp.StatusCode}
+				t.close()
+				t = nil
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Printf("mirror race: %v", err)
+			}
+			results <- result{contender: i, transfer: t}
+		}()
+	}
+
+	winner := -1
+	var transfer *upstreamTransfer
+	for range contenders {
+		r := <-results
+		if r.transfer == nil || winner != -1 {
+			if r.transfer != nil {
+				r.transfer.close() // answered as well, but later
+			}
+			cancels[r.contender]()
+			continue
+		}
+		winner, transfer = r.contender, r.transfer
+		// the winner's context lives as long as its transfer, the
+		// requests that lost are stopped
+		transfer.cancels = append(transfer.cancels, cancels[winner])
+		for i, cancel := range cancels {
+			if i != winner {
+				cancel()
+			}
+		}
+	}
+	if transfer == nil {
+		return urls, nil
+	}
+
+	log.Printf("mirror race for %v won by %v", d.key, transfer.repoURL)
+	raceWinsCounter.WithLabelValues(d.repoName, transfer.repoURL).Inc()
+	ordered := append(make([]string, 0, len(urls)), transfer.repoURL)
+	return append(ordered, slices.DeleteFunc(slices.Clone(urls), func(u string) bool { return u == transfer.repoURL })...), transfer
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRaceMirrorsPicksFastestMirror verifies that a download is received
+// from the mirror that answers first, without asking it again, and that
+// the requests to the other mirrors are cancelled.
+func TestRaceMirrorsPicksFastestMirror(t *testing.T) {
+	resetMirrorHealth(t)
+	const content = "package content from the fast mirror"
+
+	slowCancelled := make(chan struct{})
+	slowMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(slowCancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slowMirror.Close()
+	var fastRequests atomic.Int32
+	fastMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastRequests.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write([]byte(content))
+	}))
+	defer fastMirror.Close()
+
+	config.Store(&Config{
+		CacheDir:        t.TempDir(),
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos: map[string]*Repo{
+			"race-repo": {URLs: []string{slowMirror.URL, fastMirror.URL}, RaceMirrors: 2},
+		},
+	})
+	before := testutil.ToFloat64(raceWinsCounter.WithLabelValues("race-repo", fastMirror.URL))
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/race-repo/raced-1-1-any.pkg.tar.zst", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, content, w.Body.String())
+
+	select {
+	case <-slowCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request to the slow mirror was not cancelled")
+	}
+	require.Equal(t, int32(1), fastRequests.Load(), "the winner's response is the download")
+	require.Equal(t, before+1, testutil.ToFloat64(raceWinsCounter.WithLabelValues("race-repo", fastMirror.URL)))
+}
+
+// TestRaceMirrorsSkipsMissingFile verifies that a mirror without the file
+// does not win the race, and that the order stays as it was if nobody does.
+func TestRaceMirrorsSkipsMissingFile(t *testing.T) {
+	resetMirrorHealth(t)
+	const content = "package content"
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(content))
+	}))
+	defer mirror.Close()
+	missingMirror := httptest.NewServer(http.NotFoundHandler())
+	defer missingMirror.Close()
+
+	config.Store(&Config{CacheDir: t.TempDir(), Port: -1})
+	d := &Downloader{
+		config:    config.Load(),
+		repoName:  "race-repo",
+		repo:      &Repo{},
+		urlPath:   "/probed-1-1-any.pkg.tar.zst",
+		fileName:  "probed-1-1-any.pkg.tar.zst",
+		storage:   config.Load().cacheStorage(),
+		eventCond: sync.NewCond(&sync.Mutex{}),
+	}
+	urls := []string{missingMirror.URL, mirror.URL}
+	ordered, transfer := d.raceMirrors(urls, 2, http.DefaultClient)
+	require.Equal(t, []string{mirror.URL, missingMirror.URL}, ordered)
+	require.NotNil(t, transfer)
+	body, err := io.ReadAll(transfer.resp.Body)
+	transfer.close()
+	require.NoError(t, err)
+	require.Equal(t, content, string(body))
+
+	// nobody wins: the order stays as it was
+	urls = []string{missingMirror.URL, missingMirror.URL + "/other"}
+	ordered, transfer = d.raceMirrors(urls, 2, http.DefaultClient)
+	require.Equal(t, urls, ordered)
+	require.Nil(t, transfer)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isBufferFile reports whether fileName is the temporary buffer file of a
+// download (see RequestedFile.bufferFileName) rather than a cache entry.
+func isBufferFile(fileName string) bool {
+	return strings.HasPrefix(fileName, ".")
+}
+
+// sweepOrphanedFiles removes what a previous run left behind when it did not
+// shut down cleanly: buffer files of downloads that never completed, the
+// temporary directory the prefetcher unpacks databases into and snapshots
+// that were not complete. They are only valid while their owner is alive,
+// so the sweep must run before the server starts downloading.
+func sweepOrphanedFiles(cacheDir string) {
+	var removedFiles, removedBytes int64
+
+	// uploads to local repos and merged databases are buffered the same way
+	for _, dir := range []string{"pkgs", localReposDir, mergedReposDir} {
+		err := filepath.WalkDir(filepath.Join(cacheDir, dir), func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || !isBufferFile(d.Name()) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				log.Printf("Unable to remove orphaned buffer file %v: %v", path, err)
+				return nil
+			}
+			removedFiles++
+			removedBytes += info.Size()
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Sweeping orphaned buffer files failed: %v", err)
+		}
+	}
+
+	tmpDir := filepath.Join(cacheDir, "tmp-db")
+	if err := os.RemoveAll(tmpDir); err != nil {
+		log.Printf("Unable to remove leftover prefetch directory %v: %v", tmpDir, err)
+	}
+	// and snapshots that were being assembled
+	snapshotDirs, _ := os.ReadDir(filepath.Join(cacheDir, snapshotsDir))
+	for _, d := range snapshotDirs {
+		if d.IsDir() && isBufferFile(d.Name()) {
+			if err := os.RemoveAll(filepath.Join(cacheDir, snapshotsDir, d.Name())); err != nil {
+				log.Printf("Unable to remove unfinished snapshot %v: %v", d.Name(), err)
+			}
+		}
+	}
+
+	if removedFiles > 0 {
+		log.Printf("Removed %d orphaned buffer files (%d bytes) left behind by an unclean shutdown", removedFiles, removedBytes)
+	}
+}
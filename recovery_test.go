@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweepOrphanedFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	repoDir := filepath.Join(cacheDir, "pkgs", "sweeprepo")
+	require.NoError(t, os.MkdirAll(filepath.Join(repoDir, "nested"), os.ModePerm))
+	tmpDBDir := filepath.Join(cacheDir, "tmp-db")
+	require.NoError(t, os.MkdirAll(tmpDBDir, os.ModePerm))
+
+	pkg := filepath.Join(repoDir, "foo-1-1-any.pkg.tar.zst")
+	orphan := filepath.Join(repoDir, ".bar-1-1-any.pkg.tar.zst")
+	nestedOrphan := filepath.Join(repoDir, "nested", ".core.db")
+	leftoverDB := filepath.Join(tmpDBDir, "core.db.tar")
+	for _, f := range []string{pkg, orphan, nestedOrphan, leftoverDB} {
+		require.NoError(t, os.WriteFile(f, []byte("content"), 0o644))
+	}
+
+	sweepOrphanedFiles(cacheDir)
+
+	_, err := os.Stat(pkg)
+	require.NoError(t, err, "cache entries must survive the sweep")
+	for _, f := range []string{orphan, nestedOrphan, tmpDBDir} {
+		_, err := os.Stat(f)
+		require.ErrorIs(t, err, os.ErrNotExist, "%v must be removed", f)
+	}
+}
+
+func TestSweepOrphanedFilesMissingCache(t *testing.T) {
+	// a fresh cache directory has no pkgs yet, that is not an error
+	sweepOrphanedFiles(t.TempDir())
+}
+
+func TestGatherCacheStatsSkipsBufferFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	repoDir := filepath.Join(cacheDir, "statsrepo")
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "foo-1-1-any.pkg.tar.zst"), []byte("12345"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, ".bar-1-1-any.pkg.tar.zst"), []byte("partial"), 0o644))
+
+	size, count, err := gatherCacheStats(newFSStorage(cacheDir), "statsrepo")
+	require.NoError(t, err)
+	require.Equal(t, float64(5), size)
+	require.Equal(t, float64(1), count)
+}
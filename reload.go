@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tickers of the background routines driven by the current config. They are
+// owned by applyConfig; a reload stops and restarts them when the relevant
+// settings change.
+var (
+	purgeTicker    *routineTicker
+	prefetchTicker *routineTicker
+	orphanGCTicker *routineTicker
+)
+
+// routineTicker drives a background routine. Stopping a time.Ticker does
+// not close its channel, so the routine also waits for done, which Stop
+// closes, and returns then.
+type routineTicker struct {
+	*time.Ticker
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRoutineTicker(d time.Duration) *routineTicker {
+	return &routineTicker{Ticker: time.NewTicker(d), done: make(chan struct{})}
+}
+
+// wait blocks until the next tick and reports whether the routine should
+// run, false once the ticker is stopped.
+func (t *routineTicker) wait() bool {
+	select {
+	case <-t.C:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// Stop stops the ticker and ends its routine. It may be called more than
+// once.
+func (t *routineTicker) Stop() {
+	t.stopOnce.Do(func() {
+		t.Ticker.Stop()
+		close(t.done)
+	})
+}
+
+// applyGlobalSettings applies the process-wide side effects of a config:
+// log flags and the default user agent. The proxy is part of the clients of
+// the repos. The log flags are only set when log_timestamp changes, main
+// sets the ones without timestamps before the first config is applied.
+func applyGlobalSettings(oldConfig, c *Config) {
+	wasTimestamped := oldConfig != nil && oldConfig.LogTimestamp
+	if c.LogTimestamp != wasTimestamped {
+		if c.LogTimestamp {
+			log.SetFlags(log.LstdFlags)
+		} else {
+			log.SetFlags(log.Lshortfile)
+		}
+	}
+
+	if c.UserAgent == "" {
+		c.UserAgent = "Pacoloco/1.2"
+	}
+}
+
+// applyConfig makes newConfig the active configuration and brings the
+// background routines and per-repo metrics in line with it. oldConfig is the
+// configuration being replaced, nil on startup.
+//
+// The config is swapped atomically. A request loads it once and is served
+// with that snapshot, whose Repo its Downloader keeps, so requests and
+// downloads that are already running finish against the old config.
+func applyConfig(oldConfig, newConfig *Config) {
+	applyGlobalSettings(oldConfig, newConfig)
+	setupUpstreamClients(newConfig)
+
+	config.Store(newConfig)
+
+	if oldConfig != nil {
+		// the new repos have new clients, the running downloads keep
+		// using the connections of the old ones
+		for _, repo := range oldConfig.Repos {
+			repo.closeIdleConnections()
+		}
+	}
+
+	// the storage may have changed, the quotas count the cache anew
+	resetCacheUsage()
+	updateRepoGauges(oldConfig, newConfig)
+	updatePurgeRoutine(oldConfig, newConfig)
+	updatePrefetchRoutine(oldConfig, newConfig)
+	updateOrphanGCRoutine(oldConfig, newConfig)
+	updateClusterRoutine(newConfig)
+	forgetMergedDBs(newConfig)
+}
+
+// updateRepoGauges initializes the cache gauges of repos that appeared in
+// newConfig and drops the series of repos that are gone. New repos also get
+// the checksums of their cached databases indexed.
+func updateRepoGauges(oldConfig, newConfig *Config) {
+	for repoName := range newConfig.Repos {
+		if oldConfig != nil {
+			if old, ok := oldConfig.Repos[repoName]; ok && old.Local == newConfig.Repos[repoName].Local {
+				continue
+			}
+		}
+		if newConfig.Repos[repoName].Local {
+			// also refreshes the gauges and indexes the databases
+			go rebuildLocalRepo(newConfig, repoName)
+			continue
+		}
+		storage := newConfig.cacheStorage()
+		totalCacheSize, totalPackageCount, err := gatherCacheStats(storage, repoName)
+		if err != nil {
+			log.Println("Gathering size failed for ", repoName)
+		}
+		cacheSizeGauge.WithLabelValues(repoName).Set(totalCacheSize)
+		cachePackageGauge.WithLabelValues(repoName).Set(totalPackageCount)
+		go loadCachedChecksums(storage, repoName)
+		go loadCachedFilesDBs(storage, repoName)
+		go loadCachedMetadata(storage, repoName)
+	}
+
+	if oldConfig == nil {
+		return
+	}
+	for repoName := range oldConfig.Repos {
+		if _, ok := newConfig.Repos[repoName]; !ok {
+			cacheSizeGauge.DeleteLabelValues(repoName)
+			cachePackageGauge.DeleteLabelValues(repoName)
+			dropRepoDBChecksums(repoName, "")
+			dropFilesIndex(repoName, "")
+			if db := metadataDB.Load(); db != nil {
+				if err := dropMetadata(db, repoName, nil); err != nil {
+					log.Printf("Unable to drop the package metadata of %v: %v", repoName, err)
+				}
+			}
+		}
+	}
+}
+
+// updatePurgeRoutine starts or stops the purge ticker when purging gets
+// enabled or disabled. The routine reads the purge period and the repo list
+// from the active config on every run, so other changes need no restart.
+func updatePurgeRoutine(oldConfig, newConfig *Config) {
+	wasEnabled := oldConfig != nil && oldConfig.PurgeFilesAfter != 0
+	enabled := newConfig.PurgeFilesAfter != 0
+	if wasEnabled == enabled {
+		return
+	}
+	if purgeTicker != nil {
+		purgeTicker.Stop()
+		purgeTicker = nil
+	}
+	if enabled {
+		purgeTicker = setupPurgeStaleFilesRoutine()
+	}
+}
+
+// updateOrphanGCRoutine starts or stops the orphan GC ticker when the
+// orphan_gc section appears or goes away. The routine reads its settings
+// from the active config on every run.
+func updateOrphanGCRoutine(oldConfig, newConfig *Config) {
+	wasEnabled := oldConfig != nil && oldConfig.OrphanGC != nil
+	enabled := newConfig.OrphanGC != nil
+	if wasEnabled == enabled {
+		return
+	}
+	if orphanGCTicker != nil {
+		orphanGCTicker.Stop()
+		orphanGCTicker = nil
+	}
+	if enabled {
+		orphanGCTicker = setupOrphanGCRoutine()
+	}
+}
+
+// updatePrefetchRoutine (re)schedules the prefetch ticker when prefetching
+// gets enabled, disabled or its cron schedule changes.
+func updatePrefetchRoutine(oldConfig, newConfig *Config) {
+	var oldCron, newCron string
+	if oldConfig != nil && oldConfig.Prefetch != nil {
+		oldCron = oldConfig.Prefetch.Cron
+	}
+	if newConfig.Prefetch != nil {
+		newCron = newConfig.Prefetch.Cron
+		if prefetchDB == nil {
+			setupPrefetch() // enable refresh
+		}
+	}
+	if oldCron == newCron {
+		return
+	}
+	if prefetchTicker != nil {
+		prefetchTicker.Stop()
+		prefetchTicker = nil
+	}
+	if newConfig.Prefetch != nil {
+		prefetchTicker = setupPrefetchTicker()
+	}
+}
+
+// reloadConfig re-reads the config file and makes it the active
+// configuration. An invalid file leaves the running config untouched.
+func reloadConfig(configPath string) error {
+	raw, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	newConfig, err := parseConfig(raw)
+	if err != nil {
+		return err
+	}
+
+	oldConfig := config.Load()
+	if newConfig.CacheDir != oldConfig.CacheDir {
+		return fmt.Errorf("changing cache_dir from %v to %v requires a restart", oldConfig.CacheDir, newConfig.CacheDir)
+	}
+	if !sameStorage(newConfig.Storage, oldConfig.Storage) {
+		return fmt.Errorf("changing the storage requires a restart")
+	}
+	if newConfig.Address != oldConfig.Address || newConfig.Port != oldConfig.Port || !sameTls(newConfig.Tls, oldConfig.Tls) {
+		log.Printf("warning: listener settings (address, port, tls) changed, they take effect after a restart")
+	}
+
+	applyConfig(oldConfig, newConfig)
+	log.Printf("Config reloaded from %v, %d repos configured", configPath, len(newConfig.Repos))
+	return nil
+}
+
+func sameStorage(a, b *StorageConfig) bool {
+	if a == nil || a.S3 == nil || b == nil || b.S3 == nil {
+		return (a == nil || a.S3 == nil) == (b == nil || b.S3 == nil)
+	}
+	return *a.S3 == *b.S3
+}
+
+func sameTls(a, b *Tls) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, dir string, content string) string {
+	configPath := filepath.Join(dir, "pacoloco.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(content), 0o644))
+	return configPath
+}
+
+// TestReloadKeepsInflightDownloads verifies that a reload replacing the
+// mirrors of a repo does not disturb a download that is already running: it
+// keeps streaming from the old mirror while new requests use the new one.
+func TestReloadKeepsInflightDownloads(t *testing.T) {
+	const oldContent = "served by the old mirror"
+	const newContent = "served by the new mirror"
+
+	release := make(chan struct{})
+	oldMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(oldContent)))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte(oldContent))
+	}))
+	defer oldMirror.Close()
+	newMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(newContent)))
+		_, _ = w.Write([]byte(newContent))
+	}))
+	defer newMirror.Close()
+
+	dir := t.TempDir()
+	configPath := writeConfigFile(t, dir, `
+cache_dir: `+dir+`
+download_timeout: 10
+repos:
+  reload-repo:
+    url: `+oldMirror.URL+`
+`)
+	raw, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	initial, err := parseConfig(raw)
+	require.NoError(t, err)
+	applyConfig(nil, initial)
+
+	inflight := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/repo/reload-repo/old-1-1-any.pkg.tar.zst", nil)
+		require.NoError(t, handleRequest(w, req))
+		inflight <- w
+	}()
+	require.Eventually(t, func() bool {
+		downloadersMutex.Lock()
+		defer downloadersMutex.Unlock()
+		return len(downloaders) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	writeConfigFile(t, dir, `
+cache_dir: `+dir+`
+download_timeout: 10
+repos:
+  reload-repo:
+    url: `+newMirror.URL+`
+`)
+	require.NoError(t, reloadConfig(configPath))
+	require.Equal(t, newMirror.URL, config.Load().Repos["reload-repo"].URL)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/repo/reload-repo/new-1-1-any.pkg.tar.zst", nil)
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, newContent, w.Body.String(), "new requests must use the reloaded mirrors")
+
+	close(release)
+	select {
+	case w := <-inflight:
+		require.Equal(t, oldContent, w.Body.String(), "the in-flight download must finish from its original mirror")
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight download did not finish after the reload")
+	}
+}
+
+func TestReloadConfigRepoGauges(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "pkgs", "added-repo"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pkgs", "added-repo", "foo-1-1-any.pkg.tar.zst"), []byte("12345"), 0o644))
+
+	configPath := writeConfigFile(t, dir, `
+cache_dir: `+dir+`
+repos:
+  removed-repo:
+    url: http://removed.example.com
+`)
+	raw, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	initial, err := parseConfig(raw)
+	require.NoError(t, err)
+	applyConfig(nil, initial)
+
+	writeConfigFile(t, dir, `
+cache_dir: `+dir+`
+repos:
+  added-repo:
+    url: http://added.example.com
+`)
+	require.NoError(t, reloadConfig(configPath))
+
+	require.False(t, cacheSizeGauge.DeleteLabelValues("removed-repo"), "gauges of a removed repo must be dropped")
+	require.False(t, cachePackageGauge.DeleteLabelValues("removed-repo"), "gauges of a removed repo must be dropped")
+	require.Equal(t, float64(5), testutil.ToFloat64(cacheSizeGauge.WithLabelValues("added-repo")))
+	require.Equal(t, float64(1), testutil.ToFloat64(cachePackageGauge.WithLabelValues("added-repo")))
+}
+
+func TestReloadConfigInvalidKeepsCurrent(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeConfigFile(t, dir, `
+cache_dir: `+dir+`
+repos:
+  stable-repo:
+    url: http://stable.example.com
+`)
+	raw, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	initial, err := parseConfig(raw)
+	require.NoError(t, err)
+	applyConfig(nil, initial)
+
+	writeConfigFile(t, dir, `
+cache_dir: `+dir+`
+repos:
+  stable-repo: {}
+`)
+	require.Error(t, reloadConfig(configPath))
+	require.Same(t, initial, config.Load())
+
+	otherDir := t.TempDir()
+	writeConfigFile(t, dir, `
+cache_dir: `+otherDir+`
+repos:
+  stable-repo:
+    url: http://stable.example.com
+`)
+	err = reloadConfig(configPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "requires a restart")
+	require.Same(t, initial, config.Load())
+}
+
+// TestRequestKeepsItsConfig verifies that a request is served with the
+// config it was parsed under when a reload removes its repo meanwhile.
+func TestRequestKeepsItsConfig(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from the mirror"))
+	}))
+	defer mirror.Close()
+
+	dir := t.TempDir()
+	config.Store(&Config{
+		CacheDir: dir,
+		Repos:    map[string]*Repo{"removed-repo": {URL: mirror.URL}},
+	})
+	f, err := parseRequestURL(config.Load(), "/repo/removed-repo/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.NoError(t, err)
+	config.Store(&Config{CacheDir: dir, Repos: map[string]*Repo{}})
+
+	w := httptest.NewRecorder()
+	require.NoError(t, serveRepoFile(w, httptest.NewRequest(http.MethodGet, "/repo/removed-repo/foo-1.0-1-x86_64.pkg.tar.zst", nil), f))
+	require.Equal(t, "from the mirror", w.Body.String())
+}
+
+func TestRoutineTickerStop(t *testing.T) {
+	ticker := newRoutineTicker(time.Millisecond)
+	require.True(t, ticker.wait())
+
+	returned := make(chan struct{})
+	go func() {
+		for ticker.wait() {
+		}
+		close(returned)
+	}()
+	ticker.Stop()
+	ticker.Stop()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the routine did not return once its ticker was stopped")
+	}
+}
+
+func TestLogFlagsFollowLogTimestamp(t *testing.T) {
+	defer log.SetFlags(log.Flags())
+
+	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
+	applyGlobalSettings(&Config{}, &Config{})
+	require.Equal(t, log.Lshortfile|log.Lmicroseconds, log.Flags(), "a reload that keeps log_timestamp leaves the flags alone")
+
+	applyGlobalSettings(&Config{}, &Config{LogTimestamp: true})
+	require.Equal(t, log.LstdFlags, log.Flags())
+	applyGlobalSettings(&Config{LogTimestamp: true}, &Config{})
+	require.Equal(t, log.Lshortfile, log.Flags())
+}
@@ -3,47 +3,181 @@ package main
 import (
 	"archive/tar"
 	"bufio"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func extractFilenamesFromTar(filePath string) ([]string, error) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
+// repoDBEntry is the part of a package's desc entry in a repo database
+// that pacoloco uses.
+type repoDBEntry struct {
+	FileName  string
+	CSize     int64 // size of the package file
+	SHA256Sum string
+}
+
+// parseDescFields splits a desc file of a repo database into its sections.
+// A desc file is a sequence of "%NAME%" headers, each followed by one value
+// per line and terminated by an empty line.
+func parseDescFields(desc string) map[string][]string {
+	fields := make(map[string][]string)
+	var current string
+	for line := range strings.SplitSeq(desc, "\n") {
+		switch {
+		case len(line) > 2 && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			current = strings.Trim(line, "%")
+			fields[current] = []string{}
+		case line == "":
+			current = ""
+		case current != "":
+			fields[current] = append(fields[current], line)
+		}
 	}
-	defer f.Close()
+	return fields
+}
 
-	var pkgList []string
-	tr := tar.NewReader(bufio.NewReader(f))
+// isRepoDBFile reports whether fileName is a repo database, a .db or a
+// .files file.
+func isRepoDBFile(fileName string) bool {
+	ext := path.Ext(fileName)
+	return ext == ".db" || ext == ".files"
+}
+
+// walkRepoDBTar calls fn with the name and content of every file in an
+// uncompressed repo database, like "acl-2.3.1-1/desc".
+func walkRepoDBTar(r io.Reader, fn func(name string, content string) error) error {
+	tr := tar.NewReader(bufio.NewReader(r))
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
-			break // End of archive
+			return nil // End of archive
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if strings.HasSuffix(hdr.Name, "/desc") {
-			buf := new(strings.Builder)
-			if _, err = io.Copy(buf, tr); err != nil {
-				log.Printf("error: %v", err)
-				return []string{}, err
-			}
-			pkgName := buf.String()
-			matches := filenameDBRegex.FindStringSubmatch(pkgName) // find %FILENAME% and read the following string
-			if len(matches) == 2 {
-				pkgName = matches[1]
-				pkgList = append(pkgList, pkgName)
-			} else {
-				log.Printf("Skipping %v cause it doesn't match regex. This is probably a bug.", hdr.Name)
-				continue
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		buf := new(strings.Builder)
+		if _, err = io.Copy(buf, tr); err != nil {
+			log.Printf("error: %v", err)
+			return err
+		}
+		if err := fn(hdr.Name, buf.String()); err != nil {
+			return err
+		}
+	}
+}
+
+// repoDBFile is a file of a repo database, like "acl-2.3.1-1/desc".
+type repoDBFile struct {
+	name    string
+	content string
+}
+
+// writeCompressedRepoDB writes a gzip compressed repo database with the given files,
+// those of a package next to each other. It replaces dbPath atomically,
+// clients never see half a database.
+func writeCompressedRepoDB(dbPath string, files []repoDBFile, modTime time.Time) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dbPath), "."+filepath.Base(dbPath)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gzipWriter := gzip.NewWriter(tmp)
+	tarWriter := tar.NewWriter(gzipWriter)
+	var dir string
+	for _, f := range files {
+		if d := path.Dir(f.name) + "/"; d != dir {
+			dir = d
+			if err := tarWriter.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0o755, ModTime: modTime}); err != nil {
+				return err
 			}
 		}
+		hdr := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.content)), ModTime: modTime}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tarWriter, f.content); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), time.Now(), modTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dbPath)
+}
+
+// parseRepoDBTar reads the desc entries of an uncompressed repo database.
+func parseRepoDBTar(r io.Reader) ([]repoDBEntry, error) {
+	var entries []repoDBEntry
+	err := walkRepoDBTar(r, func(name string, desc string) error {
+		if !strings.HasSuffix(name, "/desc") {
+			return nil
+		}
+		matches := filenameDBRegex.FindStringSubmatch(desc) // find %FILENAME% and read the following string
+		if len(matches) != 2 {
+			log.Printf("Skipping %v cause it doesn't match regex. This is probably a bug.", name)
+			return nil
+		}
+		entry := repoDBEntry{FileName: matches[1]}
+		fields := parseDescFields(desc)
+		if v := fields["CSIZE"]; len(v) == 1 {
+			entry.CSize, _ = strconv.ParseInt(v[0], 10, 64)
+		}
+		if v := fields["SHA256SUM"]; len(v) == 1 {
+			entry.SHA256Sum = v[0]
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readRepoDB parses a compressed repo database as served by the mirrors.
+func readRepoDB(name string, f io.ReadSeeker) ([]repoDBEntry, error) {
+	r, err := newDecompressReader(name, f, databaseSizeLimit)
+	if err != nil {
+		return nil, err
+	}
+	return parseRepoDBTar(r)
+}
+
+func extractFilenamesFromTar(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := parseRepoDBTar(f)
+	if err != nil {
+		return []string{}, err
+	}
+	pkgList := make([]string, 0, len(entries))
+	for _, e := range entries {
+		pkgList = append(pkgList, e.FileName)
 	}
 	return pkgList, nil
 }
@@ -72,7 +206,7 @@ func buildMirrorPkg(fileName string, repoName string, prefixPath string) (Mirror
 
 // Downloads the db from the mirror and adds MirrorPackages
 func downloadAndParseDb(mirror MirrorDB) error {
-	tmpDir := filepath.Join(config.CacheDir, "tmp-db")
+	tmpDir := filepath.Join(config.Load().CacheDir, "tmp-db")
 	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
 		return err
 	}
@@ -81,7 +215,7 @@ func downloadAndParseDb(mirror MirrorDB) error {
 		return fmt.Errorf("url '%v' is invalid, does not match path regex", mirror.URL)
 	}
 	fileName := matches[3]
-	filePath := filepath.Join(tmpDir, fileName)
+	filePath := filepath.Join(tmpDir, matches[1], fileName)
 	// download the db file
 	if err := prefetchRequest(mirror.URL, tmpDir); err != nil {
 		return err
@@ -96,7 +230,12 @@ func downloadAndParseDb(mirror MirrorDB) error {
 		return err
 	}
 	log.Printf("Parsing %v...", filePath+".tar")
-	fileList, err := extractFilenamesFromTar(filePath + ".tar") // file names are structured as name-version-subversionnumber
+	tarFile, err := os.Open(filePath + ".tar")
+	if err != nil {
+		return err
+	}
+	entries, err := parseRepoDBTar(tarFile) // file names are structured as name-version-subversionnumber
+	tarFile.Close()
 	log.Printf("Parsed %v.", filePath+".tar")
 	if err != nil {
 		return err
@@ -104,10 +243,12 @@ func downloadAndParseDb(mirror MirrorDB) error {
 	if err := os.Remove(filePath + ".tar"); err != nil {
 		return err
 	}
+	// the freshly prefetched database is also the best source of checksums
+	setRepoDBChecksums(mirror.RepoName, fileName, entries)
 	log.Printf("Adding entries to db...")
 	var repoList []MirrorPackage
-	for _, fileName := range fileList {
-		rpkg, err := buildMirrorPkg(fileName, mirror.RepoName, matches[2])
+	for _, entry := range entries {
+		rpkg, err := buildMirrorPkg(entry.FileName, mirror.RepoName, matches[2])
 		if err != nil {
 			// If a repo package has an invalid name
 			// e.g. is not a repo package, maybe it is a src package or whatever, we skip it
@@ -126,7 +267,7 @@ func downloadAndParseDb(mirror MirrorDB) error {
 // download dbs from their URLs stored in the mirror_dbs table and load their content in the mirror_packages table
 func downloadAndParseDbs() error {
 	mirrors := getAllMirrorsDB()
-	dbsPath := filepath.Join(config.CacheDir, "tmp-db")
+	dbsPath := filepath.Join(config.Load().CacheDir, "tmp-db")
 	if err := os.MkdirAll(dbsPath, os.ModePerm); err != nil {
 		return err
 	}
@@ -4,9 +4,13 @@ import (
 	"archive/tar"
 	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -156,6 +160,21 @@ gettext
 	}
 }
 
+// withPackageChecksum rewrites the %CSIZE% and %SHA256SUM% of one db entry
+// so that it describes the given package content.
+func withPackageChecksum(db []testTarDB, pkgName string, pkgContent string) []testTarDB {
+	sum := sha256.Sum256([]byte(pkgContent))
+	csize := regexp.MustCompile(`%CSIZE%\n[^\n]*`)
+	sha := regexp.MustCompile(`%SHA256SUM%\n[^\n]*`)
+	for i := range db {
+		if db[i].PkgName == pkgName {
+			db[i].Content = csize.ReplaceAllString(db[i].Content, "%CSIZE%\n"+strconv.Itoa(len(pkgContent)))
+			db[i].Content = sha.ReplaceAllString(db[i].Content, "%SHA256SUM%\n"+hex.EncodeToString(sum[:]))
+		}
+	}
+	return db
+}
+
 // creates a test tar file
 func createDbTarball(t *testing.T, tarballFilePath string, content []testTarDB) {
 	file, err := os.Create(tarballFilePath)
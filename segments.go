@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Segmented downloads. A large package is split into segments that are
+// downloaded in parallel with Range requests, each starting at a different
+// mirror where the repo has several. The first segment is the beginning of
+// the response that delivered the metadata, so clients streaming the file
+// receive data as early as with a plain download.
+
+// byteRange is the half-open interval [start, end) of a file.
+type byteRange struct {
+	start, end int64
+}
+
+// byteRanges is a set of byte ranges, kept sorted and merged.
+type byteRanges []byteRange
+
+func (r *byteRanges) add(start, end int64) {
+	if start >= end {
+		return
+	}
+	merged := byteRange{start, end}
+	result := make(byteRanges, 0, len(*r)+1)
+	for _, x := range *r {
+		if x.end < merged.start || x.start > merged.end {
+			result = append(result, x)
+			continue
+		}
+		merged.start = min(merged.start, x.start)
+		merged.end = max(merged.end, x.end)
+	}
+	result = append(result, merged)
+	slices.SortFunc(result, func(a, b byteRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	*r = result
+}
+
+// prefix returns the end of the range that starts at the beginning of the
+// file, 0 if there is none.
+func (r byteRanges) prefix() int64 {
+	if len(r) > 0 && r[0].start == 0 {
+		return r[0].end
+	}
+	return 0
+}
+
+// size returns the number of bytes in all ranges.
+func (r byteRanges) size() int64 {
+	var size int64
+	for _, x := range r {
+		size += x.end - x.start
+	}
+	return size
+}
+
+// planSegments decides whether the body of resp is downloaded in segments
+// and splits the file if so. It returns nil for a plain download.
+func (d *Downloader) planSegments(resp *http.Response) []byteRange {
+	sd := d.config.SegmentedDownload
+	// Mutable files are small, and their segments could come from mirrors
+	// that are at different revisions. A peer is on the local network, its
+	// segments would come from the mirrors.
+	if sd == nil || d.peer != "" || resp.Header.Get("Accept-Ranges") != "bytes" || forceCheckAtServer(d.fileName) {
+		return nil
+	}
+	if d.contentLength < int64(sd.MinSizeMB)*1024*1024 || d.contentLength < int64(sd.Segments) {
+		return nil
+	}
+
+	segmentSize := d.contentLength / int64(sd.Segments)
+	segments := make([]byteRange, sd.Segments)
+	for i := range segments {
+		segments[i] = byteRange{int64(i) * segmentSize, int64(i+1) * segmentSize}
+	}
+	segments[len(segments)-1].end = d.contentLength
+	return segments
+}
+
+// receiveSegmented receives the first segment from resp while the other
+// segments are fetched concurrently, and commits the file once all of them
+// are complete.
+func (d *Downloader) receiveSegmented(ctx context.Context, client *http.Client, repoURL string, resp *http.Response, watchdog *time.Timer, stats *transferStats, segments []byteRange) error {
+	upstreamURL := repoURL + d.urlPath
+	log.Printf("downloading %v in %d segments", upstreamURL, len(segments))
+
+	// The mirror serving the first segment is busy with it: the other
+	// segments start at the other mirrors and only fall back to it.
+	urls := slices.DeleteFunc(orderMirrors(d.repo.getUrls()), func(u string) bool { return u == repoURL })
+	urls = append(urls, repoURL)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(segments)-1)
+	for i, s := range segments[1:] {
+		k := i % len(urls)
+		go func() {
+			errs <- d.fetchSegment(ctx, client, slices.Concat(urls[k:], urls[:k]), s)
+		}()
+	}
+
+	first := segments[0]
+	bodyStart := time.Now()
+	n, err := d.copyToBufferFile(resp.Body, first.start, first.end-first.start, func() {
+		watchdog.Reset(downloadStallTimeout)
+	})
+	stats.bodyBytes = n
+	stats.bodyDuration = time.Since(bodyStart)
+	if err == nil && n < first.end-first.start {
+		err = fmt.Errorf("receiving file %v: %w", upstreamURL, io.ErrUnexpectedEOF)
+	}
+	// the other segments are guarded by watchdogs of their own
+	watchdog.Stop()
+
+	for range segments[1:] {
+		if err != nil {
+			cancel()
+		}
+		if segErr := <-errs; segErr != nil && err == nil {
+			err = segErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	watchdog.Reset(downloadStallTimeout)
+	return d.commit(client, upstreamURL, resp, watchdog)
+}
+
+// fetchSegment downloads one segment of the file, trying the urls in
+// order. A mirror failing halfway through hands the rest of the segment
+// over to the next one.
+func (d *Downloader) fetchSegment(ctx context.Context, client *http.Client, urls []string, s byteRange) error {
+	var err error
+	for _, u := range urls {
+		stats := &transferStats{}
+		var n int64
+		n, err = d.fetchRange(ctx, client, u, s, stats)
+		if ctx.Err() != nil {
+			// cancelled because another segment failed
+			return err
+		}
+		recordMirrorTransfer(u, stats, err)
+		if err == nil {
+			return nil
+		}
+		log.Printf("unable to download bytes %d-%d of %v: %v", s.start+n, s.end-1, d.key, err)
+		s.start += n
+	}
+	return err
+}
+
+// fetchRange downloads a byte range of the file from a mirror into the
+// buffer file and returns the number of bytes received.
+func (d *Downloader) fetchRange(ctx context.Context, client *http.Client, repoURL string, r byteRange, stats *transferStats) (int64, error) {
+	upstreamURL := repoURL + d.urlPath
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := time.AfterFunc(downloadStallTimeout, func() {
+		stats.stalled.Store(true)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	req, err := d.newUpstreamRequest(ctx, http.MethodGet, upstreamURL)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.start, r.end-1))
+	req.Header.Add("Accept-Encoding", "identity")
+
+	requested := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	stats.latency = time.Since(requested)
+	watchdog.Reset(downloadStallTimeout)
+
+	downloadedFilesCounter.WithLabelValues(d.repoName, req.Host, strconv.Itoa(resp.StatusCode)).Inc()
+
+	// a mirror ignoring the Range header would send the whole file
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("downloading a segment: %w", &upstreamStatusError{url: upstreamURL, statusCode: resp.StatusCode})
+	}
+	if _, err := d.checkResumedResponse(repoURL, resp, r.start); err != nil {
+		return 0, fmt.Errorf("downloading a segment of %s: %w", upstreamURL, err)
+	}
+
+	bodyStart := time.Now()
+	n, err := d.copyToBufferFile(resp.Body, r.start, r.end-r.start, func() {
+		watchdog.Reset(downloadStallTimeout)
+	})
+	stats.bodyBytes = n
+	stats.bodyDuration = time.Since(bodyStart)
+	if err == nil && n < r.end-r.start {
+		err = fmt.Errorf("downloading a segment of %s: %w", upstreamURL, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteRanges(t *testing.T) {
+	var r byteRanges
+	require.Equal(t, int64(0), r.prefix())
+
+	r.add(10, 20)
+	r.add(30, 40)
+	require.Equal(t, int64(0), r.prefix())
+	require.Equal(t, int64(20), r.size())
+
+	r.add(0, 5)
+	require.Equal(t, int64(5), r.prefix())
+
+	r.add(5, 10) // adjacent ranges merge
+	require.Equal(t, int64(20), r.prefix())
+	require.Equal(t, byteRanges{{0, 20}, {30, 40}}, r)
+
+	r.add(15, 35) // overlapping ranges merge
+	require.Equal(t, byteRanges{{0, 40}}, r)
+	require.Equal(t, int64(40), r.size())
+
+	r.add(50, 50) // empty ranges are ignored
+	require.Equal(t, byteRanges{{0, 40}}, r)
+}
+
+func TestPlanSegments(t *testing.T) {
+	rangesResp := &http.Response{Header: http.Header{"Accept-Ranges": {"bytes"}}}
+	d := &Downloader{
+		config:        &Config{SegmentedDownload: &SegmentedDownload{MinSizeMB: 1, Segments: 3}},
+		fileName:      "big-1-1-any.pkg.tar.zst",
+		contentLength: 2*1024*1024 + 1,
+	}
+	require.Equal(t, []byteRange{{0, 699051}, {699051, 1398102}, {1398102, 2097153}}, d.planSegments(rangesResp))
+
+	// the upstream does not support ranges
+	require.Nil(t, d.planSegments(&http.Response{Header: http.Header{}}))
+
+	// the file is too small
+	d.contentLength = 1024
+	require.Nil(t, d.planSegments(rangesResp))
+
+	// databases are never segmented
+	d.contentLength = 2 * 1024 * 1024
+	d.fileName = "core.db"
+	require.Nil(t, d.planSegments(rangesResp))
+
+	// segmented downloads are disabled
+	d.fileName = "big-1-1-any.pkg.tar.zst"
+	d.config = &Config{}
+	require.Nil(t, d.planSegments(rangesResp))
+}
+
+// rangeMirror serves content with support for Range requests and counts the
+// requests for ranges of it.
+func rangeMirror(t *testing.T, content []byte, ranged *atomic.Int32) *httptest.Server {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(mirror.Close)
+	return mirror
+}
+
+func setupSegmentedRepo(t *testing.T, urls ...string) string {
+	resetMirrorHealth(t)
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:          cacheDir,
+		Port:              -1,
+		DownloadTimeout:   10,
+		Repos:             map[string]*Repo{"segmented-repo": {URLs: urls}},
+		SegmentedDownload: &SegmentedDownload{MinSizeMB: 1, Segments: 4},
+	})
+	return cacheDir
+}
+
+func TestSegmentedDownload(t *testing.T) {
+	content := make([]byte, 3*1024*1024+7)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	var rangedA, rangedB atomic.Int32
+	mirrorA := rangeMirror(t, content, &rangedA)
+	mirrorB := rangeMirror(t, content, &rangedB)
+	cacheDir := setupSegmentedRepo(t, mirrorA.URL, mirrorB.URL)
+
+	const fileName = "big-1-1-x86_64.pkg.tar.zst"
+	req := httptest.NewRequest(http.MethodGet, "/repo/segmented-repo/"+fileName, nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, content, w.Body.Bytes())
+
+	// the first segment comes with the initial response from mirror A, the
+	// other three are spread over both mirrors
+	require.Equal(t, int32(1), rangedA.Load())
+	require.Equal(t, int32(2), rangedB.Load())
+	// the client can have the whole body before the download is committed
+	require.Eventually(t, func() bool {
+		downloadersMutex.Lock()
+		defer downloadersMutex.Unlock()
+		return len(downloaders) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.FileExists(t, filepath.Join(cacheDir, "pkgs", "segmented-repo", fileName))
+	requireNoBufferFiles(t, filepath.Join(cacheDir, "pkgs", "segmented-repo"))
+}
+
+// TestSegmentedDownloadFailover verifies that segments a mirror fails to
+// deliver are fetched from the other mirrors.
+func TestSegmentedDownloadFailover(t *testing.T) {
+	content := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(2)).Read(content)
+
+	var ranged atomic.Int32
+	mirror := rangeMirror(t, content, &ranged)
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer noRanges.Close()
+	setupSegmentedRepo(t, mirror.URL, noRanges.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/segmented-repo/failover-1-1-any.pkg.tar.zst", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, req))
+	require.Equal(t, content, w.Body.Bytes())
+	require.Equal(t, int32(3), ranged.Load())
+}
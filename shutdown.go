@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// downloadsCtx is the base context of every upstream request. Cancelling it
+// aborts all running downloads; shutdown does so once its deadline expires.
+var downloadsCtx, cancelDownloads = context.WithCancel(context.Background())
+
+// shuttingDown is set once a graceful shutdown has started. From then on no
+// new Downloader is created, so the set of downloads to wait for only shrinks.
+var shuttingDown atomic.Bool
+
+// errShuttingDown is returned to requests that would need a new download
+// while the server is shutting down.
+var errShuttingDown = errors.New("server is shutting down")
+
+// prefetchMutex is held for the whole duration of a prefetch run, which
+// writes to prefetchDB. Shutdown takes it before closing the database so
+// that the connection is never closed in the middle of a prefetch.
+var prefetchMutex sync.Mutex
+
+// drainPollInterval is how often shutdown checks the downloaders map while
+// waiting for it to drain.
+const drainPollInterval = 50 * time.Millisecond
+
+// gracefulShutdown stops the server without cutting off work in progress.
+// It stops accepting connections, lets active clients and downloads finish
+// until the deadline of timeout, cancels whatever is still running after
+// that, stops the background routines, saves the access index and closes
+// the prefetch and metadata databases.
+func gracefulShutdown(server *http.Server, timeout time.Duration) {
+	shuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Clients did not finish within %v, closing their connections: %v", timeout, err)
+		_ = server.Close()
+	}
+
+	if purgeTicker != nil {
+		purgeTicker.Stop()
+	}
+	if prefetchTicker != nil {
+		prefetchTicker.Stop()
+	}
+	if orphanGCTicker != nil {
+		orphanGCTicker.Stop()
+	}
+	if accessIndexTicker != nil {
+		accessIndexTicker.Stop()
+	}
+	if clusterTicker != nil {
+		// the membership stays as it is while the server drains
+		clusterTicker.Stop()
+	}
+
+	if !waitForDownloaders(ctx) {
+		log.Printf("Downloads did not finish within %v, cancelling them", timeout)
+		cancelDownloads()
+		// cancelled downloads unwind quickly and remove their buffer files
+		cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cleanupCancel()
+		if !waitForDownloaders(cleanupCtx) {
+			log.Printf("warning: some downloads did not stop, their buffer files are left behind")
+		}
+	}
+
+	saveAccessIndex()
+	closePrefetchDB()
+	closeMetadataDB()
+}
+
+// waitForDownloaders waits until the downloaders map is empty. It returns
+// false if ctx expires first.
+func waitForDownloaders(ctx context.Context) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		downloadersMutex.Lock()
+		active := len(downloaders)
+		downloadersMutex.Unlock()
+		if active == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// closePrefetchDB closes the prefetch database connection, waiting for a
+// running prefetch to finish first.
+func closePrefetchDB() {
+	if prefetchDB == nil {
+		return
+	}
+	prefetchMutex.Lock()
+	defer prefetchMutex.Unlock()
+
+	sqlDB, err := prefetchDB.DB()
+	if err != nil {
+		log.Printf("Unable to get the prefetch db connection: %v", err)
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Unable to close the prefetch db: %v", err)
+	}
+}
+
+// closeMetadataDB closes the package metadata database connection.
+func closeMetadataDB() {
+	db := metadataDB.Load()
+	if db == nil {
+		return
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Printf("Unable to get the metadata db connection: %v", err)
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Unable to close the metadata db: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// resetShutdownState undoes the process-wide effects of gracefulShutdown so
+// that later tests can create downloads again.
+func resetShutdownState(t *testing.T) {
+	t.Cleanup(func() {
+		shuttingDown.Store(false)
+		downloadsCtx, cancelDownloads = context.WithCancel(context.Background())
+	})
+}
+
+// startTestServer serves pacolocoHandler on a local port. Handlers that are
+// still running when the test ends (server.Close does not wait for them)
+// are waited for, so that they do not overlap with the config of the next
+// test.
+func startTestServer(t *testing.T) (*http.Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var handlers sync.WaitGroup
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		pacolocoHandler(w, req)
+	})}
+	go server.Serve(ln)
+	t.Cleanup(handlers.Wait)
+	return server, "http://" + ln.Addr().String()
+}
+
+func requireNoBufferFiles(t *testing.T, repoDir string) {
+	entries, err := os.ReadDir(repoDir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.NotEqual(t, byte('.'), e.Name()[0], "buffer file %v left behind", e.Name())
+	}
+}
+
+// TestGracefulShutdownDrainsDownloads verifies that a shutdown lets an
+// active client download finish instead of cutting it off.
+func TestGracefulShutdownDrainsDownloads(t *testing.T) {
+	resetShutdownState(t)
+	content := "slowly delivered package content"
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer mirror.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 10,
+		Repos:           map[string]*Repo{"drain-repo": {URL: mirror.URL}},
+	})
+	server, serverURL := startTestServer(t)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(serverURL + "/repo/drain-repo/drain-1-1-any.pkg.tar.zst")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	require.Eventually(t, func() bool {
+		downloadersMutex.Lock()
+		defer downloadersMutex.Unlock()
+		return len(downloaders) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	gracefulShutdown(server, 5*time.Second)
+
+	require.Equal(t, content, <-body, "the active download must be completed")
+	cached, err := os.ReadFile(filepath.Join(cacheDir, "pkgs", "drain-repo", "drain-1-1-any.pkg.tar.zst"))
+	require.NoError(t, err)
+	require.Equal(t, content, string(cached))
+	requireNoBufferFiles(t, filepath.Join(cacheDir, "pkgs", "drain-repo"))
+
+	// no new downloads are started once the shutdown began
+	_, err = getDownloader(&RequestedFile{repoName: "drain-repo", fileName: "new-1-1-any.pkg.tar.zst", cacheDir: cacheDir, storage: newFSStorage(filepath.Join(cacheDir, "pkgs"))})
+	require.ErrorIs(t, err, errShuttingDown)
+}
+
+// TestGracefulShutdownCancelsAfterDeadline verifies that downloads still
+// running at the deadline are cancelled and their buffer files removed.
+func TestGracefulShutdownCancelsAfterDeadline(t *testing.T) {
+	resetShutdownState(t)
+	release := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mirror.Close()
+	defer close(release)
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:        cacheDir,
+		Port:            -1,
+		DownloadTimeout: 0,
+		Repos:           map[string]*Repo{"stuck-repo": {URL: mirror.URL}},
+	})
+	server, serverURL := startTestServer(t)
+
+	go func() {
+		resp, err := http.Get(serverURL + "/repo/stuck-repo/stuck-1-1-any.pkg.tar.zst")
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	require.Eventually(t, func() bool {
+		downloadersMutex.Lock()
+		defer downloadersMutex.Unlock()
+		return len(downloaders) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	gracefulShutdown(server, 200*time.Millisecond)
+	require.Less(t, time.Since(start), 5*time.Second, "shutdown must not wait for a stuck download")
+
+	downloadersMutex.Lock()
+	active := len(downloaders)
+	downloadersMutex.Unlock()
+	require.Zero(t, active, "cancelled downloads must be cleaned up")
+	requireNoBufferFiles(t, filepath.Join(cacheDir, "pkgs", "stuck-repo"))
+}
+
+func TestClosePrefetchDB(t *testing.T) {
+	testSetupHelper(t)
+	setupPrefetch()
+
+	closePrefetchDB()
+
+	sqlDB, err := prefetchDB.DB()
+	require.NoError(t, err)
+	require.Error(t, sqlDB.Ping(), "the prefetch db connection must be closed")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errSignatureInvalid reports a package whose detached signature is missing
+// or does not verify against the keyring of its repo. Such packages are
+// quarantined and never served.
+var errSignatureInvalid = errors.New("package signature verification failed")
+
+var signatureFailuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pacoloco_signature_failures_total",
+	Help: "Number of downloaded packages quarantined because their signature did not verify",
+}, []string{"repo", "upstream"})
+
+// maxSignatureSize bounds the size of a detached signature fetched from an
+// upstream; real ones are a few hundred bytes.
+const maxSignatureSize = 64 * 1024
+
+// loadKeyring reads an OpenPGP keyring file, either ASCII armored or binary.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	if isArmored(raw) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(raw))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("keyring %v contains no keys", path)
+	}
+	return keyring, nil
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN"))
+}
+
+// isPackageFile reports whether fileName is a package archive (and not its
+// signature or a database).
+func isPackageFile(fileName string) bool {
+	return filenameRegex.MatchString(fileName) && !strings.HasSuffix(fileName, ".sig")
+}
+
+// checkDetachedSignature verifies that sig is a valid signature of content
+// made by a key of keyring.
+func checkDetachedSignature(keyring openpgp.EntityList, content io.Reader, sig []byte) error {
+	var err error
+	if isArmored(sig) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, content, bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, content, bytes.NewReader(sig), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSignatureInvalid, err)
+	}
+	return nil
+}
+
+// verifySignature checks the package in the buffer file against its
+// detached signature. The signature is taken from the cache if a client
+// already requested it, and fetched from upstreamURL otherwise. A cached
+// signature the package does not verify with can be stale or broken, so
+// the one of the mirror is tried before the package is rejected. A
+// signature fetched here is cached once it verified, pacman asks for it
+// next.
+func (d *Downloader) verifySignature(ctx context.Context, client *http.Client, upstreamURL string) error {
+	sigName := d.fileName + ".sig"
+	sig, err := readCachedFile(d.storage, d.repoName, sigName, maxSignatureSize)
+	fetched := false
+	if err != nil {
+		if sig, err = d.fetchSignature(ctx, client, upstreamURL+".sig"); err != nil {
+			return err
+		}
+		fetched = true
+	}
+
+	verify := func(sig []byte) error {
+		return checkDetachedSignature(d.repo.keyring, io.NewSectionReader(d.bufferFile, 0, d.receivedPrefix()), sig)
+	}
+	err = verify(sig)
+	if err != nil && !fetched {
+		fresh, fetchErr := d.fetchSignature(ctx, client, upstreamURL+".sig")
+		if fetchErr == nil && verify(fresh) == nil {
+			log.Printf("the cached signature %v/%v does not verify, replacing it with the one of the mirror", d.repoName, sigName)
+			if err := d.storage.Delete(d.repoName, sigName); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("unable to delete the cached signature %v: %v", sigName, err)
+			}
+			sig, err, fetched = fresh, nil, true
+		}
+	}
+	if err != nil {
+		d.quarantine(sig)
+		return err
+	}
+
+	if fetched {
+		if err := storeFile(d.storage, d.repoName, sigName, filepath.Dir(d.bufferFile.Name()), sig); err != nil {
+			log.Printf("unable to cache signature %v: %v", sigName, err)
+		}
+	}
+	return nil
+}
+
+// fetchSignature downloads a detached signature. A signature the upstream
+// does not have is reported as errSignatureInvalid: a package without one
+// cannot be trusted either.
+func (d *Downloader) fetchSignature(ctx context.Context, client *http.Client, sigURL string) ([]byte, error) {
+	req, err := d.newUpstreamRequest(ctx, http.MethodGet, sigURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %v not found", errSignatureInvalid, sigURL)
+	default:
+		return nil, fmt.Errorf("unable to download signature %s, status code is %d", sigURL, resp.StatusCode)
+	}
+
+	sig, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) > maxSignatureSize {
+		return nil, fmt.Errorf("%w: %v is larger than %v bytes", errSignatureInvalid, sigURL, maxSignatureSize)
+	}
+	return sig, nil
+}
+
+// quarantineDir is where packages that failed signature verification are
+// kept for inspection, outside of the served cache.
+func quarantineDir(cacheDir string, repoName string) string {
+	return filepath.Join(cacheDir, "quarantine", repoName)
+}
+
+// quarantine copies the rejected package and its signature out of the
+// buffer file, which is reused for the next mirror.
+func (d *Downloader) quarantine(sig []byte) {
+	dir := quarantineDir(d.config.CacheDir, d.repoName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("unable to create quarantine directory %v: %v", dir, err)
+		return
+	}
+	path := filepath.Join(dir, d.fileName)
+
+	out, err := os.Create(path)
+	if err != nil {
+		log.Printf("unable to quarantine %v: %v", path, err)
+		return
+	}
+	_, err = io.Copy(out, io.NewSectionReader(d.bufferFile, 0, d.receivedPrefix()))
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.WriteFile(path+".sig", sig, 0o644)
+	}
+	if err != nil {
+		log.Printf("unable to quarantine %v: %v", path, err)
+		return
+	}
+	log.Printf("quarantined %v: its signature does not verify", path)
+}
+
+// readCachedFile reads a small cached file, failing if it is larger than
+// maxSize.
+func readCachedFile(storage Storage, repo, name string, maxSize int64) ([]byte, error) {
+	r, err := storage.Open(repo, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("cached file %v/%v is larger than %v bytes", repo, name, maxSize)
+	}
+	return data, nil
+}
+
+// storeFile writes a cache entry through a buffer file in bufferDir, so
+// that readers never see it half written.
+func storeFile(storage Storage, repo, name string, bufferDir string, data []byte) error {
+	tmp, err := os.CreateTemp(bufferDir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // left behind unless the storage moved it
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	return storage.Commit(repo, name, tmp, time.Time{})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSigner creates a signing key and writes its public part as an
+// armored keyring file.
+func newTestSigner(t *testing.T, dir string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Test Packager", "", "packager@example.com", nil)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+
+	keyringPath := filepath.Join(dir, "keyring.asc")
+	require.NoError(t, os.WriteFile(keyringPath, buf.Bytes(), 0o644))
+	return entity, keyringPath
+}
+
+func detachSign(t *testing.T, signer *openpgp.Entity, content string) []byte {
+	var sig bytes.Buffer
+	require.NoError(t, openpgp.DetachSign(&sig, signer, strings.NewReader(content), nil))
+	return sig.Bytes()
+}
+
+// signedMirror serves a package and its detached signature. The signature
+// is read at request time, as the signing key only exists once the repo is
+// configured with the mirror.
+func signedMirror(pkgName string, content string, sig *[]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + pkgName:
+			_, _ = w.Write([]byte(content))
+		case "/" + pkgName + ".sig":
+			_, _ = w.Write(*sig)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func setupKeyringRepo(t *testing.T, repoName string, urls ...string) (*openpgp.Entity, string) {
+	cacheDir := t.TempDir()
+	signer, keyringPath := newTestSigner(t, t.TempDir())
+	raw := "cache_dir: " + cacheDir + "\nrepos:\n  " + repoName + ":\n    keyring: " + keyringPath + "\n    urls:\n"
+	for _, u := range urls {
+		raw += "      - " + u + "\n"
+	}
+	c, err := parseConfig([]byte(raw))
+	require.NoError(t, err)
+	c.Port = -1
+	config.Store(c)
+	return signer, cacheDir
+}
+
+func TestSignedPackageIsVerified(t *testing.T) {
+	const pkgName = "signed-1-1-any.pkg.tar.zst"
+	const content = "a package signed by the packager"
+
+	var sig []byte
+	mirror := signedMirror(pkgName, content, &sig)
+	defer mirror.Close()
+	signer, cacheDir := setupKeyringRepo(t, "signed-repo", mirror.URL)
+	sig = detachSign(t, signer, content)
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/signed-repo/"+pkgName, nil)
+	w := httptest.NewRecorder()
+	pacolocoHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, content, w.Body.String())
+
+	repoDir := filepath.Join(cacheDir, "pkgs", "signed-repo")
+	cached, err := os.ReadFile(filepath.Join(repoDir, pkgName))
+	require.NoError(t, err)
+	require.Equal(t, content, string(cached))
+	cachedSig, err := os.ReadFile(filepath.Join(repoDir, pkgName+".sig"))
+	require.NoError(t, err)
+	require.Equal(t, sig, cachedSig, "the fetched signature is cached for pacman")
+	requireNoBufferFiles(t, repoDir)
+}
+
+// TestTamperedPackageIsQuarantined verifies that a package whose signature
+// does not verify is moved aside and the next mirror is used instead.
+func TestTamperedPackageIsQuarantined(t *testing.T) {
+	const pkgName = "tampered-1-1-any.pkg.tar.zst"
+	const content = "the package as the packager built it"
+	const tampered = "a package with a backdoor built into"
+
+	var sig []byte
+	evil := signedMirror(pkgName, tampered, &sig)
+	defer evil.Close()
+	good := signedMirror(pkgName, content, &sig)
+	defer good.Close()
+	signer, cacheDir := setupKeyringRepo(t, "tampered-repo", evil.URL, good.URL)
+	sig = detachSign(t, signer, content)
+
+	evilHost := evil.Listener.Addr().String()
+	before := testutil.ToFloat64(signatureFailuresCounter.WithLabelValues("tampered-repo", evilHost))
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/tampered-repo/"+pkgName, nil)
+	w := httptest.NewRecorder()
+	pacolocoHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, content, w.Body.String())
+
+	require.Equal(t, before+1, testutil.ToFloat64(signatureFailuresCounter.WithLabelValues("tampered-repo", evilHost)))
+	quarantined, err := os.ReadFile(filepath.Join(cacheDir, "quarantine", "tampered-repo", pkgName))
+	require.NoError(t, err)
+	require.Equal(t, tampered, string(quarantined))
+	require.FileExists(t, filepath.Join(cacheDir, "quarantine", "tampered-repo", pkgName+".sig"))
+}
+
+func TestUnverifiablePackageIsNotServed(t *testing.T) {
+	const pkgName = "unsigned-1-1-any.pkg.tar.zst"
+	const content = "a package signed by somebody else"
+
+	stranger, _ := newTestSigner(t, t.TempDir())
+	sig := detachSign(t, stranger, content)
+	mirror := signedMirror(pkgName, content, &sig)
+	defer mirror.Close()
+	_, cacheDir := setupKeyringRepo(t, "unsigned-repo", mirror.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/unsigned-repo/"+pkgName, nil)
+	w := httptest.NewRecorder()
+	pacolocoHandler(w, req)
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	require.Empty(t, w.Body.String())
+
+	require.NoFileExists(t, filepath.Join(cacheDir, "pkgs", "unsigned-repo", pkgName))
+	require.FileExists(t, filepath.Join(cacheDir, "quarantine", "unsigned-repo", pkgName))
+}
+
+func TestLoadKeyringInvalid(t *testing.T) {
+	dir := t.TempDir()
+	keyringPath := filepath.Join(dir, "keyring.gpg")
+	require.NoError(t, os.WriteFile(keyringPath, []byte("not a keyring"), 0o644))
+
+	_, err := parseConfig([]byte(`
+cache_dir: ` + dir + `
+repos:
+  signed:
+    url: http://signed.example.com
+    keyring: ` + keyringPath + `
+`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to load keyring")
+}
+
+// TestStaleCachedSignatureIsRefetched verifies that a cached signature the
+// package does not verify with is replaced by the one of the mirror instead
+// of getting the package rejected.
+func TestStaleCachedSignatureIsRefetched(t *testing.T) {
+	const pkgName = "resigned-1-1-any.pkg.tar.zst"
+	const content = "a package that was signed again"
+
+	var sig []byte
+	mirror := signedMirror(pkgName, content, &sig)
+	defer mirror.Close()
+	signer, cacheDir := setupKeyringRepo(t, "resigned-repo", mirror.URL)
+	sig = detachSign(t, signer, content)
+
+	repoDir := filepath.Join(cacheDir, "pkgs", "resigned-repo")
+	require.NoError(t, os.MkdirAll(repoDir, os.ModePerm))
+	stale := detachSign(t, signer, "the package before it was rebuilt")
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, pkgName+".sig"), stale, 0o644))
+
+	req := httptest.NewRequest(http.MethodGet, "/repo/resigned-repo/"+pkgName, nil)
+	w := httptest.NewRecorder()
+	pacolocoHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, content, w.Body.String())
+
+	cachedSig, err := os.ReadFile(filepath.Join(repoDir, pkgName+".sig"))
+	require.NoError(t, err)
+	require.Equal(t, sig, cachedSig, "the stale signature is replaced")
+	require.NoFileExists(t, filepath.Join(cacheDir, "quarantine", "resigned-repo", pkgName))
+}
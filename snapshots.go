@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshots. A snapshot preserves the cached databases of repos as they are
+// at one point in time, like the Arch Linux Archive does for the official
+// repos, so that machines pointed at it install the same package versions
+// whenever they run. Snapshots are served under /snapshot/<name>/<repo>/...
+// and the packages their databases list are exempt from the purge, the
+// orphan GC, eviction and the prefetcher's cleanup.
+
+// snapshotsDir is the directory in cache_dir the snapshots are kept in, one
+// directory per snapshot with a copy of the databases of every repo.
+const snapshotsDir = "snapshots"
+
+// snapshotManifestName is the file in a snapshot directory describing it.
+const snapshotManifestName = "snapshot.json"
+
+var (
+	snapshotNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	snapshotPathRegex = regexp.MustCompile("^/snapshot/([^/]*)/([^/]*)(/.*)?/([^/]*)$")
+)
+
+var (
+	errSnapshotExists  = errors.New("snapshot exists")
+	errInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+// Snapshot describes a snapshot, as stored in its manifest.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Repos lists the database files preserved for every repo.
+	Repos map[string][]string `json:"repos"`
+	// Packages is the number of package files the databases list.
+	Packages int `json:"packages"`
+	// DBPaths holds the path at the repo every database was requested at,
+	// by repo and database name, if it was known when the snapshot was
+	// created. The packages a database lists are fetched from there.
+	DBPaths map[string]map[string]string `json:"db_paths,omitempty"`
+}
+
+// snapshotEntry is a loaded snapshot with the eviction keys of the
+// packages it retains.
+type snapshotEntry struct {
+	Snapshot
+	pins map[string]bool
+}
+
+// snapshots holds the snapshots by name.
+var (
+	snapshots      = make(map[string]*snapshotEntry)
+	snapshotsMutex sync.RWMutex
+)
+
+// snapshotsCreateMutex serializes the creation of snapshots, which copies
+// and parses databases without holding snapshotsMutex.
+var snapshotsCreateMutex sync.Mutex
+
+// repoDBPaths holds the path at repo each database was last requested at,
+// by repo and database name. The packages a database lists are fetched
+// from the same path. pendingSnapshotFetches holds the snapshots, by repo
+// and database name, whose packages wait for the path of the database to
+// be known.
+var (
+	repoDBPaths            = make(map[string]map[string]string)
+	pendingSnapshotFetches = make(map[string]map[string][]string)
+	repoDBPathsMutex       sync.Mutex
+)
+
+// recordRepoDBPath remembers the path a database is requested at, and
+// fetches the packages of the snapshots that waited for it.
+func recordRepoDBPath(f *RequestedFile) {
+	repoDBPathsMutex.Lock()
+	if repoDBPaths[f.repoName] == nil {
+		repoDBPaths[f.repoName] = make(map[string]string)
+	}
+	repoDBPaths[f.repoName][f.fileName] = f.pathAtRepo
+	pending := pendingSnapshotFetches[f.repoName][f.fileName]
+	delete(pendingSnapshotFetches[f.repoName], f.fileName)
+	repoDBPathsMutex.Unlock()
+
+	for _, name := range pending {
+		snapshotsMutex.RLock()
+		s := snapshots[name]
+		snapshotsMutex.RUnlock()
+		if s != nil {
+			go fetchSnapshotDBPackages(f.config, &s.Snapshot, f.repoName, f.fileName, f.pathAtRepo)
+		}
+	}
+}
+
+// repoDBPath returns the path a database was last requested at. If it is
+// not known, the packages of the snapshot name are fetched once it is.
+func repoDBPath(repoName string, dbName string, name string) (string, bool) {
+	repoDBPathsMutex.Lock()
+	defer repoDBPathsMutex.Unlock()
+	pathAtRepo, ok := repoDBPaths[repoName][dbName]
+	if !ok && !slices.Contains(pendingSnapshotFetches[repoName][dbName], name) {
+		if pendingSnapshotFetches[repoName] == nil {
+			pendingSnapshotFetches[repoName] = make(map[string][]string)
+		}
+		pendingSnapshotFetches[repoName][dbName] = append(pendingSnapshotFetches[repoName][dbName], name)
+	}
+	return pathAtRepo, ok
+}
+
+// snapshotDir returns the directory of a snapshot.
+func snapshotDir(cacheDir string, name string) string {
+	return filepath.Join(cacheDir, snapshotsDir, name)
+}
+
+// readSnapshotPins lists the eviction keys of the packages the databases
+// of a snapshot in dir reference.
+func readSnapshotPins(dir string, s *Snapshot) (map[string]bool, error) {
+	storage := newFSStorage(dir)
+	pins := make(map[string]bool)
+	for repoName, dbNames := range s.Repos {
+		for _, dbName := range dbNames {
+			if filepath.Ext(dbName) != ".db" {
+				continue // the .files databases list the same packages
+			}
+			entries, err := readCachedRepoDB(storage, repoName, dbName)
+			if err != nil {
+				return nil, fmt.Errorf("reading %v/%v: %w", repoName, dbName, err)
+			}
+			for _, e := range entries {
+				pins[evictionKey(repoName, e.FileName)] = true
+			}
+		}
+	}
+	return pins, nil
+}
+
+// loadSnapshots reads the snapshots in cacheDir. Broken snapshots are
+// reported and skipped.
+func loadSnapshots(cacheDir string) {
+	dirs, err := os.ReadDir(filepath.Join(cacheDir, snapshotsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Unable to read the snapshots: %v", err)
+	}
+	loaded := make(map[string]*snapshotEntry)
+	for _, d := range dirs {
+		if !d.IsDir() || isBufferFile(d.Name()) {
+			continue
+		}
+		dir := snapshotDir(cacheDir, d.Name())
+		manifest, err := os.ReadFile(filepath.Join(dir, snapshotManifestName))
+		if err != nil {
+			log.Printf("Skipping snapshot %v: %v", d.Name(), err)
+			continue
+		}
+		entry := &snapshotEntry{}
+		if err := json.Unmarshal(manifest, &entry.Snapshot); err != nil {
+			log.Printf("Skipping snapshot %v: %v", d.Name(), err)
+			continue
+		}
+		if entry.pins, err = readSnapshotPins(dir, &entry.Snapshot); err != nil {
+			log.Printf("Skipping snapshot %v: %v", d.Name(), err)
+			continue
+		}
+		loaded[entry.Name] = entry
+	}
+
+	snapshotsMutex.Lock()
+	snapshots = loaded
+	snapshotsMutex.Unlock()
+	if len(loaded) > 0 {
+		log.Printf("Loaded %d snapshots", len(loaded))
+	}
+}
+
+// createSnapshot preserves the cached databases of the given repos, or of
+// all repos if there are none given, as snapshot name. The name defaults
+// to the current date. The packages the databases list that are not cached
+// yet are fetched in the background, before the mirrors drop them.
+func createSnapshot(c *Config, name string, repoNames []string) (*Snapshot, error) {
+	if name == "" {
+		name = time.Now().UTC().Format(time.DateOnly)
+	}
+	if !snapshotNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("%w: name %q must consist of letters, digits, '.', '_' and '-'", errInvalidSnapshot, name)
+	}
+	if len(repoNames) == 0 {
+		for repoName, repo := range c.Repos {
+			if !repo.isMerged() {
+				repoNames = append(repoNames, repoName)
+			}
+		}
+	}
+	for _, repoName := range repoNames {
+		repo := c.Repos[repoName]
+		if repo == nil {
+			return nil, fmt.Errorf("%w: repo %v is not configured", errNotFound, repoName)
+		}
+		if repo.isMerged() {
+			return nil, fmt.Errorf("%w: repo %v is a merged repo, snapshot the repos it merges", errInvalidSnapshot, repoName)
+		}
+	}
+
+	snapshotsCreateMutex.Lock()
+	defer snapshotsCreateMutex.Unlock()
+	if snapshotExists(name) {
+		return nil, fmt.Errorf("%w: %v", errSnapshotExists, name)
+	}
+
+	// assembled under a buffer name, so that a half copied snapshot is
+	// never served
+	root := filepath.Join(c.CacheDir, snapshotsDir)
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp(root, "."+name+"-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := &Snapshot{Name: name, Created: time.Now().UTC(), Repos: make(map[string][]string), DBPaths: make(map[string]map[string]string)}
+	for _, repoName := range repoNames {
+		storage := c.repoStorage(repoName)
+		files, err := storage.List(repoName)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !isRepoDBFile(strings.TrimSuffix(f.Name, ".sig")) || strings.Contains(f.Name, "/") {
+				continue
+			}
+			if err := copySnapshotFile(storage, repoName, f, filepath.Join(tmpDir, repoName, f.Name)); err != nil {
+				return nil, fmt.Errorf("copying %v/%v: %w", repoName, f.Name, err)
+			}
+			s.Repos[repoName] = append(s.Repos[repoName], f.Name)
+			repoDBPathsMutex.Lock()
+			if pathAtRepo, ok := repoDBPaths[repoName][f.Name]; ok {
+				if s.DBPaths[repoName] == nil {
+					s.DBPaths[repoName] = make(map[string]string)
+				}
+				s.DBPaths[repoName][f.Name] = pathAtRepo
+			}
+			repoDBPathsMutex.Unlock()
+		}
+		slices.Sort(s.Repos[repoName])
+	}
+	if len(s.Repos) == 0 {
+		return nil, fmt.Errorf("%w: no database of the repos is cached", errInvalidSnapshot)
+	}
+
+	pins, err := readSnapshotPins(tmpDir, s)
+	if err != nil {
+		return nil, err
+	}
+	s.Packages = len(pins)
+	manifest, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, snapshotManifestName), manifest, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpDir, snapshotDir(c.CacheDir, name)); err != nil {
+		return nil, err
+	}
+	snapshotsMutex.Lock()
+	snapshots[name] = &snapshotEntry{Snapshot: *s, pins: pins}
+	snapshotsMutex.Unlock()
+	log.Printf("Created snapshot %v of %d repos, retaining %d packages", name, len(s.Repos), s.Packages)
+	go fetchSnapshotPackages(c, s)
+	return s, nil
+}
+
+// snapshotExists reports whether there is a snapshot name.
+func snapshotExists(name string) bool {
+	snapshotsMutex.RLock()
+	defer snapshotsMutex.RUnlock()
+	return snapshots[name] != nil
+}
+
+// fetchSnapshotPackages downloads the packages the databases of snapshot s
+// list that are not cached, from the path their database was requested at.
+// The packages of a database whose path is not known yet are fetched when
+// a client requests it.
+func fetchSnapshotPackages(c *Config, s *Snapshot) {
+	for repoName, dbNames := range s.Repos {
+		for _, dbName := range dbNames {
+			if filepath.Ext(dbName) != ".db" {
+				continue
+			}
+			pathAtRepo, ok := s.DBPaths[repoName][dbName]
+			if !ok {
+				pathAtRepo, ok = repoDBPath(repoName, dbName, s.Name)
+			}
+			if !ok {
+				log.Printf("Fetching the packages %v/%v of snapshot %v lists once a client requests the database", repoName, dbName, s.Name)
+				continue
+			}
+			if !fetchSnapshotDBPackages(c, s, repoName, dbName, pathAtRepo) {
+				return
+			}
+		}
+	}
+}
+
+// fetchSnapshotDBPackages downloads the packages a database of snapshot s
+// lists that are not cached from pathAtRepo. It returns false if it stopped
+// because the snapshot was deleted or the server shuts down.
+func fetchSnapshotDBPackages(c *Config, s *Snapshot, repoName string, dbName string, pathAtRepo string) bool {
+	if repo := c.Repos[repoName]; repo == nil || repo.Local {
+		return true // local repos have all their packages
+	}
+	entries, err := readCachedRepoDB(newFSStorage(snapshotDir(c.CacheDir, s.Name)), repoName, dbName)
+	if err != nil {
+		log.Printf("Unable to fetch the packages %v/%v of snapshot %v lists: %v", repoName, dbName, s.Name, err)
+		return true
+	}
+	fetched, failed := 0, 0
+	defer func() {
+		if fetched > 0 || failed > 0 {
+			log.Printf("Fetched %d packages %v/%v of snapshot %v lists, %d failed", fetched, repoName, dbName, s.Name, failed)
+		}
+	}()
+	for _, e := range entries {
+		if shuttingDown.Load() || !snapshotExists(s.Name) {
+			return false
+		}
+		f := newRequestedFile(c, repoName, pathAtRepo, e.FileName)
+		if f.cachedFileExists() {
+			continue
+		}
+		if err := f.mkCacheDir(); err != nil {
+			log.Printf("Unable to fetch %v for snapshot %v: %v", f.key(), s.Name, err)
+			return false
+		}
+		if err := fetchFile(f); err != nil {
+			log.Printf("Unable to fetch %v for snapshot %v: %v", f.key(), s.Name, err)
+			failed++
+			continue
+		}
+		fetched++
+	}
+	return true
+}
+
+// copySnapshotFile copies a cached file into a snapshot, keeping its
+// modification time for If-Modified-Since requests.
+func copySnapshotFile(storage Storage, repoName string, f CachedFile, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	src, err := storage.Open(repoName, f.Name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, time.Now(), f.ModTime)
+}
+
+// deleteSnapshot removes a snapshot; the packages it retained are left to
+// the purge and the orphan GC.
+func deleteSnapshot(cacheDir string, name string) error {
+	snapshotsMutex.Lock()
+	defer snapshotsMutex.Unlock()
+	if snapshots[name] == nil {
+		return fmt.Errorf("%w: snapshot %v does not exist", errNotFound, name)
+	}
+	if err := os.RemoveAll(snapshotDir(cacheDir, name)); err != nil {
+		return err
+	}
+	delete(snapshots, name)
+	log.Printf("Deleted snapshot %v", name)
+	return nil
+}
+
+// listSnapshots returns the snapshots, the oldest first.
+func listSnapshots() []Snapshot {
+	snapshotsMutex.RLock()
+	defer snapshotsMutex.RUnlock()
+	list := make([]Snapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		list = append(list, s.Snapshot)
+	}
+	slices.SortFunc(list, func(a, b Snapshot) int {
+		if ret := a.Created.Compare(b.Created); ret != 0 {
+			return ret
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// snapshotPinned reports whether a snapshot retains a cached file.
+func snapshotPinned(repoName string, fileName string) bool {
+	key := evictionKey(repoName, fileName)
+	snapshotsMutex.RLock()
+	defer snapshotsMutex.RUnlock()
+	for _, s := range snapshots {
+		if s.pins[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// addSnapshotPins adds the eviction keys of the packages the snapshots
+// retain to pinned.
+func addSnapshotPins(pinned map[string]bool) {
+	snapshotsMutex.RLock()
+	defer snapshotsMutex.RUnlock()
+	for _, s := range snapshots {
+		for key := range s.pins {
+			pinned[key] = true
+		}
+	}
+}
+
+func snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	if err := handleSnapshotRequest(w, req); err != nil {
+		writeRequestError(w, err)
+	}
+}
+
+// handleSnapshotRequest serves /snapshot/<name>/<repo>/<path>/<file>: the
+// databases from the snapshot, packages like /repo/<repo>/<path>/<file>.
+func handleSnapshotRequest(w http.ResponseWriter, req *http.Request) error {
+	matches := snapshotPathRegex.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		return fmt.Errorf("%w: input url path '%v' does not match expected format", errNotFound, req.URL.Path)
+	}
+	name, repoName, pathAtRepo, fileName := matches[1], matches[2], matches[3], matches[4]
+
+	snapshotsMutex.RLock()
+	s := snapshots[name]
+	snapshotsMutex.RUnlock()
+	if s == nil {
+		return fmt.Errorf("%w: snapshot %v does not exist", errNotFound, name)
+	}
+	c := config.Load()
+	if s.Repos[repoName] == nil || c.Repos[repoName] == nil {
+		return fmt.Errorf("%w: snapshot %v has no repo %v", errNotFound, name, repoName)
+	}
+	if err := authorize(c, req, repoName); err != nil {
+		return err
+	}
+
+	if !isRepoDBFile(strings.TrimSuffix(fileName, ".sig")) {
+		return serveRepoFile(w, req, newRequestedFile(c, repoName, pathAtRepo, fileName))
+	}
+	f := &RequestedFile{
+		repoName:   repoName,
+		pathAtRepo: pathAtRepo,
+		fileName:   fileName,
+		storage:    newFSStorage(snapshotDir(c.CacheDir, name)),
+	}
+	cacheRequestsCounter.WithLabelValues(repoName).Inc()
+	if err := serveCachedFile(w, req, f); err != nil {
+		cacheServingFailedCounter.WithLabelValues(repoName).Inc()
+		return err
+	}
+	cacheServedCounter.WithLabelValues(repoName).Inc()
+	return nil
+}
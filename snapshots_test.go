@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func resetSnapshots(t *testing.T) {
+	reset := func() {
+		snapshotsMutex.Lock()
+		snapshots = make(map[string]*snapshotEntry)
+		snapshotsMutex.Unlock()
+		repoDBPathsMutex.Lock()
+		repoDBPaths = make(map[string]map[string]string)
+		pendingSnapshotFetches = make(map[string]map[string][]string)
+		repoDBPathsMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func snapshotAPIRequest(t *testing.T, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	apiHandler().ServeHTTP(w, req)
+	return w
+}
+
+func snapshotRequest(t *testing.T, urlPath string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	if err := handleSnapshotRequest(w, httptest.NewRequest(http.MethodGet, urlPath, nil)); err != nil {
+		writeRequestError(w, err)
+	}
+	return w
+}
+
+func TestSnapshots(t *testing.T) {
+	resetSnapshots(t)
+	cacheDir := setupAPIConfig(t)
+	dbTime := time.Unix(1700000000, 0)
+	writeRepoDB(t, cacheDir, "api-repo", "core.db", dbTime, []testTarDB{fooDesc("1.0-1", "x86_64")})
+
+	w := snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", `{"name": "before", "repos": ["api-repo"]}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	s := decodeAPIResponse[Snapshot](t, w)
+	require.Equal(t, "before", s.Name)
+	require.Equal(t, map[string][]string{"api-repo": {"core.db"}}, s.Repos)
+	require.Equal(t, 1, s.Packages)
+
+	require.Equal(t, http.StatusConflict, snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", `{"name": "before"}`).Code)
+	require.Equal(t, http.StatusBadRequest, snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", `{"name": "../x"}`).Code)
+	require.Equal(t, http.StatusNotFound, snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", `{"repos": ["unknown"]}`).Code)
+	require.Equal(t, http.StatusBadRequest, snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", `{"repos": ["empty-repo"]}`).Code, "nothing to snapshot")
+
+	// the repo moves on, the snapshot does not
+	writeRepoDB(t, cacheDir, "api-repo", "core.db", time.Now(), []testTarDB{fooDesc("1.1-1", "x86_64")})
+	w = snapshotRequest(t, "/snapshot/before/api-repo/core/os/x86_64/core.db")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, dbTime.UTC().Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+	entries, err := readRepoDB("core.db", strings.NewReader(w.Body.String()))
+	require.NoError(t, err)
+	require.Equal(t, "foo-1.0-1-x86_64.pkg.tar.zst", entries[0].FileName)
+
+	// packages are served from the repo
+	w = snapshotRequest(t, "/snapshot/before/api-repo/core/os/x86_64/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "1234567890", w.Body.String())
+	require.Equal(t, http.StatusNotFound, snapshotRequest(t, "/snapshot/before/api-repo/core.db.sig").Code)
+	require.Equal(t, http.StatusNotFound, snapshotRequest(t, "/snapshot/before/empty-repo/core.db").Code)
+	require.Equal(t, http.StatusNotFound, snapshotRequest(t, "/snapshot/unknown/api-repo/core.db").Code)
+
+	// the packages the snapshot lists survive the purge
+	repoDir := filepath.Join(cacheDir, "pkgs", "api-repo")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"foo-1.0-1-x86_64.pkg.tar.zst", "foo-1.0-1-x86_64.pkg.tar.zst.sig", "foobar-1.0-1-any.pkg.tar.zst"} {
+		require.NoError(t, os.Chtimes(filepath.Join(repoDir, name), old, old))
+	}
+	purgeStaleFiles(config.Load().cacheStorage(), cacheDir, 3600, "api-repo")
+	require.FileExists(t, filepath.Join(repoDir, "foo-1.0-1-x86_64.pkg.tar.zst"))
+	require.FileExists(t, filepath.Join(repoDir, "foo-1.0-1-x86_64.pkg.tar.zst.sig"))
+	require.NoFileExists(t, filepath.Join(repoDir, "foobar-1.0-1-any.pkg.tar.zst"))
+	require.True(t, pinnedFiles()["api-repo/foo-1.0-1-x86_64.pkg.tar.zst"], "and eviction")
+
+	// snapshots are loaded on startup
+	w = snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Equal(t, time.Now().UTC().Format(time.DateOnly), decodeAPIResponse[Snapshot](t, w).Name, "named after the date by default")
+	loadSnapshots(cacheDir)
+	w = snapshotAPIRequest(t, http.MethodGet, "/api/v1/snapshots", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	list := decodeAPIResponse[[]Snapshot](t, w)
+	require.Len(t, list, 2)
+	require.Equal(t, "before", list[0].Name)
+
+	require.Equal(t, http.StatusOK, snapshotAPIRequest(t, http.MethodDelete, "/api/v1/snapshots/before", "").Code)
+	require.Equal(t, http.StatusNotFound, snapshotAPIRequest(t, http.MethodDelete, "/api/v1/snapshots/before", "").Code)
+	require.NoDirExists(t, snapshotDir(cacheDir, "before"))
+	require.Equal(t, http.StatusNotFound, snapshotRequest(t, "/snapshot/before/api-repo/core.db").Code)
+	require.Len(t, listSnapshots(), 1)
+}
+
+func TestSnapshotFetchesPackages(t *testing.T) {
+	resetSnapshots(t)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/core/os/x86_64/core.db":
+			w.WriteHeader(http.StatusNotModified)
+		case "/core/os/x86_64/foo-1.1-1-x86_64.pkg.tar.zst":
+			_, _ = w.Write([]byte("foo package"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:   cacheDir,
+		Port:       -1,
+		AdminToken: testAdminToken,
+		Repos:      map[string]*Repo{"snap-repo": {URL: mirror.URL}},
+	})
+	writeRepoDB(t, cacheDir, "snap-repo", "core.db", time.Unix(1700000000, 0), []testTarDB{fooDesc("1.1-1", "x86_64")})
+	// a client tells where the database and its packages are
+	w := httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, httptest.NewRequest(http.MethodGet, "/repo/snap-repo/core/os/x86_64/core.db", nil)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", `{"name": "fetching"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	pkgPath := filepath.Join(cacheDir, "pkgs", "snap-repo", "foo-1.1-1-x86_64.pkg.tar.zst")
+	require.Eventually(t, func() bool {
+		content, err := os.ReadFile(pkgPath)
+		return err == nil && string(content) == "foo package"
+	}, 5*time.Second, 10*time.Millisecond, "the packages the snapshot lists are fetched")
+	require.True(t, snapshotPinned("snap-repo", "foo-1.1-1-x86_64.pkg.tar.zst"))
+
+	// the path is kept in the manifest, for the snapshot to outlive a restart
+	manifest, err := os.ReadFile(filepath.Join(cacheDir, "snapshots", "fetching", "snapshot.json"))
+	require.NoError(t, err)
+	var s Snapshot
+	require.NoError(t, json.Unmarshal(manifest, &s))
+	require.Equal(t, map[string]map[string]string{"snap-repo": {"core.db": "/core/os/x86_64"}}, s.DBPaths)
+}
+
+// TestSnapshotFetchesPackagesOnceDBIsRequested verifies that the packages
+// of a database no client requested since the start are fetched once one
+// does, as only then the path they are fetched from is known.
+func TestSnapshotFetchesPackagesOnceDBIsRequested(t *testing.T) {
+	resetSnapshots(t)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/core/os/x86_64/core.db":
+			w.WriteHeader(http.StatusNotModified)
+		case "/core/os/x86_64/foo-1.1-1-x86_64.pkg.tar.zst":
+			_, _ = w.Write([]byte("foo package"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+
+	cacheDir := t.TempDir()
+	config.Store(&Config{
+		CacheDir:   cacheDir,
+		Port:       -1,
+		AdminToken: testAdminToken,
+		Repos:      map[string]*Repo{"snap-repo": {URL: mirror.URL}},
+	})
+	writeRepoDB(t, cacheDir, "snap-repo", "core.db", time.Unix(1700000000, 0), []testTarDB{fooDesc("1.1-1", "x86_64")})
+	w := snapshotAPIRequest(t, http.MethodPost, "/api/v1/snapshots", `{"name": "waiting"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	pkgPath := filepath.Join(cacheDir, "pkgs", "snap-repo", "foo-1.1-1-x86_64.pkg.tar.zst")
+	require.Never(t, func() bool {
+		_, err := os.Stat(pkgPath)
+		return err == nil
+	}, 200*time.Millisecond, 10*time.Millisecond)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, handleRequest(w, httptest.NewRequest(http.MethodGet, "/repo/snap-repo/core/os/x86_64/core.db", nil)))
+	require.Eventually(t, func() bool {
+		content, err := os.ReadFile(pkgPath)
+		return err == nil && string(content) == "foo package"
+	}, 5*time.Second, 10*time.Millisecond, "the packages are fetched once the database is requested")
+}
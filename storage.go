@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/djherbis/times"
+)
+
+// Storage keeps the cached files. Downloads are received into a local
+// buffer file (see RequestedFile.bufferFileName) which is handed over to
+// the storage once it is complete and verified; cached files are addressed
+// by repo and file name.
+type Storage interface {
+	// Stat describes a cached file. It fails with fs.ErrNotExist if the
+	// file is not cached.
+	Stat(repo, name string) (CachedFile, error)
+	// Open opens a cached file for reading, with support for seeking.
+	Open(repo, name string) (io.ReadSeekCloser, error)
+	// Commit stores the complete content of a buffer file as a cached
+	// file. modTime is the modification time announced by the upstream,
+	// zero if it is unknown.
+	Commit(repo, name string, buffer *os.File, modTime time.Time) error
+	// Delete removes a cached file.
+	Delete(repo, name string) error
+	// List describes every file cached for a repo.
+	List(repo string) ([]CachedFile, error)
+	// Touch records that a cached file was served at the given time.
+	Touch(repo, name string, at time.Time) error
+	// RedirectURL returns a URL clients can download the cached file from
+	// directly, or "" if pacoloco has to serve it.
+	RedirectURL(repo, name string) (string, error)
+}
+
+// CachedFile describes a file in the Storage.
+type CachedFile struct {
+	Name       string // relative to the repo
+	Size       int64
+	ModTime    time.Time // as announced by the upstream
+	AccessTime time.Time // when the file was last served
+}
+
+// cacheStorage returns the Storage the config keeps the cache in.
+func (c *Config) cacheStorage() Storage {
+	var storage Storage
+	if c.Storage != nil && c.Storage.S3 != nil {
+		storage = newS3Storage(c.Storage.S3)
+	} else {
+		storage = newFSStorage(filepath.Join(c.CacheDir, "pkgs"))
+	}
+	storage = &usageStorage{Storage: storage, cacheDir: c.CacheDir}
+	if accessTimes != nil {
+		return &indexedStorage{Storage: storage, index: accessTimes}
+	}
+	return storage
+}
+
+// fsStorage keeps the cached files of a repo in <root>/<repo>.
+type fsStorage struct {
+	root string
+}
+
+func newFSStorage(root string) *fsStorage {
+	return &fsStorage{root: root}
+}
+
+func (s *fsStorage) path(repo, name string) (string, error) {
+	if !fs.ValidPath(repo) || !fs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("invalid cache file name %v/%v: %w", repo, name, fs.ErrNotExist)
+	}
+	return filepath.Join(s.root, repo, filepath.FromSlash(name)), nil
+}
+
+func (s *fsStorage) Stat(repo, name string) (CachedFile, error) {
+	path, err := s.path(repo, name)
+	if err != nil {
+		return CachedFile{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return CachedFile{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return CachedFile{}, fmt.Errorf("%v is not a regular file: %w", path, fs.ErrNotExist)
+	}
+	return fsCachedFile(name, info), nil
+}
+
+func fsCachedFile(name string, info fs.FileInfo) CachedFile {
+	return CachedFile{
+		Name:       name,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		AccessTime: times.Get(info).AccessTime(),
+	}
+}
+
+func (s *fsStorage) Open(repo, name string) (io.ReadSeekCloser, error) {
+	path, err := s.path(repo, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *fsStorage) Commit(repo, name string, buffer *os.File, modTime time.Time) error {
+	path, err := s.path(repo, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(buffer.Name(), path); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		return os.Chtimes(path, time.Now(), modTime)
+	}
+	return nil
+}
+
+func (s *fsStorage) Delete(repo, name string) error {
+	path, err := s.path(repo, name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// List walks the repo directory. Buffer files of running downloads live
+// there as well and are skipped.
+func (s *fsStorage) List(repo string) ([]CachedFile, error) {
+	if !fs.ValidPath(repo) {
+		return nil, fmt.Errorf("invalid repo name %v: %w", repo, fs.ErrNotExist)
+	}
+	repoDir := filepath.Join(s.root, repo)
+
+	var files []CachedFile
+	err := filepath.WalkDir(repoDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || isBufferFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(repoDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, fsCachedFile(filepath.ToSlash(rel), info))
+		return nil
+	})
+	return files, err
+}
+
+// Touch leaves the access time to the filesystem, which updates it when the
+// file is read unless its mount options prevent that; the access index
+// records the serves regardless.
+func (s *fsStorage) Touch(repo, name string, at time.Time) error {
+	return nil
+}
+
+func (s *fsStorage) RedirectURL(repo, name string) (string, error) {
+	return "", nil
+}
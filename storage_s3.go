@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 storage backend. Cached files are objects in a bucket of an
+// S3-compatible service (AWS S3, MinIO, ...), addressed path-style as
+// <endpoint>/<bucket>/<prefix>/<repo>/<file>. Requests are signed with AWS
+// Signature Version 4.
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // SHA256 of ""
+	s3AmzDateFormat   = "20060102T150405Z"
+	// s3ModTimeHeader keeps the upstream modification time of an object;
+	// the Last-Modified of the object itself is when it was written.
+	s3ModTimeHeader = "X-Amz-Meta-Upstream-Modified"
+	// s3RedirectExpiry is how long a presigned URL a client is redirected
+	// to stays valid.
+	s3RedirectExpiry = time.Hour
+	// s3TouchInterval limits how often the access time of an object is
+	// updated. Objects have no access time, Touch rewrites the object's
+	// metadata instead, so like a filesystem mounted with relatime only the
+	// first access of a day is recorded.
+	s3TouchInterval = 24 * time.Hour
+	// s3RequestTimeout bounds a request that only exchanges metadata, and
+	// how long any request waits for the response headers.
+	s3RequestTimeout = 30 * time.Second
+	// s3MinUploadRate is the slowest upload, in bytes per second, that is
+	// waited for before a Commit is given up.
+	s3MinUploadRate = 1 << 20
+)
+
+type s3Storage struct {
+	cfg     *S3Config
+	client  *http.Client
+	timeout time.Duration
+}
+
+func newS3Storage(cfg *S3Config) *s3Storage {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: DefaultDialTimeout * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout * time.Second
+	transport.ResponseHeaderTimeout = s3RequestTimeout
+	return &s3Storage{cfg: cfg, client: &http.Client{Transport: transport}, timeout: s3RequestTimeout}
+}
+
+// key returns the object key of a cached file.
+func (s *s3Storage) key(repo, name string) (string, error) {
+	if !fs.ValidPath(repo) || !fs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("invalid cache file name %v/%v: %w", repo, name, fs.ErrNotExist)
+	}
+	return path.Join(s.cfg.Prefix, repo, name), nil
+}
+
+// objectURL returns the path-style URL of an object, or of the bucket if
+// key is empty.
+func (s *s3Storage) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	p := strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	u.Path = p
+	u.RawPath = s3URIEncode(p, false)
+	return u, nil
+}
+
+// s3URIEncode percent-encodes everything but the unreserved characters, as
+// the canonical request of SigV4 requires. Encoding the path the same way
+// on the wire keeps what is signed and what the server sees identical.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var parts []string
+	for _, k := range keys {
+		values := slices.Clone(query[k])
+		slices.Sort(values)
+		for _, v := range values {
+			parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3CanonicalRequest builds the SigV4 canonical request of req over the
+// given lower-case header names, which must be sorted.
+func s3CanonicalRequest(req *http.Request, signedHeaders []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		} else {
+			value = strings.Join(req.Header.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	canonicalPath := req.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	return strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		s3CanonicalQuery(req.URL.Query()),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature signs a canonical request made at amzDate.
+func (s *s3Storage) signature(amzDate string, canonicalRequest string) string {
+	date := amzDate[:8]
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + s.scope(date) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func (s *s3Storage) scope(date string) string {
+	return date + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// sign adds the SigV4 Authorization header to req, covering the host and
+// every header already set.
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3AmzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host"}
+	for name := range req.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(name))
+	}
+	slices.Sort(signedHeaders)
+
+	signature := s.signature(amzDate, s3CanonicalRequest(req, signedHeaders, payloadHash))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKeyID, s.scope(amzDate[:8]), strings.Join(signedHeaders, ";"), signature))
+}
+
+// presign returns a URL that allows to GET u without credentials until
+// the expiry passes.
+func (s *s3Storage) presign(u *url.URL, expiry time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format(s3AmzDateFormat)
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", s.cfg.AccessKeyID+"/"+s.scope(amzDate[:8]))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	presigned := *u
+	presigned.RawQuery = s3CanonicalQuery(query)
+	req := &http.Request{Method: http.MethodGet, URL: &presigned, Header: http.Header{}}
+	signature := s.signature(amzDate, s3CanonicalRequest(req, []string{"host"}, s3UnsignedPayload))
+	presigned.RawQuery += "&X-Amz-Signature=" + signature
+	return presigned.String()
+}
+
+// do sends a signed request. A body is sent with an unsigned payload, so
+// that uploading a package does not require hashing it first. A non-zero
+// timeout is a deadline for the whole request, including reading the
+// response body; the deadline is released when the body is closed.
+func (s *s3Storage) do(method string, u *url.URL, header http.Header, body io.Reader, size int64, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := s3EmptyPayload
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = s3UnsignedPayload
+	}
+	s.sign(req, payloadHash, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a request when its response body
+// is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// s3Error describes an unexpected response, including the start of the
+// error document S3 sends with it.
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3 %v %v: %w", resp.Request.Method, resp.Request.URL.Path, fs.ErrNotExist)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %v %v: %v: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// head returns the headers of an object.
+func (s *s3Storage) head(repo, name string) (*url.URL, http.Header, error) {
+	key, err := s.key(repo, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(http.MethodHead, u, nil, nil, 0, s.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, s3Error(resp)
+	}
+	header := resp.Header.Clone()
+	header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	return u, header, nil
+}
+
+func s3CachedFile(name string, header http.Header) CachedFile {
+	f := CachedFile{Name: name}
+	f.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	f.AccessTime, _ = http.ParseTime(header.Get("Last-Modified"))
+	f.ModTime, _ = http.ParseTime(header.Get(s3ModTimeHeader))
+	return f
+}
+
+func (s *s3Storage) Stat(repo, name string) (CachedFile, error) {
+	_, header, err := s.head(repo, name)
+	if err != nil {
+		return CachedFile{}, err
+	}
+	return s3CachedFile(name, header), nil
+}
+
+func (s *s3Storage) Open(repo, name string) (io.ReadSeekCloser, error) {
+	u, header, err := s.head(repo, name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{storage: s, url: u, size: s3CachedFile(name, header).Size}, nil
+}
+
+func (s *s3Storage) Commit(repo, name string, buffer *os.File, modTime time.Time) error {
+	key, err := s.key(repo, name)
+	if err != nil {
+		return err
+	}
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	info, err := buffer.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if !modTime.IsZero() {
+		header.Set(s3ModTimeHeader, modTime.UTC().Format(http.TimeFormat))
+	}
+	timeout := s.timeout + time.Duration(info.Size()/s3MinUploadRate)*time.Second
+	resp, err := s.do(http.MethodPut, u, header, io.NewSectionReader(buffer, 0, info.Size()), info.Size(), timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) Delete(repo, name string) error {
+	key, err := s.key(repo, name)
+	if err != nil {
+		return err
+	}
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, u, nil, nil, 0, s.timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2. A listing has no object metadata, so
+// ModTime is left zero.
+func (s *s3Storage) List(repo string) ([]CachedFile, error) {
+	if !fs.ValidPath(repo) {
+		return nil, fmt.Errorf("invalid repo name %v: %w", repo, fs.ErrNotExist)
+	}
+	prefix := path.Join(s.cfg.Prefix, repo) + "/"
+	u, err := s.objectURL("")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []CachedFile
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+		resp, err := s.do(http.MethodGet, u, nil, nil, 0, s.timeout)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 listing of %v: %w", prefix, err)
+		}
+
+		for _, c := range result.Contents {
+			files = append(files, CachedFile{
+				Name:       strings.TrimPrefix(c.Key, prefix),
+				Size:       c.Size,
+				AccessTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Touch copies the object onto itself, which updates its Last-Modified,
+// unless that was done recently.
+func (s *s3Storage) Touch(repo, name string, at time.Time) error {
+	u, header, err := s.head(repo, name)
+	if err != nil {
+		return err
+	}
+	if last := s3CachedFile(name, header).AccessTime; at.Sub(last) < s3TouchInterval {
+		return nil
+	}
+	key, err := s.key(repo, name)
+	if err != nil {
+		return err
+	}
+
+	copyHeader := http.Header{}
+	copyHeader.Set("X-Amz-Copy-Source", s3URIEncode("/"+s.cfg.Bucket+"/"+key, false))
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	copyHeader.Set("Content-Type", "application/octet-stream")
+	if modTime := header.Get(s3ModTimeHeader); modTime != "" {
+		copyHeader.Set(s3ModTimeHeader, modTime)
+	}
+	resp, err := s.do(http.MethodPut, u, copyHeader, nil, 0, s.timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) RedirectURL(repo, name string) (string, error) {
+	if !s.cfg.Redirect {
+		return "", nil
+	}
+	key, err := s.key(repo, name)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+	return s.presign(u, s3RedirectExpiry, time.Now()), nil
+}
+
+// s3Object reads an object with ranged GET requests. A request streams
+// from the current offset until the reader seeks elsewhere.
+type s3Object struct {
+	storage *s3Storage
+	url     *url.URL
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		// the body streams to a client for as long as it reads, so only
+		// the wait for the response headers is bounded
+		resp, err := o.storage.do(http.MethodGet, o.url, header, nil, 0, 0)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("unknown whence parameter: %v", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %v", offset)
+	}
+	if offset != o.offset {
+		_ = o.Close()
+		o.offset = offset
+	}
+	return o.offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeBuffer creates a buffer file with the given content, as a Downloader
+// leaves it behind for the storage.
+func writeBuffer(t *testing.T, dir string, content string) *os.File {
+	buffer, err := os.CreateTemp(dir, ".buffer-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = buffer.Close() })
+	_, err = buffer.WriteString(content)
+	require.NoError(t, err)
+	return buffer
+}
+
+func TestFSStorage(t *testing.T) {
+	root := t.TempDir()
+	storage := newFSStorage(root)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	buffer := writeBuffer(t, t.TempDir(), "package content")
+	require.NoError(t, storage.Commit("fs-repo", "foo-1-1-any.pkg.tar.zst", buffer, modTime))
+	_, err := os.Stat(buffer.Name())
+	require.ErrorIs(t, err, os.ErrNotExist, "the buffer file is moved into the cache")
+
+	f, err := storage.Stat("fs-repo", "foo-1-1-any.pkg.tar.zst")
+	require.NoError(t, err)
+	require.Equal(t, int64(len("package content")), f.Size)
+	require.True(t, modTime.Equal(f.ModTime))
+
+	r, err := storage.Open("fs-repo", "foo-1-1-any.pkg.tar.zst")
+	require.NoError(t, err)
+	_, err = r.Seek(8, io.SeekStart)
+	require.NoError(t, err)
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(content))
+	require.NoError(t, r.Close())
+
+	// nested files are listed by their path in the repo, buffer files of
+	// running downloads are not listed at all
+	require.NoError(t, storage.Commit("fs-repo", "os/x86_64/core.db", writeBuffer(t, t.TempDir(), "db"), time.Time{}))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "fs-repo", ".bar-1-1-any.pkg.tar.zst"), []byte("partial"), 0o644))
+	files, err := storage.List("fs-repo")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.Equal(t, "foo-1-1-any.pkg.tar.zst", files[0].Name)
+	require.Equal(t, "os/x86_64/core.db", files[1].Name)
+
+	require.NoError(t, storage.Delete("fs-repo", "foo-1-1-any.pkg.tar.zst"))
+	_, err = storage.Stat("fs-repo", "foo-1-1-any.pkg.tar.zst")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	redirect, err := storage.RedirectURL("fs-repo", "os/x86_64/core.db")
+	require.NoError(t, err)
+	require.Empty(t, redirect, "the filesystem storage is served by pacoloco")
+}
+
+func TestFSStorageInvalidNames(t *testing.T) {
+	root := t.TempDir()
+	storage := newFSStorage(filepath.Join(root, "pkgs"))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0o644))
+
+	for _, name := range []string{"../../secret", ".", "/secret", "a/../../secret"} {
+		_, err := storage.Stat("fs-repo", name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+		_, err = storage.Open("fs-repo", name)
+		require.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+	// a repo directory is no cached file
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "pkgs", "fs-repo", "dir"), os.ModePerm))
+	_, err := storage.Stat("fs-repo", "dir")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	files, err := storage.List("missing-repo")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Empty(t, files)
+}
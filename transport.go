@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Connections to the mirrors. Every repo with mirrors gets its own client
+// when the config is applied, with the proxy, the TLS settings and the
+// `transport` options of the repo, falling back to the global ones. The
+// client lives as long as the config, so downloads reuse its keep-alive
+// connections and TLS sessions; a reload builds new ones and closes the
+// idle connections of the old ones.
+
+// Transport tunes the connections to the mirrors.
+type Transport struct {
+	// DialTimeout and TLSHandshakeTimeout are in seconds, 0 for the default.
+	DialTimeout         int  `yaml:"dial_timeout"`
+	TLSHandshakeTimeout int  `yaml:"tls_handshake_timeout"`
+	MaxConnsPerHost     int  `yaml:"max_conns_per_host"`
+	DisableHTTP2        bool `yaml:"disable_http2"`
+	// SourceAddress is the local IP address connections are made from.
+	SourceAddress string `yaml:"source_address"`
+	// IPPreference is "ipv4" or "ipv6" to try the addresses of that family
+	// of a mirror first, "" for the order of the resolver.
+	IPPreference string `yaml:"ip_preference"`
+}
+
+// validate checks the options of the transport.
+func (t *Transport) validate() error {
+	if t.DialTimeout < 0 || t.TLSHandshakeTimeout < 0 || t.MaxConnsPerHost < 0 {
+		return fmt.Errorf("timeouts and max_conns_per_host cannot be negative")
+	}
+	if t.SourceAddress != "" && net.ParseIP(t.SourceAddress) == nil {
+		return fmt.Errorf("source_address %v is not an IP address", t.SourceAddress)
+	}
+	if t.IPPreference != "" && t.IPPreference != "ipv4" && t.IPPreference != "ipv6" {
+		return fmt.Errorf("ip_preference must be ipv4 or ipv6")
+	}
+	return nil
+}
+
+// setupUpstreamClients builds the clients of the repos with mirrors.
+func setupUpstreamClients(c *Config) {
+	for _, repo := range c.Repos {
+		if !repo.Local && !repo.isMerged() {
+			repo.client = newUpstreamClient(c, repo)
+		}
+	}
+}
+
+// newUpstreamClient builds the client for the mirrors of a repo of c, whose
+// options parseConfig validated.
+func newUpstreamClient(c *Config, repo *Repo) *http.Client {
+	options := cmp.Or(repo.Transport, c.Transport, &Transport{})
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy := cmp.Or(repo.HttpProxy, c.HttpProxy); proxy != "" {
+		proxyURL, _ := url.Parse(proxy)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	transport.TLSClientConfig = repo.tlsConfig
+	transport.TLSHandshakeTimeout = time.Duration(cmp.Or(options.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout)) * time.Second
+	transport.MaxConnsPerHost = options.MaxConnsPerHost
+	if options.DisableHTTP2 {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		transport.Protocols = &protocols
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(cmp.Or(options.DialTimeout, DefaultDialTimeout)) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if options.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(options.SourceAddress)}
+	}
+	if options.SourceAddress != "" || options.IPPreference != "" {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialPreferring(ctx, dialer, network, addr, options)
+		}
+	} else {
+		transport.DialContext = dialer.DialContext
+	}
+	return &http.Client{Transport: transport, CheckRedirect: stripUpstreamHeader(repo.upstreamHeader)}
+}
+
+// dialPreferring connects to the addresses of a host one after another, the
+// ones of the preferred family first. A source address restricts them to
+// its family.
+func dialPreferring(ctx context.Context, dialer *net.Dialer, network, addr string, options *Transport) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if options.SourceAddress != "" {
+		ipv4 := net.ParseIP(options.SourceAddress).To4() != nil
+		ips = slices.DeleteFunc(ips, func(ip netip.Addr) bool { return ip.Unmap().Is4() != ipv4 })
+	}
+	if options.IPPreference != "" {
+		preferIPv4 := options.IPPreference == "ipv4"
+		rank := func(ip netip.Addr) int {
+			if ip.Unmap().Is4() == preferIPv4 {
+				return 0
+			}
+			return 1
+		}
+		slices.SortStableFunc(ips, func(a, b netip.Addr) int { return cmp.Compare(rank(a), rank(b)) })
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%v has no address to connect to from %v", host, options.SourceAddress)
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// closeIdleConnections closes the connections of the client of a repo that
+// no download uses.
+func (r *Repo) closeIdleConnections() {
+	if r.client != nil {
+		r.client.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamClientReuse(t *testing.T) {
+	var conns atomic.Int32
+	var proto atomic.Value
+	mirror := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		_, _ = w.Write([]byte("from the mirror"))
+	}))
+	mirror.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	mirror.EnableHTTP2 = true
+	mirror.StartTLS()
+	defer mirror.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(mirror.Certificate())
+
+	config.Store(&Config{
+		CacheDir:  t.TempDir(),
+		Port:      -1,
+		Transport: &Transport{IPPreference: "ipv6"},
+		Repos: map[string]*Repo{
+			"reuse-repo": {URL: mirror.URL, tlsConfig: &tls.Config{RootCAs: rootCAs}},
+			"http1-repo": {URL: mirror.URL, tlsConfig: &tls.Config{RootCAs: rootCAs}, Transport: &Transport{DisableHTTP2: true}},
+			"local-repo": {Local: true},
+		},
+	})
+	setupUpstreamClients(config.Load())
+	require.Nil(t, config.Load().Repos["local-repo"].client)
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		w := peerTestRequest(t, handleRequest, http.MethodGet, "/repo/reuse-repo/x86_64/"+name+"-1.0-1-x86_64.pkg.tar.zst")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "from the mirror", w.Body.String())
+	}
+	require.Equal(t, int32(1), conns.Load(), "the downloads share a connection")
+	require.Equal(t, "HTTP/2.0", proto.Load())
+
+	w := peerTestRequest(t, handleRequest, http.MethodGet, "/repo/http1-repo/x86_64/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "HTTP/1.1", proto.Load())
+
+	// a reload brings new clients
+	old := config.Load().Repos["reuse-repo"].client
+	newConfig := &Config{CacheDir: config.Load().CacheDir, Port: -1, Repos: map[string]*Repo{"reuse-repo": {URL: mirror.URL}}}
+	applyConfig(config.Load(), newConfig)
+	require.NotNil(t, config.Load().Repos["reuse-repo"].client)
+	require.NotSame(t, old, config.Load().Repos["reuse-repo"].client)
+}
+
+func TestDialPreferring(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	dial := func(options *Transport, host string) error {
+		conn, err := dialPreferring(context.Background(), &net.Dialer{}, "tcp", net.JoinHostPort(host, port), options)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+	// the other family is tried if the preferred one does not connect
+	require.NoError(t, dial(&Transport{IPPreference: "ipv6"}, "localhost"))
+	require.NoError(t, dial(&Transport{SourceAddress: "127.0.0.1"}, "127.0.0.1"))
+	require.ErrorContains(t, dial(&Transport{SourceAddress: "::1"}, "127.0.0.1"), "no address")
+}
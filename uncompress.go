@@ -14,6 +14,10 @@ import (
 // Limits the size of the extracted file up to 100MB, so far community db is around 20MB
 const databaseSizeLimit = 100 * 1024 * 1024
 
+// filesDatabaseSizeLimit limits the extracted size of the .files databases,
+// which list every file of every package; extra.files is several hundred MB.
+const filesDatabaseSizeLimit = 2 * 1024 * 1024 * 1024
+
 type decompressFunc func(r io.Reader) (io.Reader, error)
 
 var decompressors = []struct {
@@ -49,46 +53,51 @@ func zstdReader(r io.Reader) (io.Reader, error) {
 	return zstd.NewReader(r)
 }
 
-func uncompress(inputFile string, targetFile string) error {
-	compressedFile, err := os.Open(inputFile)
-	if err != nil {
-		return err
-	}
-	defer compressedFile.Close()
-
-	fi, err := compressedFile.Stat()
-	if err != nil {
-		return fmt.Errorf("%s: unable to get file size", inputFile)
-	}
-	magicSize := min(fi.Size(), 6)
-	magic := make([]byte, magicSize)
-	_, err = compressedFile.ReadAt(magic, 0)
-	if err != nil {
-		return fmt.Errorf("%s unable to read header", inputFile)
+// newDecompressReader detects the compression format of a database file by
+// its magic bytes and returns a reader of its uncompressed content, limited
+// to limit bytes.
+func newDecompressReader(inputFile string, compressedFile io.ReadSeeker, limit int64) (io.Reader, error) {
+	magic := make([]byte, 6)
+	magicSize, err := io.ReadFull(compressedFile, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%s unable to read header", inputFile)
 	}
 	_, err = compressedFile.Seek(0, io.SeekStart)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var f decompressFunc
 
 	for _, d := range decompressors {
-		l := min(len(d.magic), int(magicSize))
+		l := min(len(d.magic), magicSize)
 		if bytes.Equal(d.magic, magic[:l]) {
 			f = d.f
 			break
 		}
 	}
 	if f == nil {
-		return fmt.Errorf("%s: unknown database compression format", inputFile)
+		return nil, fmt.Errorf("%s: unknown database compression format", inputFile)
 	}
 
 	reader, err := f(compressedFile)
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(reader, limit), nil
+}
+
+func uncompress(inputFile string, targetFile string) error {
+	compressedFile, err := os.Open(inputFile)
+	if err != nil {
+		return err
+	}
+	defer compressedFile.Close()
+
+	limitedReader, err := newDecompressReader(inputFile, compressedFile, databaseSizeLimit)
 	if err != nil {
 		return err
 	}
-	limitedReader := io.LimitReader(reader, databaseSizeLimit)
 	writer, err := os.Create(targetFile)
 	if err != nil {
 		return err
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Upstream authentication. Mirrors of private repos may require HTTP Basic
+// credentials or a bearer token (`upstream_auth`), other headers
+// (`headers`), a client certificate (`client_cert`, `client_key`) or trust
+// in a private CA (`ca_bundle`). They are loaded with the config and apply
+// to every request to the mirrors of the repo, for clients and for the
+// prefetcher alike, but not to the peers. The secrets never appear in the
+// logs or in errors. A mirror that redirects to another host, e.g. a CDN,
+// does not pass them on.
+
+// readSecret reads a secret from a file or, if file is empty, from the
+// environment variable env. A trailing newline of the file is dropped.
+func readSecret(file string, env string) (string, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		secret := strings.TrimRight(string(content), "\r\n")
+		if secret == "" {
+			return "", fmt.Errorf("%v is empty", file)
+		}
+		return secret, nil
+	}
+	secret := os.Getenv(env)
+	if secret == "" {
+		return "", fmt.Errorf("environment variable %v is not set", env)
+	}
+	return secret, nil
+}
+
+// authorization returns the value of the Authorization header for the
+// credentials.
+func (a *UpstreamAuth) authorization() (string, error) {
+	hasPassword := a.PasswordFile != "" || a.PasswordEnv != ""
+	hasToken := a.TokenFile != "" || a.TokenEnv != ""
+	switch {
+	case a.PasswordFile != "" && a.PasswordEnv != "", a.TokenFile != "" && a.TokenEnv != "":
+		return "", fmt.Errorf("upstream_auth takes a secret from a file or an environment variable, not both")
+	case hasPassword && hasToken:
+		return "", fmt.Errorf("upstream_auth takes a password or a token, not both")
+	case hasPassword:
+		if a.Username == "" {
+			return "", fmt.Errorf("upstream_auth needs a username with the password")
+		}
+		password, err := readSecret(a.PasswordFile, a.PasswordEnv)
+		if err != nil {
+			return "", fmt.Errorf("upstream_auth password: %v", err)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Username+":"+password)), nil
+	case hasToken:
+		if a.Username != "" {
+			return "", fmt.Errorf("upstream_auth sends a token without a username")
+		}
+		token, err := readSecret(a.TokenFile, a.TokenEnv)
+		if err != nil {
+			return "", fmt.Errorf("upstream_auth token: %v", err)
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("upstream_auth needs a password or a token")
+	}
+}
+
+// loadUpstreamOptions validates the settings of the requests to the mirrors
+// of a repo and loads the credentials and certificates they name.
+func (r *Repo) loadUpstreamOptions() error {
+	if r.UpstreamAuth == nil && len(r.Headers) == 0 && r.ClientCert == "" && r.ClientKey == "" && r.CABundle == "" && r.Transport == nil {
+		return nil
+	}
+	if r.Local || r.isMerged() {
+		return fmt.Errorf("a repo without mirrors cannot have upstream_auth, headers, client_cert, client_key, ca_bundle or transport")
+	}
+
+	header := make(http.Header)
+	for name, value := range r.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid header %q", name)
+		}
+		header.Set(name, value)
+	}
+	if r.UpstreamAuth != nil {
+		if header.Get("Authorization") != "" {
+			return fmt.Errorf("the Authorization header cannot be combined with upstream_auth")
+		}
+		authorization, err := r.UpstreamAuth.authorization()
+		if err != nil {
+			return err
+		}
+		header.Set("Authorization", authorization)
+	}
+	r.upstreamHeader = header
+
+	if (r.ClientCert == "") != (r.ClientKey == "") {
+		return fmt.Errorf("client_cert and client_key have to be set together")
+	}
+	if r.ClientCert != "" || r.CABundle != "" {
+		r.tlsConfig = &tls.Config{}
+	}
+	if r.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(r.ClientCert, r.ClientKey)
+		if err != nil {
+			return fmt.Errorf("unable to load client_cert: %v", err)
+		}
+		r.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if r.CABundle != "" {
+		pool, err := loadCertPool(r.CABundle)
+		if err != nil {
+			return fmt.Errorf("unable to load ca_bundle: %v", err)
+		}
+		r.tlsConfig.RootCAs = pool
+	}
+	return nil
+}
+
+// maxRedirects is the number of redirects the mirror clients follow, the
+// limit of http.Client without a CheckRedirect.
+const maxRedirects = 10
+
+// stripUpstreamHeader is the CheckRedirect of the clients of the mirrors of
+// a repo. It drops the credentials and headers of the repo from a redirect
+// to another host than the mirror; http.Client only drops Authorization
+// and cookies on its own.
+func stripUpstreamHeader(header http.Header) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			for name := range header {
+				req.Header.Del(name)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamAuth(t *testing.T) {
+	var mutex sync.Mutex
+	var authorizations, apiKeys []string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		apiKeys = append(apiKeys, r.Header.Get("X-Api-Key"))
+		mutex.Unlock()
+		if user, password, ok := r.BasicAuth(); !ok || user != "builder" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("from the private mirror"))
+	}))
+	defer mirror.Close()
+	var peerAuthorization string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerAuthorization = r.Header.Get("Authorization")
+		if r.URL.Path != "/peer/private-repo/x86_64/bar-1.0-1-x86_64.pkg.tar.zst" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("from the peer"))
+	}))
+	defer peer.Close()
+
+	t.Setenv("PRIVATE_REPO_PASSWORD", "secret")
+	repo := &Repo{
+		URL:          mirror.URL,
+		UpstreamAuth: &UpstreamAuth{Username: "builder", PasswordEnv: "PRIVATE_REPO_PASSWORD"},
+		Headers:      map[string]string{"X-Api-Key": "key"},
+	}
+	require.NoError(t, repo.loadUpstreamOptions())
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     -1,
+		Peers:    []string{peer.URL},
+		Repos:    map[string]*Repo{"private-repo": repo},
+	})
+
+	w := peerTestRequest(t, handleRequest, http.MethodGet, "/repo/private-repo/x86_64/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the private mirror", w.Body.String())
+
+	// the prefetcher downloads with the same credentials
+	require.NoError(t, prefetchRequest("/repo/private-repo/x86_64/baz-1.0-1-x86_64.pkg.tar.zst", ""))
+	require.Equal(t, []string{"Basic YnVpbGRlcjpzZWNyZXQ=", "Basic YnVpbGRlcjpzZWNyZXQ="}, authorizations)
+	require.Equal(t, []string{"key", "key"}, apiKeys)
+
+	// which are not sent to the peers
+	w = peerTestRequest(t, handleRequest, http.MethodGet, "/repo/private-repo/x86_64/bar-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the peer", w.Body.String())
+	require.Empty(t, peerAuthorization)
+}
+
+func writePEM(t *testing.T, name string, blockType string, der []byte) string {
+	file := path.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return file
+}
+
+func TestUpstreamClientCertificate(t *testing.T) {
+	ca := newTestCert(t, "pacoloco test CA", nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	mirror := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	mirror.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	mirror.StartTLS()
+	defer mirror.Close()
+
+	cert := newTestCert(t, "pacoloco", &ca)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	repo := &Repo{
+		URL:        mirror.URL,
+		ClientCert: writePEM(t, "client.crt", "CERTIFICATE", cert.Certificate[0]),
+		ClientKey:  writePEM(t, "client.key", "PRIVATE KEY", key),
+		CABundle:   writePEM(t, "ca.pem", "CERTIFICATE", mirror.Certificate().Raw),
+	}
+	require.NoError(t, repo.loadUpstreamOptions())
+	config.Store(&Config{
+		CacheDir: t.TempDir(),
+		Port:     -1,
+		Repos:    map[string]*Repo{"private-repo": repo},
+	})
+	repo.client = newUpstreamClient(config.Load(), repo)
+
+	w := peerTestRequest(t, handleRequest, http.MethodGet, "/repo/private-repo/x86_64/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from pacoloco", w.Body.String())
+}
+
+func TestUpstreamRedirectToOtherHost(t *testing.T) {
+	var cdnHeader http.Header
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnHeader = r.Header.Clone()
+		_, _ = w.Write([]byte("from the cdn"))
+	}))
+	defer cdn.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/moved/") {
+			// a redirect on the mirror keeps the credentials
+			http.Redirect(w, r, strings.TrimPrefix(r.URL.Path, "/moved"), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer mirror.Close()
+
+	t.Setenv("PRIVATE_REPO_TOKEN", "s3cr3t")
+	repo := &Repo{
+		URL:          mirror.URL,
+		UpstreamAuth: &UpstreamAuth{TokenEnv: "PRIVATE_REPO_TOKEN"},
+		Headers:      map[string]string{"X-Api-Key": "key"},
+	}
+	require.NoError(t, repo.loadUpstreamOptions())
+	config.Store(&Config{
+		CacheDir:  t.TempDir(),
+		Port:      -1,
+		UserAgent: "pacoloco-test",
+		Repos:     map[string]*Repo{"private-repo": repo},
+	})
+	repo.client = newUpstreamClient(config.Load(), repo)
+
+	w := peerTestRequest(t, handleRequest, http.MethodGet, "/repo/private-repo/moved/x86_64/foo-1.0-1-x86_64.pkg.tar.zst")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "from the cdn", w.Body.String())
+	require.Empty(t, cdnHeader.Get("Authorization"))
+	require.Empty(t, cdnHeader.Get("X-Api-Key"))
+	require.Equal(t, "pacoloco-test", cdnHeader.Get("User-Agent"), "other headers are kept")
+}
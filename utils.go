@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func fileExists(path string) (bool, error) {
@@ -13,3 +16,33 @@ func fileExists(path string) (bool, error) {
 		return false, err
 	}
 }
+
+// sizeUnits are the suffixes parseSize accepts, as powers of 1024.
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize parses a size in bytes like "500M" or "2T". A number without a
+// suffix is a number of bytes; "KiB"/"KB" style suffixes are accepted as well.
+func parseSize(s string) (int64, error) {
+	unit := strings.ToUpper(strings.TrimSpace(s))
+	if u, ok := strings.CutSuffix(unit, "IB"); ok && u != "" {
+		unit = u
+	} else {
+		unit = strings.TrimSuffix(unit, "B")
+	}
+	number := strings.TrimRight(unit, "KMGT")
+	multiplier, ok := sizeUnits[unit[len(number):]]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -30,3 +30,26 @@ func TestFileExistsWithDirectory(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, exists)
 }
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"0":        0,
+		"1024":     1024,
+		"10K":      10 << 10,
+		"500M":     500 << 20,
+		"500MiB":   500 << 20,
+		"2 GB":     2 << 30,
+		"3t":       3 << 40,
+		" 1G ":     1 << 30,
+		"8388607T": 8388607 << 40,
+	} {
+		size, err := parseSize(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, size, s)
+	}
+
+	for _, s := range []string{"", "G", "-1G", "1.5G", "10X", "1GG", "8388608T", "B", "1I", "1KBB"} {
+		_, err := parseSize(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+)
+
+// vercmp compares two package versions ("[epoch:]version[-release]") the way
+// pacman does (alpm_pkg_vercmp). It returns -1 if a is older than b, 0 if
+// they are equal and 1 if a is newer.
+func vercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	epochA, versionA, releaseA := parseEVR(a)
+	epochB, versionB, releaseB := parseEVR(b)
+	if ret := rpmvercmp(epochA, epochB); ret != 0 {
+		return ret
+	}
+	if ret := rpmvercmp(versionA, versionB); ret != 0 {
+		return ret
+	}
+	if releaseA != "" && releaseB != "" {
+		return rpmvercmp(releaseA, releaseB)
+	}
+	return 0
+}
+
+// parseEVR splits a version into its epoch (defaulting to "0"), version and
+// release.
+func parseEVR(evr string) (epoch, version, release string) {
+	epoch = "0"
+	digits := len(evr) - len(strings.TrimLeft(evr, "0123456789"))
+	if digits < len(evr) && evr[digits] == ':' {
+		if digits > 0 {
+			epoch = evr[:digits]
+		}
+		evr = evr[digits+1:]
+	}
+	if i := strings.LastIndexByte(evr, '-'); i >= 0 {
+		return epoch, evr[:i], evr[i+1:]
+	}
+	return epoch, evr, ""
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isAlpha(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+
+// rpmvercmp compares two version strings segment by segment: runs of
+// digits compare numerically, runs of letters lexically, a numeric segment
+// is newer than an alphabetic one, and a trailing alphabetic segment marks
+// a pre-release ("1.0rc1" is older than "1.0").
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	one, two := a, b
+	for one != "" && two != "" {
+		sepOne := len(one) - len(strings.TrimLeftFunc(one, isSeparator))
+		sepTwo := len(two) - len(strings.TrimLeftFunc(two, isSeparator))
+		one, two = one[sepOne:], two[sepTwo:]
+		if one == "" || two == "" {
+			break
+		}
+		// a longer separator wins ("1..0" is newer than "1.0")
+		if sepOne != sepTwo {
+			if sepOne < sepTwo {
+				return -1
+			}
+			return 1
+		}
+
+		isNum := isDigit(one[0])
+		segment := isAlpha
+		if isNum {
+			segment = isDigit
+		}
+		endOne := segmentLength(one, segment)
+		endTwo := segmentLength(two, segment)
+		if endTwo == 0 {
+			// segments of different types: the numeric one is newer
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+		segOne, segTwo := one[:endOne], two[:endTwo]
+		one, two = one[endOne:], two[endTwo:]
+
+		if isNum {
+			segOne = strings.TrimLeft(segOne, "0")
+			segTwo = strings.TrimLeft(segTwo, "0")
+			// the longer number is larger
+			if len(segOne) != len(segTwo) {
+				if len(segOne) < len(segTwo) {
+					return -1
+				}
+				return 1
+			}
+		}
+		if ret := strings.Compare(segOne, segTwo); ret != 0 {
+			return ret
+		}
+	}
+
+	if one == "" && two == "" {
+		return 0
+	}
+	// A remaining alphabetic segment never beats an empty string: a is
+	// older if it ran out and b goes on with something other than letters,
+	// or if a goes on with letters.
+	if (one == "" && !isAlpha(two[0])) || (one != "" && isAlpha(one[0])) {
+		return -1
+	}
+	return 1
+}
+
+func isSeparator(r rune) bool {
+	return r >= 128 || !isDigit(byte(r)) && !isAlpha(byte(r))
+}
+
+func segmentLength(s string, in func(byte) bool) int {
+	n := 0
+	for n < len(s) && in(s[n]) {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The cases are taken from pacman's vercmp test suite.
+func TestVercmp(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.5.0", "1.5.0", 0},
+		{"1.5.1", "1.5.0", 1},
+		{"1.5.1", "1.5", 1},
+		{"1.5.0", "1.5", 1},
+		{"1.5", "1.5.0", -1},
+		{"1.5b", "1.5", -1},
+		{"1.5rc1", "1.5", -1},
+		{"1.5a", "1.5b", -1},
+		{"1.5.a", "1.5", 1},
+		{"1.5.a", "1.5.b", -1},
+		{"1.5.1", "1.5.a", 1},
+		{"1.001", "1.1", 0},
+		{"2.0", "10.0", -1},
+		{"1.0.1", "1.0a", 1},
+		{"1..0", "1.0", 1},
+		{"1.0", "1..0", -1},
+		{"1.1-1", "1.1-2", -1},
+		{"1.1-1", "1.1", 0},
+		{"1.1", "1.1-2", 0},
+		{"1.1-1.1", "1.1-1", 1},
+		{"1:1.0-1", "2.0-1", 1},
+		{"0:1.0-1", "1.0-1", 0},
+		{"1:1.0", "2:0.5", -1},
+		{"2023.10.01-1", "2023.9.30-1", 1},
+		{"6.6.7.arch1-1", "6.6.10.arch1-1", -1},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expected, vercmp(c.a, c.b), "vercmp(%v, %v)", c.a, c.b)
+		require.Equal(t, -c.expected, vercmp(c.b, c.a), "vercmp(%v, %v)", c.b, c.a)
+	}
+}
+
+func TestParseEVR(t *testing.T) {
+	epoch, version, release := parseEVR("2:1.0.3-4")
+	require.Equal(t, []string{"2", "1.0.3", "4"}, []string{epoch, version, release})
+	epoch, version, release = parseEVR("1.0")
+	require.Equal(t, []string{"0", "1.0", ""}, []string{epoch, version, release})
+	epoch, version, release = parseEVR(":1.0-1")
+	require.Equal(t, []string{"0", "1.0", "1"}, []string{epoch, version, release})
+}